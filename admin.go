@@ -0,0 +1,147 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// Authentication for the handlers which change state; the read-only pages
+// remain open to all.
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const kADMIN_SCOPE_ALL = "*"
+
+type adminToken struct {
+	token  []byte
+	scopes map[string]bool
+}
+
+var adminTokens []adminToken
+
+// One token per line, followed by whitespace and a comma-separated list of
+// scopes, or "*" for all scopes.  Blank lines and lines starting '#' ignored.
+func LoadAdminTokens(filename string) error {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	tokens, err := readAdminTokens(fh)
+	if err != nil {
+		return err
+	}
+	adminTokens = tokens
+	Log.Printf("Loaded %d admin tokens", len(adminTokens))
+	return nil
+}
+
+func readAdminTokens(in io.Reader) ([]adminToken, error) {
+	tokens := make([]adminToken, 0, 4)
+	scanner := bufio.NewScanner(in)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("admin tokens line %d: expected \"token scope[,scope...]\"", lineNum)
+		}
+		scopes := make(map[string]bool)
+		for _, scope := range strings.Split(fields[1], ",") {
+			if scope != "" {
+				scopes[scope] = true
+			}
+		}
+		tokens = append(tokens, adminToken{token: []byte(fields[0]), scopes: scopes})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Bearer token, or the password of HTTP Basic auth (username ignored), so
+// that both curl scripts and browsers can authenticate.
+func requestToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	if _, password, ok := req.BasicAuth(); ok {
+		return password
+	}
+	return ""
+}
+
+// Every configured token is compared, so the time taken doesn't reveal how
+// close a guess came or which entry matched.
+func findAdminToken(given string) *adminToken {
+	var found *adminToken
+	for i := range adminTokens {
+		if subtle.ConstantTimeCompare([]byte(given), adminTokens[i].token) == 1 {
+			found = &adminTokens[i]
+		}
+	}
+	return found
+}
+
+// Wrap a handler so that it requires a token granting the given scope:
+// 401 for a missing or unknown token, 403 for a known token lacking scope.
+func adminHandler(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		given := requestToken(req)
+		var token *adminToken
+		if given != "" {
+			token = findAdminToken(given)
+		}
+		if token == nil {
+			Log.Printf("Unauthenticated request for admin URI %s from %s", req.URL.Path, req.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Basic realm="sks_spider admin"`)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		if !token.scopes[scope] && !token.scopes[kADMIN_SCOPE_ALL] {
+			Log.Printf("Token lacking scope \"%s\" used for admin URI %s from %s", scope, req.URL.Path, req.RemoteAddr)
+			http.Error(w, "Token not valid for this action", http.StatusForbidden)
+			return
+		}
+		handler(w, req)
+	}
+}
+
+func apiRescanz(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentTypeTextPlain)
+	if req.Method != "POST" {
+		http.Error(w, "Rescan must be requested with POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if scanScheduler == nil || !scanScheduler.ScanNow() {
+		http.Error(w, "Scan already in progress", http.StatusConflict)
+		return
+	}
+	Log.Printf("Rescan requested by %s", req.RemoteAddr)
+	fmt.Fprintf(w, "Rescan started.\n")
+}
@@ -0,0 +1,73 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testAdminTokens = `# test tokens
+s3kr1t-all *
+s3kr1t-rescan rescan,other
+s3kr1t-other other
+`
+
+func TestAdminHandler(t *testing.T) {
+	setupTestLogging()
+	tokens, err := readAdminTokens(strings.NewReader(testAdminTokens))
+	if err != nil {
+		t.Fatalf("Failed to read tokens: %s", err)
+	}
+	saved := adminTokens
+	defer func() { adminTokens = saved }()
+	adminTokens = tokens
+
+	handler := adminHandler("rescan", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	for _, tc := range []struct {
+		bearer, basic string
+		want          int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"wrong", "", http.StatusUnauthorized},
+		{"s3kr1t-all", "", http.StatusTeapot},
+		{"s3kr1t-rescan", "", http.StatusTeapot},
+		{"", "s3kr1t-rescan", http.StatusTeapot},
+		{"s3kr1t-other", "", http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest("POST", "/rescanz", nil)
+		if tc.bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.bearer)
+		}
+		if tc.basic != "" {
+			req.SetBasicAuth("admin", tc.basic)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != tc.want {
+			t.Fatalf("Token bearer=%q basic=%q: got status %d, expected %d", tc.bearer, tc.basic, rec.Code, tc.want)
+		}
+	}
+
+	if _, err := readAdminTokens(strings.NewReader("token-without-scope\n")); err == nil {
+		t.Fatalf("Token line without scopes accepted")
+	}
+}
@@ -0,0 +1,104 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// Operator notes about specific servers, eg "scheduled for removal".
+// These are display-only and must never influence the ip-valid filtering.
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// One entry per line: hostname, whitespace, free text.  Blank lines and lines
+// starting '#' are ignored.  A later entry for the same host replaces an
+// earlier one.
+func LoadAnnotations(filename string) (map[string]string, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	return readAnnotations(fh)
+}
+
+func readAnnotations(in io.Reader) (map[string]string, error) {
+	notes := make(map[string]string, 20)
+	reader := bufio.NewReader(in)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line == "" && err == io.EOF {
+			break
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		split := strings.IndexAny(line, " \t")
+		if split < 0 {
+			continue
+		}
+		note := strings.TrimSpace(line[split+1:])
+		if note == "" {
+			continue
+		}
+		notes[normalizeHostname(line[:split])] = note
+	}
+	return notes, nil
+}
+
+// Notes keyed on an alias are attached to the canonical host; if there's a
+// note for both, the one for the canonical name wins.
+func ApplyAnnotations(hostMap HostMap, aliasMap AliasMap, notes map[string]string) {
+	for _, node := range hostMap {
+		if node != nil {
+			node.Annotation = ""
+		}
+	}
+	for name, note := range notes {
+		canonical, ok := aliasMap[name]
+		if !ok {
+			Log.Printf("Annotation for unknown host \"%s\" ignored", name)
+			continue
+		}
+		node, ok := hostMap[canonical]
+		if !ok || node == nil {
+			continue
+		}
+		if node.Annotation != "" && name != canonical {
+			continue
+		}
+		node.Annotation = note
+	}
+}
+
+func (p *PersistedHostInfo) LoadAnnotations() {
+	if *flAnnotationsFile == "" {
+		return
+	}
+	notes, err := LoadAnnotations(*flAnnotationsFile)
+	if err != nil {
+		Log.Printf("Failed to load annotations from \"%s\": %s", *flAnnotationsFile, err)
+		return
+	}
+	ApplyAnnotations(p.HostMap, p.AliasMap, notes)
+}
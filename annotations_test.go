@@ -0,0 +1,64 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"strings"
+	"testing"
+)
+
+const testAnnotations = `# comment line
+keys.example.org	operator unresponsive
+Alias.Example.NET.  scheduled for removal
+
+nonote.example.org
+unknown.example.com something
+`
+
+func TestAnnotations(t *testing.T) {
+	setupTestLogging()
+	notes, err := readAnnotations(strings.NewReader(testAnnotations))
+	if err != nil {
+		t.Fatalf("Failed to read annotations: %s", err)
+	}
+	if len(notes) != 3 {
+		t.Fatalf("Expected 3 annotations, got %d: %v", len(notes), notes)
+	}
+
+	hostMap := HostMap{
+		"keys.example.org":  &SksNode{Hostname: "keys.example.org", Annotation: "stale"},
+		"canon.example.net": &SksNode{Hostname: "canon.example.net"},
+		"other.example.org": &SksNode{Hostname: "other.example.org", Annotation: "stale"},
+	}
+	aliasMap := AliasMap{
+		"keys.example.org":  "keys.example.org",
+		"canon.example.net": "canon.example.net",
+		"alias.example.net": "canon.example.net",
+		"other.example.org": "other.example.org",
+	}
+	ApplyAnnotations(hostMap, aliasMap, notes)
+
+	if hostMap["keys.example.org"].Annotation != "operator unresponsive" {
+		t.Fatalf("Bad annotation: %q", hostMap["keys.example.org"].Annotation)
+	}
+	if hostMap["canon.example.net"].Annotation != "scheduled for removal" {
+		t.Fatalf("Annotation via alias not applied: %q", hostMap["canon.example.net"].Annotation)
+	}
+	if hostMap["other.example.org"].Annotation != "" {
+		t.Fatalf("Stale annotation not cleared: %q", hostMap["other.example.org"].Annotation)
+	}
+}
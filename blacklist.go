@@ -0,0 +1,64 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// Everything which stops a hostname or address being crawled, as it stands,
+// for working out why a server never shows up.  Operational config rather
+// than anything secret, but still behind an admin token with scope
+// "blacklist", like the other management pages.
+
+import (
+	"net/http"
+	"sort"
+)
+
+type EffectiveBlacklist struct {
+	Hosts          []string `json:"hosts"`           // BlacklistedHosts
+	QueryHosts     []string `json:"query_hosts"`     // ignored in peer lists
+	SkipSuffixes   []string `json:"skip_suffixes"`   // never looked up in DNS
+	CrawlSuffixes  []string `json:"crawl_suffixes"`  // empty for no restriction
+	DisallowedNets []string `json:"disallowed_nets"` // special-use address ranges
+}
+
+func GetEffectiveBlacklist() *EffectiveBlacklist {
+	hosts := make([]string, 0, len(BlacklistedHosts))
+	for hostname := range BlacklistedHosts {
+		hosts = append(hosts, hostname)
+	}
+	HostSort(hosts)
+	nets := make([]string, len(disallowedIPs))
+	for i, block := range disallowedIPs {
+		nets[i] = block.String()
+	}
+	queryHosts := append([]string(nil), blacklistedQueryHosts...)
+	sort.Strings(queryHosts)
+	return &EffectiveBlacklist{
+		Hosts:          hosts,
+		QueryHosts:     queryHosts,
+		SkipSuffixes:   effectiveSkipSuffixes(),
+		CrawlSuffixes:  parseHostSuffixes(*flCrawlSuffixes),
+		DisallowedNets: nets,
+	}
+}
+
+func apiBlacklistz(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form information", http.StatusBadRequest)
+		return
+	}
+	reportWriteJson(w, req, GetEffectiveBlacklist())
+}
@@ -0,0 +1,79 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBlacklistz(t *testing.T) {
+	setupTestLogging()
+	tokens, err := readAdminTokens(strings.NewReader(testAdminTokens + "s3kr1t-blacklist blacklist\n"))
+	if err != nil {
+		t.Fatalf("Failed to read tokens: %s", err)
+	}
+	savedTokens, savedHosts, savedProxy := adminTokens, BlacklistedHosts, *flSocksProxy
+	defer func() { adminTokens, BlacklistedHosts, *flSocksProxy = savedTokens, savedHosts, savedProxy }()
+	adminTokens = tokens
+	BlacklistedHosts = map[string]bool{"slow.example.org": true, "broken.example.com": true}
+	*flSocksProxy = "127.0.0.1:9050"
+
+	handler := adminHandler("blacklist", apiBlacklistz)
+	get := func(token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/blacklistz", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	if rec := get("s3kr1t-other"); rec.Code != http.StatusForbidden {
+		t.Fatalf("Wrong scope: got status %d, expected %d", rec.Code, http.StatusForbidden)
+	}
+
+	rec := get("s3kr1t-blacklist")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Bad status %d: %s", rec.Code, rec.Body)
+	}
+	var blacklist EffectiveBlacklist
+	if err := json.Unmarshal(rec.Body.Bytes(), &blacklist); err != nil {
+		t.Fatalf("Bad JSON: %s\n%s", err, rec.Body)
+	}
+	if len(blacklist.Hosts) != 2 || blacklist.Hosts[0] != "broken.example.com" {
+		t.Fatalf("Bad blacklisted hosts, expected host order: %v", blacklist.Hosts)
+	}
+	if len(blacklist.QueryHosts) != len(blacklistedQueryHosts) {
+		t.Fatalf("Bad query hosts %v", blacklist.QueryHosts)
+	}
+	for _, suffix := range blacklist.SkipSuffixes {
+		if suffix == kONION_SUFFIX {
+			t.Fatalf("Skip suffixes %v include %s despite the SOCKS proxy", blacklist.SkipSuffixes, kONION_SUFFIX)
+		}
+	}
+	var sawDocumentation bool
+	for _, block := range blacklist.DisallowedNets {
+		if block == "2001:db8::/32" {
+			sawDocumentation = true
+		}
+	}
+	if !sawDocumentation {
+		t.Fatalf("Documentation range not among disallowed nets: %v", blacklist.DisallowedNets)
+	}
+}
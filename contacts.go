@@ -0,0 +1,95 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// Server operators' contacts, as their stats pages give them, so that pool
+// maintainers can reach whoever runs a problematic server.  A contact is
+// often an email address, so they're only public with -public-contacts;
+// otherwise an admin token with scope "contacts" is needed.
+
+import (
+	"net/http"
+)
+
+const kCONTACTS_SCOPE = "contacts"
+
+type ServerContact struct {
+	Hostname string `json:"hostname"`
+	Contact  string `json:"contact"`
+	Keycount int    `json:"keycount"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Only servers giving a contact are listed, in host order.
+func ServerContacts(hostmap HostMap) []ServerContact {
+	hostnames := make([]string, 0, len(hostmap))
+	for hostname, node := range hostmap {
+		if node != nil && node.AdminContact != "" {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+	HostSort(hostnames)
+	contacts := make([]ServerContact, len(hostnames))
+	for i, hostname := range hostnames {
+		node := hostmap[hostname]
+		contacts[i] = ServerContact{
+			Hostname: hostname,
+			Contact:  node.AdminContact,
+			Keycount: node.Keycount,
+			Error:    node.AnalyzeError,
+		}
+	}
+	return contacts
+}
+
+// For pages showing a whole node: a copy without the contact, unless
+// contacts are public.
+func publicNode(node *SksNode) *SksNode {
+	if *flPublicContacts {
+		return node
+	}
+	if _, ok := node.Settings[kSETTING_CONTACT]; !ok && node.AdminContact == "" {
+		return node
+	}
+	redacted := *node
+	redacted.AdminContact = ""
+	redacted.Settings = make(map[string]string, len(node.Settings))
+	for key, value := range node.Settings {
+		if key != kSETTING_CONTACT {
+			redacted.Settings[key] = value
+		}
+	}
+	return &redacted
+}
+
+func apiContactsPage(w http.ResponseWriter, req *http.Request) {
+	if !*flPublicContacts {
+		adminHandler(kCONTACTS_SCOPE, serveContacts)(w, req)
+		return
+	}
+	serveContacts(w, req)
+}
+
+func serveContacts(w http.ResponseWriter, req *http.Request) {
+	persisted := reportSetup(w, req)
+	if persisted == nil {
+		return
+	}
+	reportWriteJson(w, req, map[string]interface{}{
+		"servers": ServerContacts(persisted.HostMap),
+	})
+}
@@ -0,0 +1,74 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestContactsPage(t *testing.T) {
+	persisted := newTestPersisted(t)
+	persisted.HostMap["keys.kfwebs.net"].AdminContact = "0x0b7f8b60e3edfae3"
+	persisted.HostMap["sks.pkqs.net"].AdminContact = "admin@pkqs.example"
+	SetCurrentPersisted(persisted)
+
+	tokens, err := readAdminTokens(strings.NewReader("s3kr1t-contacts contacts\ns3kr1t-other other\n"))
+	if err != nil {
+		t.Fatalf("Failed to read tokens: %s", err)
+	}
+	savedTokens, savedPublic := adminTokens, *flPublicContacts
+	defer func() { adminTokens, *flPublicContacts = savedTokens, savedPublic }()
+	adminTokens = tokens
+
+	get := func(token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", SERVE_PREFIX+"/contacts", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		apiContactsPage(rec, req)
+		return rec
+	}
+
+	*flPublicContacts = false
+	if rec := get(""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Contacts served without a token: %d", rec.Code)
+	}
+	if rec := get("s3kr1t-other"); rec.Code != http.StatusForbidden {
+		t.Fatalf("Contacts served to a token without scope: %d", rec.Code)
+	}
+	rec := get("s3kr1t-contacts")
+	var result struct {
+		Servers []ServerContact `json:"servers"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Bad JSON: %s\n%s", err, rec.Body)
+	}
+	if len(result.Servers) != 2 || result.Servers[0].Hostname != "keys.kfwebs.net" ||
+		result.Servers[1].Contact != "admin@pkqs.example" || result.Servers[0].Keycount != 3169004 {
+		t.Fatalf("Bad contacts: %+v", result.Servers)
+	}
+
+	*flPublicContacts = true
+	if rec := get(""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "admin@pkqs.example") {
+		t.Fatalf("Contacts not public with -public-contacts: %d\n%s", rec.Code, rec.Body)
+	}
+}
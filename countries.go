@@ -17,14 +17,17 @@
 package sks_spider
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 import (
+	maxminddb "github.com/oschwald/maxminddb-golang"
 	btree "github.com/runningwild/go-btree"
 )
 
@@ -79,13 +82,51 @@ func reverseIP(ipstr string) (reversed string, err error) {
 	return
 }
 
-func CountryForIPString(ipstr string) (country string, err error) {
+// Where countries come from.  The context is for providers which go over
+// the network, as the DNS one does; an IP which is looked up fine but has no
+// country yields "" rather than an error.
+type GeoIPProvider interface {
+	CountryForIP(ctx context.Context, ipstr string) (string, error)
+}
+
+// Providers with AS numbers too may also implement this; 0 if not known.
+type ASNProvider interface {
+	ASNForIP(ctx context.Context, ipstr string) (uint, error)
+}
+
+// If set, we look up countries in this instead of in DNS
+var geoipReader *maxminddb.Reader
+
+// Set by SetGeoIPProvider, to override the default choice
+var geoipProvider GeoIPProvider
+
+// For deployments with a provider of their own; nil restores the default.
+// Spiders pick up the provider when created, so set this at start-up.
+func SetGeoIPProvider(provider GeoIPProvider) {
+	geoipProvider = provider
+}
+
+// The -geoip-db, if open, else the -countries-zone in DNS
+func currentGeoIPProvider() GeoIPProvider {
+	if geoipProvider != nil {
+		return geoipProvider
+	}
+	if geoipReader != nil {
+		return &MaxMindProvider{reader: geoipReader}
+	}
+	return DNSCountryProvider{}
+}
+
+// TXT records under -countries-zone, with the IP reversed as for PTR lookups
+type DNSCountryProvider struct{}
+
+func (DNSCountryProvider) CountryForIP(ctx context.Context, ipstr string) (string, error) {
 	rev, err := reverseIP(ipstr)
 	if err != nil {
 		return "", err
 	}
 	query := fmt.Sprintf("%s.%s", rev, *flCountriesZone)
-	txtList, err := net.LookupTXT(query)
+	txtList, err := net.DefaultResolver.LookupTXT(ctx, query)
 	if err != nil {
 		return "", err
 	}
@@ -94,3 +135,82 @@ func CountryForIPString(ipstr string) (country string, err error) {
 	}
 	return "", fmt.Errorf("No TXT records (and no error) for: %s", query)
 }
+
+// GeoIP lookups are local and quick, so ctx is ignored.
+type MaxMindProvider struct {
+	reader *maxminddb.Reader
+}
+
+func (p *MaxMindProvider) CountryForIP(ctx context.Context, ipstr string) (string, error) {
+	return countryFromGeoIP(p.reader, ipstr)
+}
+
+// Only a GeoLite2-ASN database has these; others give 0.
+func (p *MaxMindProvider) ASNForIP(ctx context.Context, ipstr string) (uint, error) {
+	ip := net.ParseIP(ipstr)
+	if ip == nil {
+		return 0, &net.DNSError{Err: "unrecognized address", Name: ipstr}
+	}
+	var record struct {
+		ASN uint `maxminddb:"autonomous_system_number"`
+	}
+	if err := p.reader.Lookup(ip, &record); err != nil {
+		return 0, err
+	}
+	return record.ASN, nil
+}
+
+// Recorded for an IP whose country lookups all failed, as distinct from one
+// which looked up as blank (not in the database).
+const kCOUNTRY_UNKNOWN = "??"
+
+// A -geoip-db was given but couldn't be opened.  Falling back to DNS would
+// be a surprise, so we go without countries: no lookups are made, and
+// country filters are refused rather than matching nothing.
+var geoipUnavailable bool
+
+// MaxMind only ship the GeoLite2 (.mmdb) format now; the country data is
+// the same shape in the City and Country databases.
+func OpenGeoIPDatabase(filename string) error {
+	reader, err := maxminddb.Open(filename)
+	if err != nil {
+		return err
+	}
+	Log.Printf("Using GeoIP database \"%s\" (%s, built %s)", filename,
+		reader.Metadata.DatabaseType, time.Unix(int64(reader.Metadata.BuildEpoch), 0).UTC().Format("2006-01-02"))
+	geoipReader = reader
+	return nil
+}
+
+type geoipCountryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// An IP which isn't in the database yields an empty country, not an error.
+func countryFromGeoIP(reader *maxminddb.Reader, ipstr string) (string, error) {
+	ip := net.ParseIP(ipstr)
+	if ip == nil {
+		return "", &net.DNSError{Err: "unrecognized address", Name: ipstr}
+	}
+	var record geoipCountryRecord
+	if err := reader.Lookup(ip, &record); err != nil {
+		return "", err
+	}
+	if record.Country.ISOCode != "" {
+		return strings.ToUpper(record.Country.ISOCode), nil
+	}
+	return strings.ToUpper(record.RegisteredCountry.ISOCode), nil
+}
+
+func CountryForIPString(ipstr string) (country string, err error) {
+	return CountryForIPStringContext(context.Background(), ipstr)
+}
+
+func CountryForIPStringContext(ctx context.Context, ipstr string) (country string, err error) {
+	return currentGeoIPProvider().CountryForIP(ctx, ipstr)
+}
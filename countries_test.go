@@ -17,7 +17,11 @@
 package sks_spider
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"strings"
 	"testing"
 )
 
@@ -79,3 +83,184 @@ func TestCountrySets(t *testing.T) {
 	}
 	t.Logf("Countryset OK: %s", set)
 }
+
+const TEST_GEOIP_DB = "data/geoip-country-test.mmdb"
+
+func TestCountryGeoIP(t *testing.T) {
+	setupTestLogging()
+	if err := OpenGeoIPDatabase(TEST_GEOIP_DB); err != nil {
+		t.Fatalf("Failed to open \"%s\": %s", TEST_GEOIP_DB, err)
+	}
+	defer func() { geoipReader = nil }()
+
+	for ip, want := range map[string]string{
+		"213.161.224.2":     "NL",
+		"130.225.1.1":       "DK",
+		"2001:16d8:ee30::4": "SE",
+		"8.8.8.8":           "",
+		"2001:db8::1":       "",
+	} {
+		country, err := CountryForIPString(ip)
+		if err != nil {
+			t.Fatalf("Lookup of [%s] failed: %s", ip, err)
+		}
+		if country != want {
+			t.Fatalf("IP [%s]: expected country \"%s\", got \"%s\"", ip, want, country)
+		}
+	}
+	if _, err := CountryForIPString("not-an-ip"); err == nil {
+		t.Fatalf("Lookup of bogus IP succeeded")
+	}
+}
+
+type fakeGeoIPProvider map[string]string
+
+func (f fakeGeoIPProvider) CountryForIP(ctx context.Context, ipstr string) (string, error) {
+	country, ok := f[ipstr]
+	if !ok {
+		return "", errors.New("fake lookup failure")
+	}
+	return country, nil
+}
+
+func TestGeoIPProvider(t *testing.T) {
+	setupTestLogging()
+	if _, ok := currentGeoIPProvider().(DNSCountryProvider); !ok {
+		t.Fatalf("Default provider without -geoip-db isn't DNS: %T", currentGeoIPProvider())
+	}
+	if err := OpenGeoIPDatabase(TEST_GEOIP_DB); err != nil {
+		t.Fatalf("Failed to open \"%s\": %s", TEST_GEOIP_DB, err)
+	}
+	defer func() { geoipReader = nil; SetGeoIPProvider(nil) }()
+	maxmind, ok := currentGeoIPProvider().(*MaxMindProvider)
+	if !ok {
+		t.Fatalf("Default provider with -geoip-db isn't MaxMind: %T", currentGeoIPProvider())
+	}
+	var _ ASNProvider = maxmind
+	if asn, err := maxmind.ASNForIP(context.Background(), "130.225.1.1"); err != nil || asn != 0 {
+		t.Fatalf("Country database gave AS%d: %v", asn, err)
+	}
+
+	SetGeoIPProvider(fakeGeoIPProvider{"192.0.2.1": "FR"})
+	spider := newSpider()
+	SetGeoIPProvider(nil)
+	go spider.shared.QueryCountryForIP("192.0.2.1")
+	if cr := <-spider.shared.countryResult; cr.err != nil || cr.country != "FR" {
+		t.Fatalf("Fake provider not used: %+v", cr)
+	}
+	go spider.shared.QueryCountryForIP("192.0.2.2")
+	if cr := <-spider.shared.countryResult; cr.err == nil {
+		t.Fatalf("Fake provider failure lost: %+v", cr)
+	}
+	// Resetting restores the default
+	if country, err := CountryForIPString("130.225.1.1"); err != nil || country != "DK" {
+		t.Fatalf("Default not restored: %q %v", country, err)
+	}
+}
+
+func TestCountryBatching(t *testing.T) {
+	setupTestLogging()
+	if err := OpenGeoIPDatabase(TEST_GEOIP_DB); err != nil {
+		t.Fatalf("Failed to open \"%s\": %s", TEST_GEOIP_DB, err)
+	}
+	savedBatch := *flCountryBatch
+	defer func() { geoipReader = nil; *flCountryBatch = savedBatch }()
+	*flCountryBatch = 3
+
+	want := map[string]string{
+		"213.161.224.2":     "NL",
+		"213.161.224.3":     "NL",
+		"130.225.1.1":       "DK",
+		"2001:16d8:ee30::4": "SE",
+		"8.8.8.8":           "",
+	}
+	spider := newSpider()
+	for ip := range want {
+		spider.queueCountryLookup(ip)
+	}
+	if len(spider.countryBatch) != 2 || spider.countryFlush == nil {
+		t.Fatalf("Expected 2 IPs awaiting a timed flush, have %v", spider.countryBatch)
+	}
+	got := make(map[string]string)
+	for i := 0; i < 3; i++ {
+		cr := <-spider.shared.countryResult
+		got[cr.ip] = cr.country
+	}
+	<-spider.countryFlush
+	spider.flushCountryBatch()
+	if spider.countryBatch != nil || spider.countryFlush != nil {
+		t.Fatalf("Batch not reset after flush")
+	}
+	for i := 0; i < 2; i++ {
+		cr := <-spider.shared.countryResult
+		got[cr.ip] = cr.country
+	}
+	for ip, country := range want {
+		if c, ok := got[ip]; !ok || c != country {
+			t.Fatalf("IP [%s]: expected country \"%s\", got \"%s\" (%v)", ip, country, c, ok)
+		}
+	}
+}
+
+func benchmarkCountryIPs(b *testing.B) (*spiderShared, []string) {
+	setupTestLogging()
+	if err := OpenGeoIPDatabase(TEST_GEOIP_DB); err != nil {
+		b.Fatalf("Failed to open \"%s\": %s", TEST_GEOIP_DB, err)
+	}
+	ips := make([]string, 2000)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("130.225.%d.%d", i/250, i%250+1)
+	}
+	b.ResetTimer()
+	return newSpider().shared, ips
+}
+
+func BenchmarkCountryLookupPerIP(b *testing.B) {
+	shared, ips := benchmarkCountryIPs(b)
+	defer func() { geoipReader = nil }()
+	for n := 0; n < b.N; n++ {
+		for _, ip := range ips {
+			go shared.QueryCountryForIP(ip)
+		}
+		for range ips {
+			<-shared.countryResult
+		}
+	}
+}
+
+func BenchmarkCountryLookupBatched(b *testing.B) {
+	shared, ips := benchmarkCountryIPs(b)
+	defer func() { geoipReader = nil }()
+	for n := 0; n < b.N; n++ {
+		for i := 0; i < len(ips); i += 100 {
+			go shared.QueryCountriesForIPs(geoipReader, ips[i:i+100])
+		}
+		for range ips {
+			<-shared.countryResult
+		}
+	}
+}
+
+func TestCountryGeoIPUnavailable(t *testing.T) {
+	loadTestPersisted(t)
+	savedPort := *flSksPortHkp
+	defer func() { geoipUnavailable = false; *flSksPortHkp = savedPort }()
+	geoipUnavailable = true
+	*flSksPortHkp = 1
+
+	spider := newSpider()
+	spider.processDnsResult(&DnsResult{hostname: "localhost", ipList: []string{"8.8.8.8"}})
+	if len(spider.pendingCountries) != 0 || len(spider.countriesForIPs) != 0 {
+		t.Fatalf("Country lookups scheduled without GeoIP: %v", spider.pendingCountries)
+	}
+	<-spider.shared.hostResult
+
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?countries=NL")
+	if !strings.Contains(rec.Body.String(), "reason=geoip_unavailable") {
+		t.Fatalf("Country filter not refused: %s", rec.Body)
+	}
+	rec = testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid")
+	if !strings.Contains(rec.Body.String(), "status=COMPLETE") {
+		t.Fatalf("Unfiltered request failed without GeoIP: %s", rec.Body)
+	}
+}
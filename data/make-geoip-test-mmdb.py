@@ -0,0 +1,97 @@
+#!/usr/bin/env python3
+#
+# Generates geoip-country-test.mmdb, a tiny MaxMind DB (format v2.0) holding
+# just country ISO codes for a few networks, for the tests in countries_test.go
+#
+#   ./make-geoip-test-mmdb.py geoip-country-test.mmdb
+
+import ipaddress, struct, sys
+
+def enc_str(s):
+    b = s.encode()
+    assert len(b) < 29
+    return bytes([(2 << 5) | len(b)]) + b
+
+def enc_uint(typ, v):
+    b = v.to_bytes((v.bit_length() + 7) // 8, 'big') if v else b''
+    if typ <= 7:
+        return bytes([(typ << 5) | len(b)]) + b
+    return bytes([len(b), typ - 7]) + b
+
+def enc_map(d):
+    out = bytes([(7 << 5) | len(d)])
+    for k, v in d.items():
+        out += enc_str(k) + enc(v)
+    return out
+
+def enc_array(a):
+    out = bytes([len(a), 11 - 7])
+    for v in a:
+        out += enc(v)
+    return out
+
+def enc(v):
+    if isinstance(v, str): return enc_str(v)
+    if isinstance(v, dict): return enc_map(v)
+    if isinstance(v, list): return enc_array(v)
+    if isinstance(v, tuple): return enc_uint(*v)
+    raise TypeError(v)
+
+networks = {
+    '213.161.224.0/19': 'NL',
+    '130.225.0.0/16': 'DK',
+    '2001:16d8::/32': 'SE',
+    '2001:6b0::/32': 'SE',
+}
+
+data = b''
+offsets = {}
+for cc in sorted(set(networks.values())):
+    offsets[cc] = len(data)
+    data += enc({'country': {'iso_code': cc}})
+
+EMPTY = -1
+nodes = [[EMPTY, EMPTY]]
+for net, cc in networks.items():
+    n = ipaddress.ip_network(net)
+    if n.version == 4:
+        bits, plen = int(n.network_address), 96 + n.prefixlen
+    else:
+        bits, plen = int(n.network_address), n.prefixlen
+    node = 0
+    for i in range(plen):
+        bit = (bits >> (127 - i)) & 1
+        if i == plen - 1:
+            nodes[node][bit] = ('data', cc)
+        else:
+            if nodes[node][bit] == EMPTY:
+                nodes.append([EMPTY, EMPTY])
+                nodes[node][bit] = len(nodes) - 1
+            node = nodes[node][bit]
+
+count = len(nodes)
+tree = b''
+for l, r in nodes:
+    for rec in (l, r):
+        if rec == EMPTY:
+            v = count
+        elif isinstance(rec, tuple):
+            v = count + 16 + offsets[rec[1]]
+        else:
+            v = rec
+        tree += v.to_bytes(3, 'big')
+
+meta = enc({
+    'binary_format_major_version': (5, 2),
+    'binary_format_minor_version': (5, 0),
+    'build_epoch': (9, 1358640000),
+    'database_type': 'sks_spider-Test',
+    'description': {'en': 'sks_spider test data'},
+    'ip_version': (5, 6),
+    'languages': ['en'],
+    'node_count': (6, count),
+    'record_size': (5, 24),
+})
+out = tree + b'\0' * 16 + data + b'\xab\xcd\xefMaxMind.com' + meta
+open(sys.argv[1], 'wb').write(out)
+print(count, len(out))
@@ -54,3 +54,85 @@ func TestDepthSnapshot(t *testing.T) {
 	}
 	t.Logf("Depth OK; %d entries, max distance %d", len(depthSorted), distance)
 }
+
+func TestPruneToNearest(t *testing.T) {
+	setupTestLogging()
+	hostMap := HostMap{
+		"seed.example.org":  &SksNode{Keycount: 100},
+		"near1.example.org": &SksNode{Keycount: 200},
+		"near2.example.org": &SksNode{Keycount: 300},
+		"far.example.org":   &SksNode{Keycount: 900},
+		"grace.example.org": &SksNode{Keycount: 900, Distance: 3},
+	}
+	distances := map[string]int{
+		"seed.example.org":  0,
+		"near1.example.org": 1,
+		"near2.example.org": 1,
+		"far.example.org":   2,
+	}
+	if pruned := pruneToNearest(hostMap, distances, 0, nil); pruned != 0 || len(hostMap) != 5 {
+		t.Fatalf("Pruned %d hosts with no limit", pruned)
+	}
+	if pruned := pruneToNearest(hostMap, distances, 2, nil); pruned != 3 {
+		t.Fatalf("Expected 3 pruned, got %d", pruned)
+	}
+	if _, ok := hostMap["seed.example.org"]; !ok {
+		t.Fatalf("Seed pruned: %v", hostMap)
+	}
+	if _, ok := hostMap["near2.example.org"]; !ok || len(hostMap) != 2 {
+		t.Fatalf("Tie not broken by keycount: %v", hostMap)
+	}
+}
+
+func TestPruneToNearestKeepsPinned(t *testing.T) {
+	setupTestLogging()
+	hostMap := HostMap{
+		"seed.example.org":   &SksNode{Keycount: 100},
+		"near.example.org":   &SksNode{Keycount: 200},
+		"far.example.org":    &SksNode{Keycount: 900},
+		"anchor.example.org": &SksNode{Keycount: -2, Pinned: true},
+	}
+	distances := map[string]int{
+		"seed.example.org":   0,
+		"near.example.org":   1,
+		"far.example.org":    2,
+		"anchor.example.org": 3,
+	}
+	if pruned := pruneToNearest(hostMap, distances, 2, nil); pruned != 2 {
+		t.Fatalf("Expected 2 pruned, got %d", pruned)
+	}
+	if _, ok := hostMap["anchor.example.org"]; !ok {
+		t.Fatalf("Pinned host pruned: %v", hostMap)
+	}
+	if _, ok := hostMap["seed.example.org"]; !ok || len(hostMap) != 2 {
+		t.Fatalf("Pinned host not counted towards the limit: %v", hostMap)
+	}
+}
+
+func TestPruneToNearestKeepsStartHost(t *testing.T) {
+	setupTestLogging()
+	saved := *flSpiderStartHost
+	defer func() { *flSpiderStartHost = saved }()
+	*flSpiderStartHost = "start.example.org"
+
+	spider := newSpider()
+	seedResolvedHost(spider, "start.example.org", []string{"192.0.2.1"})
+	hostMap := HostMap{
+		"start.example.org": &SksNode{Keycount: 100},
+		"other.example.org": &SksNode{Keycount: 900},
+	}
+	distances := map[string]int{
+		"start.example.org": 0,
+		"other.example.org": 0,
+	}
+	if pruned := pruneToNearest(hostMap, distances, 1, spider.startHostNames()); pruned != 1 {
+		t.Fatalf("Expected 1 pruned, got %d", pruned)
+	}
+	if _, ok := hostMap["start.example.org"]; !ok || len(hostMap) != 1 {
+		t.Fatalf("Start host pruned: %v", hostMap)
+	}
+	graph := GenerateGraph(GenerateHostlistSorted(hostMap), hostMap, GetAliasMapForHostmap(hostMap))
+	if label := graph.LabelMutualWithBase("start.example.org"); label != "n/a" {
+		t.Fatalf("Start host labelled %q relative to itself", label)
+	}
+}
@@ -19,8 +19,10 @@ package sks_spider
 import (
 	"fmt"
 	"io"
+	"net/http"
 	"runtime"
 	"sync"
+	"time"
 )
 
 var diagnosticSpiderDump chan io.Writer
@@ -41,6 +43,10 @@ func SpiderDiagnostics(out io.Writer) {
 }
 
 func (spider *Spider) diagnosticDumpInRoutine(out io.Writer) {
+	if sink, ok := out.(*diagnosticsDumpSink); ok {
+		spider.fillDiagnosticsDump(sink.dump)
+		return
+	}
 	fmt.Fprintf(out, "BatchAddHost: %d / %d\n", len(spider.batchAddHost), cap(spider.batchAddHost))
 	fmt.Fprintf(out, "Waitgroup: %#+v\n", spider.pending)
 	hostnames := make([]string, len(spider.pendingHosts))
@@ -56,11 +62,48 @@ func (spider *Spider) diagnosticDumpInRoutine(out io.Writer) {
 			fmt.Fprintf(out, "\tWait: %3d  %s\n", count, h)
 		}
 	}
+	if spider.capSkipped > 0 {
+		fmt.Fprintf(out, "Hostnames ignored over consideration cap: %d\n", spider.capSkipped)
+	}
+	if len(spider.dnsFailures) > 0 {
+		failed := make([]string, 0, len(spider.dnsFailures))
+		for h := range spider.dnsFailures {
+			failed = append(failed, h)
+		}
+		HostSort(failed)
+		fmt.Fprintf(out, "DNS failures: %d\n", len(failed))
+		for _, h := range failed {
+			fmt.Fprintf(out, "\tDNS: %-40s %s\n", h, spider.dnsFailures[h])
+		}
+	}
 	n := runtime.NumGoroutine()
 	fmt.Fprintf(out, "Go-routines: %d\n", n)
 	fmt.Fprintf(out, "\n")
 }
 
+// From the installed snapshot, not the running spider: servers whose gossip
+// peer list came out shorter than the count they report for themselves.
+func PeerCountDiagnostics(out io.Writer, persisted *PersistedHostInfo) {
+	if persisted == nil {
+		return
+	}
+	truncated := make([]string, 0)
+	for _, name := range persisted.Sorted {
+		if persisted.HostMap[name].PeerListTruncated() {
+			truncated = append(truncated, name)
+		}
+	}
+	if len(truncated) == 0 {
+		return
+	}
+	fmt.Fprintf(out, "Gossip peer lists shorter than self-reported count: %d\n", len(truncated))
+	for _, name := range truncated {
+		node := persisted.HostMap[name]
+		fmt.Fprintf(out, "\tPeers: %-40s parsed %d of %d\n", name, len(node.GossipPeerList), node.ReportedPeers)
+	}
+	fmt.Fprintf(out, "\n")
+}
+
 func KillDummySpiderForDiagnosticsChannel() {
 	diagnosticSpiderDummyLock.Lock()
 	defer diagnosticSpiderDummyLock.Unlock()
@@ -95,3 +138,73 @@ func DummySpiderForDiagnosticsChannel() {
 		}
 	}
 }
+
+// The latest Analyze() panic per host, kept across scans: the host's own
+// error stays short, but a parsing bug can only be fixed knowing where.
+type AnalyzePanic struct {
+	Hostname string
+	When     time.Time
+	Panic    string
+	Stack    []byte
+}
+
+var (
+	analyzePanics     = make(map[string]*AnalyzePanic)
+	analyzePanicsLock sync.Mutex
+)
+
+// The trace is logged only the first time a host panics a given way, rather
+// than on every scan.
+func recordAnalyzePanic(hostname string, x interface{}, stack []byte) {
+	p := &AnalyzePanic{Hostname: hostname, When: time.Now(), Panic: fmt.Sprint(x), Stack: stack}
+	analyzePanicsLock.Lock()
+	previous := analyzePanics[hostname]
+	analyzePanics[hostname] = p
+	analyzePanicsLock.Unlock()
+	if previous == nil || previous.Panic != p.Panic {
+		Log.Printf("[%s] PANIC in Analyze: %s\n%s", hostname, p.Panic, stack)
+	}
+}
+
+func sortedAnalyzePanics() []*AnalyzePanic {
+	analyzePanicsLock.Lock()
+	defer analyzePanicsLock.Unlock()
+	hostnames := make([]string, 0, len(analyzePanics))
+	for h := range analyzePanics {
+		hostnames = append(hostnames, h)
+	}
+	HostSort(hostnames)
+	panics := make([]*AnalyzePanic, len(hostnames))
+	for i, h := range hostnames {
+		panics[i] = analyzePanics[h]
+	}
+	return panics
+}
+
+func AnalyzePanicDiagnostics(out io.Writer) {
+	panics := sortedAnalyzePanics()
+	if len(panics) == 0 {
+		return
+	}
+	fmt.Fprintf(out, "Analyze panics: %d (traces at /analyzepanicz)\n", len(panics))
+	for _, p := range panics {
+		fmt.Fprintf(out, "\tPanic: %-40s %s  %s\n", p.Hostname, p.When.UTC().Format("2006-01-02T15:04:05Z"), p.Panic)
+	}
+	fmt.Fprintf(out, "\n")
+}
+
+func apiAnalyzePanicz(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentTypeTextPlain)
+	host := normalizeHostname(req.FormValue("host"))
+	shown := 0
+	for _, p := range sortedAnalyzePanics() {
+		if host != "" && p.Hostname != host {
+			continue
+		}
+		fmt.Fprintf(w, "== %s at %s: %s\n%s\n", p.Hostname, p.When.UTC().Format("2006-01-02T15:04:05Z"), p.Panic, p.Stack)
+		shown += 1
+	}
+	if shown == 0 {
+		fmt.Fprintf(w, "No analyze panics recorded.\n")
+	}
+}
@@ -0,0 +1,192 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// A structured dump of the running spider's state, written to a file on
+// SIGUSR2, for post-mortems of scans which hang in production.  SIGUSR1 is
+// already taken by -json-persist.  The state is gathered from within the
+// main loop, over the same channel as /scanstatusz, so it's consistent and
+// the scan carries on undisturbed.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A signal storm mustn't become a disk-filling storm
+const kDIAGNOSTICS_DUMP_INTERVAL = 30 * time.Second
+
+// With -json-load, no spider or dummy is ever listening
+const kDIAGNOSTICS_DUMP_TIMEOUT = 10 * time.Second
+
+type QueryErrorDiagnostic struct {
+	Error string `json:"error"`
+	Class string `json:"class"`
+}
+
+type SpiderDiagnosticsDump struct {
+	Timestamp        time.Time                       `json:"timestamp"`
+	ScanRunning      bool                            `json:"scan_running"`
+	BatchQueue       int                             `json:"batch_queue,omitempty"`
+	PendingHosts     map[string]int                  `json:"pending_hosts,omitempty"`
+	PendingCountries map[string]int                  `json:"pending_countries,omitempty"`
+	Considering      int                             `json:"considering,omitempty"`
+	CapSkipped       int                             `json:"cap_skipped,omitempty"`
+	BadDNS           map[string]string               `json:"bad_dns,omitempty"`
+	QueryErrors      map[string]QueryErrorDiagnostic `json:"query_errors,omitempty"`
+	Distances        map[string]int                  `json:"distances,omitempty"`
+	Goroutines       int                             `json:"goroutines"`
+}
+
+// Coarse, so that a dump with hundreds of failures can be skimmed for the
+// pattern: one unreachable network looks quite different from a proxy gone
+// bad.
+func classifyFetchError(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case err == errRobotsDisallowed:
+		return "robots"
+	case errors.Is(err, context.Canceled):
+		return "cancelled"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	case errors.As(err, &netErr) && netErr.Timeout(), strings.Contains(err.Error(), "timed out"):
+		return "timeout"
+	case strings.Contains(err.Error(), "tls:"), strings.Contains(err.Error(), "x509:"):
+		return "tls"
+	case strings.Contains(err.Error(), "redirect"):
+		return "redirect"
+	}
+	return "other"
+}
+
+// Passed down diagnosticSpiderDump in place of a plain writer, so that the
+// main loop knows to fill it in rather than write text.
+type diagnosticsDumpSink struct {
+	dump *SpiderDiagnosticsDump
+}
+
+func (sink *diagnosticsDumpSink) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// Only to be called from the main loop
+func (spider *Spider) fillDiagnosticsDump(dump *SpiderDiagnosticsDump) {
+	dump.ScanRunning = true
+	dump.BatchQueue = len(spider.batchAddHost)
+	dump.PendingHosts = make(map[string]int)
+	for hostname, count := range spider.pendingHosts {
+		if count != 0 {
+			dump.PendingHosts[hostname] = count
+		}
+	}
+	dump.PendingCountries = make(map[string]int)
+	for ip, count := range spider.pendingCountries {
+		if count != 0 {
+			dump.PendingCountries[ip] = count
+		}
+	}
+	dump.Considering = len(spider.considering)
+	dump.CapSkipped = spider.capSkipped
+	dump.BadDNS = make(map[string]string, len(spider.badDNS))
+	for hostname := range spider.badDNS {
+		reason := spider.dnsFailures[hostname]
+		if reason == "" {
+			reason = "bad DNS"
+		}
+		dump.BadDNS[hostname] = reason
+	}
+	dump.QueryErrors = make(map[string]QueryErrorDiagnostic, len(spider.queryErrors))
+	for hostname, err := range spider.queryErrors {
+		dump.QueryErrors[hostname] = QueryErrorDiagnostic{Error: err.Error(), Class: classifyFetchError(err)}
+	}
+	for hostname := range spider.robotsRefused {
+		dump.QueryErrors[hostname] = QueryErrorDiagnostic{Error: errRobotsDisallowed.Error(), Class: "robots"}
+	}
+	dump.Distances = make(map[string]int, len(spider.distances))
+	for hostname, distance := range spider.distances {
+		dump.Distances[hostname] = distance
+	}
+}
+
+// When no scan is running, the dummy answers instead, and the dump says so.
+func GatherSpiderDiagnostics(now time.Time) *SpiderDiagnosticsDump {
+	sink := &diagnosticsDumpSink{dump: &SpiderDiagnosticsDump{Timestamp: now.UTC()}}
+	select {
+	case diagnosticSpiderDump <- sink:
+		<-diagnosticSpiderDone
+	case <-time.After(kDIAGNOSTICS_DUMP_TIMEOUT):
+		Log.Printf("Nothing answered for spider diagnostics after %s", kDIAGNOSTICS_DUMP_TIMEOUT)
+	}
+	sink.dump.Goroutines = runtime.NumGoroutine()
+	return sink.dump
+}
+
+func WriteDiagnosticsDump(dir string, now time.Time) (string, error) {
+	dump := GatherSpiderDiagnostics(now)
+	filename := filepath.Join(dir, fmt.Sprintf("sks_spider-diagnostics-%s.json", now.UTC().Format("20060102T150405Z")))
+	fh, err := os.Create(filename)
+	if err != nil {
+		return "", err
+	}
+	err = writeDiagnosticsJson(fh, dump)
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	return filename, err
+}
+
+func writeDiagnosticsJson(out io.Writer, dump *SpiderDiagnosticsDump) error {
+	b, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", b)
+	return err
+}
+
+func diagnosticsDumpRunner(ch <-chan os.Signal) {
+	var last time.Time
+	for signal := range ch {
+		if since := time.Since(last); since < kDIAGNOSTICS_DUMP_INTERVAL {
+			Log.Printf("Received signal %s only %s after the last diagnostics dump; ignoring", signal, since)
+			continue
+		}
+		last = time.Now()
+		filename, err := WriteDiagnosticsDump(*flDiagnosticsDir, last)
+		if err != nil {
+			Log.Printf("Error writing diagnostics dump: %s", err)
+			continue
+		}
+		Log.Printf("Received signal %s; wrote diagnostics to \"%s\"", signal, filename)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnalyzePanicRecorded(t *testing.T) {
+	setupTestLogging()
+	defer func() {
+		analyzePanicsLock.Lock()
+		analyzePanics = make(map[string]*AnalyzePanic)
+		analyzePanicsLock.Unlock()
+	}()
+
+	func() {
+		defer func() {
+			if x := recover(); x != nil {
+				recordAnalyzePanic("broken.example.org", x, debug.Stack())
+			}
+		}()
+		var node *SksNode
+		node.Analyze()
+	}()
+	recordAnalyzePanic("other.example.org", "index out of range", []byte("goroutine 1 [running]:\n"))
+
+	var out bytes.Buffer
+	AnalyzePanicDiagnostics(&out)
+	if !strings.Contains(out.String(), "Analyze panics: 2") || !strings.Contains(out.String(), "broken.example.org") {
+		t.Fatalf("Bad diagnostics:\n%s", out.String())
+	}
+
+	body := testGet(t, apiAnalyzePanicz, "/analyzepanicz?host=Broken.Example.Org.").Body.String()
+	if !strings.HasPrefix(body, "== broken.example.org at ") || !strings.Contains(body, "TestAnalyzePanicRecorded") {
+		t.Fatalf("Stack trace not retrievable:\n%s", body)
+	}
+	if strings.Contains(body, "other.example.org") {
+		t.Fatalf("Host filter not applied:\n%s", body)
+	}
+
+	tokens, err := readAdminTokens(strings.NewReader(testAdminTokens + "s3kr1t-diagnostics diagnostics\n"))
+	if err != nil {
+		t.Fatalf("Failed to read tokens: %s", err)
+	}
+	savedTokens := adminTokens
+	defer func() { adminTokens = savedTokens }()
+	adminTokens = tokens
+	handler := adminHandler("diagnostics", apiAnalyzePanicz)
+	for token, want := range map[string]int{
+		"":                   http.StatusUnauthorized,
+		"s3kr1t-other":       http.StatusForbidden,
+		"s3kr1t-diagnostics": http.StatusOK,
+	} {
+		req, _ := http.NewRequest("GET", "/analyzepanicz", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != want {
+			t.Fatalf("Token %q: got status %d, expected %d", token, rec.Code, want)
+		}
+	}
+}
+
+func TestDiagnosticsDump(t *testing.T) {
+	setupTestLogging()
+	KillDummySpiderForDiagnosticsChannel()
+	spider := newSpider()
+	spider.pendingHosts["slow.example.org"] = 1
+	spider.pendingHosts["done.example.org"] = 0
+	spider.pendingCountries["192.0.2.7"] = 2
+	spider.badDNS["gone.example.org"] = true
+	spider.robotsRefused["robots.example.org"] = true
+	spider.queryErrors["odd.example.org"] = errors.New("unexpected EOF")
+	spider.distances["slow.example.org"] = 1
+	go spiderMainLoop(spider)
+
+	dir := t.TempDir()
+	when := time.Date(2026, 10, 16, 12, 30, 0, 0, time.UTC)
+	filename, err := WriteDiagnosticsDump(dir, when)
+	if err != nil {
+		t.Fatalf("Writing dump failed: %s", err)
+	}
+	if !strings.HasSuffix(filename, "sks_spider-diagnostics-20261016T123000Z.json") {
+		t.Fatalf("Bad dump filename %q", filename)
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Reading dump failed: %s", err)
+	}
+	var dump SpiderDiagnosticsDump
+	if err := json.Unmarshal(b, &dump); err != nil {
+		t.Fatalf("Dump not JSON: %s\n%s", err, b)
+	}
+	if !dump.ScanRunning || len(dump.PendingHosts) != 1 || dump.PendingHosts["slow.example.org"] != 1 {
+		t.Fatalf("Bad pending hosts in dump:\n%s", b)
+	}
+	if dump.PendingCountries["192.0.2.7"] != 2 || dump.BadDNS["gone.example.org"] != "bad DNS" || dump.Distances["slow.example.org"] != 1 {
+		t.Fatalf("Bad dump:\n%s", b)
+	}
+	if dump.QueryErrors["robots.example.org"].Class != "robots" || dump.QueryErrors["odd.example.org"].Class != "other" {
+		t.Fatalf("Bad query error classes:\n%s", b)
+	}
+
+	spider.Terminate()
+	if dump := GatherSpiderDiagnostics(when); dump.ScanRunning || dump.PendingHosts != nil {
+		t.Fatalf("Dummy answer claims a running scan: %+v", dump)
+	}
+}
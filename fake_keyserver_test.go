@@ -0,0 +1,148 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	TEST_STATS_NO_HOSTNAME = "data/stats-sks-no-hostname.html"
+	TEST_STATS_TRUNCATED   = "data/stats-sks-truncated.html"
+)
+
+// A keyserver serving one canned stats page, so that Fetch and Analyze can
+// be exercised without the network.  Other paths give 404, as SKS does.
+type fakeKeyserver struct {
+	*httptest.Server
+	page         []byte
+	serverHeader string
+	statsPath    string
+	requests     int
+}
+
+func newFakeKeyserver(t *testing.T, page []byte) *fakeKeyserver {
+	fake := &fakeKeyserver{page: page, serverHeader: "sks_www/1.1.4+", statsPath: kDEFAULT_STATS_PATH}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fake.requests += 1
+		if req.URL.RequestURI() != fake.statsPath {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Server", fake.serverHeader)
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		w.Write(fake.page)
+	}))
+	return fake
+}
+
+func newFakeKeyserverFromFile(t *testing.T, filename string) *fakeKeyserver {
+	page, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read \"%s\": %s", filename, err)
+	}
+	return newFakeKeyserver(t, page)
+}
+
+// A node for the fake, with nothing yet fetched
+func (fake *fakeKeyserver) Node(t *testing.T) *SksNode {
+	host, port := testServerHostPort(t, fake.Server)
+	return &SksNode{Hostname: host, Port: port}
+}
+
+// Fetch and Analyze, as the spider would, but panics aren't recovered
+func (fake *fakeKeyserver) FetchNode(t *testing.T) *SksNode {
+	node := fake.Node(t)
+	if err := node.Fetch(); err != nil {
+		t.Fatalf("Fetch from fake keyserver failed: %s", err)
+	}
+	node.Analyze()
+	return node
+}
+
+func TestFakeKeyserverAnalyze(t *testing.T) {
+	setupTestLogging()
+
+	normal := newFakeKeyserverFromFile(t, TEST_STATS_SKS)
+	defer normal.Close()
+	node := normal.FetchNode(t)
+	if node.analyzeError != nil || node.Keycount != 3169004 || node.Version != "1.1.4+" {
+		t.Fatalf("Bad analysis of normal page: err=%v keycount=%d version=%q", node.analyzeError, node.Keycount, node.Version)
+	}
+	if name, ok := node.ReportedHostname(); !ok || name != "keys.kfwebs.net" {
+		t.Fatalf("Bad hostname: %q %v", name, ok)
+	}
+	if len(node.GossipPeerList) != 4 || len(node.MailsyncPeers) != 1 || node.ServerHeader != "sks_www/1.1.4+" {
+		t.Fatalf("Bad analysis of normal page: %+v", node)
+	}
+
+	nameless := newFakeKeyserverFromFile(t, TEST_STATS_NO_HOSTNAME)
+	defer nameless.Close()
+	node = nameless.FetchNode(t)
+	if name, ok := node.ReportedHostname(); ok {
+		t.Fatalf("Hostname %q found on page without one", name)
+	}
+	if node.Keycount != 3169004 || len(node.GossipPeerList) != 4 {
+		t.Fatalf("Page without hostname otherwise misread: %+v", node)
+	}
+
+	truncated := newFakeKeyserverFromFile(t, TEST_STATS_TRUNCATED)
+	defer truncated.Close()
+	node = truncated.FetchNode(t)
+	if node.Keycount != 0 || node.Version != "1.1.4+" {
+		t.Fatalf("Bad analysis of truncated page: keycount=%d version=%q", node.Keycount, node.Version)
+	}
+
+	for page, want := range map[string]int{
+		"<html><body><h2>Statistics</h2><p>Total number of keys 3169004</p></body></html>":       -1,
+		"<html><body><h2>Statistics</h2><p>Total number of keys: lots</p></body></html>":         -1,
+		"<html><body><h2>Statistics</h2><p>Total number of keys: 3169004</p></body></html>":      3169004,
+		"<html><body><h2>Statistics</h2><p>Something else entirely</p></body></html>":            0,
+		"<html><body><p>Not a stats page at all, perhaps a proxy's error page</p></body></html>": 0,
+	} {
+		fake := newFakeKeyserver(t, []byte(page))
+		node := fake.FetchNode(t)
+		fake.Close()
+		if node.Keycount != want {
+			t.Fatalf("Keycount %d, expected %d, from: %s", node.Keycount, want, page)
+		}
+	}
+}
+
+func TestFakeKeyserverQueryHost(t *testing.T) {
+	setupTestLogging()
+	savedPort := *flSksPortHkp
+	defer func() { *flSksPortHkp = savedPort }()
+
+	fake := newFakeKeyserverFromFile(t, TEST_STATS_TRUNCATED)
+	defer fake.Close()
+	host, port := testServerHostPort(t, fake.Server)
+	*flSksPortHkp = port
+
+	spider := newSpider()
+	spider.shared.QueryHost(host)
+	result := <-spider.shared.hostResult
+	if result.err != nil || result.node == nil || result.node.Version != "1.1.4+" {
+		t.Fatalf("Bad result for truncated page: %+v", result)
+	}
+	if fake.requests != 1 {
+		t.Fatalf("Expected 1 request to fake keyserver, got %d", fake.requests)
+	}
+}
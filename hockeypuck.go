@@ -0,0 +1,119 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// Hockeypuck serves an SKS-like HTML stats page, but also a JSON one, at
+// /pks/lookup?op=stats&options=mr, which is much less fragile to parse.  Its
+// fields are mapped onto the same SksNode fields as the SKS page gives, with
+// the Settings keys SKS uses, so nothing downstream needs to know which
+// software it was.
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type hockeypuckPeer struct {
+	Name      string `json:"name"`
+	HTTPAddr  string `json:"httpAddr"`
+	ReconAddr string `json:"reconAddr"`
+}
+
+type hockeypuckStats struct {
+	Version   string           `json:"version"`
+	Hostname  string           `json:"hostname"`
+	Nodename  string           `json:"nodename"`
+	Software  string           `json:"software"`
+	Contact   string           `json:"contact"`
+	HTTPAddr  string           `json:"httpAddr"`
+	ReconAddr string           `json:"reconAddr"`
+	Peers     []hockeypuckPeer `json:"peers"`
+	Total     int              `json:"total"`
+}
+
+// Body shape rather than Content-Type, which proxies get wrong
+func looksLikeJson(buf []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(buf), []byte("{"))
+}
+
+func parseHockeypuckStats(buf []byte) (*hockeypuckStats, error) {
+	stats := new(hockeypuckStats)
+	if err := json.Unmarshal(buf, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Addresses are "host:port", or just ":port" for the server's own listeners
+func splitHockeypuckAddr(addr string) (host, port string) {
+	host, port, err := net.SplitHostPort(strings.TrimSpace(addr))
+	if err != nil {
+		return "", ""
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		port = ""
+	}
+	return host, port
+}
+
+func (sn *SksNode) analyzeHockeypuck() {
+	stats := sn.jsonStatus
+	settings := make(map[string]string, 7)
+	for key, value := range map[string]string{
+		kSETTING_HOSTNAME: stats.Hostname,
+		kSETTING_NODENAME: stats.Nodename,
+		kSETTING_VERSION:  stats.Version,
+		kSETTING_SOFTWARE: stats.Software,
+		kSETTING_CONTACT:  stats.Contact,
+	} {
+		if value != "" {
+			settings[key] = value
+		}
+	}
+	if _, port := splitHockeypuckAddr(stats.HTTPAddr); port != "" {
+		settings[kSETTING_HTTP_PORT] = port
+	}
+	if _, port := splitHockeypuckAddr(stats.ReconAddr); port != "" {
+		settings[kSETTING_RECON_PORT] = port
+	}
+	sn.Settings = settings
+	sn.Version, _ = sn.ReportedVersion()
+	sn.Software, _ = sn.ReportedSoftware()
+	if sn.Software == "" {
+		sn.Software = "Hockeypuck"
+	}
+	sn.AdminContact, _ = sn.ReportedContact()
+	sn.Keycount = stats.Total
+	sn.setTypedSettings()
+
+	peers := make(map[string]string, len(stats.Peers))
+	sn.GossipPeerList = make([]string, 0, len(stats.Peers))
+	for _, peer := range stats.Peers {
+		host, port := splitHockeypuckAddr(peer.ReconAddr)
+		if host == "" {
+			continue
+		}
+		if _, seen := peers[host]; !seen {
+			sn.GossipPeerList = append(sn.GossipPeerList, host)
+		}
+		peers[host] = port
+	}
+	sn.GossipPeers = peers
+}
@@ -19,6 +19,7 @@ package sks_spider
 import (
 	"sort"
 	"strings"
+	"time"
 )
 
 type HostMap map[string]*SksNode
@@ -83,6 +84,23 @@ func GetAliasMapForHostmap(hostMap HostMap) AliasMap {
 }
 
 func GeneratePersistedInformation(spider *Spider) *PersistedHostInfo {
+	return generatePersistedInformation(spider, true)
+}
+
+// The number of hosts the scan found, before any purging or carrying forward.
+func (spider *Spider) hostCount() int {
+	count := 0
+	for _, node := range spider.serverInfos {
+		if node != nil {
+			count += 1
+		}
+	}
+	return count
+}
+
+// Without trackStale, the scan's failures aren't recorded in staleHosts and
+// nothing is purged or carried forward: the snapshot is the scan as it was.
+func generatePersistedInformation(spider *Spider, trackStale bool) *PersistedHostInfo {
 	hostMap := make(HostMap, len(spider.serverInfos))
 	aliasMap := make(AliasMap, len(spider.serverInfos)*2)
 	for hn := range spider.serverInfos {
@@ -90,13 +108,33 @@ func GeneratePersistedInformation(spider *Spider) *PersistedHostInfo {
 			continue
 		}
 		hostMap[hn] = spider.serverInfos[hn]
+		// To let JSON Marshal/Unmarshal work:
+		if hostMap[hn].analyzeError != nil {
+			hostMap[hn].AnalyzeError = hostMap[hn].analyzeError.Error()
+			hostMap[hn].analyzeError = nil
+		}
+	}
+	spider.markPinned(hostMap)
+	if trackStale {
+		staleHosts.update(hostMap, spider.queryErrors, spider.badDNS, time.Now())
+		staleHosts.carryForward(hostMap, GetCurrentPersisted(), time.Now())
 	}
+	spider.retainPinned(hostMap)
+	pruned := pruneToNearest(hostMap, spider.distances, *flKeepNearest, spider.startHostNames())
 
 	hostnames := GenerateHostlistSorted(hostMap)
 
 	for _, hostname := range hostnames {
 		aliasMap[hostname] = hostname
+		if !hostMap[hostname].LastGoodScan.IsZero() {
+			// Already normalised in the snapshot it came from
+			for _, alias := range hostMap[hostname].Aliases {
+				aliasMap[alias] = hostname
+			}
+			continue
+		}
 		hostMap[hostname].IpList = spider.ipsForHost[hostname]
+		hostMap[hostname].setAddressFamilies()
 		hostMap[hostname].Aliases = make([]string, 0, len(spider.aliasesForHost[hostname]))
 		for _, alias := range spider.aliasesForHost[hostname] {
 			aliasMap[alias] = hostname
@@ -107,11 +145,6 @@ func GeneratePersistedInformation(spider *Spider) *PersistedHostInfo {
 		HostSort(hostMap[hostname].GossipPeerList)
 		HostSort(hostMap[hostname].MailsyncPeers)
 		hostMap[hostname].Distance = spider.distances[hostname]
-		// To let JSON Marshal/Unmarshal work:
-		if hostMap[hostname].analyzeError != nil {
-			hostMap[hostname].AnalyzeError = hostMap[hostname].analyzeError.Error()
-			hostMap[hostname].analyzeError = nil
-		}
 	}
 
 	countryMap := make(IPCountryMap, len(spider.countriesForIPs))
@@ -129,10 +162,174 @@ func GeneratePersistedInformation(spider *Spider) *PersistedHostInfo {
 		Sorted:       hostnames,
 		DepthSorted:  GenerateDepthSorted(hostMap),
 		Graph:        GenerateGraph(hostnames, hostMap, aliasMap),
+		RawPages:     spider.rawPages,
+		SharedIPs:    FindSharedIPs(hostMap, spider.knownIPs),
+
+		HostnameMismatches: sortedMismatches(spider.nameMismatches),
+		SelfPeers:          sortedSelfPeers(spider.selfPeers, hostMap),
+		PrunedHosts:        pruned,
+		DownHosts:          spider.downHosts(hostMap),
+		Phases:             spider.Phases(),
+	}
+}
+
+// The start host, as given and as filed, which the peer pages are rendered
+// relative to, so must survive any pruning.
+func (spider *Spider) startHostNames() map[string]bool {
+	names := map[string]bool{*flSpiderStartHost: true}
+	if canonical, ok := spider.knownHosts[normalizeHostname(*flSpiderStartHost)]; ok {
+		names[canonical] = true
 	}
+	return names
+}
+
+// Unlike a limit on crawl depth, the whole mesh is still walked, so that the
+// distances are right; only the results are cut down, to the n hosts nearest
+// the seeds, preferring the larger keycount at equal distance.  Pinned hosts
+// and those in keep count towards the n but are never pruned, even if there
+// are more than n.
+func pruneToNearest(hostMap HostMap, distances map[string]int, n int, keep map[string]bool) int {
+	if n <= 0 || len(hostMap) <= n {
+		return 0
+	}
+	distance := func(hostname string) int {
+		if d, ok := distances[hostname]; ok {
+			return d
+		}
+		return hostMap[hostname].Distance
+	}
+	hostnames := make([]string, 0, len(hostMap))
+	for hostname := range hostMap {
+		hostnames = append(hostnames, hostname)
+	}
+	kept := func(hostname string) bool {
+		return hostMap[hostname].Pinned || keep[hostname]
+	}
+	sort.Slice(hostnames, func(i, j int) bool {
+		hi, hj := hostnames[i], hostnames[j]
+		if pi, pj := kept(hi), kept(hj); pi != pj {
+			return pi
+		}
+		if di, dj := distance(hi), distance(hj); di != dj {
+			return di < dj
+		}
+		if ki, kj := hostMap[hi].Keycount, hostMap[hj].Keycount; ki != kj {
+			return ki > kj
+		}
+		return hi < hj
+	})
+	pruned := 0
+	for _, hostname := range hostnames[n:] {
+		if kept(hostname) {
+			continue
+		}
+		delete(hostMap, hostname)
+		pruned += 1
+	}
+	Log.Printf("Pruned %d hosts beyond the %d nearest", pruned, n)
+	return pruned
+}
+
+// Hosts still in the results, as carried forward or pinned, aren't down
+func (spider *Spider) downHosts(hostMap HostMap) map[string]string {
+	down := make(map[string]string, len(spider.queryErrors)+len(spider.badDNS))
+	for hostname := range spider.badDNS {
+		reason := spider.dnsFailures[hostname]
+		if reason == "" {
+			reason = "bad DNS"
+		}
+		down[hostname] = "DNS: " + reason
+	}
+	for hostname, err := range spider.queryErrors {
+		down[hostname] = "fetch: " + err.Error()
+	}
+	for hostname := range hostMap {
+		delete(down, hostname)
+	}
+	return down
+}
+
+func sortedMismatches(mismatches map[string]HostnameMismatch) []HostnameMismatch {
+	hostnames := make([]string, 0, len(mismatches))
+	for hostname := range mismatches {
+		hostnames = append(hostnames, hostname)
+	}
+	HostSort(hostnames)
+	sorted := make([]HostnameMismatch, len(hostnames))
+	for i, hostname := range hostnames {
+		sorted[i] = mismatches[hostname]
+	}
+	return sorted
+}
+
+// Only for hosts still in the results
+func sortedSelfPeers(selfPeers map[string][]string, hostMap HostMap) []SelfPeer {
+	hostnames := make([]string, 0, len(selfPeers))
+	for hostname := range selfPeers {
+		if _, ok := hostMap[hostname]; ok {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+	HostSort(hostnames)
+	sorted := make([]SelfPeer, len(hostnames))
+	for i, hostname := range hostnames {
+		sorted[i] = SelfPeer{Hostname: hostname, ListedAs: selfPeers[hostname]}
+	}
+	return sorted
+}
+
+type SharedIP struct {
+	IP        string   `json:"ip"`
+	Hostnames []string `json:"hostnames"`
+}
+
+// De-duping by IP means that a second canonical host with an IP we already
+// know is usually folded in silently, but the folding depends on the order
+// of DNS results, so distinct servers can still end up sharing an IP.  That's
+// split-brain DNS or stale records, worth telling someone about.  knownIPs
+// may be nil, when we only have a HostMap loaded from JSON.
+func FindSharedIPs(hostMap HostMap, knownIPs map[string]string) []SharedIP {
+	owners := make(map[string]map[string]bool, len(hostMap)*2)
+	claim := func(ip, hostname string) {
+		if _, ok := owners[ip]; !ok {
+			owners[ip] = make(map[string]bool, 2)
+		}
+		owners[ip][hostname] = true
+	}
+	for hostname, node := range hostMap {
+		for _, ip := range node.IpList {
+			claim(ip, hostname)
+		}
+	}
+	for ip, hostname := range knownIPs {
+		if _, ok := hostMap[hostname]; ok {
+			claim(ip, hostname)
+		}
+	}
+
+	shared := make([]SharedIP, 0)
+	for ip, hosts := range owners {
+		if len(hosts) < 2 {
+			continue
+		}
+		hostnames := make([]string, 0, len(hosts))
+		for hostname := range hosts {
+			hostnames = append(hostnames, hostname)
+		}
+		HostSort(hostnames)
+		shared = append(shared, SharedIP{IP: ip, Hostnames: hostnames})
+	}
+	sort.Slice(shared, func(i, j int) bool { return shared[i].IP < shared[j].IP })
+	if len(shared) > 0 {
+		Log.Printf("Found %d IPs claimed by more than one canonical host", len(shared))
+	}
+	return shared
 }
 
 func GetFreshCountryForHostmap(hostMap HostMap) IPCountryMap {
+	if geoipUnavailable {
+		return make(IPCountryMap)
+	}
 	Log.Print("Quering DNS (sequentially) for fresh country map")
 	countryMap := make(IPCountryMap, len(hostMap))
 	triedIPs := make(map[string]bool, len(hostMap)*3)
@@ -148,6 +345,8 @@ func GetFreshCountryForHostmap(hostMap HostMap) IPCountryMap {
 			country, err := CountryForIPString(ip)
 			if err == nil {
 				countryMap[ip] = country
+			} else {
+				countryMap[ip] = kCOUNTRY_UNKNOWN
 			}
 		}
 	}
@@ -163,15 +362,8 @@ func (p *PersistedHostInfo) LogInformation() {
 
 func (p *PersistedHostInfo) UpdateStatsCounters(spider *Spider) {
 	statsCollectionTimestamp.Set(p.Timestamp.Unix())
-	var countOkayAndBad = int64(len(p.HostMap))
-	var countBadData int64 = 0
-	for hostname := range p.HostMap {
-		if p.HostMap[hostname].AnalyzeError != "" {
-			countBadData++
-		}
-	}
-	statsServersHaveData.Set(countOkayAndBad - countBadData)
-	statsServersBadData.Set(countBadData)
+	statsServersHaveData.Set(int64(p.Summary.Reachable))
+	statsServersBadData.Set(int64(p.Summary.Failed))
 	statsServersBadDNS.Set(int64(len(spider.badDNS)))
 	statsServersTotal.Set(int64(len(p.HostMap)))
 	statsServersHostnamesSeen.Set(int64(len(spider.considering)))
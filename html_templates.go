@@ -85,7 +85,7 @@ func prepareTemplates() {
 
 	kPAGE_TEMPLATE_HOST := `
    <tr class="peer host {{.Rowclass}}">
-    <td class="hostname"{{.Rowspan}}><a href="{{.Sks_info}}">{{.Hostname}}</a>{{.Host_aliases_text}}</td>
+    <td class="hostname"{{.Rowspan}}><a href="{{.Sks_info}}">{{.Hostname}}</a>{{.Host_aliases_text}}{{if .Annotation}} <span class="annotation">{{.Annotation}}</span>{{end}}</td>
     <td class="morelink"{{.Rowspan}}><a href="{{.Info_page}}">&dagger;</a></td>
     <td class="ipaddr">{{.Ip}}</td>
     <td class="location">{{.Geo}}</td>
@@ -100,7 +100,7 @@ func prepareTemplates() {
 
 	kPAGE_TEMPLATE_HOSTERR := `
    <tr class="peer host failure {{.Rowclass}}">
-    <td class="hostname">{{.Hostname}}</td>
+    <td class="hostname">{{.Hostname}}{{if .Annotation}} <span class="annotation">{{.Annotation}}</span>{{end}}</td>
     <td class="morelink"><a href="{{.Info_page}}">&dagger;</a></td>
     <td class="exception" colspan="8">Error: {{.Error}}</td>
    </tr>
@@ -130,6 +130,9 @@ func prepareTemplates() {
    <tr><td>Web Server</td><td>{{.Web_server}}</td></tr>
    <tr><td>Proxy / via</td><td>{{.Via_info}}</td></tr>
    <tr><td>Key count</td><td>{{.Keycount}}</td></tr>
+{{if .Annotation}}
+   <tr><td>Note</td><td class="annotation">{{.Annotation}}</td></tr>
+{{end}}
 {{if .Mailsync_count}}
    <tr><td rowspan=".Mailsync_count">Mailsync</td>{{$need_tr := false}}
 {{range .Mailsync}}
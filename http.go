@@ -71,14 +71,45 @@ func setupHttpServer(listen string) *http.Server {
 	http.HandleFunc(SERVE_PREFIX+"/peer-info", apiPeerInfoPage)
 	http.HandleFunc(SERVE_PREFIX+"/ip-valid", apiIpValidPage)
 	http.HandleFunc(SERVE_PREFIX+"/ip-valid-stats", apiIpValidStatsPage)
+	http.HandleFunc(SERVE_PREFIX+"/ip-valid-simulate", apiIpValidSimulatePage)
 	http.HandleFunc(SERVE_PREFIX+"/hostnames-json", apiHostnamesJsonPage)
 	http.HandleFunc(SERVE_PREFIX+"/graph-dot", apiGraphDot)
+	http.HandleFunc(SERVE_PREFIX+"/keycount-histogram", apiKeycountHistogramPage)
+	http.HandleFunc(SERVE_PREFIX+"/slow-hosts", apiSlowHostsPage)
+	http.HandleFunc(SERVE_PREFIX+"/stale-hosts", apiStaleHostsPage)
+	http.HandleFunc(SERVE_PREFIX+"/static-keycounts", apiStaticKeycountsPage)
+	http.HandleFunc(SERVE_PREFIX+"/versions", apiVersionsPage)
+	http.HandleFunc(SERVE_PREFIX+"/raw-page", apiRawPage)
+	http.HandleFunc(SERVE_PREFIX+"/shared-ips", apiSharedIPsPage)
+	http.HandleFunc(SERVE_PREFIX+"/host-identity", apiHostIdentityPage)
+	http.HandleFunc(SERVE_PREFIX+"/host-record", apiHostRecordPage)
+	http.HandleFunc(SERVE_PREFIX+"/summary", apiSummaryPage)
+	http.HandleFunc(SERVE_PREFIX+"/country-drift", apiCountryDriftPage)
+	http.HandleFunc(SERVE_PREFIX+"/proxy-cohorts", apiProxyCohortsPage)
+	http.HandleFunc(SERVE_PREFIX+"/address-families", apiAddressFamiliesPage)
+	http.HandleFunc(SERVE_PREFIX+"/prefix-concentration", apiPrefixConcentrationPage)
+	http.HandleFunc(SERVE_PREFIX+"/co-located", apiCoLocatedPage)
+	http.HandleFunc(SERVE_PREFIX+"/hostname-mismatches", apiHostnameMismatchesPage)
+	http.HandleFunc(SERVE_PREFIX+"/self-peers", apiSelfPeersPage)
+	http.HandleFunc(SERVE_PREFIX+"/contacts", apiContactsPage)
+	http.HandleFunc(SERVE_PREFIX+"/ip-check", apiIpCheckPage)
+	http.HandleFunc(SERVE_PREFIX+"/pool-diff", apiPoolDiffPage)
+	http.HandleFunc(SERVE_PREFIX+"/minimum-versions", apiMinimumVersionsPage)
+	http.HandleFunc(SERVE_PREFIX+"/minimum-version-for", apiMinimumVersionForPage)
+	http.HandleFunc(SERVE_PREFIX+"/removal-candidates", apiRemovalCandidatesPage)
+	http.HandleFunc(SERVE_PREFIX+"/snapshots", apiSnapshotsPage)
 	http.HandleFunc("/helpz", apiHelpz)
 	http.HandleFunc("/scanstatusz", apiScanStatusz)
-	// MISSING: threadz environz rescanz internalz quitz
+	http.HandleFunc("/analyzepanicz", adminHandler("diagnostics", apiAnalyzePanicz))
+	http.HandleFunc("/metrics", apiMetrics)
+	http.HandleFunc("/rescanz", adminHandler("rescan", apiRescanz))
+	http.HandleFunc("/tunablesz", adminHandler("tunables", apiTunablesz))
+	http.HandleFunc("/promotez", adminHandler("promote", apiPromotez))
+	http.HandleFunc("/blacklistz", adminHandler("blacklist", apiBlacklistz))
+	// MISSING: threadz environz internalz quitz
 	// net/http/pprof provides /debug/pprof with threads and profiling information
 	// expvar provides /debug/vars (JSON)
-	// MISSING: environz rescanz (internalz) quitz
+	// MISSING: environz (internalz) quitz
 	// leave quitz out?
 	http.HandleFunc("/", apiOops)
 	return s
@@ -101,7 +132,15 @@ func apiHelpz(w http.ResponseWriter, req *http.Request) {
 
 func apiScanStatusz(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", ContentTypeTextPlain)
+	if scanScheduler != nil {
+		if next := scanScheduler.NextScan(); !next.IsZero() {
+			fmt.Fprintf(w, "Next scan: %s (in %s)\n", next.UTC().Format("2006-01-02T15:04:05Z"), next.Sub(time.Now()))
+		}
+		fmt.Fprintf(w, "Scan running: %v\n\n", scanScheduler.Running())
+	}
 	SpiderDiagnostics(w)
+	PeerCountDiagnostics(w, GetCurrentPersisted())
+	AnalyzePanicDiagnostics(w)
 	fmt.Fprintf(w, "\nDone.\n")
 }
 
@@ -165,6 +204,7 @@ func apiPeersPage(w http.ResponseWriter, req *http.Request) {
 		attributes["Hostname"] = host
 		attributes["Sks_info"] = NodeUrl(host, node)
 		attributes["Info_page"] = fmt.Sprintf(SERVE_PREFIX+"/peer-info?peer=%s", host)
+		attributes["Annotation"] = node.Annotation
 
 		if node.AnalyzeError != "" {
 			attributes["Error"] = node.AnalyzeError
@@ -253,6 +293,7 @@ func apiPeerInfoPage(w http.ResponseWriter, req *http.Request) {
 	namespace["Web_server"] = node.ServerHeader
 	namespace["Via_info"] = node.ViaHeader
 	namespace["Peer_statsurl"] = node.Url()
+	namespace["Annotation"] = node.Annotation
 
 	peer_list := persisted.Graph.AllPeersOf(node.Hostname)
 
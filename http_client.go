@@ -0,0 +1,143 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// The client used for fetching stats pages from keyservers; DNS lookups done
+// by the spider itself are unaffected by anything here.
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+import (
+	"golang.org/x/net/proxy"
+)
+
+var fetchClient = &http.Client{CheckRedirect: checkFetchRedirect}
+
+// A redirect could take us anywhere, so by default none are followed and the
+// fetch fails; with -max-redirects, that many are followed.
+func checkFetchRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > *flMaxRedirects {
+		return fmt.Errorf("refusing redirect to <%s> after %d redirects (-max-redirects %d)",
+			req.URL.Redacted(), len(via)-1, *flMaxRedirects)
+	}
+	return nil
+}
+
+// Where a followed redirect ended up.  Another host entirely might be a
+// hijacked or misconfigured server, so is flagged.
+func (sn *SksNode) recordRedirect(resp *http.Response) {
+	sn.FinalURL, sn.CrossHost = "", false
+	if resp.Request == nil || resp.Request.URL.String() == sn.uri {
+		return
+	}
+	sn.FinalURL = resp.Request.URL.String()
+	if !strings.EqualFold(resp.Request.URL.Hostname(), sn.Hostname) {
+		sn.CrossHost = true
+		Log.Printf("[%s] Warning: stats page redirected to another host, <%s>", sn.Hostname, sn.FinalURL)
+	}
+}
+
+func fetchProxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	if *flHttpProxy == "" {
+		probe, _ := http.NewRequest("GET", "http://keyserver.invalid/", nil)
+		if proxy, err := http.ProxyFromEnvironment(probe); err == nil && proxy != nil {
+			Log.Printf("Fetching stats pages via proxy <%s> from environment", proxy.Redacted())
+		} else {
+			Log.Printf("Fetching stats pages directly, no proxy")
+		}
+		return http.ProxyFromEnvironment, nil
+	}
+	proxy, err := url.Parse(*flHttpProxy)
+	if err != nil {
+		return nil, err
+	}
+	if (proxy.Scheme != "http" && proxy.Scheme != "https") || proxy.Host == "" {
+		return nil, fmt.Errorf("proxy URL must be http://host:port or https://host:port, got \"%s\"", proxy.Redacted())
+	}
+	Log.Printf("Fetching stats pages via proxy <%s>", proxy.Redacted())
+	return http.ProxyURL(proxy), nil
+}
+
+// The per-phase timeouts let us give up quickly on hosts which are gone,
+// while staying patient with slow ones; -http-fetch-timeout still bounds
+// the whole fetch, body included.
+func fetchTransport(proxyFunc func(*http.Request) (*url.URL, error)) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   *flHttpDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy:                 proxyFunc,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   *flHttpTlsTimeout,
+		ResponseHeaderTimeout: *flHttpHeaderTimeout,
+	}
+}
+
+// The SOCKS5 dialer is given hostnames, not addresses, so the proxy does the
+// name resolution: that's the only way .onion names work, and with Tor it
+// keeps our lookups private too.  The dial timeout then covers the proxy's
+// connection onwards, as well as our connection to the proxy.
+func socksTransport(address string) (*http.Transport, error) {
+	transport := fetchTransport(nil)
+	dialer, err := proxy.SOCKS5("tcp", address, nil, &net.Dialer{
+		Timeout:   *flHttpDialTimeout,
+		KeepAlive: 30 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("SOCKS5 dialer for %s does not support contexts", address)
+	}
+	transport.DialContext = contextDialer.DialContext
+	return transport, nil
+}
+
+func setupFetchClient() error {
+	if *flSocksProxy != "" {
+		if *flHttpProxy != "" {
+			return fmt.Errorf("can't use both -http-proxy and -socks-proxy")
+		}
+		transport, err := socksTransport(*flSocksProxy)
+		if err != nil {
+			return err
+		}
+		Log.Printf("Fetching stats pages via SOCKS5 proxy <%s>", *flSocksProxy)
+		fetchClient = &http.Client{Transport: transport, CheckRedirect: checkFetchRedirect}
+		return nil
+	}
+	proxyFunc, err := fetchProxyFunc()
+	if err != nil {
+		return err
+	}
+	Log.Printf("Fetch timeouts: dial %s, TLS handshake %s, response headers %s, overall %s",
+		*flHttpDialTimeout, *flHttpTlsTimeout, *flHttpHeaderTimeout, *flHttpFetchTimeout)
+	fetchClient = &http.Client{
+		Transport:     fetchTransport(proxyFunc),
+		CheckRedirect: checkFetchRedirect,
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchProxy(t *testing.T) {
+	setupTestLogging()
+	saved := *flHttpProxy
+	defer func() { *flHttpProxy = saved }()
+
+	for _, bad := range []string{"socks5://127.0.0.1:1080", "proxy.example.org:3128", "http://"} {
+		*flHttpProxy = bad
+		if _, err := fetchProxyFunc(); err == nil {
+			t.Fatalf("Bad proxy URL \"%s\" accepted", bad)
+		}
+	}
+
+	*flHttpProxy = "http://proxy.example.org:3128"
+	proxyFunc, err := fetchProxyFunc()
+	if err != nil {
+		t.Fatalf("Good proxy URL rejected: %s", err)
+	}
+	req, _ := http.NewRequest("GET", "http://keys.example.org:11371/pks/lookup?op=stats", nil)
+	proxy, err := proxyFunc(req)
+	if err != nil || proxy == nil || proxy.Host != "proxy.example.org:3128" {
+		t.Fatalf("Request not sent via proxy: %v %v", proxy, err)
+	}
+}
+
+func TestFetchHeaderTimeout(t *testing.T) {
+	setupTestLogging()
+	saved := *flHttpHeaderTimeout
+	defer func() { *flHttpHeaderTimeout = saved }()
+	*flHttpHeaderTimeout = 50 * time.Millisecond
+
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := &http.Client{Transport: fetchTransport(nil)}
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	started := time.Now()
+	_, err := HttpDoWithTimeout(client, req, time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "timeout awaiting response headers") {
+		t.Fatalf("Slow response headers not timed out: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Fatalf("Header timeout took %s, overall timeout used instead", elapsed)
+	}
+}
+
+// Just enough of a SOCKS5 server to see what we're asked to connect to,
+// before refusing.
+func fakeSocksServer(t *testing.T, requested chan<- string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		greeting := make([]byte, 3)
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			return
+		}
+		conn.Write([]byte{5, 0})
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		if header[3] != 3 {
+			requested <- "address type " + strconv.Itoa(int(header[3]))
+			return
+		}
+		name := make([]byte, int(header[4])+2)
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+		requested <- string(name[:len(name)-2])
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+	}()
+	return listener
+}
+
+func TestSocksProxyResolvesNames(t *testing.T) {
+	setupTestLogging()
+	requested := make(chan string, 1)
+	listener := fakeSocksServer(t, requested)
+	defer listener.Close()
+
+	transport, err := socksTransport(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to set up SOCKS transport: %s", err)
+	}
+	client := &http.Client{Transport: transport}
+	req, _ := http.NewRequest("GET", "http://keysabcdefghijklm.onion:11371/pks/lookup?op=stats", nil)
+	if _, err := HttpDoWithTimeout(client, req, 10*time.Second); err == nil {
+		t.Fatalf("Refused connection reported as success")
+	}
+	if got := <-requested; got != "keysabcdefghijklm.onion" {
+		t.Fatalf("Proxy asked for %q, not the hostname", got)
+	}
+}
+
+func TestSocksProxyExclusive(t *testing.T) {
+	setupTestLogging()
+	savedHttp, savedSocks := *flHttpProxy, *flSocksProxy
+	defer func() { *flHttpProxy, *flSocksProxy = savedHttp, savedSocks }()
+	*flHttpProxy = "http://proxy.example.org:3128"
+	*flSocksProxy = "127.0.0.1:9050"
+	if err := setupFetchClient(); err == nil {
+		t.Fatalf("Both -http-proxy and -socks-proxy accepted")
+	}
+}
+
+func TestFetchRedirectPolicy(t *testing.T) {
+	setupTestLogging()
+	saved := *flMaxRedirects
+	defer func() { *flMaxRedirects = saved }()
+
+	fake := newFakeKeyserverFromFile(t, TEST_STATS_SKS)
+	defer fake.Close()
+	_, fakePort := testServerHostPort(t, fake.Server)
+	var redirectTo string
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/moved" {
+			w.Write(fake.page)
+			return
+		}
+		http.Redirect(w, req, redirectTo, http.StatusFound)
+	}))
+	defer redirector.Close()
+	host, port := testServerHostPort(t, redirector)
+	node := func() *SksNode { return &SksNode{Hostname: host, Port: port} }
+
+	redirectTo = "http://localhost:" + strconv.Itoa(fakePort) + kDEFAULT_STATS_PATH
+	*flMaxRedirects = 0
+	if err := node().Fetch(); err == nil || !strings.Contains(err.Error(), "refusing redirect") {
+		t.Fatalf("Redirect followed by default: %v", err)
+	}
+
+	*flMaxRedirects = 1
+	n := node()
+	if err := n.Fetch(); err != nil {
+		t.Fatalf("Redirect not followed: %s", err)
+	}
+	n.Analyze()
+	if n.FinalURL != redirectTo || !n.CrossHost || n.Keycount != 3169004 {
+		t.Fatalf("Bad redirected fetch: final=%q cross_host=%v keycount=%d", n.FinalURL, n.CrossHost, n.Keycount)
+	}
+
+	redirectTo = "/moved"
+	n = node()
+	if err := n.Fetch(); err != nil {
+		t.Fatalf("Same-host redirect not followed: %s", err)
+	}
+	if !strings.HasSuffix(n.FinalURL, "/moved") || n.CrossHost {
+		t.Fatalf("Bad same-host redirect: final=%q cross_host=%v", n.FinalURL, n.CrossHost)
+	}
+}
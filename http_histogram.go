@@ -0,0 +1,138 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+type KeycountBucket struct {
+	Bucket int `json:"bucket"`
+	Min    int `json:"min"`
+	Max    int `json:"max"`
+	Count  int `json:"count"`
+}
+
+type KeycountHistogram struct {
+	Width      int              `json:"width"`
+	HostCount  int              `json:"host_count"`
+	Skipped    int              `json:"skipped"`
+	ModeBucket int              `json:"mode_bucket"`
+	Mean       float64          `json:"mean"`
+	StdDev     float64          `json:"stddev"`
+	Buckets    []KeycountBucket `json:"buckets"`
+	Collected  string           `json:"collected,omitempty"`
+}
+
+// Bucket the keycounts of all hosts which reported one.  Hosts with errors or
+// no sane keycount are counted in Skipped, so that the buckets still sum to
+// HostCount.
+func NewKeycountHistogram(hostmap HostMap, width int) *KeycountHistogram {
+	if width < 1 {
+		width = kBUCKET_SIZE
+	}
+	h := &KeycountHistogram{Width: width, Buckets: make([]KeycountBucket, 0, 40)}
+	counts := make(map[int]int, 40)
+	var sum float64
+	for _, node := range hostmap {
+		if node == nil || node.Keycount <= 1 {
+			h.Skipped += 1
+			continue
+		}
+		counts[node.Keycount/width] += 1
+		sum += float64(node.Keycount)
+		h.HostCount += 1
+	}
+	if h.HostCount == 0 {
+		return h
+	}
+	h.Mean = sum / float64(h.HostCount)
+	for _, node := range hostmap {
+		if node == nil || node.Keycount <= 1 {
+			continue
+		}
+		d := float64(node.Keycount) - h.Mean
+		h.StdDev += d * d
+	}
+	h.StdDev = math.Sqrt(h.StdDev / float64(h.HostCount))
+
+	bucketList := make([]int, 0, len(counts))
+	for b := range counts {
+		bucketList = append(bucketList, b)
+	}
+	sort.Ints(bucketList)
+	modeLen := 0
+	for _, b := range bucketList {
+		h.Buckets = append(h.Buckets, KeycountBucket{
+			Bucket: b,
+			Min:    b * width,
+			Max:    (b+1)*width - 1,
+			Count:  counts[b],
+		})
+		// strictly greater, so that ties go to the smaller bucket, for stability
+		if counts[b] > modeLen {
+			h.ModeBucket = b
+			modeLen = counts[b]
+		}
+	}
+	return h
+}
+
+func apiKeycountHistogramPage(w http.ResponseWriter, req *http.Request) {
+	var err error
+	if err = req.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form information", http.StatusBadRequest)
+		return
+	}
+	width := kBUCKET_SIZE
+	if ws := req.Form.Get("width"); ws != "" {
+		width, err = strconv.Atoi(ws)
+		if err != nil || width < 1 {
+			http.Error(w, "Bad 'width' parameter, need a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	persisted := GetCurrentPersisted()
+	if persisted == nil {
+		http.Error(w, "Still awaiting data collection", http.StatusServiceUnavailable)
+		return
+	}
+
+	histogram := NewKeycountHistogram(persisted.HostMap, width)
+	if !persisted.Timestamp.IsZero() {
+		histogram.Collected = persisted.Timestamp.UTC().Format("2006-01-02T15:04:05") + "Z"
+	}
+	b, err := json.Marshal(histogram)
+	if err != nil {
+		Log.Printf("Failed to marshal keycount histogram to JSON: %s", err)
+		http.Error(w, "JSON encoding glitch", http.StatusInternalServerError)
+		return
+	}
+
+	contentType := ContentTypeJson
+	if _, ok := req.Form["textplain"]; ok {
+		contentType = ContentTypeTextPlain
+	}
+	w.Header().Set("Content-Type", contentType)
+	fmt.Fprintf(w, "%s\n", b)
+}
@@ -0,0 +1,69 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"testing"
+)
+
+func TestKeycountHistogram(t *testing.T) {
+	hostmap := HostMap{
+		"a.example.org": &SksNode{Keycount: 3000100},
+		"b.example.org": &SksNode{Keycount: 3000200},
+		"c.example.org": &SksNode{Keycount: 3001900},
+		"d.example.org": &SksNode{Keycount: 2990000},
+		"e.example.org": &SksNode{Keycount: -1},
+		"f.example.org": nil,
+	}
+	h := NewKeycountHistogram(hostmap, 1000)
+	if h.HostCount != 4 || h.Skipped != 2 {
+		t.Fatalf("Bad counts: hosts=%d skipped=%d", h.HostCount, h.Skipped)
+	}
+	if h.ModeBucket != 3000 {
+		t.Fatalf("Bad mode bucket: %d", h.ModeBucket)
+	}
+	if len(h.Buckets) != 3 || h.Buckets[0].Bucket != 2990 || h.Buckets[1].Count != 2 {
+		t.Fatalf("Bad buckets: %+v", h.Buckets)
+	}
+	if h.Buckets[1].Min != 3000000 || h.Buckets[1].Max != 3000999 {
+		t.Fatalf("Bad bucket bounds: %+v", h.Buckets[1])
+	}
+	if h.Mean != 2998050 {
+		t.Fatalf("Bad mean: %f", h.Mean)
+	}
+	if h.StdDev <= 0 {
+		t.Fatalf("Bad stddev: %f", h.StdDev)
+	}
+}
+
+func TestKeycountHistogramSnapshot(t *testing.T) {
+	hostmap, err := LoadJSONFromFile(TEST_DATA_FILE)
+	if err != nil {
+		t.Fatalf("Failed to load \"%s\": %s", TEST_DATA_FILE, err)
+	}
+	h := NewKeycountHistogram(hostmap, 0)
+	if h.Width != kBUCKET_SIZE {
+		t.Fatalf("Default width not applied: %d", h.Width)
+	}
+	total := 0
+	for _, b := range h.Buckets {
+		total += b.Count
+	}
+	if total != h.HostCount || h.HostCount+h.Skipped != len(hostmap) {
+		t.Fatalf("Buckets sum to %d, hosts %d, skipped %d, of %d", total, h.HostCount, h.Skipped, len(hostmap))
+	}
+}
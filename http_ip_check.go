@@ -0,0 +1,356 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// Checking a hand-maintained pool list against the current scan, and asking
+// what-if questions of it, with the same threshold as ip-valid would use.
+// The published pool can be checked too, straight from DNS.
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const kIP_CHECK_MAX_BODY = 1 << 20
+
+type IPCheck struct {
+	IP              string `json:"ip"`
+	Known           bool   `json:"known"`
+	Hostname        string `json:"hostname,omitempty"`
+	Keycount        int    `json:"keycount,omitempty"`
+	Country         string `json:"country,omitempty"`
+	PassesThreshold bool   `json:"passes_threshold"`
+	Quarantined     bool   `json:"quarantined,omitempty"`
+}
+
+type IPCheckReport struct {
+	Threshold int       `json:"threshold,omitempty"`
+	Reason    string    `json:"reason,omitempty"` // why there's no threshold
+	Results   []IPCheck `json:"results"`
+}
+
+// The IPs to check come from the 'ips' form parameter, or else a POST body;
+// either way, separated by commas or whitespace.
+func candidateIPs(req *http.Request) ([]string, error) {
+	list := req.Form.Get("ips")
+	if list == "" && req.Method == "POST" {
+		body, err := ioutil.ReadAll(&io.LimitedReader{R: req.Body, N: kIP_CHECK_MAX_BODY})
+		if err != nil {
+			return nil, err
+		}
+		list = string(body)
+	}
+	fields := strings.FieldsFunc(list, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+	ips := make([]string, 0, len(fields))
+	for _, field := range fields {
+		ip := net.ParseIP(field)
+		if ip == nil {
+			return nil, fmt.Errorf("not an IP address: \"%s\"", field)
+		}
+		ips = append(ips, ip.String())
+	}
+	return ips, nil
+}
+
+// What ip-valid yields with none of its optional filters: servers count
+// towards the statistics, but quarantined versions don't pass.
+type ipValidBase struct {
+	threshold   *ipThreshold // nil if none could be computed
+	reason      string       // why not
+	hostForIP   map[string]string
+	quarantined map[string]bool
+}
+
+func newIpValidBase(persisted *PersistedHostInfo, tunables IpValidTunables) *ipValidBase {
+	var (
+		ips_one_per_server = make(map[string]int, len(persisted.HostMap))
+		ips_all            = make(map[string]int, len(persisted.HostMap)*2)
+	)
+	base := &ipValidBase{
+		hostForIP:   make(map[string]string, len(persisted.HostMap)*2),
+		quarantined: make(map[string]bool, len(tunables.QuarantineVersions)),
+	}
+	weighted := make(map[string]bool, len(persisted.HostMap))
+	for _, name := range persisted.Sorted {
+		node := persisted.HostMap[name]
+		if node.Keycount <= 1 || tunables.aboveSanityMax(node.Keycount) || len(node.IpList) == 0 {
+			continue
+		}
+		if weightKey := nodeWeightKey(name, node); !weighted[weightKey] {
+			weighted[weightKey] = true
+			ips_one_per_server[node.IpList[0]] = node.Keycount
+		}
+		for _, ip := range node.IpList {
+			ips_all[ip] = node.Keycount
+			base.hostForIP[ip] = name
+		}
+	}
+	for _, version := range tunables.QuarantineVersions {
+		base.quarantined[version] = true
+	}
+	base.threshold, _, base.reason = computeThreshold("", ips_one_per_server, ips_all, tunables,
+		trustedKeycounts(persisted, tunables), 0, false,
+		func(string, ...interface{}) {})
+	return base
+}
+
+func (base *ipValidBase) passes(ip string, node *SksNode) bool {
+	if base.threshold == nil || base.quarantined[node.Version] {
+		return false
+	}
+	count, inBounds := base.threshold.inBounds[ip]
+	return inBounds && count >= base.threshold.threshold
+}
+
+func CheckIPs(persisted *PersistedHostInfo, tunables IpValidTunables, ips []string) *IPCheckReport {
+	base := newIpValidBase(persisted, tunables)
+	report := &IPCheckReport{Results: make([]IPCheck, len(ips)), Reason: base.reason}
+	if base.threshold != nil {
+		report.Threshold = base.threshold.threshold
+	}
+	for i, ip := range ips {
+		check := &report.Results[i]
+		check.IP = ip
+		name, ok := base.hostForIP[ip]
+		if !ok {
+			continue
+		}
+		node := persisted.HostMap[name]
+		check.Known = true
+		check.Hostname = name
+		check.Keycount = node.Keycount
+		check.Country = persisted.IPCountryMap[ip]
+		check.Quarantined = base.quarantined[node.Version]
+		check.PassesThreshold = base.passes(ip, node)
+	}
+	return report
+}
+
+type PoolDiff struct {
+	Pool      string   `json:"pool"`
+	Threshold int      `json:"threshold,omitempty"`
+	Reason    string   `json:"reason,omitempty"` // why there's no threshold
+	InDNS     int      `json:"in_dns"`
+	Valid     int      `json:"valid"`
+	Stale     []string `json:"stale"`   // in DNS, no longer valid
+	Missing   []string `json:"missing"` // valid, not yet in DNS
+	UpToDate  bool     `json:"up_to_date"`
+}
+
+// Does the zone need updating?  Only the IP sets are compared; ip-valid's
+// optional filters don't apply.
+func ComparePool(persisted *PersistedHostInfo, tunables IpValidTunables, pool string, dnsIPs []string) *PoolDiff {
+	base := newIpValidBase(persisted, tunables)
+	diff := &PoolDiff{Pool: pool, Reason: base.reason, Stale: make([]string, 0), Missing: make([]string, 0)}
+	if base.threshold != nil {
+		diff.Threshold = base.threshold.threshold
+	}
+	published := make(map[string]bool, len(dnsIPs))
+	for _, ip := range flattenIPs(dnsIPs) {
+		published[ip] = true
+	}
+	valid := make(map[string]bool, len(base.hostForIP))
+	for ip, name := range base.hostForIP {
+		if base.passes(ip, persisted.HostMap[name]) {
+			valid[ip] = true
+			if !published[ip] {
+				diff.Missing = append(diff.Missing, ip)
+			}
+		}
+	}
+	for ip := range published {
+		if !valid[ip] {
+			diff.Stale = append(diff.Stale, ip)
+		}
+	}
+	sort.Strings(diff.Stale)
+	sort.Strings(diff.Missing)
+	diff.InDNS = len(published)
+	diff.Valid = len(valid)
+	diff.UpToDate = len(diff.Stale) == 0 && len(diff.Missing) == 0
+	return diff
+}
+
+type MinimumVersionCounts struct {
+	Threshold int            `json:"threshold,omitempty"`
+	Reason    string         `json:"reason,omitempty"` // why there's no threshold
+	Counts    map[string]int `json:"counts"`           // version to IPs yielded
+}
+
+// As ip-valid with each minimum_version in turn, but with the statistics
+// worked out only once.
+func CountByMinimumVersion(persisted *PersistedHostInfo, tunables IpValidTunables, versions []*SksVersion) *MinimumVersionCounts {
+	base := newIpValidBase(persisted, tunables)
+	result := &MinimumVersionCounts{Reason: base.reason, Counts: make(map[string]int, len(versions))}
+	if base.threshold != nil {
+		result.Threshold = base.threshold.threshold
+	}
+	for _, minimum := range versions {
+		result.Counts[minimum.String()] = 0
+	}
+	for ip, name := range base.hostForIP {
+		node := persisted.HostMap[name]
+		if !base.passes(ip, node) {
+			continue
+		}
+		thisVersion := NewSksVersion(node.Version)
+		for _, minimum := range versions {
+			if thisVersion != nil && thisVersion.IsAtLeast(minimum) {
+				result.Counts[minimum.String()] += 1
+			}
+		}
+	}
+	return result
+}
+
+type MinimumVersionChoice struct {
+	Target     int    `json:"target"`
+	Threshold  int    `json:"threshold,omitempty"`
+	Reason     string `json:"reason,omitempty"`  // why there's no threshold
+	Version    string `json:"version,omitempty"` // highest minimum keeping the target
+	Servers    int    `json:"servers"`
+	IPs        int    `json:"ips"`
+	Achievable bool   `json:"achievable"`
+}
+
+// The inverse of CountByMinimumVersion: the highest minimum_version which
+// still leaves at least target servers.  Only versions some passing server
+// runs need be tried, as anything between two of those yields the same.
+// When no minimum leaves that many, the counts are for all passing servers.
+func ChooseMinimumVersion(persisted *PersistedHostInfo, tunables IpValidTunables, target int) *MinimumVersionChoice {
+	base := newIpValidBase(persisted, tunables)
+	choice := &MinimumVersionChoice{Target: target, Reason: base.reason}
+	if base.threshold != nil {
+		choice.Threshold = base.threshold.threshold
+	}
+	ipsForServer := make(map[string]int, len(persisted.HostMap))
+	for ip, name := range base.hostForIP {
+		if base.passes(ip, persisted.HostMap[name]) {
+			ipsForServer[name] += 1
+			choice.IPs += 1
+		}
+	}
+	choice.Servers = len(ipsForServer)
+
+	candidates := make(map[string]*SksVersion)
+	for name := range ipsForServer {
+		if version := NewSksVersion(persisted.HostMap[name].Version); version != nil {
+			candidates[version.String()] = version
+		}
+	}
+	var best *SksVersion
+	for _, minimum := range candidates {
+		if best != nil && best.IsAtLeast(minimum) {
+			continue
+		}
+		servers, ips := 0, 0
+		for name, count := range ipsForServer {
+			if version := NewSksVersion(persisted.HostMap[name].Version); version != nil && version.IsAtLeast(minimum) {
+				servers += 1
+				ips += count
+			}
+		}
+		if servers < target {
+			continue
+		}
+		best = minimum
+		choice.Servers, choice.IPs = servers, ips
+	}
+	if best != nil {
+		choice.Version = best.String()
+		choice.Achievable = true
+	}
+	return choice
+}
+
+func apiIpCheckPage(w http.ResponseWriter, req *http.Request) {
+	persisted := reportSetup(w, req)
+	if persisted == nil {
+		return
+	}
+	ips, err := candidateIPs(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Bad IP list: %s", err), http.StatusBadRequest)
+		return
+	}
+	if len(ips) == 0 {
+		http.Error(w, "No IPs given to check, use 'ips' or a POST body", http.StatusBadRequest)
+		return
+	}
+	reportWriteJson(w, req, CheckIPs(persisted, GetIpValidTunables(), ips))
+}
+
+func apiMinimumVersionsPage(w http.ResponseWriter, req *http.Request) {
+	persisted := reportSetup(w, req)
+	if persisted == nil {
+		return
+	}
+	versions := make([]*SksVersion, 0, 4)
+	for _, v := range strings.Split(req.Form.Get("versions"), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		version := NewSksVersion(v)
+		if version == nil {
+			http.Error(w, fmt.Sprintf("Bad version \"%s\"", v), http.StatusBadRequest)
+			return
+		}
+		versions = append(versions, version)
+	}
+	if len(versions) == 0 {
+		http.Error(w, "Missing 'versions' parameter, comma-separated", http.StatusBadRequest)
+		return
+	}
+	reportWriteJson(w, req, CountByMinimumVersion(persisted, GetIpValidTunables(), versions))
+}
+
+func apiPoolDiffPage(w http.ResponseWriter, req *http.Request) {
+	persisted := reportSetup(w, req)
+	if persisted == nil {
+		return
+	}
+	if *flPoolHostname == "" {
+		http.Error(w, "No pool to compare with, use -pool-hostname", http.StatusNotFound)
+		return
+	}
+	ips, err := lookupHostFunc(req.Context(), *flPoolHostname)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Resolving pool \"%s\" failed: %s", *flPoolHostname, err), http.StatusBadGateway)
+		return
+	}
+	reportWriteJson(w, req, ComparePool(persisted, GetIpValidTunables(), *flPoolHostname, ips))
+}
+
+func apiMinimumVersionForPage(w http.ResponseWriter, req *http.Request) {
+	persisted := reportSetup(w, req)
+	if persisted == nil {
+		return
+	}
+	target, err := strconv.Atoi(req.Form.Get("servers"))
+	if err != nil || target < 1 {
+		http.Error(w, "Missing or bad 'servers' parameter, a count of at least 1", http.StatusBadRequest)
+		return
+	}
+	reportWriteJson(w, req, ChooseMinimumVersion(persisted, GetIpValidTunables(), target))
+}
@@ -0,0 +1,247 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func decodeIPCheck(t *testing.T, rec *httptest.ResponseRecorder) IPCheckReport {
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Bad status %d: %s", rec.Code, rec.Body)
+	}
+	var report IPCheckReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Bad JSON: %s\n%s", err, rec.Body)
+	}
+	return report
+}
+
+func TestIpCheck(t *testing.T) {
+	persisted := loadTestPersisted(t)
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?json")
+	var valid struct {
+		Status map[string]interface{} `json:"status"`
+		IPs    []string               `json:"ips"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &valid); err != nil {
+		t.Fatalf("Bad JSON: %s\n%s", err, rec.Body)
+	}
+
+	minimum := int(valid.Status["minimum"].(float64))
+	var low string
+	for _, name := range persisted.Sorted {
+		if node := persisted.HostMap[name]; node.Keycount > 1 && node.Keycount < minimum && len(node.IpList) > 0 {
+			low = node.IpList[0]
+			break
+		}
+	}
+	if low == "" {
+		t.Fatalf("No server below threshold %d in test data", minimum)
+	}
+
+	query := strings.Join(append([]string{valid.IPs[0], low}, "192.0.2.1"), ",")
+	report := decodeIPCheck(t, testGet(t, apiIpCheckPage, SERVE_PREFIX+"/ip-check?ips="+query))
+	if report.Threshold != minimum || len(report.Results) != 3 {
+		t.Fatalf("Bad report: %+v", report)
+	}
+	good, bad, unknown := report.Results[0], report.Results[1], report.Results[2]
+	if !good.Known || !good.PassesThreshold || good.Hostname != hostForTestIP(persisted, good.IP) {
+		t.Fatalf("IP yielded by ip-valid not passing: %+v", good)
+	}
+	if !bad.Known || bad.PassesThreshold || bad.Keycount != persisted.HostMap[bad.Hostname].Keycount {
+		t.Fatalf("Low keycount IP passing: %+v", bad)
+	}
+	if unknown.Known || unknown.PassesThreshold || unknown.Hostname != "" {
+		t.Fatalf("Unknown IP reported as known: %+v", unknown)
+	}
+
+	req, _ := http.NewRequest("POST", SERVE_PREFIX+"/ip-check", strings.NewReader(strings.Join(valid.IPs, "\n")+"\n"))
+	req.Header.Set("Content-Type", "text/plain")
+	rec = httptest.NewRecorder()
+	apiIpCheckPage(rec, req)
+	report = decodeIPCheck(t, rec)
+	if len(report.Results) != len(valid.IPs) {
+		t.Fatalf("Checked %d of %d IPs from POST body", len(report.Results), len(valid.IPs))
+	}
+	for _, check := range report.Results {
+		if !check.PassesThreshold {
+			t.Fatalf("IP yielded by ip-valid not passing: %+v", check)
+		}
+	}
+
+	for _, query := range []string{"", "ips=not-an-ip"} {
+		if rec := testGet(t, apiIpCheckPage, SERVE_PREFIX+"/ip-check?"+query); rec.Code != http.StatusBadRequest {
+			t.Fatalf("Query %q: got status %d, expected %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestMinimumVersions(t *testing.T) {
+	loadTestPersisted(t)
+	versions := []string{"1.1.0", "1.1.3", "1.1.4", "9.0.0"}
+	rec := testGet(t, apiMinimumVersionsPage, SERVE_PREFIX+"/minimum-versions?versions="+strings.Join(versions, ","))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Bad status %d: %s", rec.Code, rec.Body)
+	}
+	var result MinimumVersionCounts
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Bad JSON: %s\n%s", err, rec.Body)
+	}
+	if len(result.Counts) != len(versions) {
+		t.Fatalf("Expected %d counts, got %v", len(versions), result.Counts)
+	}
+	for _, version := range versions {
+		status := ipValidJsonStatus(t, "minimum_version="+version)
+		want := 0
+		if count, ok := status["count"]; ok {
+			want = int(count.(float64))
+		}
+		if result.Counts[version] != want {
+			t.Fatalf("Version %s: got count %d, ip-valid yields %d", version, result.Counts[version], want)
+		}
+	}
+	if result.Counts["1.1.0"] == 0 || result.Counts["9.0.0"] != 0 {
+		t.Fatalf("Implausible counts: %v", result.Counts)
+	}
+
+	for _, query := range []string{"", "versions=1.1.x"} {
+		if rec := testGet(t, apiMinimumVersionsPage, SERVE_PREFIX+"/minimum-versions?"+query); rec.Code != http.StatusBadRequest {
+			t.Fatalf("Query %q: got status %d, expected %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestPoolDiff(t *testing.T) {
+	persisted := loadTestPersisted(t)
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?json")
+	var ipValid struct {
+		IPs []string `json:"ips"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &ipValid); err != nil {
+		t.Fatalf("Bad JSON: %s\n%s", err, rec.Body)
+	}
+	valid := ipValid.IPs
+	base := newIpValidBase(persisted, GetIpValidTunables())
+	var low string
+	for ip, name := range base.hostForIP {
+		if !base.passes(ip, persisted.HostMap[name]) {
+			low = ip
+			break
+		}
+	}
+	if low == "" || len(valid) < 2 {
+		t.Fatalf("Test data has no IP below threshold, or too few valid")
+	}
+
+	savedPool, savedLookup := *flPoolHostname, lookupHostFunc
+	defer func() { *flPoolHostname, lookupHostFunc = savedPool, savedLookup }()
+	*flPoolHostname = ""
+	if rec := testGet(t, apiPoolDiffPage, SERVE_PREFIX+"/pool-diff"); rec.Code != http.StatusNotFound {
+		t.Fatalf("Without -pool-hostname: got status %d, expected %d", rec.Code, http.StatusNotFound)
+	}
+
+	*flPoolHostname = "pool.example.net"
+	published := append([]string{low, "192.0.2.1"}, valid[1:]...)
+	lookupHostFunc = func(ctx context.Context, hostname string) ([]string, error) {
+		if hostname != "pool.example.net" {
+			t.Fatalf("Resolved %q, not the pool", hostname)
+		}
+		return published, nil
+	}
+	rec = testGet(t, apiPoolDiffPage, SERVE_PREFIX+"/pool-diff")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Bad status %d: %s", rec.Code, rec.Body)
+	}
+	var diff PoolDiff
+	if err := json.Unmarshal(rec.Body.Bytes(), &diff); err != nil {
+		t.Fatalf("Bad JSON: %s\n%s", err, rec.Body)
+	}
+	if diff.UpToDate || diff.InDNS != len(published) || diff.Valid != len(valid) {
+		t.Fatalf("Bad diff: %+v", diff)
+	}
+	if len(diff.Missing) != 1 || diff.Missing[0] != valid[0] {
+		t.Fatalf("Missing should be just %s: %v", valid[0], diff.Missing)
+	}
+	if len(diff.Stale) != 2 || !(diff.Stale[0] == low || diff.Stale[1] == low) {
+		t.Fatalf("Stale should be %s and 192.0.2.1: %v", low, diff.Stale)
+	}
+
+	if diff := ComparePool(persisted, GetIpValidTunables(), "pool.example.net", valid); !diff.UpToDate {
+		t.Fatalf("Pool of exactly the ip-valid set not up to date: %+v", diff)
+	}
+
+	lookupHostFunc = func(ctx context.Context, hostname string) ([]string, error) {
+		return nil, errors.New("no such host")
+	}
+	if rec := testGet(t, apiPoolDiffPage, SERVE_PREFIX+"/pool-diff"); rec.Code != http.StatusBadGateway {
+		t.Fatalf("Failed lookup: got status %d, expected %d", rec.Code, http.StatusBadGateway)
+	}
+}
+
+func TestMinimumVersionFor(t *testing.T) {
+	persisted := loadTestPersisted(t)
+	all := ChooseMinimumVersion(persisted, GetIpValidTunables(), 1)
+	if !all.Achievable || all.Version == "" {
+		t.Fatalf("No minimum version keeps a single server: %+v", all)
+	}
+
+	rec := testGet(t, apiMinimumVersionForPage, SERVE_PREFIX+"/minimum-version-for?servers=20")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Bad status %d: %s", rec.Code, rec.Body)
+	}
+	var choice MinimumVersionChoice
+	if err := json.Unmarshal(rec.Body.Bytes(), &choice); err != nil {
+		t.Fatalf("Bad JSON: %s\n%s", err, rec.Body)
+	}
+	if !choice.Achievable || choice.Servers < 20 || choice.Target != 20 {
+		t.Fatalf("Bad choice: %+v", choice)
+	}
+	// Agrees with ip-valid, and nothing higher would do
+	status := ipValidJsonStatus(t, "minimum_version="+choice.Version)
+	if count := int(status["count"].(float64)); count != choice.IPs {
+		t.Fatalf("Version %s: choice gives %d IPs, ip-valid yields %d", choice.Version, choice.IPs, count)
+	}
+	chosen := NewSksVersion(choice.Version)
+	counts := CountByMinimumVersion(persisted, GetIpValidTunables(), []*SksVersion{chosen})
+	if counts.Counts[choice.Version] != choice.IPs {
+		t.Fatalf("Disagrees with minimum-versions: %v", counts.Counts)
+	}
+	// One server more needs a lower minimum
+	if more := ChooseMinimumVersion(persisted, GetIpValidTunables(), choice.Servers+1); more.Achievable {
+		if lower := NewSksVersion(more.Version); !chosen.IsAtLeast(lower) || lower.IsAtLeast(chosen) {
+			t.Fatalf("%d servers kept by %s, not lower than %s", more.Target, more.Version, choice.Version)
+		}
+	}
+
+	beyond := ChooseMinimumVersion(persisted, GetIpValidTunables(), len(persisted.HostMap)+1)
+	if beyond.Achievable || beyond.Version != "" || beyond.Servers < choice.Servers {
+		t.Fatalf("Unreachable target achieved: %+v", beyond)
+	}
+
+	for _, query := range []string{"", "servers=0", "servers=many"} {
+		if rec := testGet(t, apiMinimumVersionForPage, SERVE_PREFIX+"/minimum-version-for?"+query); rec.Code != http.StatusBadRequest {
+			t.Fatalf("Query %q: got status %d, expected %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// What-if questions of the whole ip-valid algorithm: what happens to the pool
+// if these servers upgrade, join or leave?  A synthetic set of hosts is
+// POSTed as JSON, and ip-valid run over it instead of the current snapshot,
+// with the same query parameters as ip-valid itself.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const kSIMULATE_MAX_BODY = 4 << 20
+
+type SimulatedHost struct {
+	Hostname string   `json:"hostname"`
+	Version  string   `json:"version"`
+	Keycount int      `json:"keycount"`
+	IPs      []string `json:"ips"`
+	Country  string   `json:"country"` // for all of its IPs
+}
+
+type simulationRequest struct {
+	Hosts []SimulatedHost `json:"hosts"`
+}
+
+// Only what ip-valid looks at is filled in; the hosts all look like they
+// were fetched fine, directly rather than through a proxy.
+func SimulatedPersisted(hosts []SimulatedHost) (*PersistedHostInfo, error) {
+	hostMap := make(HostMap, len(hosts))
+	countries := make(IPCountryMap, len(hosts)*2)
+	for _, host := range hosts {
+		hostname := normalizeHostname(host.Hostname)
+		if hostname == "" {
+			return nil, fmt.Errorf("host without a hostname")
+		}
+		if _, dup := hostMap[hostname]; dup {
+			return nil, fmt.Errorf("host \"%s\" given twice", hostname)
+		}
+		ipList := make([]string, 0, len(host.IPs))
+		for _, ipstr := range host.IPs {
+			ip := net.ParseIP(strings.TrimSpace(ipstr))
+			if ip == nil {
+				return nil, fmt.Errorf("host \"%s\": not an IP address: \"%s\"", hostname, ipstr)
+			}
+			ipList = append(ipList, ip.String())
+			if host.Country != "" {
+				countries[ip.String()] = strings.ToUpper(host.Country)
+			}
+		}
+		node := &SksNode{
+			Hostname:     hostname,
+			Port:         *flSksPortHkp,
+			initialised:  true,
+			Status:       "200 OK",
+			ServerHeader: "sks_www/" + host.Version,
+			Version:      host.Version,
+			Keycount:     host.Keycount,
+			IpList:       flattenIPs(ipList),
+			Settings:     map[string]string{kSETTING_HOSTNAME: hostname, kSETTING_VERSION: host.Version},
+		}
+		node.setAddressFamilies()
+		hostMap[hostname] = node
+	}
+	return &PersistedHostInfo{
+		HostMap:      hostMap,
+		AliasMap:     GetAliasMapForHostmap(hostMap),
+		IPCountryMap: countries,
+		Sorted:       GenerateHostlistSorted(hostMap),
+	}, nil
+}
+
+func apiIpValidSimulatePage(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "POST a JSON object of \"hosts\"", http.StatusMethodNotAllowed)
+		return
+	}
+	var simulation simulationRequest
+	decoder := json.NewDecoder(&io.LimitedReader{R: req.Body, N: kSIMULATE_MAX_BODY})
+	if err := decoder.Decode(&simulation); err != nil {
+		http.Error(w, fmt.Sprintf("Bad JSON hosts: %s", err), http.StatusBadRequest)
+		return
+	}
+	if len(simulation.Hosts) == 0 {
+		http.Error(w, "No hosts to simulate with", http.StatusBadRequest)
+		return
+	}
+	persisted, err := SimulatedPersisted(simulation.Hosts)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Bad hosts: %s", err), http.StatusBadRequest)
+		return
+	}
+	serveIpValid(w, req, persisted, true)
+}
@@ -0,0 +1,117 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func ipValidJsonIPs(t *testing.T, rec *httptest.ResponseRecorder) []string {
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Bad status %d: %s", rec.Code, rec.Body)
+	}
+	var result struct {
+		IPs []string `json:"ips"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Bad JSON: %s\n%s", err, rec.Body)
+	}
+	sort.Strings(result.IPs)
+	return result.IPs
+}
+
+func postSimulation(t *testing.T, query string, hosts []SimulatedHost) *httptest.ResponseRecorder {
+	body, err := json.Marshal(map[string]interface{}{"hosts": hosts})
+	if err != nil {
+		t.Fatalf("Can't encode hosts: %s", err)
+	}
+	req, _ := http.NewRequest("POST", SERVE_PREFIX+"/ip-valid-simulate?"+query, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	apiIpValidSimulatePage(rec, req)
+	return rec
+}
+
+func TestIpValidSimulate(t *testing.T) {
+	persisted := loadTestPersisted(t)
+	hosts := make([]SimulatedHost, 0, len(persisted.HostMap))
+	for _, hostname := range persisted.Sorted {
+		node := persisted.HostMap[hostname]
+		hosts = append(hosts, SimulatedHost{Hostname: hostname, Version: node.Version, Keycount: node.Keycount, IPs: node.IpList})
+	}
+
+	// The same hosts give the same answer as the snapshot
+	live := ipValidJsonIPs(t, testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?json"))
+	simulated := ipValidJsonIPs(t, postSimulation(t, "json", hosts))
+	if len(live) == 0 || strings.Join(live, ",") != strings.Join(simulated, ",") {
+		t.Fatalf("Simulation of the snapshot differs:\nlive      %v\nsimulated %v", live, simulated)
+	}
+
+	// What if one of them upgrades and the rest stay put?
+	status := ipValidJsonStatus(t, "minimum_version=1.1.4")
+	upgraded := 0
+	for i := range hosts {
+		if version := NewSksVersion(hosts[i].Version); version != nil && !version.IsAtLeast(NewSksVersion("1.1.4")) && hosts[i].Keycount > 3000000 {
+			hosts[i].Version = "1.1.6"
+			upgraded += len(hosts[i].IPs)
+			break
+		}
+	}
+	if upgraded == 0 {
+		t.Fatalf("No old server to upgrade in test data")
+	}
+	after := ipValidJsonIPs(t, postSimulation(t, "json&minimum_version=1.1.4", hosts))
+	if before := int(status["count"].(float64)); len(after) != before+upgraded {
+		t.Fatalf("Upgrading a server with %d IPs took the pool from %d to %d", upgraded, before, len(after))
+	}
+
+	hosts[0].Country = "de"
+	rec := postSimulation(t, "json&countries=DE", hosts)
+	if ips := ipValidJsonIPs(t, rec); len(ips) > len(hosts[0].IPs) {
+		t.Fatalf("Country filter let through %v", ips)
+	}
+	geoipUnavailable = true
+	rec = postSimulation(t, "json&countries=DE", hosts)
+	liveStatus := ipValidJsonStatus(t, "countries=DE")
+	geoipUnavailable = false
+	if ips := ipValidJsonIPs(t, rec); len(ips) == 0 {
+		t.Fatalf("Simulated hosts with their own countries refused without GeoIP:\n%s", rec.Body)
+	}
+	if liveStatus["reason_code"] != kREASON_GEOIP_UNAVAILABLE {
+		t.Fatalf("Live snapshot filtered by country without GeoIP: %v", liveStatus)
+	}
+
+	if rec := testGet(t, apiIpValidSimulatePage, SERVE_PREFIX+"/ip-valid-simulate"); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET: got status %d, expected %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+	for _, bad := range [][]SimulatedHost{
+		nil,
+		{{Hostname: "", Keycount: 3000000}},
+		{{Hostname: "a.example.org", IPs: []string{"not-an-ip"}}},
+		{{Hostname: "a.example.org"}, {Hostname: "A.example.org."}},
+	} {
+		if rec := postSimulation(t, "json", bad); rec.Code != http.StatusBadRequest {
+			t.Fatalf("Hosts %+v: got status %d, expected %d", bad, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
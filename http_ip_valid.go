@@ -17,10 +17,14 @@
 package sks_spider
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -31,40 +35,293 @@ import (
 	btree "github.com/runningwild/go-btree"
 )
 
+// Clients key compatibility on these rather than on the tags, which record
+// the algorithm, not the format.  api_version is in the status of every
+// output style (and the IP-Gen/ prefix of the text styles); format_version is
+// the top-level JSON layout: an object with "status" and one of "ips" or
+// "hostnames", optionally preceded by "stats".
+const (
+	kIPGEN_API_VERSION    = "1.1"
+	kIPGEN_FORMAT_VERSION = 1
+	kIPGEN_STATUS_PREFIX  = "IP-Gen/" + kIPGEN_API_VERSION + ":"
+)
+
+// Stable machine-readable codes for why no results were given, as
+// reason_code alongside the older free-text reason (kept for compatibility,
+// and which may contain punctuation).  This is the full enumeration; new
+// codes may be added, existing ones won't change meaning.
+const (
+	kREASON_FIRST_SCAN          = "first_scan"         // no scan has completed yet
+	kREASON_GEOIP_UNAVAILABLE   = "geoip_unavailable"  // country filter asked for, no GeoIP database
+	kREASON_NO_BUCKETS          = "no_buckets"         // no servers with keycounts at all
+	kREASON_BROKEN_DATA         = "broken_data"        // keycounts below -keys-sanity-min
+	kREASON_THRESHOLD_TOO_HIGH  = "threshold_too_high" // no servers at or above the threshold
+	kREASON_FILTERED_QUARANTINE = "filtered_v1010"     // nothing left after -quarantine-versions (once just v1.0.10)
+	kREASON_FILTERED_VERSION    = "filtered_version"   // nothing left after minimum_version
+	kREASON_FILTERED_COUNTRY    = "filtered_country"   // nothing left after countries
+	kREASON_FILTERED_PROXIES    = "filtered_proxies"   // nothing left after proxies
+	kREASON_FILTERED_SERVER     = "filtered_server"    // nothing left after exclude_server
+)
+
+// For explain=<ip>: how one IP fared through the algorithm.  DroppedBy is
+// the step which removed it: "unknown" (no server has that IP),
+// "analyze_error", "low_keycount", "high_keycount", "out_of_bounds",
+// "threshold", "absolute_min", "sample", or one of the filtered_* reason
+// codes.
+type IpExplanation struct {
+	IP              string `json:"ip"`
+	Hostname        string `json:"hostname"`
+	Keycount        int    `json:"keycount"`
+	InBounds        bool   `json:"in_bounds"`
+	PassedThreshold bool   `json:"passed_threshold"`
+	Recovering      bool   `json:"recovering,omitempty"`
+	DroppedBy       string `json:"dropped_by,omitempty"`
+	Included        bool   `json:"included"`
+}
+
+func (ex *IpExplanation) String() string {
+	return fmt.Sprintf("ip=%s hostname=%s keycount=%d in_bounds=%v passed_threshold=%v recovering=%v dropped_by=%s included=%v",
+		ex.IP, ex.Hostname, ex.Keycount, ex.InBounds, ex.PassedThreshold, ex.Recovering, ex.DroppedBy, ex.Included)
+}
+
+// How often, at most, streamed text-mode stats are flushed to the client
+const kSTATS_FLUSH_INTERVAL = 250 * time.Millisecond
+
+// The text styles have nothing before the stats which needs all of them, so
+// each line goes to the client as it's generated, flushed now and then, and
+// someone watching a large mesh with curl sees progress.  JSON needs the
+// complete array, so stays buffered.
+type statsStreamer struct {
+	w         http.ResponseWriter
+	flusher   http.Flusher
+	prefix    string
+	lastFlush time.Time
+}
+
+func newStatsStreamer(w http.ResponseWriter, prefix string) *statsStreamer {
+	flusher, _ := w.(http.Flusher)
+	return &statsStreamer{w: w, flusher: flusher, prefix: prefix, lastFlush: time.Now()}
+}
+
+func (s *statsStreamer) Printf(format string, v ...interface{}) {
+	fmt.Fprintf(s.w, "%s%s\n", s.prefix, fmt.Sprintf(format, v...))
+	if time.Since(s.lastFlush) >= kSTATS_FLUSH_INTERVAL {
+		s.Flush()
+	}
+}
+
+func (s *statsStreamer) Flush() {
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	s.lastFlush = time.Now()
+}
+
+// Relative or absolute owner names, or "@"; nothing which could break out of
+// the record in a zone file.
+var zoneOwnerRegexp = regexp.MustCompile(`^(@|[A-Za-z0-9_*-]+(\.[A-Za-z0-9_-]+)*\.?)$`)
+
 func apiIpValidPage(w http.ResponseWriter, req *http.Request) {
+	serveIpValid(w, req, GetCurrentPersisted(), false)
+}
+
+// Turns the request into options for ComputeValidIPs, run over persisted,
+// and renders what comes back; persisted needn't be the current snapshot,
+// and nil is taken to mean that there isn't one yet.  With ownCountries,
+// persisted brought its countries with it, rather than from GeoIP.
+func serveIpValid(w http.ResponseWriter, req *http.Request, persisted *PersistedHostInfo, ownCountries bool) {
 	var err error
 	if err = req.ParseForm(); err != nil {
 		http.Error(w, "Failed to parse form information", http.StatusBadRequest)
 		return
 	}
+	tunables := GetIpValidTunables()
 	var (
 		showStats        bool
+		includeDown      bool
 		emitJson         bool
+		emitZone         bool
+		emitGeoDns       bool
+		emitServers      bool
+		emitHostnames    bool
 		limitToProxies   bool
+		trendAware       bool
+		splitFamily      bool
+		detailed         bool
+		orderByCountry   bool
 		limitToCountries *CountrySet
+		excludeServer    string
+		zoneOwner        = *flZoneOwner
+		zoneTTL          = *flZoneTTL
 	)
 	if _, ok := req.Form["stats"]; ok {
 		showStats = true
 	}
+	// Diagnostic: was a small result down to failures, or to filtering?
+	if _, ok := req.Form["include_down"]; ok {
+		showStats = true
+		includeDown = true
+	}
 	if _, ok := req.Form["json"]; ok {
 		emitJson = true
 	}
+	switch req.Form.Get("format") {
+	case "":
+	case "json":
+		emitJson = true
+	case "zone":
+		emitZone = true
+		if o := req.Form.Get("owner"); o != "" {
+			zoneOwner = o
+		}
+		if t := req.Form.Get("ttl"); t != "" {
+			zoneTTL, err = strconv.Atoi(t)
+			if err != nil || zoneTTL < 0 {
+				http.Error(w, "Bad 'ttl' parameter", http.StatusBadRequest)
+				return
+			}
+		}
+		if !zoneOwnerRegexp.MatchString(zoneOwner) {
+			http.Error(w, "Bad 'owner' parameter", http.StatusBadRequest)
+			return
+		}
+	case "geodns":
+		emitGeoDns = true
+	case "servers":
+		emitJson = true
+		emitServers = true
+	default:
+		http.Error(w, "Unknown 'format' parameter", http.StatusBadRequest)
+		return
+	}
+	switch req.Form.Get("output") {
+	case "", "ips":
+	case "hostnames":
+		if emitZone {
+			http.Error(w, "Zone format needs IPs, not hostnames", http.StatusBadRequest)
+			return
+		}
+		if emitGeoDns {
+			http.Error(w, "GeoDNS format needs IPs, not hostnames", http.StatusBadRequest)
+			return
+		}
+		if emitServers {
+			http.Error(w, "Servers format already gives hostnames", http.StatusBadRequest)
+			return
+		}
+		emitHostnames = true
+	default:
+		http.Error(w, "Unknown 'output' parameter", http.StatusBadRequest)
+		return
+	}
 	if _, ok := req.Form["proxies"]; ok {
 		limitToProxies = true
 	}
+	if _, ok := req.Form["trend_aware"]; ok {
+		trendAware = true
+	}
+	if _, ok := req.Form["split_family"]; ok {
+		splitFamily = true
+	}
+	if _, ok := req.Form["detailed"]; ok {
+		detailed = true
+	}
+	switch req.Form.Get("order") {
+	case "":
+	case "country-keycount":
+		if emitHostnames || emitServers {
+			http.Error(w, "Ordering by country needs IPs, not hostnames", http.StatusBadRequest)
+			return
+		}
+		orderByCountry = true
+	default:
+		http.Error(w, "Unknown 'order' parameter", http.StatusBadRequest)
+		return
+	}
+	// A random sample, weighted by keycount, spreads consumers who need only a
+	// few IPs across the pool; without a seed, each request differs.
+	sample := 0
+	sampleSeed := time.Now().UnixNano()
+	if s, ok := req.Form["sample"]; ok {
+		sample, err = strconv.Atoi(s[0])
+		if err != nil || sample <= 0 {
+			http.Error(w, "Bad 'sample' parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := req.Form.Get("seed"); s != "" {
+		sampleSeed, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, "Bad 'seed' parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	var explainIP string
+	if e := req.Form.Get("explain"); e != "" {
+		ip := net.ParseIP(e)
+		if ip == nil {
+			http.Error(w, "Bad 'explain' parameter, need an IP address", http.StatusBadRequest)
+			return
+		}
+		explainIP = ip.String()
+	}
+	// Consumed as-is by a GeoDNS backend, so nothing else can be mixed in
+	if emitGeoDns && (showStats || emitJson || detailed || explainIP != "") {
+		http.Error(w, "GeoDNS format can't have stats, json, detailed or explain", http.StatusBadRequest)
+		return
+	}
 	if _, ok := req.Form["countries"]; ok {
 		limitToCountries = NewCountrySet(req.Form.Get("countries"))
 	}
+	// Software to avoid whether proxied or not, such as a buggy reverse proxy
+	excludeServer = strings.ToLower(strings.TrimSpace(req.Form.Get("exclude_server")))
 
-	statsList := make([]string, 0, 100)
-	Statsf := func(s string, v ...interface{}) {
-		statsList = append(statsList, fmt.Sprintf(s, v...))
+	var minimumVersion *SksVersion = nil
+	mvReq := req.Form.Get("minimum_version")
+	if mvReq != "" {
+		tmp := NewSksVersion(mvReq)
+		minimumVersion = tmp
+	}
+	// Servers below the soft minimum are kept, but counted and reported so
+	// that upgrade pressure can be watched without shrinking the pool.
+	var softMinimumVersion *SksVersion = nil
+	if smvReq := req.Form.Get("soft_minimum_version"); smvReq != "" {
+		softMinimumVersion = NewSksVersion(smvReq)
 	}
 
+	overrideThreshold := 0
+	if nt, ok := req.Form["threshold"]; ok {
+		i, ok2 := strconv.Atoi(nt[0])
+		if ok2 == nil && i > 0 {
+			overrideThreshold = i
+		}
+	}
+
+	// A hard floor, for when the whole mesh is degraded and the statistics
+	// would happily follow it down.
+	absoluteMin := 0
+	if am, ok := req.Form["absolute_min"]; ok {
+		i, err := strconv.Atoi(am[0])
+		if err != nil || i < 0 {
+			http.Error(w, "Bad 'absolute_min' parameter", http.StatusBadRequest)
+			return
+		}
+		absoluteMin = i
+	}
+
+	// The explanation and stats come back in the result, which the closures
+	// below only look at once it's known; Statsf stays nil unless streaming.
 	var (
-		abortMessage func(string)
-		doShowStats  func()
-		contentType  string
+		explanation *IpExplanation
+		statsList   []string
+		Statsf      func(string, ...interface{})
+	)
+
+	var (
+		abortMessage  func(code, reason string)
+		doShowStats   func()
+		doShowExplain func()
+		contentType   string
 	)
 
 	if emitJson {
@@ -80,42 +337,385 @@ func apiIpValidPage(w http.ResponseWriter, req *http.Request) {
 			}
 			fmt.Fprintf(w, "\"stats\": %s\n", b)
 		}
-		abortMessage = func(s string) {
-			fmt.Fprintf(w, "{\n")
+		doShowExplain = func() {
+			b, err := json.Marshal(explanation)
+			if err != nil {
+				Log.Printf("Unable to JSON marshal explanation: %s", err)
+				return
+			}
+			fmt.Fprintf(w, "\"explain\": %s,\n", b)
+		}
+		abortMessage = func(code, s string) {
+			fmt.Fprintf(w, "{\n\"format_version\": %d,\n", kIPGEN_FORMAT_VERSION)
+			if explanation != nil {
+				doShowExplain()
+			}
 			if showStats {
 				doShowStats()
 				fmt.Fprintf(w, ", ")
 			}
-			fmt.Fprintf(w, `"status": { "status": "INVALID", "count": 0, "reason": "%s" }`, s)
+			fmt.Fprintf(w, `"status": { "status": "INVALID", "count": 0, "reason": "%s", "reason_code": "%s", "api_version": "%s" }`,
+				s, code, kIPGEN_API_VERSION)
 			fmt.Fprintf(w, "\n}\n")
 		}
-	} else {
+	} else if emitGeoDns {
+		contentType = ContentTypeJson
+		// An empty object would have the backend answer nothing at all;
+		// failing makes it keep whatever it last loaded.
+		abortMessage = func(code, s string) {
+			http.Error(w, fmt.Sprintf("%s status=INVALID count=0 reason=%s reason_code=%s api_version=%s",
+				kIPGEN_STATUS_PREFIX, s, code, kIPGEN_API_VERSION), http.StatusServiceUnavailable)
+		}
+	} else if emitZone {
 		contentType = ContentTypeTextPlain
-		doShowStats = func() {
-			for _, l := range statsList {
-				fmt.Fprintf(w, "STATS: %s\n", l)
+		if showStats {
+			streamer := newStatsStreamer(w, "; STATS: ")
+			Statsf, doShowStats = streamer.Printf, streamer.Flush
+		}
+		doShowExplain = func() {
+			fmt.Fprintf(w, "; EXPLAIN: %s\n", explanation)
+		}
+		abortMessage = func(code, s string) {
+			if showStats {
+				doShowStats()
+			}
+			if explanation != nil {
+				doShowExplain()
 			}
+			fmt.Fprintf(w, "; %s status=INVALID count=0 reason=%s reason_code=%s api_version=%s\n",
+				kIPGEN_STATUS_PREFIX, s, code, kIPGEN_API_VERSION)
 		}
-		abortMessage = func(s string) {
+	} else {
+		contentType = ContentTypeTextPlain
+		if showStats {
+			streamer := newStatsStreamer(w, "STATS: ")
+			Statsf, doShowStats = streamer.Printf, streamer.Flush
+		}
+		doShowExplain = func() {
+			fmt.Fprintf(w, "EXPLAIN: %s\n", explanation)
+		}
+		abortMessage = func(code, s string) {
 			if showStats {
 				doShowStats()
 			}
-			fmt.Fprintf(w, "IP-Gen/1.1: status=INVALID count=0 reason=%s\n.\n", s)
+			if explanation != nil {
+				doShowExplain()
+			}
+			fmt.Fprintf(w, "%s status=INVALID count=0 reason=%s reason_code=%s api_version=%s\n.\n",
+				kIPGEN_STATUS_PREFIX, s, code, kIPGEN_API_VERSION)
 		}
 	}
 	w.Header().Set("Content-Type", contentType)
 
-	persisted := GetCurrentPersisted()
-	if persisted == nil {
-		abortMessage("first_scan")
+	result, err := ComputeValidIPs(persisted, tunables, IpValidOptions{
+		ShowStats:          showStats,
+		IncludeDown:        includeDown,
+		LimitToProxies:     limitToProxies,
+		TrendAware:         trendAware,
+		SplitFamily:        splitFamily,
+		LimitToCountries:   limitToCountries,
+		ExcludeServer:      excludeServer,
+		MinimumVersion:     minimumVersion,
+		SoftMinimumVersion: softMinimumVersion,
+		OverrideThreshold:  overrideThreshold,
+		AbsoluteMin:        absoluteMin,
+		Explain:            explainIP,
+		OwnCountries:       ownCountries,
+		SkipAnalyzeErrors:  *flSkipAnalyzeErrors,
+		Statsf:             Statsf,
+	})
+	explanation, statsList = result.Explanation, result.Stats
+	if err != nil {
+		abort, ok := err.(*IpValidAbort)
+		if !ok {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		abortMessage(abort.Code, abort.Reason)
 		return
 	}
+	ips, ips_all, host_for_ip := result.IPs, result.Keycounts, result.HostForIP
 
-	var minimumVersion *SksVersion = nil
-	mvReq := req.Form.Get("minimum_version")
-	if mvReq != "" {
-		tmp := NewSksVersion(mvReq)
-		minimumVersion = tmp
+	if orderByCountry {
+		sortByCountryKeycount(ips, ips_all, persisted.IPCountryMap)
+	}
+	if sample > 0 {
+		rng := rand.New(rand.NewSource(sampleSeed))
+		if emitHostnames || emitServers {
+			chosen := make(map[string]bool, sample)
+			for _, name := range sampleByKeycount(hostnamesForIPs(ips, host_for_ip), sample, func(name string) int {
+				return persisted.HostMap[name].Keycount
+			}, rng) {
+				chosen[name] = true
+			}
+			sampled := make([]string, 0, len(ips))
+			for _, ip := range ips {
+				if chosen[host_for_ip[ip]] {
+					sampled = append(sampled, ip)
+				}
+			}
+			ips = sampled
+		} else {
+			ips = sampleByKeycount(ips, sample, func(ip string) int { return ips_all[ip] }, rng)
+		}
+		if explanation != nil && explanation.Included {
+			explanation.Included = false
+			for _, ip := range ips {
+				if ip == explanation.IP {
+					explanation.Included = true
+				}
+			}
+			if !explanation.Included {
+				explanation.DroppedBy = "sample"
+			}
+		}
+	}
+
+	//TODO: change now to be the time the scan finished
+	timestamp := time.Now().UTC().Format("2006-01-02T15:04:05") + "Z"
+	results, resultsKey := ips, "ips"
+	if emitHostnames {
+		results, resultsKey = hostnamesForIPs(ips, host_for_ip), "hostnames"
+	} else if emitServers {
+		results, resultsKey = hostnamesForIPs(ips, host_for_ip), "servers"
+	}
+	count := len(results)
+	Log.Printf("ip-valid: Yielding %d %s from %d of %d IPs", count, resultsKey, len(ips), len(ips_all))
+
+	// The tags are public statements; history:
+	//   skip 1.0.10 -> skip_1010, because of lookup problems biting gnupg
+	//   alg_1 used a fixed threshold (too small to deal with jitter)
+	//   alg_2 used stddev+jitter
+	//   alg_3 fixed maximum bucket selection (was a code bug)
+	//   alg_4 stopped double-counting servers with multiple IP addresses
+	//   alg_5 keep 1.0.10 servers for long enough to calculate stats, drop afterwards
+	//   skip_<version without dots> generalises skip_1010 for -quarantine-versions
+	statusD := make(map[string]interface{}, 16)
+	statusD["status"] = "COMPLETE"
+	statusD["api_version"] = kIPGEN_API_VERSION
+	statusD["count"] = count
+	if emitHostnames || emitServers {
+		statusD["count_unit"] = "servers"
+		statusD["ip_count"] = len(ips)
+	}
+	tags := make([]string, 0, len(tunables.QuarantineVersions)+1)
+	for _, version := range tunables.QuarantineVersions {
+		tags = append(tags, "skip_"+strings.Replace(version, ".", "", -1))
+	}
+	statusD["tags"] = append(tags, "alg_5")
+	if minimumVersion != nil {
+		statusD["minimum_version"] = minimumVersion.String()
+	}
+	if softMinimumVersion != nil {
+		statusD["soft_minimum_version"] = softMinimumVersion.String()
+		statusD["below_soft_min"] = result.BelowSoftMin
+	}
+	if limitToProxies {
+		statusD["proxies"] = "1"
+	}
+	if excludeServer != "" {
+		statusD["exclude_server"] = excludeServer
+	}
+	if trendAware {
+		statusD["trend_aware"] = "1"
+		statusD["recovering"] = result.Recovering
+	}
+	if limitToCountries != nil {
+		statusD["countries"] = limitToCountries.String()
+	}
+	if orderByCountry {
+		statusD["order"] = "country-keycount"
+	}
+	if sample > 0 {
+		statusD["sample"] = sample
+		statusD["seed"] = strconv.FormatInt(sampleSeed, 10)
+	}
+	if result.LastKnownGood > 0 {
+		statusD["last_known_good"] = result.LastKnownGood
+	}
+	statusD["minimum"] = result.Threshold
+	if absoluteMin > 0 {
+		statusD["absolute_min"] = absoluteMin
+		statusD["statistical_minimum"] = result.Statistical
+		if absoluteMin > result.Statistical {
+			statusD["minimum_binding"] = "absolute_min"
+		} else {
+			statusD["minimum_binding"] = "statistical"
+		}
+	}
+	if splitFamily {
+		statusD["split_family"] = "1"
+		for family, threshold := range result.FamilyThresholds {
+			statusD["minimum_"+strings.ToLower(family)] = threshold
+		}
+	}
+	statusD["collected"] = timestamp
+
+	// For weighting DNS answers by how up-to-date each server is
+	keycountOf := func(result string) int {
+		if emitHostnames || emitServers {
+			return persisted.HostMap[result].Keycount
+		}
+		return ips_all[result]
+	}
+	if detailed {
+		statusD["detailed"] = "1"
+	}
+
+	if emitJson {
+		fmt.Fprintf(w, "{\n\"format_version\": %d,\n", kIPGEN_FORMAT_VERSION)
+		if explanation != nil {
+			doShowExplain()
+		}
+		if showStats {
+			doShowStats()
+			fmt.Fprintf(w, ", ")
+		}
+		var bResults []byte
+		if emitServers {
+			servers := serversForHostnames(results, ips, persisted.HostMap)
+			if detailed {
+				for i := range servers {
+					servers[i].Keycount = keycountOf(servers[i].Hostname)
+				}
+			}
+			bResults, _ = json.Marshal(servers)
+		} else if detailed {
+			details := make([]ipValidDetail, len(results))
+			for i, result := range results {
+				details[i].Keycount = keycountOf(result)
+				if emitHostnames {
+					details[i].Hostname = result
+				} else {
+					details[i].IP = result
+				}
+			}
+			bResults, _ = json.Marshal(details)
+		} else {
+			bResults, _ = json.Marshal(results)
+		}
+		bStatus, _ := json.Marshal(statusD)
+		fmt.Fprintf(w, "\"status\": %s,\n\"%s\": %s\n}\n", bStatus, resultsKey, bResults)
+	} else if emitGeoDns {
+		b, err := json.Marshal(groupIPsByCountry(ips, persisted.IPCountryMap))
+		if err != nil {
+			Log.Printf("Unable to JSON marshal GeoDNS groups: %s", err)
+			return
+		}
+		w.Write(b)
+		fmt.Fprintf(w, "\n")
+	} else if emitZone {
+		if showStats {
+			doShowStats()
+		}
+		if explanation != nil {
+			doShowExplain()
+		}
+		fmt.Fprintf(w, "; %s\n", ipGenStatusLine(statusD))
+		for _, ip := range ips {
+			rrType := "AAAA"
+			if net.ParseIP(ip).To4() != nil {
+				rrType = "A"
+			}
+			fmt.Fprintf(w, "%s\t%d\tIN\t%s\t%s\n", zoneOwner, zoneTTL, rrType, ip)
+		}
+	} else {
+		if showStats {
+			doShowStats()
+		}
+		if explanation != nil {
+			doShowExplain()
+		}
+		fmt.Fprintf(w, "%s\n", ipGenStatusLine(statusD))
+		for _, result := range results {
+			if detailed {
+				fmt.Fprintf(w, "%s %d\n", result, keycountOf(result))
+			} else {
+				fmt.Fprintf(w, "%s\n", result)
+			}
+		}
+		fmt.Fprintf(w, ".\n")
+	}
+
+}
+
+// Why ComputeValidIPs gave up: Code is one of the kREASON_* codes, Reason the
+// more specific text shown alongside it.
+type IpValidAbort struct {
+	Code   string
+	Reason string
+}
+
+func newIpValidAbort(code, reason string) *IpValidAbort {
+	return &IpValidAbort{Code: code, Reason: reason}
+}
+
+func (a *IpValidAbort) Error() string {
+	return fmt.Sprintf("ip-valid: %s (%s)", a.Reason, a.Code)
+}
+
+// Everything which shapes the ip-valid result, rather than how it's shown.
+// With a nil Statsf, stats lines are collected into the result instead.
+type IpValidOptions struct {
+	ShowStats          bool
+	IncludeDown        bool
+	LimitToProxies     bool
+	TrendAware         bool
+	SplitFamily        bool
+	LimitToCountries   *CountrySet
+	ExcludeServer      string
+	MinimumVersion     *SksVersion
+	SoftMinimumVersion *SksVersion
+	OverrideThreshold  int
+	AbsoluteMin        int
+	Explain            string // an IP, normalised
+	OwnCountries       bool   // countries not from GeoIP, so they're there even if it's down
+	SkipAnalyzeErrors  bool   // see -skip-analyze-errors
+	Statsf             func(string, ...interface{})
+}
+
+type IpValidResult struct {
+	IPs              []string
+	Keycounts        map[string]int    // every IP seen, to its server's keycount
+	HostForIP        map[string]string // every IP seen, to its server
+	Threshold        int               // lowest across families, with split_family
+	Statistical      int               // as Threshold, before any absolute_min
+	FamilyThresholds map[string]int    // only with split_family
+	Recovering       int
+	BelowSoftMin     int
+	LastKnownGood    int
+	Explanation      *IpExplanation
+	Stats            []string
+}
+
+// The ip-valid algorithm, without any of the HTTP around it.  The result is
+// returned even with an error, which is always an *IpValidAbort, so that the
+// stats and explanation gathered before giving up can still be shown.
+func ComputeValidIPs(persisted *PersistedHostInfo, tunables IpValidTunables, options IpValidOptions) (*IpValidResult, error) {
+	result := &IpValidResult{}
+	Statsf := options.Statsf
+	if Statsf == nil {
+		result.Stats = make([]string, 0, 100)
+		Statsf = func(s string, v ...interface{}) {
+			result.Stats = append(result.Stats, fmt.Sprintf(s, v...))
+		}
+	}
+	var explanation *IpExplanation
+	if options.Explain != "" {
+		explanation = &IpExplanation{IP: options.Explain}
+		result.Explanation = explanation
+	}
+
+	if persisted == nil {
+		return result, newIpValidAbort(kREASON_FIRST_SCAN, "first_scan")
+	}
+	if options.LimitToCountries != nil && geoipUnavailable && !options.OwnCountries {
+		return result, newIpValidAbort(kREASON_GEOIP_UNAVAILABLE, "geoip_unavailable")
+	}
+
+	quarantined := make(map[string]bool, len(tunables.QuarantineVersions))
+	for _, version := range tunables.QuarantineVersions {
+		quarantined[version] = true
 	}
 
 	var (
@@ -123,59 +723,111 @@ func apiIpValidPage(w http.ResponseWriter, req *http.Request) {
 		// just one IP per box, but then later deal with all the IPs for filtering.
 		ips_one_per_server = make(map[string]int, len(persisted.HostMap)*2)
 		ips_all            = make(map[string]int, len(persisted.HostMap)*2)
+		host_for_ip        = make(map[string]string, len(persisted.HostMap)*2)
+		// and for split_family, one IP per server per family
+		ips_one_per_family = map[string]map[string]int{
+			"IPv4": make(map[string]int, len(persisted.HostMap)),
+			"IPv6": make(map[string]int, len(persisted.HostMap)),
+		}
+		// keyed by nodeWeightKey, so -merge-by-nodename clusters count once
+		weightedAs     = make(map[string]string, len(persisted.HostMap))
+		weightedFamily = make(map[string]bool, len(persisted.HostMap)*2)
 	)
 
 	var (
-		count_servers_1010            int
+		count_servers_quarantined     int
 		count_servers_too_old         int
 		count_servers_unwanted_server int
 		count_servers_wrong_country   int
-		ips_skip_1010                 btree.SortedSet = btree.NewTree(btreeStringLess)
+		count_servers_excluded_server int
+		count_servers_analyze_error   int
+		ips_quarantined               btree.SortedSet = btree.NewTree(btreeStringLess)
 		ips_too_old                   btree.SortedSet = btree.NewTree(btreeStringLess)
 		ips_unwanted_server           btree.SortedSet = btree.NewTree(btreeStringLess)
 		ips_wrong_country             btree.SortedSet = btree.NewTree(btreeStringLess)
+		ips_excluded_server           btree.SortedSet = btree.NewTree(btreeStringLess)
+		ips_below_soft_min            btree.SortedSet = btree.NewTree(btreeStringLess)
 	)
 
 	for _, name := range persisted.Sorted {
 		node := persisted.HostMap[name]
+		if explanation != nil && explanation.Hostname == "" {
+			for _, ip := range node.IpList {
+				if ip == explanation.IP {
+					explanation.Hostname = name
+					explanation.Keycount = node.Keycount
+				}
+			}
+			if explanation.Hostname == name && node.Keycount <= 1 {
+				explanation.DroppedBy = "low_keycount"
+			}
+		}
 		var (
-			skip_this_1010     = false
-			skip_this_age      = false
-			skip_this_nonproxy = false
-			skip_this_country  = false
+			skip_this_quarantined = false
+			skip_this_age         = false
+			skip_this_nonproxy    = false
+			skip_this_country     = false
+			skip_this_server      = false
+			below_soft_min        = false
 		)
 		if node.Keycount <= 1 {
 			Statsf("dropping server <%s> with %d keys", name, node.Keycount)
 			continue
 		}
+		if tunables.aboveSanityMax(node.Keycount) {
+			Statsf("dropping server <%s> with %d keys, above the sanity maximum %d", name, node.Keycount, tunables.SanityMax)
+			if explanation != nil && explanation.Hostname == name {
+				explanation.DroppedBy = "high_keycount"
+			}
+			continue
+		}
+		// A page which only partly parsed can have a keycount, but not one
+		// to be trusted in the statistics.
+		if options.SkipAnalyzeErrors && node.AnalyzeError != "" {
+			Statsf("dropping server <%s> with analyze error: %s", name, node.AnalyzeError)
+			count_servers_analyze_error += 1
+			if explanation != nil && explanation.Hostname == name {
+				explanation.DroppedBy = "analyze_error"
+			}
+			continue
+		}
 
-		if string(node.Version) == "1.0.10" {
-			skip_this_1010 = true
-			//ips_skip_1010.Insert(name) // nope, IPs
-			count_servers_1010 += 1
+		if quarantined[node.Version] {
+			skip_this_quarantined = true
+			//ips_quarantined.Insert(name) // nope, IPs
+			count_servers_quarantined += 1
 		}
 
-		if minimumVersion != nil {
+		if options.MinimumVersion != nil {
 			thisVersion := NewSksVersion(node.Version)
-			if thisVersion == nil || !thisVersion.IsAtLeast(minimumVersion) {
+			if thisVersion == nil || !thisVersion.IsAtLeast(options.MinimumVersion) {
 				skip_this_age = true
 				count_servers_too_old += 1
 			}
 		}
 
-		if limitToProxies && node.ViaHeader == "" {
-			server := strings.ToLower(strings.SplitN(node.ServerHeader, "/", 2)[0])
-			if _, ok := serverHeadersNative[server]; ok {
-				skip_this_nonproxy = true
-				count_servers_unwanted_server += 1
+		if options.SoftMinimumVersion != nil {
+			thisVersion := NewSksVersion(node.Version)
+			if thisVersion == nil || !thisVersion.IsAtLeast(options.SoftMinimumVersion) {
+				below_soft_min = true
 			}
 		}
 
-		if limitToCountries != nil {
+		if options.LimitToProxies && node.ServedNatively() {
+			skip_this_nonproxy = true
+			count_servers_unwanted_server += 1
+		}
+
+		if options.ExcludeServer != "" && strings.Contains(strings.ToLower(node.ServerHeader), options.ExcludeServer) {
+			skip_this_server = true
+			count_servers_excluded_server += 1
+		}
+
+		if options.LimitToCountries != nil {
 			var keep bool
 			for _, ip := range node.IpList {
 				geo, ok := persisted.IPCountryMap[ip]
-				if ok && limitToCountries.HasCountry(geo) {
+				if ok && options.LimitToCountries.HasCountry(geo) {
 					keep = true
 				}
 			}
@@ -186,11 +838,24 @@ func apiIpValidPage(w http.ResponseWriter, req *http.Request) {
 		}
 
 		if len(node.IpList) > 0 {
-			ips_one_per_server[node.IpList[0]] = node.Keycount
+			weightKey := nodeWeightKey(name, node)
+			if first, ok := weightedAs[weightKey]; ok {
+				Statsf("merging server <%s> into <%s> for weighting, same nodename", name, first)
+			} else {
+				weightedAs[weightKey] = name
+				ips_one_per_server[node.IpList[0]] = node.Keycount
+			}
+			for _, ip := range node.IpList {
+				if family := ipFamily(ip); !weightedFamily[weightKey+" "+family] {
+					weightedFamily[weightKey+" "+family] = true
+					ips_one_per_family[family][ip] = node.Keycount
+				}
+			}
 			for _, ip := range node.IpList {
 				ips_all[ip] = node.Keycount
-				if skip_this_1010 {
-					ips_skip_1010.Insert(ip)
+				host_for_ip[ip] = name
+				if skip_this_quarantined {
+					ips_quarantined.Insert(ip)
 				}
 				if skip_this_age {
 					ips_too_old.Insert(ip)
@@ -201,9 +866,372 @@ func apiIpValidPage(w http.ResponseWriter, req *http.Request) {
 				if skip_this_country {
 					ips_wrong_country.Insert(ip)
 				}
+				if skip_this_server {
+					ips_excluded_server.Insert(ip)
+				}
+				if below_soft_min {
+					ips_below_soft_min.Insert(ip)
+				}
+			}
+		}
+
+	}
+	if count_servers_analyze_error > 0 {
+		Statsf("excluded %d servers with analyze errors from the statistics", count_servers_analyze_error)
+	}
+
+	if options.ShowStats {
+		if sm := persisted.Summary; sm != nil {
+			Statsf("scan: %d hosts, %d reachable, %d failed, %d distinct IPs in %d countries",
+				sm.TotalHosts, sm.Reachable, sm.Failed, sm.DistinctIPs, sm.DistinctCountries)
+			if sm.UnknownCountryIPs > 0 {
+				Statsf("scan: %d IPs with unknown country (lookups failed)", sm.UnknownCountryIPs)
+			}
+		}
+	}
+	if options.IncludeDown {
+		downStats(persisted, Statsf)
+	}
+
+	trusted := trustedKeycounts(persisted, tunables)
+
+	// With split_family, each address family gets its own statistics, so that
+	// a cohort of one family which is temporarily low doesn't drag down the
+	// other; a family which can't be computed yields nothing, but only if no
+	// family can be computed do we give up.
+	var thresholds []*ipThreshold
+	if options.SplitFamily {
+		var failCode, failReason string
+		for _, family := range []string{"IPv4", "IPv6"} {
+			t, code, reason := computeThreshold(family, ips_one_per_family[family], ipsOfFamily(ips_all, family),
+				tunables, trusted, options.OverrideThreshold, options.ShowStats, Statsf)
+			if t == nil {
+				Statsf("[%s] no threshold (%s), yielding no %s addresses", family, reason, family)
+				failCode, failReason = code, reason
+				continue
+			}
+			thresholds = append(thresholds, t)
+		}
+		if len(thresholds) == 0 {
+			return result, newIpValidAbort(failCode, failReason)
+		}
+	} else {
+		t, code, reason := computeThreshold("", ips_one_per_server, ips_all, tunables, trusted, options.OverrideThreshold, options.ShowStats, Statsf)
+		if t == nil {
+			return result, newIpValidAbort(code, reason)
+		}
+		thresholds = append(thresholds, t)
+	}
+	for _, t := range thresholds {
+		t.statistical = t.threshold
+		if t.threshold < options.AbsoluteMin {
+			if t.family == "" {
+				Statsf("absolute_min applied: threshold %d -> %d", t.threshold, options.AbsoluteMin)
+			} else {
+				Statsf("[%s] absolute_min applied: threshold %d -> %d", t.family, t.threshold, options.AbsoluteMin)
+			}
+			t.threshold = options.AbsoluteMin
+		}
+	}
+	thresholdFor := func(ip string) *ipThreshold {
+		for _, t := range thresholds {
+			if t.family == "" || t.family == ipFamily(ip) {
+				return t
+			}
+		}
+		return nil
+	}
+	threshold, statistical := thresholds[0].threshold, thresholds[0].statistical
+	for _, t := range thresholds[1:] {
+		if t.threshold < threshold {
+			threshold = t.threshold
+		}
+		if t.statistical < statistical {
+			statistical = t.statistical
+		}
+	}
+
+	ips := make([]string, 0, len(ips_all))
+	for _, t := range thresholds {
+		for ip, count := range t.inBounds {
+			if count >= t.threshold {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	if explanation != nil && explanation.Hostname == "" {
+		explanation.DroppedBy = "unknown"
+	} else if explanation != nil && explanation.DroppedBy == "" {
+		var count int
+		var inBounds bool
+		t := thresholdFor(explanation.IP)
+		if t != nil {
+			count, inBounds = t.inBounds[explanation.IP]
+		}
+		explanation.InBounds = inBounds
+		explanation.PassedThreshold = inBounds && count >= t.threshold
+		if !inBounds {
+			explanation.DroppedBy = "out_of_bounds"
+		} else if !explanation.PassedThreshold && count >= t.statistical {
+			explanation.DroppedBy = "absolute_min"
+		} else if !explanation.PassedThreshold {
+			explanation.DroppedBy = "threshold"
+		}
+	}
+
+	// A server just below the threshold whose keycount has risen since the
+	// previous scan is probably converging after a resync, not stuck low.
+	recovering := make(map[string]bool)
+	if options.TrendAware {
+		if persisted.PreviousKeycounts == nil {
+			Statsf("trend_aware: no previous scan to compare against")
+		}
+		for ip, count := range ips_all {
+			t := thresholdFor(ip)
+			if t == nil || count >= t.threshold || count < t.threshold-tunables.DailyJitter || count < options.AbsoluteMin {
+				continue
+			}
+			name := host_for_ip[ip]
+			previous, ok := persisted.PreviousKeycounts[name]
+			if !ok || count <= previous {
+				continue
+			}
+			ips = append(ips, ip)
+			if explanation != nil && ip == explanation.IP {
+				explanation.Recovering = true
+				explanation.DroppedBy = ""
+			}
+			if !recovering[name] {
+				recovering[name] = true
+				Statsf("keeping recovering server <%s> with %d keys, up %d since previous scan", name, count, count-previous)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		Statsf("No IPs above threshold %d", threshold)
+		return result, newIpValidAbort(kREASON_THRESHOLD_TOO_HIGH, "threshold_too_high")
+	}
+
+	filterOut := func(code, rationale string, eliminate btree.SortedSet, eliminate_server_count int, candidates []string) []string {
+		if explanation != nil && explanation.DroppedBy == "" && eliminate.Contains(explanation.IP) {
+			explanation.DroppedBy = code
+		}
+		alreadyDropped := btree.NewTree(btreeStringLess)
+		for ip := range eliminate.Data() {
+			alreadyDropped.Insert(ip)
+		}
+		for _, ip := range candidates {
+			alreadyDropped.Remove(ip)
+		}
+		ips = make([]string, 0, len(candidates))
+		for _, ip := range candidates {
+			if !eliminate.Contains(ip) {
+				ips = append(ips, ip)
+			}
+		}
+		Statsf("dropping all %d servers %s, for %d possible IPs but %d of those already dropped",
+			eliminate_server_count, rationale, eliminate.Len(), alreadyDropped.Len())
+		return ips
+	}
+
+	if len(tunables.QuarantineVersions) > 0 {
+		versions := "v" + strings.Join(tunables.QuarantineVersions, ",v")
+		ips = filterOut(kREASON_FILTERED_QUARANTINE, "running version "+versions, ips_quarantined, count_servers_quarantined, ips)
+		if len(ips) == 0 {
+			return result, newIpValidAbort(kREASON_FILTERED_QUARANTINE, fmt.Sprintf("No_servers_left_after_%s_filter", versions))
+		}
+	}
+
+	if options.MinimumVersion != nil {
+		ips = filterOut(kREASON_FILTERED_VERSION, fmt.Sprintf("running version < v%s", options.MinimumVersion), ips_too_old, count_servers_too_old, ips)
+		if len(ips) == 0 {
+			return result, newIpValidAbort(kREASON_FILTERED_VERSION, fmt.Sprintf("No_servers_left_after_minimum_version_filter_(v%s)", options.MinimumVersion))
+		}
+	}
+
+	if options.LimitToCountries != nil {
+		ips = filterOut(kREASON_FILTERED_COUNTRY, fmt.Sprintf("not in countries [%s]", options.LimitToCountries), ips_wrong_country, count_servers_wrong_country, ips)
+		if len(ips) == 0 {
+			return result, newIpValidAbort(kREASON_FILTERED_COUNTRY, fmt.Sprintf("No_servers_left_after_country_filter_[%s]", options.LimitToCountries))
+		}
+	}
+
+	if options.LimitToProxies {
+		ips = filterOut(kREASON_FILTERED_PROXIES, "not behind a web-proxy", ips_unwanted_server, count_servers_unwanted_server, ips)
+		if len(ips) == 0 {
+			return result, newIpValidAbort(kREASON_FILTERED_PROXIES, "No_servers_left_after_proxies_filter")
+		}
+	}
+
+	if options.ExcludeServer != "" {
+		ips = filterOut(kREASON_FILTERED_SERVER, fmt.Sprintf("with Server header containing \"%s\"", options.ExcludeServer), ips_excluded_server, count_servers_excluded_server, ips)
+		if len(ips) == 0 {
+			return result, newIpValidAbort(kREASON_FILTERED_SERVER, "No_servers_left_after_exclude_server_filter")
+		}
+	}
+
+	// Only what survived the real filters counts as below the soft minimum;
+	// with a hard minimum at or above it, this is always zero.
+	var softMinIps []string
+	var count_servers_below_soft_min int
+	if options.SoftMinimumVersion != nil {
+		softMinIps = make([]string, 0, ips_below_soft_min.Len())
+		for _, ip := range ips {
+			if ips_below_soft_min.Contains(ip) {
+				softMinIps = append(softMinIps, ip)
+			}
+		}
+		sort.Strings(softMinIps)
+		count_servers_below_soft_min = len(hostnamesForIPs(softMinIps, host_for_ip))
+		Statsf("keeping %d servers running version < v%s (soft minimum), with %d IPs: %s",
+			count_servers_below_soft_min, options.SoftMinimumVersion, len(softMinIps), strings.Join(softMinIps, " "))
+	}
+
+	var count_servers_last_good int
+	for _, name := range hostnamesForIPs(ips, host_for_ip) {
+		if !persisted.HostMap[name].LastGoodScan.IsZero() {
+			count_servers_last_good += 1
+		}
+	}
+	if count_servers_last_good > 0 {
+		Statsf("keeping %d servers which failed this scan, on last-known-good data", count_servers_last_good)
+	}
+
+	if explanation != nil {
+		for _, ip := range ips {
+			if ip == explanation.IP {
+				explanation.Included = true
+			}
+		}
+	}
+
+	result.IPs = ips
+	result.Keycounts = ips_all
+	result.HostForIP = host_for_ip
+	result.Threshold, result.Statistical = threshold, statistical
+	if options.SplitFamily {
+		result.FamilyThresholds = make(map[string]int, len(thresholds))
+		for _, t := range thresholds {
+			result.FamilyThresholds[t.family] = t.threshold
+		}
+	}
+	result.Recovering = len(recovering)
+	result.BelowSoftMin = count_servers_below_soft_min
+	result.LastKnownGood = count_servers_last_good
+	return result, nil
+}
+
+type ipValidDetail struct {
+	IP       string `json:"ip,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	Keycount int    `json:"keycount"`
+}
+
+// For format=servers: a surviving server's addresses, by family, so that the
+// records for a dual-stack server can be kept together.
+type ipValidServer struct {
+	Hostname string   `json:"hostname"`
+	IPv4     []string `json:"ipv4"`
+	IPv6     []string `json:"ipv6"`
+	Keycount int      `json:"keycount,omitempty"` // with detailed
+}
+
+// Only the IPs which survived are given, not all of each server's IpList.
+func serversForHostnames(hostnames, ips []string, hostMap HostMap) []ipValidServer {
+	surviving := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		surviving[ip] = true
+	}
+	servers := make([]ipValidServer, len(hostnames))
+	for i, hostname := range hostnames {
+		servers[i] = ipValidServer{Hostname: hostname, IPv4: []string{}, IPv6: []string{}}
+		for _, ip := range hostMap[hostname].IpList {
+			if !surviving[ip] {
+				continue
+			}
+			if ipFamily(ip) == "IPv6" {
+				servers[i].IPv6 = append(servers[i].IPv6, ip)
+			} else {
+				servers[i].IPv4 = append(servers[i].IPv4, ip)
+			}
+		}
+	}
+	return servers
+}
+
+type ipThreshold struct {
+	family      string         // "" when computed over all addresses together
+	threshold   int            // minimum keycount to be yielded
+	statistical int            // threshold before any absolute_min
+	inBounds    map[string]int // IP to keycount, for IPs within the first bounds
+}
+
+func ipFamily(ipstr string) string {
+	if ip := net.ParseIP(ipstr); ip != nil && ip.To4() == nil {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+func ipsOfFamily(ips map[string]int, family string) map[string]int {
+	result := make(map[string]int, len(ips))
+	for ip, count := range ips {
+		if ipFamily(ip) == family {
+			result[ip] = count
+		}
+	}
+	return result
+}
+
+// Servers are weighted once each in the statistics, however many IPs they
+// have.  With -merge-by-nodename, servers reporting the same Nodename are
+// one logical server, such as a cluster behind several hostnames, and are
+// weighted once between them; their IPs are all still candidates.  Distinct
+// servers which happen to share a nodename, such as a default or copied
+// configuration, are wrongly merged, shrinking their weight.
+func nodeWeightKey(hostname string, node *SksNode) string {
+	if *flMergeByNodename {
+		if nodename, ok := node.NodeName(); ok {
+			if nodename = strings.ToLower(strings.TrimSpace(nodename)); nodename != "" {
+				return "nodename:" + nodename
 			}
 		}
+	}
+	return hostname
+}
+
+// Keycounts of the trusted servers in this snapshot, by canonical name or
+// alias; any which failed, have no keycount or claim an impossible one are
+// left out.
+func trustedKeycounts(persisted *PersistedHostInfo, tunables IpValidTunables) []int {
+	hostnames := tunables.TrustedServers
+	counts := make([]int, 0, len(hostnames))
+	seen := make(map[string]bool, len(hostnames))
+	for _, hostname := range hostnames {
+		if canonical, ok := persisted.AliasMap[hostname]; ok {
+			hostname = canonical
+		}
+		node, ok := persisted.HostMap[hostname]
+		if !ok || seen[hostname] || node.AnalyzeError != "" || node.Keycount <= 1 || tunables.aboveSanityMax(node.Keycount) {
+			continue
+		}
+		seen[hostname] = true
+		counts = append(counts, node.Keycount)
+	}
+	return counts
+}
 
+// Returns nil and an abort reason code and message if no threshold can be
+// computed.  Statistics lines are prefixed with the family, if any.  The
+// keycounts of trusted servers, if any, put a floor under the mean and the
+// threshold.
+func computeThreshold(family string, ips_one_per_server, ips_all map[string]int, tunables IpValidTunables, trusted []int,
+	overrideThreshold int, showStats bool, statsf func(string, ...interface{})) (*ipThreshold, string, string) {
+	Statsf := statsf
+	if family != "" {
+		Statsf = func(s string, v ...interface{}) {
+			statsf("[%s] %s", family, fmt.Sprintf(s, v...))
+		}
 	}
 
 	// We want to discard statistic-distorting outliers, then of what remains,
@@ -221,15 +1249,14 @@ func apiIpValidPage(w http.ResponseWriter, req *http.Request) {
 	// This was ... "much easier" with list comprehensions in Python
 	var buckets = make(map[int][]int, 40)
 	for _, count := range ips_one_per_server {
-		bucket := int(count / kBUCKET_SIZE)
+		bucket := int(count / tunables.BucketSize)
 		if _, ok := buckets[bucket]; !ok {
 			buckets[bucket] = make([]int, 0, 20)
 		}
 		buckets[bucket] = append(buckets[bucket], count)
 	}
 	if len(buckets) == 0 {
-		abortMessage("broken_no_buckets")
-		return
+		return nil, kREASON_NO_BUCKETS, "broken_no_buckets"
 	}
 
 	var largest_bucket int
@@ -295,17 +1322,42 @@ func apiIpValidPage(w http.ResponseWriter, req *http.Request) {
 			Statsf("%6d: %s", b, strings.Repeat("*", len(buckets[b])))
 		}
 		Statsf("largest bucket is %d with %d entries", largest_bucket, first_n)
-		Statsf("bucket size %d means bucket %d is [%d, %d)", kBUCKET_SIZE, largest_bucket,
-			kBUCKET_SIZE*largest_bucket, kBUCKET_SIZE*(largest_bucket+1))
+		Statsf("bucket size %d means bucket %d is [%d, %d)", tunables.BucketSize, largest_bucket,
+			tunables.BucketSize*largest_bucket, tunables.BucketSize*(largest_bucket+1))
 		Statsf("largest bucket: mean=%f sd=%f", first_mean, first_sd)
 		Statsf("first bounds: [%d, %d]", first_bounds_min, first_bounds_max)
 		Statsf("have %d servers within bounds, mean value %f sd=%f", len(first_ips_list), second_mean, second_sd)
 	}
 
-	if second_mean < float64(*flKeysSanityMin) {
-		Statsf("mean %f < %d", second_mean, *flKeysSanityMin)
-		abortMessage("broken_data")
-		return
+	// An influx of desynced servers can drag the whole distribution down, so
+	// known-good servers set a floor: the mean is at least theirs, and the
+	// threshold at least the lowest of them less the usual margin, which in
+	// normal running is already below the threshold, so does nothing.
+	// A trusted server which is itself below the sanity minimum is ignored.
+	trusted_floor := -1
+	trusted_sane := make([]int, 0, len(trusted))
+	for _, count := range trusted {
+		if count >= tunables.SanityMin {
+			trusted_sane = append(trusted_sane, count)
+		}
+	}
+	if len(trusted_sane) > 0 {
+		sort.Ints(trusted_sane)
+		var trusted_mean float64
+		for _, count := range trusted_sane {
+			trusted_mean += float64(count)
+		}
+		trusted_mean /= float64(len(trusted_sane))
+		trusted_floor = trusted_sane[0] - (tunables.DailyJitter + int(second_sd))
+		if second_mean < trusted_mean {
+			Statsf("trusted floor applied: mean of %d trusted servers %f > %f", len(trusted_sane), trusted_mean, second_mean)
+			second_mean = trusted_mean
+		}
+	}
+
+	if second_mean < float64(tunables.SanityMin) {
+		Statsf("mean %f < %d", second_mean, tunables.SanityMin)
+		return nil, kREASON_BROKEN_DATA, "broken_data"
 	}
 	threshold_base_index := len(first_ips) - 2
 	if threshold_base_index < 0 {
@@ -316,144 +1368,157 @@ func apiIpValidPage(w http.ResponseWriter, req *http.Request) {
 		threshold_candidates = append(threshold_candidates, count)
 	}
 	sort.Ints(threshold_candidates)
-	var threshold int = threshold_candidates[threshold_base_index] - (*flKeysDailyJitter + int(second_sd))
+	var threshold int = threshold_candidates[threshold_base_index] - (tunables.DailyJitter + int(second_sd))
 
 	if showStats {
 		Statsf("Second largest count within bounds: %d", threshold_candidates[threshold_base_index])
 		Statsf("threshold: %d", threshold)
 	}
-
-	if nt, ok := req.Form["threshold"]; ok {
-		i, ok2 := strconv.Atoi(nt[0])
-		if ok2 == nil && i > 0 {
-			Statsf("Overriding threshold from CGI parameter; %d -> %d", threshold, i)
-			threshold = i
-		}
+	if threshold < trusted_floor {
+		Statsf("trusted floor applied: threshold %d -> %d", threshold, trusted_floor)
+		threshold = trusted_floor
 	}
 
-	ips := make([]string, 0, len(first_ips_all))
-	for ip, count := range first_ips_all {
-		if count >= threshold {
-			ips = append(ips, ip)
-		}
-	}
-	if len(ips) == 0 {
-		Statsf("No IPs above threshold %d", threshold)
-		abortMessage("threshold_too_high")
-		return
+	if overrideThreshold > 0 {
+		Statsf("Overriding threshold from CGI parameter; %d -> %d", threshold, overrideThreshold)
+		threshold = overrideThreshold
 	}
 
-	filterOut := func(rationale string, eliminate btree.SortedSet, eliminate_server_count int, candidates []string) []string {
-		alreadyDropped := btree.NewTree(btreeStringLess)
-		for ip := range eliminate.Data() {
-			alreadyDropped.Insert(ip)
-		}
-		for _, ip := range candidates {
-			alreadyDropped.Remove(ip)
+	return &ipThreshold{family: family, threshold: threshold, inBounds: first_ips_all}, "", ""
+}
+
+// For include_down: the hosts which never reached the HostMap at all, which
+// the rest of the stats can't show, as well as those which are in it but
+// failed.
+func downStats(persisted *PersistedHostInfo, Statsf func(string, ...interface{})) {
+	if persisted.DownHosts == nil {
+		Statsf("down: hosts which failed to become nodes aren't known for a snapshot loaded from JSON")
+	} else {
+		Statsf("down: %d hosts queued this scan never became nodes", len(persisted.DownHosts))
+		hostnames := make([]string, 0, len(persisted.DownHosts))
+		for hostname := range persisted.DownHosts {
+			hostnames = append(hostnames, hostname)
 		}
-		ips = make([]string, 0, len(candidates))
-		for _, ip := range candidates {
-			if !eliminate.Contains(ip) {
-				ips = append(ips, ip)
-			}
+		HostSort(hostnames)
+		for _, hostname := range hostnames {
+			Statsf("down: <%s> %s", hostname, persisted.DownHosts[hostname])
 		}
-		Statsf("dropping all %d servers %s, for %d possible IPs but %d of those already dropped",
-			eliminate_server_count, rationale, eliminate.Len(), alreadyDropped.Len())
-		return ips
 	}
-
-	ips = filterOut("running version v1.0.10", ips_skip_1010, count_servers_1010, ips)
-	if len(ips) == 0 {
-		abortMessage("No_servers_left_after_v1.0.10_filter")
-		return
-	}
-
-	if minimumVersion != nil {
-		ips = filterOut(fmt.Sprintf("running version < v%s", minimumVersion), ips_too_old, count_servers_too_old, ips)
-		if len(ips) == 0 {
-			abortMessage(fmt.Sprintf("No_servers_left_after_minimum_version_filter_(v%s)", minimumVersion))
-			return
+	failed := 0
+	for _, node := range persisted.HostMap {
+		if node.AnalyzeError != "" {
+			failed += 1
 		}
 	}
+	Statsf("down: %d hosts in the results failed analysis", failed)
+}
 
-	if limitToCountries != nil {
-		ips = filterOut(fmt.Sprintf("not in countries [%s]", limitToCountries), ips_wrong_country, count_servers_wrong_country, ips)
-		if len(ips) == 0 {
-			abortMessage(fmt.Sprintf("No_servers_left_after_country_filter_[%s]", limitToCountries))
-			return
+// For format=geodns: country code to IPs, in the order given, with IPs whose
+// country isn't known under "unknown".
+func groupIPsByCountry(ips []string, countries IPCountryMap) map[string][]string {
+	groups := make(map[string][]string, 40)
+	for _, ip := range ips {
+		country := countries[ip]
+		if country == "" || country == kCOUNTRY_UNKNOWN {
+			country = "unknown"
 		}
+		groups[country] = append(groups[country], ip)
 	}
+	return groups
+}
 
-	if limitToProxies {
-		ips = filterOut("not behind a web-proxy", ips_unwanted_server, count_servers_unwanted_server, ips)
-		if len(ips) == 0 {
-			abortMessage("No_servers_left_after_proxies_filter")
-			return
+// Grouped by country, in order of country code, with the IPs whose country
+// isn't known last, as one "unknown" group; within each group, the largest
+// keycount first.  Tooling building round-robin records can then take IPs
+// from each group in turn, for geographic diversity.
+func sortByCountryKeycount(ips []string, keycounts map[string]int, countries IPCountryMap) {
+	countryOf := func(ip string) string {
+		if country := countries[ip]; country != "" && country != kCOUNTRY_UNKNOWN {
+			return country
 		}
+		return ""
 	}
+	sort.Slice(ips, func(i, j int) bool {
+		ci, cj := countryOf(ips[i]), countryOf(ips[j])
+		if ci != cj {
+			if ci == "" || cj == "" {
+				return cj == ""
+			}
+			return ci < cj
+		}
+		if ki, kj := keycounts[ips[i]], keycounts[ips[j]]; ki != kj {
+			return ki > kj
+		}
+		return ips[i] < ips[j]
+	})
+}
 
-	//TODO: change now to be the time the scan finished
-	timestamp := time.Now().UTC().Format("2006-01-02T15:04:05") + "Z"
-	count := len(ips)
-	Log.Printf("ip-valid: Yielding %d of %d values", count, len(ips_all))
-
-	// The tags are public statements; history:
-	//   skip 1.0.10 -> skip_1010, because of lookup problems biting gnupg
-	//   alg_1 used a fixed threshold (too small to deal with jitter)
-	//   alg_2 used stddev+jitter
-	//   alg_3 fixed maximum bucket selection (was a code bug)
-	//   alg_4 stopped double-counting servers with multiple IP addresses
-	//   alg_5 keep 1.0.10 servers for long enough to calculate stats, drop afterwards
-	statusD := make(map[string]interface{}, 16)
-	statusD["status"] = "COMPLETE"
-	statusD["count"] = count
-	statusD["tags"] = []string{"skip_1010", "alg_5"}
-	if minimumVersion != nil {
-		statusD["minimum_version"] = minimumVersion.String()
+// Weighted random sampling without replacement (Efraimidis and Spirakis):
+// each item draws a key of log(u)/weight, and the n largest keys win.  The
+// winners keep their order in items, so any ordering already applied holds.
+// Keys are drawn in sorted order, so that one seed gives one sample however
+// items happens to be ordered.
+func sampleByKeycount(items []string, n int, weight func(string) int, rng *rand.Rand) []string {
+	if n >= len(items) {
+		return items
 	}
-	if limitToProxies {
-		statusD["proxies"] = "1"
+	byKey := append([]string(nil), items...)
+	sort.Strings(byKey)
+	keys := make(map[string]float64, len(items))
+	for _, item := range byKey {
+		w := weight(item)
+		if w < 1 {
+			w = 1
+		}
+		keys[item] = math.Log(rng.Float64()) / float64(w)
 	}
-	if limitToCountries != nil {
-		statusD["countries"] = limitToCountries.String()
+	sort.Slice(byKey, func(i, j int) bool { return keys[byKey[i]] > keys[byKey[j]] })
+	chosen := make(map[string]bool, n)
+	for _, item := range byKey[:n] {
+		chosen[item] = true
 	}
-	statusD["minimum"] = threshold
-	statusD["collected"] = timestamp
-
-	if emitJson {
-		fmt.Fprintf(w, "{\n")
-		if showStats {
-			doShowStats()
-			fmt.Fprintf(w, ", ")
+	sampled := make([]string, 0, n)
+	for _, item := range items {
+		if chosen[item] {
+			sampled = append(sampled, item)
 		}
-		bIps, _ := json.Marshal(ips)
-		bStatus, _ := json.Marshal(statusD)
-		fmt.Fprintf(w, "\"status\": %s,\n\"ips\": %s\n}\n", bStatus, bIps)
-	} else {
-		if showStats {
-			doShowStats()
-		}
-		fmt.Fprintf(w, "IP-Gen/1.1:")
-		for k, v := range statusD {
-			var vstr string
-			//fmt.Fprintf(w, " {{%T}}", v)
-			switch v.(type) {
-			case int:
-				vstr = strconv.Itoa(v.(int))
-			case []string:
-				vstr = strings.Join(v.([]string), ",")
-			default:
-				vstr = fmt.Sprintf("%s", v)
-			}
-			fmt.Fprintf(w, " %s=%s", k, vstr)
-		}
-		fmt.Fprintf(w, "\n")
-		for _, ip := range ips {
-			fmt.Fprintf(w, "%s\n", ip)
+	}
+	return sampled
+}
+
+// Each server once, however many of its IPs survived, in host order
+func hostnamesForIPs(ips []string, hostForIP map[string]string) []string {
+	seen := make(map[string]bool, len(ips))
+	hostnames := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		name, ok := hostForIP[ip]
+		if !ok || seen[name] {
+			continue
 		}
-		fmt.Fprintf(w, ".\n")
+		seen[name] = true
+		hostnames = append(hostnames, name)
 	}
+	HostSort(hostnames)
+	return hostnames
+}
 
+func ipGenStatusLine(statusD map[string]interface{}) string {
+	buf := new(bytes.Buffer)
+	buf.WriteString(kIPGEN_STATUS_PREFIX)
+	for k, v := range statusD {
+		var vstr string
+		//fmt.Fprintf(w, " {{%T}}", v)
+		switch v.(type) {
+		case int:
+			vstr = strconv.Itoa(v.(int))
+		case []string:
+			vstr = strings.Join(v.([]string), ",")
+		default:
+			vstr = fmt.Sprintf("%s", v)
+		}
+		fmt.Fprintf(buf, " %s=%s", k, vstr)
+	}
+	return buf.String()
 }
 
 func apiIpValidStatsPage(w http.ResponseWriter, req *http.Request) {
@@ -0,0 +1,1060 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// As for -json-load, but without the DNS lookups for countries
+func loadTestPersisted(t *testing.T) *PersistedHostInfo {
+	persisted := newTestPersisted(t)
+	SetCurrentPersisted(persisted)
+	return persisted
+}
+
+func newTestPersisted(t *testing.T) *PersistedHostInfo {
+	setupTestLogging()
+	hostmap, err := LoadJSONFromFile(TEST_DATA_FILE)
+	if err != nil {
+		t.Fatalf("Failed to load \"%s\": %s", TEST_DATA_FILE, err)
+	}
+	hostnames := GenerateHostlistSorted(hostmap)
+	aliasMap := GetAliasMapForHostmap(hostmap)
+	persisted := &PersistedHostInfo{
+		HostMap:      hostmap,
+		AliasMap:     aliasMap,
+		IPCountryMap: make(IPCountryMap),
+		Sorted:       hostnames,
+		DepthSorted:  GenerateDepthSorted(hostmap),
+		Graph:        GenerateGraph(hostnames, hostmap, aliasMap),
+	}
+	return persisted
+}
+
+func testGet(t *testing.T, handler http.HandlerFunc, uri string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		t.Fatalf("Bad request URI \"%s\": %s", uri, err)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestIpValidZone(t *testing.T) {
+	loadTestPersisted(t)
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?format=zone&owner=pool&ttl=600")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Bad status %d: %s", rec.Code, rec.Body)
+	}
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if !strings.HasPrefix(lines[0], "; IP-Gen/1.1:") || !strings.Contains(lines[0], "status=COMPLETE") {
+		t.Fatalf("Bad status comment: %s", lines[0])
+	}
+	if len(lines) < 2 {
+		t.Fatalf("No records emitted")
+	}
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 5 || fields[0] != "pool" || fields[1] != "600" || fields[2] != "IN" {
+			t.Fatalf("Bad record line: %q", line)
+		}
+		ip := net.ParseIP(fields[4])
+		if ip == nil {
+			t.Fatalf("Bad address in record: %q", line)
+		}
+		if (ip.To4() != nil) != (fields[3] == "A") {
+			t.Fatalf("Wrong record type for address: %q", line)
+		}
+	}
+
+	for _, bad := range []string{"format=zone&owner=a+b", "format=zone&owner=x%0Ay", "format=zone&ttl=-1", "format=xml"} {
+		rec = testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?"+bad)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("Bad parameter %q accepted", bad)
+		}
+	}
+}
+
+func TestIpValidHostnames(t *testing.T) {
+	persisted := loadTestPersisted(t)
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?output=hostnames")
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if !strings.Contains(lines[0], "count_unit=servers") {
+		t.Fatalf("Count not labelled as servers: %s", lines[0])
+	}
+	if lines[len(lines)-1] != "." || len(lines) < 3 {
+		t.Fatalf("Bad body: %s", rec.Body)
+	}
+	seen := make(map[string]bool)
+	for _, name := range lines[1 : len(lines)-1] {
+		if _, ok := persisted.HostMap[name]; !ok {
+			t.Fatalf("Result \"%s\" is not a known server", name)
+		}
+		if seen[name] {
+			t.Fatalf("Server \"%s\" listed twice", name)
+		}
+		seen[name] = true
+	}
+	if !strings.Contains(lines[0], fmt.Sprintf("count=%d ", len(seen))) && !strings.HasSuffix(lines[0], fmt.Sprintf("count=%d", len(seen))) {
+		t.Fatalf("Count does not match %d servers: %s", len(seen), lines[0])
+	}
+
+	rec = testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?output=hostnames&format=zone")
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Hostnames in zone format accepted")
+	}
+}
+
+func ipValidJsonStatus(t *testing.T, query string) map[string]interface{} {
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?json&"+query)
+	var result struct {
+		Status map[string]interface{} `json:"status"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Bad JSON for %q: %s\n%s", query, err, rec.Body)
+	}
+	return result.Status
+}
+
+func TestIpValidSoftMinimum(t *testing.T) {
+	loadTestPersisted(t)
+	plain := ipValidJsonStatus(t, "")
+	soft := ipValidJsonStatus(t, "soft_minimum_version=1.1.4")
+	if soft["count"] != plain["count"] {
+		t.Fatalf("Soft minimum changed the count: %v -> %v", plain["count"], soft["count"])
+	}
+	if n, ok := soft["below_soft_min"].(float64); !ok || n < 1 {
+		t.Fatalf("Expected servers below soft minimum, got %v", soft["below_soft_min"])
+	}
+	if soft["soft_minimum_version"] != "1.1.4" {
+		t.Fatalf("Soft minimum not reported: %v", soft)
+	}
+
+	both := ipValidJsonStatus(t, "minimum_version=1.1.3&soft_minimum_version=1.1.4")
+	hard := ipValidJsonStatus(t, "minimum_version=1.1.3")
+	if both["count"] != hard["count"] {
+		t.Fatalf("Soft minimum changed the count under a hard minimum: %v -> %v", hard["count"], both["count"])
+	}
+	if both["below_soft_min"].(float64) >= soft["below_soft_min"].(float64) {
+		t.Fatalf("Hard minimum should have removed some soft-minimum servers: %v vs %v", both, soft)
+	}
+	covered := ipValidJsonStatus(t, "minimum_version=1.1.4&soft_minimum_version=1.1.4")
+	if covered["below_soft_min"].(float64) != 0 {
+		t.Fatalf("Servers below a soft minimum equal to the hard minimum: %v", covered)
+	}
+
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?stats&soft_minimum_version=1.1.4")
+	if !strings.Contains(rec.Body.String(), "STATS: keeping ") {
+		t.Fatalf("Stats do not list soft-minimum servers:\n%s", rec.Body)
+	}
+}
+
+func TestIpValidApiVersion(t *testing.T) {
+	loadTestPersisted(t)
+	for _, query := range []string{"json", "json&stats", "json&countries=XX"} {
+		rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?"+query)
+		var result struct {
+			FormatVersion int                    `json:"format_version"`
+			Status        map[string]interface{} `json:"status"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+			t.Fatalf("Bad JSON for %q: %s\n%s", query, err, rec.Body)
+		}
+		if result.FormatVersion != kIPGEN_FORMAT_VERSION || result.Status["api_version"] != kIPGEN_API_VERSION {
+			t.Fatalf("Versions missing for %q: %s", query, rec.Body)
+		}
+	}
+	for _, query := range []string{"", "countries=XX", "format=zone"} {
+		rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?"+query)
+		if !strings.Contains(rec.Body.String(), "api_version=1.1") {
+			t.Fatalf("No api_version for %q: %s", query, rec.Body)
+		}
+	}
+}
+
+func TestIpValidTrendAware(t *testing.T) {
+	previous := loadTestPersisted(t)
+	current := newTestPersisted(t)
+	var name string
+	for _, candidate := range current.Sorted {
+		node := current.HostMap[candidate]
+		if node.Keycount > *flKeysSanityMin && len(node.IpList) == 1 && node.Version != "1.0.10" {
+			name = candidate
+			break
+		}
+	}
+	if name == "" {
+		t.Fatalf("No suitable server in test data")
+	}
+	threshold := current.HostMap[name].Keycount
+	current.HostMap[name].Keycount = threshold - 10
+	previous.HostMap[name].Keycount = threshold - 100
+	SetCurrentPersisted(current)
+	ip := current.HostMap[name].IpList[0]
+	query := fmt.Sprintf("stats&threshold=%d", threshold)
+
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?"+query)
+	if strings.Contains(rec.Body.String(), "\n"+ip+"\n") {
+		t.Fatalf("Server below threshold included without trend_aware")
+	}
+	rec = testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?trend_aware&"+query)
+	body := rec.Body.String()
+	if !strings.Contains(body, "\n"+ip+"\n") {
+		t.Fatalf("Recovering server not included with trend_aware:\n%s", body)
+	}
+	if !strings.Contains(body, "recovering server <"+name+">") || !strings.Contains(body, "recovering=1") {
+		t.Fatalf("Recovering server not annotated:\n%s", body)
+	}
+
+	current.PreviousKeycounts[name] = threshold
+	rec = testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?trend_aware&"+query)
+	if strings.Contains(rec.Body.String(), "\n"+ip+"\n") {
+		t.Fatalf("Falling server included with trend_aware")
+	}
+}
+
+func TestIpValidReasonCodes(t *testing.T) {
+	loadTestPersisted(t)
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?countries=XX")
+	if !strings.Contains(rec.Body.String(), " reason_code=filtered_country ") {
+		t.Fatalf("No reason_code in text output: %s", rec.Body)
+	}
+	status := ipValidJsonStatus(t, "threshold=999999999")
+	if status["reason_code"] != kREASON_THRESHOLD_TOO_HIGH || status["reason"] != "threshold_too_high" {
+		t.Fatalf("Bad JSON reason: %v", status)
+	}
+
+	snakeCase := regexp.MustCompile(`^[a-z0-9]+(_[a-z0-9]+)*$`)
+	for _, code := range []string{kREASON_FIRST_SCAN, kREASON_GEOIP_UNAVAILABLE, kREASON_NO_BUCKETS,
+		kREASON_BROKEN_DATA, kREASON_THRESHOLD_TOO_HIGH, kREASON_FILTERED_QUARANTINE, kREASON_FILTERED_VERSION,
+		kREASON_FILTERED_COUNTRY, kREASON_FILTERED_PROXIES, kREASON_FILTERED_SERVER} {
+		if !snakeCase.MatchString(code) {
+			t.Fatalf("Reason code %q is not snake_case", code)
+		}
+	}
+}
+
+func TestIpValidQuarantineVersions(t *testing.T) {
+	loadTestPersisted(t)
+	saved := *flQuarantineVersions
+	defer func() { *flQuarantineVersions = saved }()
+
+	defaults := ipValidJsonStatus(t, "")
+	if fmt.Sprint(defaults["tags"]) != "[skip_1010 alg_5]" {
+		t.Fatalf("Default tags changed: %v", defaults["tags"])
+	}
+
+	*flQuarantineVersions = "1.1.3, 1.0.10"
+	more := ipValidJsonStatus(t, "")
+	if fmt.Sprint(more["tags"]) != "[skip_113 skip_1010 alg_5]" {
+		t.Fatalf("Bad tags for quarantined versions: %v", more["tags"])
+	}
+	if more["count"].(float64) >= defaults["count"].(float64) {
+		t.Fatalf("Quarantining 1.1.3 did not reduce count: %v -> %v", defaults["count"], more["count"])
+	}
+	if more["minimum"] != defaults["minimum"] {
+		t.Fatalf("Quarantined servers not kept for statistics: threshold %v -> %v", defaults["minimum"], more["minimum"])
+	}
+
+	*flQuarantineVersions = ""
+	none := ipValidJsonStatus(t, "")
+	if fmt.Sprint(none["tags"]) != "[alg_5]" || none["count"].(float64) < defaults["count"].(float64) {
+		t.Fatalf("Bad status with no quarantine: %v", none)
+	}
+}
+
+func TestIpValidExplain(t *testing.T) {
+	persisted := loadTestPersisted(t)
+	explain := func(query string) IpExplanation {
+		rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?json&"+query)
+		var result struct {
+			Explain IpExplanation `json:"explain"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+			t.Fatalf("Bad JSON for %q: %s\n%s", query, err, rec.Body)
+		}
+		return result.Explain
+	}
+
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid")
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	included := lines[1]
+	ex := explain("explain=" + included)
+	if !ex.Included || !ex.InBounds || !ex.PassedThreshold || ex.DroppedBy != "" || ex.Hostname == "" {
+		t.Fatalf("Bad explanation for included IP: %+v", ex)
+	}
+	ex = explain("explain=" + included + "&countries=XX")
+	if ex.Included || ex.DroppedBy != kREASON_FILTERED_COUNTRY {
+		t.Fatalf("Bad explanation for IP dropped by country: %+v", ex)
+	}
+
+	var old string
+	for _, name := range persisted.Sorted {
+		node := persisted.HostMap[name]
+		if node.Version == "1.0.10" && node.Keycount > *flKeysSanityMin && len(node.IpList) > 0 {
+			old = node.IpList[0]
+			break
+		}
+	}
+	if old == "" {
+		t.Fatalf("No v1.0.10 server in test data")
+	}
+	ex = explain("explain=" + old)
+	if ex.Included || ex.DroppedBy != kREASON_FILTERED_QUARANTINE {
+		t.Fatalf("Bad explanation for v1.0.10 IP: %+v", ex)
+	}
+
+	ex = explain("explain=192.0.2.1")
+	if ex.Included || ex.DroppedBy != "unknown" {
+		t.Fatalf("Bad explanation for unknown IP: %+v", ex)
+	}
+
+	rec = testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?explain="+included)
+	if !strings.HasPrefix(rec.Body.String(), "EXPLAIN: ip="+included+" ") {
+		t.Fatalf("No explanation in text output: %s", rec.Body)
+	}
+	rec = testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?explain=bogus")
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Bogus explain IP accepted")
+	}
+}
+
+func TestIpValidAbsoluteMin(t *testing.T) {
+	persisted := loadTestPersisted(t)
+	plain := ipValidJsonStatus(t, "")
+	if _, ok := plain["minimum_binding"]; ok {
+		t.Fatalf("Binding reported without absolute_min: %v", plain)
+	}
+	minimum := int(plain["minimum"].(float64))
+
+	loose := ipValidJsonStatus(t, fmt.Sprintf("absolute_min=%d", minimum-1))
+	if loose["minimum_binding"] != "statistical" || loose["count"] != plain["count"] {
+		t.Fatalf("Floor below the threshold changed the results: %v", loose)
+	}
+
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid")
+	included := make(map[string]bool)
+	for _, ip := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n")[1:] {
+		included[ip] = true
+	}
+	highest := 0
+	for _, node := range persisted.HostMap {
+		for _, ip := range node.IpList {
+			if included[ip] && node.Keycount > highest {
+				highest = node.Keycount
+			}
+		}
+	}
+	tight := ipValidJsonStatus(t, fmt.Sprintf("absolute_min=%d", highest))
+	if tight["minimum_binding"] != "absolute_min" || int(tight["minimum"].(float64)) != highest {
+		t.Fatalf("Floor above the threshold not binding: %v", tight)
+	}
+	if int(tight["statistical_minimum"].(float64)) != minimum {
+		t.Fatalf("Statistical threshold misreported: %v", tight)
+	}
+	if n := tight["count"].(float64); n < 1 || n >= plain["count"].(float64) {
+		t.Fatalf("Expected fewer servers with the floor, got %v of %v", n, plain["count"])
+	}
+
+	rec = testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?absolute_min=-1")
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Negative absolute_min accepted")
+	}
+}
+
+func TestComputeThresholdSplitFamily(t *testing.T) {
+	setupTestLogging()
+	onePerServer := make(map[string]int)
+	for i := 0; i < 5; i++ {
+		onePerServer[fmt.Sprintf("192.0.2.%d", i+1)] = 3200000 + i
+	}
+	// A lagging IPv6 cohort, which the combined statistics treat as outliers
+	for i := 0; i < 4; i++ {
+		onePerServer[fmt.Sprintf("2001:db8::%d", i+1)] = 3150000 + i
+	}
+	quiet := func(string, ...interface{}) {}
+	tunables := GetIpValidTunables()
+
+	combined, _, _ := computeThreshold("", onePerServer, onePerServer, tunables, nil, 0, false, quiet)
+	if combined == nil {
+		t.Fatalf("No combined threshold")
+	}
+	if _, ok := combined.inBounds["2001:db8::1"]; ok {
+		t.Fatalf("Lagging IPv6 server within combined bounds: %+v", combined)
+	}
+
+	v4, _, _ := computeThreshold("IPv4", ipsOfFamily(onePerServer, "IPv4"), ipsOfFamily(onePerServer, "IPv4"), tunables, nil, 0, false, quiet)
+	v6, _, _ := computeThreshold("IPv6", ipsOfFamily(onePerServer, "IPv6"), ipsOfFamily(onePerServer, "IPv6"), tunables, nil, 0, false, quiet)
+	if v4 == nil || v6 == nil {
+		t.Fatalf("Missing family threshold: %+v %+v", v4, v6)
+	}
+	if v4.threshold != combined.threshold {
+		t.Fatalf("IPv4 threshold %d dragged away from combined %d", v4.threshold, combined.threshold)
+	}
+	for ip, count := range ipsOfFamily(onePerServer, "IPv6") {
+		if _, ok := v6.inBounds[ip]; !ok || count < v6.threshold {
+			t.Fatalf("IPv6 server %s (%d) not passing its own threshold %d", ip, count, v6.threshold)
+		}
+	}
+}
+
+func TestIpValidSplitFamily(t *testing.T) {
+	loadTestPersisted(t)
+	plain := ipValidJsonStatus(t, "")
+	if _, ok := plain["split_family"]; ok {
+		t.Fatalf("split_family reported when not requested: %v", plain)
+	}
+	split := ipValidJsonStatus(t, "split_family")
+	if split["split_family"] != "1" || split["minimum_ipv4"] == nil || split["minimum_ipv6"] == nil {
+		t.Fatalf("Per-family thresholds missing: %v", split)
+	}
+
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?stats&split_family")
+	body := rec.Body.String()
+	for _, want := range []string{"[IPv4] threshold: ", "[IPv6] threshold: ", "[IPv6] largest bucket: mean="} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("Missing %q in stats:\n%s", want, body)
+		}
+	}
+	if !strings.Contains(body, "\n2001:") || !strings.Contains(body, "\n213.161.224.2\n") {
+		t.Fatalf("Expected addresses of both families:\n%s", body)
+	}
+}
+
+func TestIpValidLastKnownGood(t *testing.T) {
+	persisted := newTestPersisted(t)
+	SetCurrentPersisted(persisted)
+	if _, ok := ipValidJsonStatus(t, "")["last_known_good"]; ok {
+		t.Fatalf("last_known_good reported with only fresh data")
+	}
+	persisted.HostMap["keys.kfwebs.net"].LastGoodScan = time.Now().Add(-time.Hour)
+	if n := ipValidJsonStatus(t, "")["last_known_good"]; n != float64(1) {
+		t.Fatalf("Expected 1 server on last-known-good data, got %v", n)
+	}
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?stats")
+	if !strings.Contains(rec.Body.String(), "keeping 1 servers which failed this scan") {
+		t.Fatalf("Missing last-known-good stats line:\n%s", rec.Body)
+	}
+}
+
+func TestIpValidDetailed(t *testing.T) {
+	persisted := loadTestPersisted(t)
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?json&detailed")
+	var result struct {
+		Status map[string]interface{} `json:"status"`
+		IPs    []ipValidDetail        `json:"ips"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Bad JSON: %s\n%s", err, rec.Body)
+	}
+	if len(result.IPs) == 0 || result.Status["detailed"] != "1" {
+		t.Fatalf("No detailed results: %s", rec.Body)
+	}
+	for _, detail := range result.IPs {
+		if detail.IP == "" || detail.Keycount != persisted.HostMap[hostForTestIP(persisted, detail.IP)].Keycount {
+			t.Fatalf("Bad detail %+v", detail)
+		}
+	}
+
+	plain := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?json")
+	if !regexp.MustCompile(`"ips": \["[0-9a-f.:]+"`).Match(plain.Body.Bytes()) {
+		t.Fatalf("Default JSON no longer a list of strings:\n%s", plain.Body)
+	}
+
+	text := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?detailed").Body.String()
+	if !strings.Contains(text, "\n213.161.224.2 3169004\n") {
+		t.Fatalf("Keycount not appended in text format:\n%s", text)
+	}
+}
+
+func hostForTestIP(persisted *PersistedHostInfo, ip string) string {
+	for name, node := range persisted.HostMap {
+		for _, candidate := range node.IpList {
+			if candidate == ip {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+func TestIpValidOrderCountryKeycount(t *testing.T) {
+	persisted := newTestPersisted(t)
+	i := 0
+	for _, name := range persisted.Sorted {
+		for _, ip := range persisted.HostMap[name].IpList {
+			switch i % 4 {
+			case 0:
+				persisted.IPCountryMap[ip] = "US"
+			case 1:
+				persisted.IPCountryMap[ip] = "DE"
+			case 2:
+				persisted.IPCountryMap[ip] = kCOUNTRY_UNKNOWN
+			}
+			i += 1
+		}
+	}
+	SetCurrentPersisted(persisted)
+
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?json&detailed&order=country-keycount")
+	var result struct {
+		Status map[string]interface{} `json:"status"`
+		IPs    []ipValidDetail        `json:"ips"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Bad JSON: %s\n%s", err, rec.Body)
+	}
+	if result.Status["order"] != "country-keycount" || len(result.IPs) == 0 {
+		t.Fatalf("Bad result: %s", rec.Body)
+	}
+	group := func(ip string) string {
+		switch country := persisted.IPCountryMap[ip]; country {
+		case "", kCOUNTRY_UNKNOWN:
+			return "~unknown"
+		default:
+			return country
+		}
+	}
+	seen := make(map[string]bool)
+	for n := 1; n < len(result.IPs); n++ {
+		prev, cur := result.IPs[n-1], result.IPs[n]
+		seen[group(cur.IP)] = true
+		if group(prev.IP) > group(cur.IP) {
+			t.Fatalf("Country order broken at %d: %s (%s) before %s (%s)",
+				n, prev.IP, group(prev.IP), cur.IP, group(cur.IP))
+		}
+		if group(prev.IP) == group(cur.IP) && prev.Keycount < cur.Keycount {
+			t.Fatalf("Keycount order broken at %d: %+v before %+v", n, prev, cur)
+		}
+	}
+	if !seen["DE"] || !seen["US"] || !seen["~unknown"] {
+		t.Fatalf("Expected all groups in results, saw %v", seen)
+	}
+
+	for _, query := range []string{"order=bogus", "order=country-keycount&output=hostnames"} {
+		if rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?"+query); rec.Code != http.StatusBadRequest {
+			t.Fatalf("Query %q: got status %d, expected %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestIpValidExcludeServer(t *testing.T) {
+	persisted := loadTestPersisted(t)
+	plain := ipValidJsonStatus(t, "")
+	excluded := ipValidJsonStatus(t, "exclude_server=NGINX/0.7")
+	if excluded["exclude_server"] != "nginx/0.7" {
+		t.Fatalf("Exclusion pattern not in status: %v", excluded)
+	}
+	if excluded["count"].(float64) >= plain["count"].(float64) || excluded["minimum"] != plain["minimum"] {
+		t.Fatalf("Bad exclusion: %v -> %v", plain, excluded)
+	}
+
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?exclude_server=nginx/0.7")
+	for _, ip := range strings.Split(rec.Body.String(), "\n") {
+		if name := hostForTestIP(persisted, ip); name != "" && strings.HasPrefix(persisted.HostMap[name].ServerHeader, "nginx/0.7") {
+			t.Fatalf("Excluded server %s yielded as %s", name, ip)
+		}
+	}
+
+	// Alongside the proxies filter, not instead of it
+	proxies := ipValidJsonStatus(t, "proxies")
+	both := ipValidJsonStatus(t, "proxies&exclude_server=nginx")
+	if both["proxies"] != "1" || both["count"].(float64) >= proxies["count"].(float64) {
+		t.Fatalf("Exclusion not applied with proxies: %v -> %v", proxies, both)
+	}
+}
+
+func TestIpValidStatsStreamed(t *testing.T) {
+	loadTestPersisted(t)
+	for _, query := range []string{"stats", "stats&format=zone"} {
+		rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?"+query)
+		if !rec.Flushed {
+			t.Fatalf("Stats for %q not flushed", query)
+		}
+		lines := strings.Split(rec.Body.String(), "\n")
+		seenStatus := false
+		for _, line := range lines {
+			if strings.Contains(line, kIPGEN_STATUS_PREFIX) {
+				seenStatus = true
+			} else if strings.Contains(line, "STATS: ") && seenStatus {
+				t.Fatalf("Stats line after status for %q: %s", query, line)
+			}
+		}
+		if !seenStatus || !strings.Contains(lines[0], "STATS: ") {
+			t.Fatalf("Bad streamed output for %q:\n%s", query, rec.Body)
+		}
+	}
+	if rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?json&stats"); rec.Flushed {
+		t.Fatalf("JSON stats flushed early")
+	}
+
+	rec := httptest.NewRecorder()
+	streamer := newStatsStreamer(rec, "STATS: ")
+	streamer.Printf("first %d", 1)
+	if rec.Flushed {
+		t.Fatalf("Flushed within the interval")
+	}
+	streamer.lastFlush = streamer.lastFlush.Add(-kSTATS_FLUSH_INTERVAL)
+	streamer.Printf("second %d", 2)
+	if !rec.Flushed || rec.Body.String() != "STATS: first 1\nSTATS: second 2\n" {
+		t.Fatalf("Bad streamed stats, flushed=%v: %q", rec.Flushed, rec.Body)
+	}
+}
+
+func TestComputeThresholdTrustedFloor(t *testing.T) {
+	setupTestLogging()
+	onePerServer := make(map[string]int)
+	for i := 0; i < 5; i++ {
+		onePerServer[fmt.Sprintf("192.0.2.%d", i+1)] = 3200000 + i
+	}
+	quiet := func(string, ...interface{}) {}
+	tunables := GetIpValidTunables()
+	trusted := []int{3200000, 3200001, 3200002}
+
+	plain, _, _ := computeThreshold("", onePerServer, onePerServer, tunables, nil, 0, false, quiet)
+	floored, _, _ := computeThreshold("", onePerServer, onePerServer, tunables, trusted, 0, false, quiet)
+	if plain == nil || floored == nil || plain.threshold != floored.threshold {
+		t.Fatalf("Trusted floor changed a healthy threshold: %+v -> %+v", plain, floored)
+	}
+
+	// A flood of servers which are sane, but far behind
+	for i := 0; i < 20; i++ {
+		onePerServer[fmt.Sprintf("198.51.100.%d", i+1)] = 3100100 + i
+	}
+	poisoned, _, _ := computeThreshold("", onePerServer, onePerServer, tunables, nil, 0, false, quiet)
+	if poisoned == nil || poisoned.threshold > 3100200 {
+		t.Fatalf("Flood did not drag the threshold down: %+v", poisoned)
+	}
+	stats := make([]string, 0, 20)
+	statsf := func(s string, v ...interface{}) { stats = append(stats, fmt.Sprintf(s, v...)) }
+	floored, _, _ = computeThreshold("", onePerServer, onePerServer, tunables, append(trusted, 3000000), 0, true, statsf)
+	if floored == nil || floored.threshold < 3200000-tunables.DailyJitter-100 || floored.threshold > 3200000 {
+		t.Fatalf("Trusted floor not applied: %+v", floored)
+	}
+	if !strings.Contains(strings.Join(stats, "\n"), "trusted floor applied: threshold") {
+		t.Fatalf("Trusted floor not noted in stats:\n%s", strings.Join(stats, "\n"))
+	}
+}
+
+func TestIpValidMergeByNodename(t *testing.T) {
+	persisted := loadTestPersisted(t)
+	saved := *flMergeByNodename
+	defer func() { *flMergeByNodename = saved }()
+
+	cluster := make([]string, 0, 2)
+	for _, name := range persisted.Sorted {
+		if node := persisted.HostMap[name]; node.Keycount > 1 && len(node.IpList) > 0 && len(cluster) < 2 {
+			node.Settings = map[string]string{"Nodename": "Cluster.example.org"}
+			cluster = append(cluster, name)
+		}
+	}
+	serversLine := func() string {
+		rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?stats")
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			if strings.Contains(line, " servers in ") {
+				return line
+			}
+		}
+		t.Fatalf("No server count in stats:\n%s", rec.Body)
+		return ""
+	}
+	var before, after int
+	fmt.Sscanf(serversLine(), "STATS: have %d servers", &before)
+	*flMergeByNodename = true
+	fmt.Sscanf(serversLine(), "STATS: have %d servers", &after)
+	if after != before-1 {
+		t.Fatalf("Expected %d servers after merging %v, got %d", before-1, cluster, after)
+	}
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?stats")
+	want := fmt.Sprintf("merging server <%s> into <%s>", cluster[1], cluster[0])
+	if !strings.Contains(rec.Body.String(), want) {
+		t.Fatalf("Missing %q in stats:\n%s", want, rec.Body)
+	}
+}
+
+func TestIpValidGeoDns(t *testing.T) {
+	persisted := loadTestPersisted(t)
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?json")
+	var plain struct {
+		IPs []string `json:"ips"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &plain); err != nil || len(plain.IPs) < 2 {
+		t.Fatalf("Bad JSON: %v\n%s", err, rec.Body)
+	}
+	for i, ip := range plain.IPs {
+		persisted.IPCountryMap[ip] = []string{"DE", "NL", "US"}[i%3]
+	}
+	delete(persisted.IPCountryMap, plain.IPs[0])
+	persisted.IPCountryMap[plain.IPs[1]] = kCOUNTRY_UNKNOWN
+
+	rec = testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?format=geodns")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != ContentTypeJson {
+		t.Fatalf("Bad response %d %q: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+	var groups map[string][]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &groups); err != nil {
+		t.Fatalf("Bad JSON: %s\n%s", err, rec.Body)
+	}
+	seen := make(map[string]bool, len(plain.IPs))
+	for country, ips := range groups {
+		for _, ip := range ips {
+			if want := persisted.IPCountryMap[ip]; country != "unknown" && country != want {
+				t.Fatalf("IP %s in group %s, but country is %q", ip, country, want)
+			}
+			seen[ip] = true
+		}
+	}
+	if len(seen) != len(plain.IPs) {
+		t.Fatalf("GeoDNS has %d IPs, ip-valid %d", len(seen), len(plain.IPs))
+	}
+	if len(groups["unknown"]) != 2 {
+		t.Fatalf("Expected 2 IPs of unknown country: %v", groups["unknown"])
+	}
+
+	for _, query := range []string{"format=geodns&stats", "format=geodns&output=hostnames", "format=geodns&json"} {
+		if rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?"+query); rec.Code != http.StatusBadRequest {
+			t.Fatalf("Bad status %d for %q", rec.Code, query)
+		}
+	}
+	if rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?format=geodns&countries=XX"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Bad status %d with no IPs left: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestIpValidServers(t *testing.T) {
+	persisted := loadTestPersisted(t)
+	plain := ipValidJsonStatus(t, "")
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?json")
+	var flat struct {
+		IPs []string `json:"ips"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &flat); err != nil {
+		t.Fatalf("Bad JSON: %s\n%s", err, rec.Body)
+	}
+
+	rec = testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?format=servers&detailed")
+	var result struct {
+		Status  map[string]interface{} `json:"status"`
+		Servers []ipValidServer        `json:"servers"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Bad JSON: %s\n%s", err, rec.Body)
+	}
+	if result.Status["count_unit"] != "servers" || int(result.Status["ip_count"].(float64)) != len(flat.IPs) {
+		t.Fatalf("Bad status: %v", result.Status)
+	}
+	seen := make(map[string]bool, len(flat.IPs))
+	dualStack := 0
+	for _, server := range result.Servers {
+		node := persisted.HostMap[server.Hostname]
+		if node == nil || server.Keycount != node.Keycount {
+			t.Fatalf("Bad server entry %+v", server)
+		}
+		for _, ip := range server.IPv4 {
+			if ipFamily(ip) != "IPv4" {
+				t.Fatalf("%s listed as IPv4 for %s", ip, server.Hostname)
+			}
+			seen[ip] = true
+		}
+		for _, ip := range server.IPv6 {
+			if ipFamily(ip) != "IPv6" {
+				t.Fatalf("%s listed as IPv6 for %s", ip, server.Hostname)
+			}
+			seen[ip] = true
+		}
+		if len(server.IPv4) > 0 && len(server.IPv6) > 0 {
+			dualStack += 1
+		}
+	}
+	if len(seen) != len(flat.IPs) || len(flat.IPs) != int(plain["count"].(float64)) {
+		t.Fatalf("Servers give %d IPs, ip-valid %d", len(seen), len(flat.IPs))
+	}
+	if dualStack == 0 {
+		t.Fatalf("No dual-stack server in test data")
+	}
+
+	for _, query := range []string{"format=servers&output=hostnames", "format=servers&order=country-keycount"} {
+		if rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?"+query); rec.Code != http.StatusBadRequest {
+			t.Fatalf("Bad status %d for %q", rec.Code, query)
+		}
+	}
+}
+
+func TestIpValidSkipAnalyzeErrors(t *testing.T) {
+	persisted := loadTestPersisted(t)
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid")
+	included := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")[1]
+	var garbled string
+	for _, name := range persisted.Sorted {
+		for _, ip := range persisted.HostMap[name].IpList {
+			if ip == included {
+				garbled = name
+			}
+		}
+	}
+	persisted.HostMap[garbled].AnalyzeError = "analyze panic: index out of range"
+
+	saved := *flSkipAnalyzeErrors
+	defer func() { *flSkipAnalyzeErrors = saved }()
+	*flSkipAnalyzeErrors = false
+	rec = testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?stats")
+	if !strings.Contains(rec.Body.String(), "\n"+included+"\n") || strings.Contains(rec.Body.String(), "analyze error") {
+		t.Fatalf("Server with analyze error dropped without the flag:\n%s", rec.Body)
+	}
+
+	*flSkipAnalyzeErrors = true
+	rec = testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?stats&explain="+included)
+	body := rec.Body.String()
+	if strings.Contains(body, "\n"+included+"\n") {
+		t.Fatalf("Server with analyze error still yielded:\n%s", body)
+	}
+	if !strings.Contains(body, "excluded 1 servers with analyze errors") || !strings.Contains(body, "dropped_by=analyze_error") {
+		t.Fatalf("Exclusion not reported:\n%s", body)
+	}
+}
+
+func TestIpValidIncludeDown(t *testing.T) {
+	persisted := loadTestPersisted(t)
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?include_down")
+	if !strings.Contains(rec.Body.String(), "STATS: down: hosts which failed to become nodes aren't known") {
+		t.Fatalf("Missing note about JSON-loaded snapshot:\n%s", rec.Body)
+	}
+
+	persisted.DownHosts = map[string]string{
+		"gone.example.org":    "DNS: not found",
+		"refused.example.org": "fetch: connection refused",
+	}
+	rec = testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?include_down")
+	for _, want := range []string{
+		"STATS: down: 2 hosts queued this scan never became nodes\n",
+		"STATS: down: <gone.example.org> DNS: not found\n",
+		"STATS: down: <refused.example.org> fetch: connection refused\n",
+		"STATS: down: " + strconv.Itoa(persisted.Summary.Failed) + " hosts in the results failed analysis\n",
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Fatalf("Missing %q in:\n%s", want, rec.Body)
+		}
+	}
+
+	spider := newSpider()
+	spider.badDNS["gone.example.org"] = true
+	spider.dnsFailures["gone.example.org"] = "not found"
+	spider.queryErrors["refused.example.org"] = errors.New("connection refused")
+	spider.queryErrors["carried.example.org"] = errors.New("timeout")
+	down := spider.downHosts(HostMap{"carried.example.org": &SksNode{}})
+	if len(down) != 2 || down["gone.example.org"] != "DNS: not found" || down["refused.example.org"] != "fetch: connection refused" {
+		t.Fatalf("Bad down hosts: %v", down)
+	}
+}
+
+func TestComputeValidIPs(t *testing.T) {
+	setupTestLogging()
+	tunables := GetIpValidTunables()
+	simulated := func(hosts ...SimulatedHost) *PersistedHostInfo {
+		persisted, err := SimulatedPersisted(hosts)
+		if err != nil {
+			t.Fatalf("Simulating %+v: %s", hosts, err)
+		}
+		return persisted
+	}
+	abortCode := func(err error) string {
+		if err == nil {
+			return ""
+		}
+		abort, ok := err.(*IpValidAbort)
+		if !ok {
+			t.Fatalf("Error not an *IpValidAbort: %s", err)
+		}
+		return abort.Code
+	}
+
+	result, err := ComputeValidIPs(nil, tunables, IpValidOptions{Explain: "192.0.2.1"})
+	if abortCode(err) != kREASON_FIRST_SCAN {
+		t.Fatalf("No snapshot: got %v, expected %s", err, kREASON_FIRST_SCAN)
+	}
+	if result == nil || result.Explanation == nil || result.Explanation.IP != "192.0.2.1" {
+		t.Fatalf("No snapshot: lost the explanation, got %+v", result)
+	}
+
+	empty := simulated(SimulatedHost{Hostname: "empty.example.org", Keycount: 0, IPs: []string{"203.0.113.1"}})
+	if _, err := ComputeValidIPs(empty, tunables, IpValidOptions{}); abortCode(err) != kREASON_NO_BUCKETS {
+		t.Fatalf("No keycounts: got %v, expected %s", err, kREASON_NO_BUCKETS)
+	}
+
+	single := simulated(SimulatedHost{Hostname: "one.example.org", Version: "1.1.6", Keycount: 5000000,
+		IPs: []string{"203.0.113.1", "2a01:4f8::7"}, Country: "DE"})
+	result, err = ComputeValidIPs(single, tunables, IpValidOptions{})
+	if err != nil {
+		t.Fatalf("Single server: %s", err)
+	}
+	if len(result.IPs) != 2 || result.HostForIP["2a01:4f8::7"] != "one.example.org" {
+		t.Fatalf("Single server: got IPs %v, hosts %v", result.IPs, result.HostForIP)
+	}
+	if len(result.Stats) == 0 {
+		t.Fatalf("Single server: no stats collected")
+	}
+
+	hosts := make([]SimulatedHost, 0, 10)
+	for i := 0; i < 10; i++ {
+		hosts = append(hosts, SimulatedHost{
+			Hostname: fmt.Sprintf("sks%d.example.de", i),
+			Version:  "1.1.6",
+			Keycount: 5000000 + i,
+			IPs:      []string{fmt.Sprintf("203.0.113.%d", i+1)},
+			Country:  "DE",
+		})
+	}
+	mesh := simulated(hosts...)
+	result, err = ComputeValidIPs(mesh, tunables, IpValidOptions{LimitToCountries: NewCountrySet("DE")})
+	if err != nil || len(result.IPs) != len(hosts) {
+		t.Fatalf("All in one country: got %v, error %v", result.IPs, err)
+	}
+	if _, err := ComputeValidIPs(mesh, tunables, IpValidOptions{LimitToCountries: NewCountrySet("NL")}); abortCode(err) != kREASON_FILTERED_COUNTRY {
+		t.Fatalf("All in another country: got %v, expected %s", err, kREASON_FILTERED_COUNTRY)
+	}
+
+	result, err = ComputeValidIPs(mesh, tunables, IpValidOptions{OverrideThreshold: 5000005})
+	if err != nil {
+		t.Fatalf("Threshold override: %s", err)
+	}
+	if result.Threshold != 5000005 || len(result.IPs) != 5 {
+		t.Fatalf("Threshold override: got minimum %d with IPs %v", result.Threshold, result.IPs)
+	}
+	if _, err := ComputeValidIPs(mesh, tunables, IpValidOptions{OverrideThreshold: 6000000}); abortCode(err) != kREASON_THRESHOLD_TOO_HIGH {
+		t.Fatalf("Threshold above everything: got %v, expected %s", err, kREASON_THRESHOLD_TOO_HIGH)
+	}
+
+	var streamed int
+	result, err = ComputeValidIPs(mesh, tunables, IpValidOptions{
+		ShowStats: true,
+		Statsf:    func(string, ...interface{}) { streamed += 1 },
+	})
+	if err != nil || streamed == 0 || result.Stats != nil {
+		t.Fatalf("Streamed stats: %d streamed, %d collected, error %v", streamed, len(result.Stats), err)
+	}
+
+	// Taken from the options, whatever the flag says
+	mesh.HostMap["sks0.example.de"].AnalyzeError = "analyze panic: index out of range"
+	result, err = ComputeValidIPs(mesh, tunables, IpValidOptions{SkipAnalyzeErrors: true, Explain: "203.0.113.1"})
+	if err != nil || len(result.IPs) != len(hosts)-1 || result.Explanation.DroppedBy != "analyze_error" {
+		t.Fatalf("Skipping analyze errors: got %v, explained %s, error %v", result.IPs, result.Explanation, err)
+	}
+}
+
+func TestIpValidSanityMax(t *testing.T) {
+	setupTestLogging()
+	tunables := GetIpValidTunables()
+	hosts := make([]SimulatedHost, 0, 11)
+	for i := 0; i < 10; i++ {
+		hosts = append(hosts, SimulatedHost{
+			Hostname: fmt.Sprintf("sks%d.example.org", i),
+			Version:  "1.1.6",
+			Keycount: 5000000 + i,
+			IPs:      []string{fmt.Sprintf("203.0.113.%d", i+1)},
+		})
+	}
+	hosts = append(hosts, SimulatedHost{Hostname: "huge.example.org", Version: "1.1.6", Keycount: 2000000000,
+		IPs: []string{"203.0.113.99"}})
+	persisted, err := SimulatedPersisted(hosts)
+	if err != nil {
+		t.Fatalf("Simulating: %s", err)
+	}
+
+	result, err := ComputeValidIPs(persisted, tunables, IpValidOptions{Explain: "203.0.113.99"})
+	if err != nil {
+		t.Fatalf("With the sanity maximum: %s", err)
+	}
+	if len(result.IPs) != 10 || result.Explanation.DroppedBy != "high_keycount" {
+		t.Fatalf("Huge keycount not dropped: %v, explained %s", result.IPs, result.Explanation)
+	}
+	var noted bool
+	for _, line := range result.Stats {
+		if strings.Contains(line, "huge.example.org") && strings.Contains(line, "above the sanity maximum") {
+			noted = true
+		}
+	}
+	if !noted {
+		t.Fatalf("No stats note for the dropped server: %v", result.Stats)
+	}
+
+	tunables.TrustedServers = []string{"huge.example.org"}
+	result, err = ComputeValidIPs(persisted, tunables, IpValidOptions{})
+	if err != nil || len(result.IPs) != 10 {
+		t.Fatalf("Trusted server with a huge keycount set the floor: %v, error %v", result, err)
+	}
+	tunables.TrustedServers = nil
+
+	tunables.SanityMax = 0
+	result, err = ComputeValidIPs(persisted, tunables, IpValidOptions{Explain: "203.0.113.99"})
+	if err == nil && result.Explanation.DroppedBy == "high_keycount" {
+		t.Fatalf("Dropped as high keycount without a sanity maximum")
+	}
+}
+
+func TestIpValidSample(t *testing.T) {
+	persisted := loadTestPersisted(t)
+	SetCurrentPersisted(persisted)
+
+	full := ipValidJsonStatus(t, "")
+	first := ipValidJsonStatus(t, "sample=5&seed=42")
+	if first["count"].(float64) != 5 || first["sample"].(float64) != 5 || first["seed"] != "42" {
+		t.Fatalf("Bad sampled status %v", first)
+	}
+	rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?json&sample=5&seed=42")
+	again := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?json&sample=5&seed=42")
+	if a, b := ipValidJsonIPs(t, rec), ipValidJsonIPs(t, again); strings.Join(a, " ") != strings.Join(b, " ") {
+		t.Fatalf("Same seed gave different samples: %v and %v", a, b)
+	}
+	if all := ipValidJsonStatus(t, fmt.Sprintf("sample=%d", int(full["count"].(float64))+10)); all["count"] != full["count"] {
+		t.Fatalf("Sample larger than the pool changed the count: %v -> %v", full["count"], all["count"])
+	}
+	if servers := ipValidJsonStatus(t, "output=hostnames&sample=3"); servers["count"].(float64) != 3 {
+		t.Fatalf("Bad sampled hostnames status %v", servers)
+	}
+
+	for _, bad := range []string{"sample=0", "sample=lots", "sample=3&seed=x"} {
+		if rec := testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?"+bad); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: got status %d, expected %d", bad, rec.Code, http.StatusBadRequest)
+		}
+	}
+
+	// Weighted by keycount: the heavy item should win far more often
+	weights := map[string]int{"heavy": 9000000, "light": 1000000}
+	rng := rand.New(rand.NewSource(1))
+	var heavy int
+	for i := 0; i < 1000; i++ {
+		if sampleByKeycount([]string{"light", "heavy"}, 1, func(s string) int { return weights[s] }, rng)[0] == "heavy" {
+			heavy += 1
+		}
+	}
+	if heavy < 850 || heavy > 950 {
+		t.Fatalf("Heavy item chosen %d times of 1000, expected about 900", heavy)
+	}
+}
@@ -0,0 +1,68 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// The page exactly as the server sent it, for working out why Analyze() broke.
+// It includes the operator's contact, so is guarded like /contacts.
+func apiRawPage(w http.ResponseWriter, req *http.Request) {
+	if !*flPublicContacts {
+		adminHandler(kCONTACTS_SCOPE, serveRawPage)(w, req)
+		return
+	}
+	serveRawPage(w, req)
+}
+
+// Served as text so that a hostile page can't do anything in our origin.
+func serveRawPage(w http.ResponseWriter, req *http.Request) {
+	var err error
+	if err = req.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form information", http.StatusBadRequest)
+		return
+	}
+	peer := normalizeHostname(req.Form.Get("peer"))
+	if peer == "" {
+		http.Error(w, "Missing 'peer' parameter to query", http.StatusBadRequest)
+		return
+	}
+	if !*flKeepRawPages {
+		http.Error(w, "Raw pages are not being retained (see -keep-raw-pages)", http.StatusNotFound)
+		return
+	}
+	persisted := GetCurrentPersisted()
+	if persisted == nil {
+		http.Error(w, "Still awaiting data collection", http.StatusServiceUnavailable)
+		return
+	}
+	page, ok := persisted.RawPages[peer]
+	if !ok {
+		if canonical, ok2 := persisted.AliasMap[peer]; ok2 {
+			page, ok = persisted.RawPages[canonical]
+		}
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("No raw page retained for \"%s\"", peer), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", ContentTypeTextPlain)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(page)
+}
@@ -0,0 +1,107 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRawPageRetained(t *testing.T) {
+	setupTestLogging()
+	savedKeep, savedPort, savedPublic := *flKeepRawPages, *flSksPortHkp, *flPublicContacts
+	defer func() { *flKeepRawPages, *flSksPortHkp, *flPublicContacts = savedKeep, savedPort, savedPublic }()
+	*flKeepRawPages = true
+	*flPublicContacts = true
+
+	const body = "<html><body><h2>Not a stats page</h2></body></html>"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+	host, port := testServerHostPort(t, server)
+	*flSksPortHkp = port
+
+	spider := newSpider()
+	spider.shared.QueryHost(host)
+	spider.processHostResult(<-spider.shared.hostResult)
+	if string(spider.rawPages[host]) != body {
+		t.Fatalf("Raw page not retained for \"%s\": %q", host, spider.rawPages[host])
+	}
+
+	persisted := loadTestPersisted(t)
+	persisted.RawPages = spider.rawPages
+	persisted.AliasMap["alias.example.org"] = host
+	for _, peer := range []string{host, "alias.example.org"} {
+		rec := testGet(t, apiRawPage, SERVE_PREFIX+"/raw-page?peer="+peer)
+		if rec.Code != http.StatusOK || rec.Body.String() != body {
+			t.Fatalf("Bad raw page for \"%s\": %d %q", peer, rec.Code, rec.Body)
+		}
+		if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+			t.Fatalf("Raw page served as %q", rec.Header().Get("Content-Type"))
+		}
+	}
+	rec := testGet(t, apiRawPage, SERVE_PREFIX+"/raw-page?peer=unknown.example.org")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Unknown peer gave status %d", rec.Code)
+	}
+
+	*flKeepRawPages = false
+	node := &SksNode{Hostname: host}
+	if err := node.Fetch(); err != nil {
+		t.Fatalf("Fetch failed: %s", err)
+	}
+	if node.rawPage != nil {
+		t.Fatalf("Raw page retained without -keep-raw-pages")
+	}
+}
+
+func TestRawPageNeedsContactsScope(t *testing.T) {
+	persisted := loadTestPersisted(t)
+	persisted.RawPages = map[string][]byte{"keys.kfwebs.net": []byte("Server contact: admin@kfwebs.example")}
+	tokens, err := readAdminTokens(strings.NewReader("s3kr1t-contacts contacts\ns3kr1t-other other\n"))
+	if err != nil {
+		t.Fatalf("Failed to read tokens: %s", err)
+	}
+	savedTokens, savedKeep, savedPublic := adminTokens, *flKeepRawPages, *flPublicContacts
+	defer func() { adminTokens, *flKeepRawPages, *flPublicContacts = savedTokens, savedKeep, savedPublic }()
+	adminTokens = tokens
+	*flKeepRawPages = true
+	*flPublicContacts = false
+
+	get := func(token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", SERVE_PREFIX+"/raw-page?peer=keys.kfwebs.net", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		apiRawPage(rec, req)
+		return rec
+	}
+	if rec := get(""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Raw page served without a token: %d", rec.Code)
+	}
+	if rec := get("s3kr1t-other"); rec.Code != http.StatusForbidden {
+		t.Fatalf("Raw page served to a token without scope: %d", rec.Code)
+	}
+	if rec := get("s3kr1t-contacts"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "admin@kfwebs.example") {
+		t.Fatalf("Raw page not served with a contacts token: %d %q", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,633 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// Reports over the current persisted scan, for operators rather than for
+// the DNS-building clients.
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const kREPORT_DEFAULT_COUNT = 20
+
+// Common preamble for report pages: parse the form, get the current data or
+// complain that there is none.
+func reportSetup(w http.ResponseWriter, req *http.Request) *PersistedHostInfo {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form information", http.StatusBadRequest)
+		return nil
+	}
+	persisted := GetCurrentPersisted()
+	if persisted == nil {
+		http.Error(w, "Still awaiting data collection", http.StatusServiceUnavailable)
+		return nil
+	}
+	return persisted
+}
+
+func reportCount(req *http.Request) int {
+	count := kREPORT_DEFAULT_COUNT
+	if c, err := strconv.Atoi(req.Form.Get("count")); err == nil && c > 0 {
+		count = c
+	}
+	return count
+}
+
+func reportWriteJson(w http.ResponseWriter, req *http.Request, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		Log.Printf("Failed to marshal report to JSON: %s", err)
+		http.Error(w, "JSON encoding glitch", http.StatusInternalServerError)
+		return
+	}
+	contentType := ContentTypeJson
+	if _, ok := req.Form["textplain"]; ok {
+		contentType = ContentTypeTextPlain
+	}
+	w.Header().Set("Content-Type", contentType)
+	fmt.Fprintf(w, "%s\n", b)
+}
+
+type slowHost struct {
+	Hostname string  `json:"hostname"`
+	FetchMs  float64 `json:"fetch_ms"`
+}
+
+// Hosts which never returned a page have no duration and aren't listed;
+// they're on the main page as errors.
+func SlowestHosts(hostmap HostMap, count int) []slowHost {
+	hosts := make([]slowHost, 0, len(hostmap))
+	for name, node := range hostmap {
+		if node == nil || node.FetchDuration <= 0 {
+			continue
+		}
+		hosts = append(hosts, slowHost{Hostname: name, FetchMs: node.FetchDuration.Seconds() * 1000})
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if hosts[i].FetchMs != hosts[j].FetchMs {
+			return hosts[i].FetchMs > hosts[j].FetchMs
+		}
+		return hosts[i].Hostname < hosts[j].Hostname
+	})
+	if len(hosts) > count {
+		hosts = hosts[:count]
+	}
+	return hosts
+}
+
+func apiSlowHostsPage(w http.ResponseWriter, req *http.Request) {
+	persisted := reportSetup(w, req)
+	if persisted == nil {
+		return
+	}
+	reportWriteJson(w, req, map[string]interface{}{
+		"hosts": SlowestHosts(persisted.HostMap, reportCount(req)),
+	})
+}
+
+type VersionCount struct {
+	Version string  `json:"version"`
+	Count   int     `json:"count"`
+	Percent float64 `json:"percent"`
+}
+
+// Oldest first; versions we can't parse (including hosts which gave no
+// version at all) come last, in string order.
+func VersionDistribution(hostmap HostMap) []VersionCount {
+	counts := make(map[string]int, 20)
+	total := 0
+	for _, node := range hostmap {
+		if node == nil {
+			continue
+		}
+		counts[node.Version] += 1
+		total += 1
+	}
+	dist := make([]VersionCount, 0, len(counts))
+	for version, count := range counts {
+		dist = append(dist, VersionCount{
+			Version: version,
+			Count:   count,
+			Percent: 100 * float64(count) / float64(total),
+		})
+	}
+	sort.Slice(dist, func(i, j int) bool {
+		vi, vj := NewSksVersion(dist[i].Version), NewSksVersion(dist[j].Version)
+		switch {
+		case vi != nil && vj != nil:
+			return !vi.IsAtLeast(vj)
+		case vi != nil:
+			return true
+		case vj != nil:
+			return false
+		}
+		return dist[i].Version < dist[j].Version
+	})
+	return dist
+}
+
+func apiVersionsPage(w http.ResponseWriter, req *http.Request) {
+	persisted := reportSetup(w, req)
+	if persisted == nil {
+		return
+	}
+	dist := VersionDistribution(persisted.HostMap)
+	if _, ok := req.Form["json"]; ok {
+		reportWriteJson(w, req, map[string]interface{}{
+			"total":    len(persisted.HostMap),
+			"versions": dist,
+		})
+		return
+	}
+	w.Header().Set("Content-Type", ContentTypeTextPlain)
+	fmt.Fprintf(w, "%-12s %6s %7s\n", "Version", "Count", "Percent")
+	for _, vc := range dist {
+		version := vc.Version
+		if version == "" {
+			version = "(unknown)"
+		}
+		fmt.Fprintf(w, "%-12s %6d %6.2f%%\n", version, vc.Count, vc.Percent)
+	}
+	fmt.Fprintf(w, "%-12s %6d\n", "Total", len(persisted.HostMap))
+}
+
+func apiSharedIPsPage(w http.ResponseWriter, req *http.Request) {
+	persisted := reportSetup(w, req)
+	if persisted == nil {
+		return
+	}
+	shared := persisted.SharedIPs
+	if shared == nil {
+		shared = FindSharedIPs(persisted.HostMap, nil)
+	}
+	reportWriteJson(w, req, map[string]interface{}{
+		"count":      len(shared),
+		"shared_ips": shared,
+	})
+}
+
+type HostIdentity struct {
+	Canonical string   `json:"canonical"`
+	Aliases   []string `json:"aliases"`
+	IPs       []string `json:"ips"`
+	Distance  int      `json:"distance"`
+}
+
+// How the spider de-duplicated a host: any of its names gets the lot.
+func apiHostIdentityPage(w http.ResponseWriter, req *http.Request) {
+	persisted := reportSetup(w, req)
+	if persisted == nil {
+		return
+	}
+	peer := normalizeHostname(req.Form.Get("peer"))
+	if peer == "" {
+		http.Error(w, "Missing 'peer' parameter to query", http.StatusBadRequest)
+		return
+	}
+	canonical, ok := persisted.AliasMap[peer]
+	if !ok {
+		canonical = peer
+	}
+	node, ok := persisted.HostMap[canonical]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Host \"%s\" not known in current scan", peer), http.StatusNotFound)
+		return
+	}
+	identity := HostIdentity{
+		Canonical: canonical,
+		Aliases:   node.Aliases,
+		IPs:       node.IpList,
+		Distance:  node.Distance,
+	}
+	if identity.Aliases == nil {
+		identity.Aliases = []string{}
+	}
+	if identity.IPs == nil {
+		identity.IPs = []string{}
+	}
+	reportWriteJson(w, req, identity)
+}
+
+type HostRecordIP struct {
+	IP      string `json:"ip"`
+	Country string `json:"country,omitempty"`
+}
+
+type HostRecord struct {
+	Canonical string            `json:"canonical"`
+	Aliases   []string          `json:"aliases"`
+	IPs       []HostRecordIP    `json:"ips"`
+	Distance  int               `json:"distance"`
+	Error     string            `json:"error,omitempty"`
+	Mismatch  *HostnameMismatch `json:"hostname_mismatch,omitempty"`
+	Node      *SksNode          `json:"node"`
+}
+
+// An IP is looked for in each server's IpList, as the snapshot keeps no
+// other map of IPs to servers.
+func canonicalForPeer(persisted *PersistedHostInfo, peer string) (string, bool) {
+	if ip := net.ParseIP(peer); ip != nil {
+		for hostname, node := range persisted.HostMap {
+			for _, ipstr := range node.IpList {
+				if other := net.ParseIP(ipstr); other != nil && other.Equal(ip) {
+					return hostname, true
+				}
+			}
+		}
+		return "", false
+	}
+	canonical, ok := persisted.AliasMap[peer]
+	if !ok {
+		canonical = peer
+	}
+	_, ok = persisted.HostMap[canonical]
+	return canonical, ok
+}
+
+// Everything about one server, found by any of its names or IPs, for
+// troubleshooting.
+func apiHostRecordPage(w http.ResponseWriter, req *http.Request) {
+	persisted := reportSetup(w, req)
+	if persisted == nil {
+		return
+	}
+	peer := normalizeHostname(req.Form.Get("peer"))
+	if peer == "" {
+		http.Error(w, "Missing 'peer' parameter to query", http.StatusBadRequest)
+		return
+	}
+	canonical, ok := canonicalForPeer(persisted, peer)
+	if !ok {
+		if reason, down := persisted.DownHosts[peer]; down {
+			http.Error(w, fmt.Sprintf("Host \"%s\" never became a node in current scan: %s", peer, reason), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Host \"%s\" not known in current scan", peer), http.StatusNotFound)
+		return
+	}
+	node := persisted.HostMap[canonical]
+	record := HostRecord{
+		Canonical: canonical,
+		Aliases:   node.Aliases,
+		IPs:       make([]HostRecordIP, len(node.IpList)),
+		Distance:  node.Distance,
+		Error:     node.AnalyzeError,
+		Node:      publicNode(node),
+	}
+	if record.Aliases == nil {
+		record.Aliases = []string{}
+	}
+	for i, ip := range node.IpList {
+		record.IPs[i] = HostRecordIP{IP: ip, Country: persisted.IPCountryMap[ip]}
+	}
+	for i := range persisted.HostnameMismatches {
+		if persisted.HostnameMismatches[i].Queried == canonical {
+			record.Mismatch = &persisted.HostnameMismatches[i]
+			break
+		}
+	}
+	reportWriteJson(w, req, record)
+}
+
+// A server with IPs in several countries counts once in each; servers with
+// no known country aren't counted at all.
+func CountryServerCounts(p *PersistedHostInfo) map[string]int {
+	counts := make(map[string]int, 50)
+	for _, node := range p.HostMap {
+		seen := make(map[string]bool, 2)
+		for _, ip := range node.IpList {
+			country := p.IPCountryMap[ip]
+			if country == "" || country == kCOUNTRY_UNKNOWN || seen[country] {
+				continue
+			}
+			seen[country] = true
+			counts[country] += 1
+		}
+	}
+	return counts
+}
+
+type CountryDrift struct {
+	Country  string `json:"country"`
+	Current  int    `json:"current"`
+	Previous int    `json:"previous"`
+	Delta    int    `json:"delta"`
+}
+
+// Biggest movements first, whichever direction
+func CountryDistributionDrift(current, previous map[string]int) []CountryDrift {
+	drift := make([]CountryDrift, 0, len(current)+len(previous))
+	for country, count := range current {
+		drift = append(drift, CountryDrift{country, count, previous[country], count - previous[country]})
+	}
+	for country, count := range previous {
+		if _, ok := current[country]; !ok {
+			drift = append(drift, CountryDrift{country, 0, count, -count})
+		}
+	}
+	abs := func(i int) int {
+		if i < 0 {
+			return -i
+		}
+		return i
+	}
+	sort.Slice(drift, func(i, j int) bool {
+		if di, dj := abs(drift[i].Delta), abs(drift[j].Delta); di != dj {
+			return di > dj
+		}
+		return drift[i].Country < drift[j].Country
+	})
+	return drift
+}
+
+func apiCountryDriftPage(w http.ResponseWriter, req *http.Request) {
+	persisted := reportSetup(w, req)
+	if persisted == nil {
+		return
+	}
+	reportWriteJson(w, req, map[string]interface{}{
+		"have_previous": persisted.PreviousCountryCounts != nil,
+		"countries":     CountryDistributionDrift(CountryServerCounts(persisted), persisted.PreviousCountryCounts),
+	})
+}
+
+type ProxyCohort struct {
+	Servers      int     `json:"servers"`
+	Percent      float64 `json:"percent"`
+	WithKeycount int     `json:"with_keycount"`
+	Mean         float64 `json:"mean"`
+	StdDev       float64 `json:"stddev"`
+	Min          int     `json:"min"`
+	Max          int     `json:"max"`
+}
+
+// Proxied versus native, classified as for ip-valid's proxies filter; only
+// servers with a sane keycount contribute to the keycount statistics.
+func ProxyCohorts(hostmap HostMap) (proxied, native *ProxyCohort) {
+	proxied, native = &ProxyCohort{}, &ProxyCohort{}
+	keycounts := map[*ProxyCohort][]int{proxied: nil, native: nil}
+	for _, node := range hostmap {
+		cohort := proxied
+		if node.ServedNatively() {
+			cohort = native
+		}
+		cohort.Servers += 1
+		if node.Keycount > 1 {
+			keycounts[cohort] = append(keycounts[cohort], node.Keycount)
+		}
+	}
+	for cohort, counts := range keycounts {
+		if len(hostmap) > 0 {
+			cohort.Percent = 100 * float64(cohort.Servers) / float64(len(hostmap))
+		}
+		cohort.WithKeycount = len(counts)
+		if len(counts) == 0 {
+			continue
+		}
+		sort.Ints(counts)
+		cohort.Min, cohort.Max = counts[0], counts[len(counts)-1]
+		var sum float64
+		for _, count := range counts {
+			sum += float64(count)
+		}
+		cohort.Mean = sum / float64(len(counts))
+		for _, count := range counts {
+			d := float64(count) - cohort.Mean
+			cohort.StdDev += d * d
+		}
+		cohort.StdDev = math.Sqrt(cohort.StdDev / float64(len(counts)))
+	}
+	return proxied, native
+}
+
+func apiProxyCohortsPage(w http.ResponseWriter, req *http.Request) {
+	persisted := reportSetup(w, req)
+	if persisted == nil {
+		return
+	}
+	proxied, native := ProxyCohorts(persisted.HostMap)
+	reportWriteJson(w, req, map[string]interface{}{
+		"total":   len(persisted.HostMap),
+		"proxied": proxied,
+		"native":  native,
+	})
+}
+
+type FamilyCount struct {
+	Servers  int     `json:"servers"`
+	Fraction float64 `json:"fraction"`
+}
+
+func apiAddressFamiliesPage(w http.ResponseWriter, req *http.Request) {
+	persisted := reportSetup(w, req)
+	if persisted == nil {
+		return
+	}
+	var v4, v6, dual FamilyCount
+	for _, node := range persisted.HostMap {
+		if node.HasIPv4 {
+			v4.Servers += 1
+		}
+		if node.HasIPv6 {
+			v6.Servers += 1
+		}
+		if node.HasIPv4 && node.HasIPv6 {
+			dual.Servers += 1
+		}
+	}
+	if total := len(persisted.HostMap); total > 0 {
+		for _, fc := range []*FamilyCount{&v4, &v6, &dual} {
+			fc.Fraction = float64(fc.Servers) / float64(total)
+		}
+	}
+	reportWriteJson(w, req, map[string]interface{}{
+		"total":      len(persisted.HostMap),
+		"ipv4":       v4,
+		"ipv6":       v6,
+		"dual_stack": dual,
+	})
+}
+
+func apiHostnameMismatchesPage(w http.ResponseWriter, req *http.Request) {
+	persisted := reportSetup(w, req)
+	if persisted == nil {
+		return
+	}
+	mismatches := persisted.HostnameMismatches
+	if mismatches == nil {
+		mismatches = []HostnameMismatch{}
+	}
+	reportWriteJson(w, req, map[string]interface{}{
+		"count":      len(mismatches),
+		"mismatches": mismatches,
+	})
+}
+
+func apiSelfPeersPage(w http.ResponseWriter, req *http.Request) {
+	persisted := reportSetup(w, req)
+	if persisted == nil {
+		return
+	}
+	selfPeers := persisted.SelfPeers
+	if selfPeers == nil {
+		selfPeers = []SelfPeer{}
+	}
+	reportWriteJson(w, req, map[string]interface{}{
+		"count":      len(selfPeers),
+		"self_peers": selfPeers,
+	})
+}
+
+// Roughly one allocation to one customer, or at least one provider's subnet
+const (
+	kPREFIX_BITS_IPV4 = 24
+	kPREFIX_BITS_IPV6 = 48
+)
+
+type PrefixServers struct {
+	Prefix    string   `json:"prefix"`
+	Servers   int      `json:"servers"`
+	Hostnames []string `json:"hostnames"`
+}
+
+func ipPrefix(ipstr string) string {
+	return ipPrefixBits(ipstr, kPREFIX_BITS_IPV4, kPREFIX_BITS_IPV6)
+}
+
+func ipPrefixBits(ipstr string, bits4, bits6 int) string {
+	ip := net.ParseIP(ipstr)
+	if ip == nil {
+		return ""
+	}
+	bits, size := bits6, 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, size = ip4, bits4, 32
+	}
+	network := net.IPNet{IP: ip.Mask(net.CIDRMask(bits, size)), Mask: net.CIDRMask(bits, size)}
+	return network.String()
+}
+
+// Prefix to sorted canonical hostnames; a dual-stack server is in each of
+// its prefixes.
+func hostnamesByPrefix(hostmap HostMap, bits4, bits6 int) map[string][]string {
+	servers := make(map[string]map[string]bool, len(hostmap))
+	for name, node := range hostmap {
+		for _, ip := range node.IpList {
+			prefix := ipPrefixBits(ip, bits4, bits6)
+			if prefix == "" {
+				continue
+			}
+			if _, ok := servers[prefix]; !ok {
+				servers[prefix] = make(map[string]bool, 2)
+			}
+			servers[prefix][name] = true
+		}
+	}
+	byPrefix := make(map[string][]string, len(servers))
+	for prefix, names := range servers {
+		hostnames := make([]string, 0, len(names))
+		for name := range names {
+			hostnames = append(hostnames, name)
+		}
+		HostSort(hostnames)
+		byPrefix[prefix] = hostnames
+	}
+	return byPrefix
+}
+
+// Many servers in one prefix likely share a provider, and so an outage; a
+// dual-stack server counts once in each of its prefixes.  Most crowded
+// first.
+func PrefixConcentration(hostmap HostMap, count int) []PrefixServers {
+	byPrefix := hostnamesByPrefix(hostmap, kPREFIX_BITS_IPV4, kPREFIX_BITS_IPV6)
+	prefixes := make([]PrefixServers, 0, len(byPrefix))
+	for prefix, hostnames := range byPrefix {
+		prefixes = append(prefixes, PrefixServers{Prefix: prefix, Servers: len(hostnames), Hostnames: hostnames})
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if prefixes[i].Servers != prefixes[j].Servers {
+			return prefixes[i].Servers > prefixes[j].Servers
+		}
+		return prefixes[i].Prefix < prefixes[j].Prefix
+	})
+	if len(prefixes) > count {
+		prefixes = prefixes[:count]
+	}
+	return prefixes
+}
+
+func apiPrefixConcentrationPage(w http.ResponseWriter, req *http.Request) {
+	persisted := reportSetup(w, req)
+	if persisted == nil {
+		return
+	}
+	reportWriteJson(w, req, map[string]interface{}{
+		"prefixes": PrefixConcentration(persisted.HostMap, reportCount(req)),
+	})
+}
+
+// Which servers share a network, for peering and diversity planning: only
+// prefixes with more than one server are given, without a count limit.
+func CoLocatedServers(hostmap HostMap, bits4, bits6 int) map[string][]string {
+	groups := hostnamesByPrefix(hostmap, bits4, bits6)
+	for prefix, hostnames := range groups {
+		if len(hostnames) < 2 {
+			delete(groups, prefix)
+		}
+	}
+	return groups
+}
+
+func apiCoLocatedPage(w http.ResponseWriter, req *http.Request) {
+	persisted := reportSetup(w, req)
+	if persisted == nil {
+		return
+	}
+	bits4, bits6 := kPREFIX_BITS_IPV4, kPREFIX_BITS_IPV6
+	for _, param := range []struct {
+		name string
+		dest *int
+		max  int
+	}{
+		{"bits4", &bits4, 32},
+		{"bits6", &bits6, 128},
+	} {
+		value := req.Form.Get(param.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > param.max {
+			http.Error(w, fmt.Sprintf("Bad '%s' parameter, need a prefix length from 1 to %d", param.name, param.max),
+				http.StatusBadRequest)
+			return
+		}
+		*param.dest = n
+	}
+	reportWriteJson(w, req, map[string]interface{}{
+		"bits4":  bits4,
+		"bits6":  bits6,
+		"groups": CoLocatedServers(persisted.HostMap, bits4, bits6),
+	})
+}
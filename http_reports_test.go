@@ -0,0 +1,327 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowestHosts(t *testing.T) {
+	hostmap := HostMap{
+		"a.example.org": &SksNode{FetchDuration: 3 * time.Second},
+		"b.example.org": &SksNode{FetchDuration: 200 * time.Millisecond},
+		"c.example.org": &SksNode{FetchDuration: 9 * time.Second},
+		"d.example.org": &SksNode{},
+	}
+	slow := SlowestHosts(hostmap, 2)
+	if len(slow) != 2 || slow[0].Hostname != "c.example.org" || slow[1].Hostname != "a.example.org" {
+		t.Fatalf("Bad slowest hosts: %+v", slow)
+	}
+	if slow[0].FetchMs != 9000 {
+		t.Fatalf("Bad duration: %f", slow[0].FetchMs)
+	}
+	if len(SlowestHosts(hostmap, 10)) != 3 {
+		t.Fatalf("Host without a duration was listed")
+	}
+}
+
+func TestVersionDistribution(t *testing.T) {
+	hostmap := HostMap{
+		"a.example.org": &SksNode{Version: "1.1.4"},
+		"b.example.org": &SksNode{Version: "1.0.10"},
+		"c.example.org": &SksNode{Version: "1.1.4+"},
+		"d.example.org": &SksNode{Version: "1.1.4"},
+		"e.example.org": &SksNode{Version: ""},
+		"f.example.org": &SksNode{Version: "1.1.10"},
+	}
+	dist := VersionDistribution(hostmap)
+	order := []string{"1.0.10", "1.1.4", "1.1.4+", "1.1.10", ""}
+	if len(dist) != len(order) {
+		t.Fatalf("Expected %d versions, got %+v", len(order), dist)
+	}
+	for i := range order {
+		if dist[i].Version != order[i] {
+			t.Fatalf("Position %d: expected version %q, got %q", i, order[i], dist[i].Version)
+		}
+	}
+	if dist[1].Count != 2 || dist[1].Percent < 33.3 || dist[1].Percent > 33.4 {
+		t.Fatalf("Bad count for 1.1.4: %+v", dist[1])
+	}
+}
+
+func TestFindSharedIPs(t *testing.T) {
+	setupTestLogging()
+	hostmap := HostMap{
+		"a.example.org": &SksNode{IpList: []string{"192.0.2.1", "2001:db8::1"}},
+		"b.example.org": &SksNode{IpList: []string{"192.0.2.2"}},
+		"c.example.org": &SksNode{IpList: []string{"192.0.2.3", "2001:db8::1"}},
+	}
+	knownIPs := map[string]string{
+		"192.0.2.1":  "a.example.org",
+		"192.0.2.2":  "c.example.org",
+		"192.0.2.3":  "c.example.org",
+		"192.0.2.99": "failed.example.org",
+	}
+	shared := FindSharedIPs(hostmap, knownIPs)
+	if len(shared) != 2 {
+		t.Fatalf("Expected 2 shared IPs, got %+v", shared)
+	}
+	if shared[0].IP != "192.0.2.2" || strings.Join(shared[0].Hostnames, " ") != "b.example.org c.example.org" {
+		t.Fatalf("Bad first shared IP: %+v", shared[0])
+	}
+	if shared[1].IP != "2001:db8::1" || strings.Join(shared[1].Hostnames, " ") != "a.example.org c.example.org" {
+		t.Fatalf("Bad second shared IP: %+v", shared[1])
+	}
+	if len(FindSharedIPs(HostMap{"b.example.org": hostmap["b.example.org"]}, nil)) != 0 {
+		t.Fatalf("Shared IPs found with only one host")
+	}
+}
+
+func TestHostIdentity(t *testing.T) {
+	loadTestPersisted(t)
+	for _, peer := range []string{"keyserver.computer42.org", "SKS.kserver.EU."} {
+		rec := testGet(t, apiHostIdentityPage, SERVE_PREFIX+"/host-identity?peer="+peer)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Lookup of \"%s\" failed: %d %s", peer, rec.Code, rec.Body)
+		}
+		var identity HostIdentity
+		if err := json.Unmarshal(rec.Body.Bytes(), &identity); err != nil {
+			t.Fatalf("Bad JSON for \"%s\": %s", peer, err)
+		}
+		if identity.Canonical != "keyserver.computer42.org" || strings.Join(identity.Aliases, " ") != "sks.kserver.eu" ||
+			len(identity.IPs) != 2 || identity.Distance != 2 {
+			t.Fatalf("Bad identity for \"%s\": %+v", peer, identity)
+		}
+	}
+	rec := testGet(t, apiHostIdentityPage, SERVE_PREFIX+"/host-identity?peer=unknown.example.org")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Unknown host gave status %d", rec.Code)
+	}
+}
+
+func TestHostRecord(t *testing.T) {
+	persisted := newTestPersisted(t)
+	node := persisted.HostMap["keyserver.computer42.org"]
+	node.AdminContact = "admin@computer42.example"
+	node.Settings = map[string]string{"Hostname": "keyserver.computer42.org", "Server contact": node.AdminContact}
+	persisted.IPCountryMap[node.IpList[0]] = "DE"
+	persisted.DownHosts = map[string]string{"gone.example.org": "DNS: not found"}
+	SetCurrentPersisted(persisted)
+	savedPublic := *flPublicContacts
+	defer func() { *flPublicContacts = savedPublic }()
+	*flPublicContacts = false
+
+	for _, peer := range []string{"SKS.kserver.EU.", node.IpList[1]} {
+		rec := testGet(t, apiHostRecordPage, SERVE_PREFIX+"/host-record?peer="+peer)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Lookup of \"%s\" failed: %d %s", peer, rec.Code, rec.Body)
+		}
+		var record HostRecord
+		if err := json.Unmarshal(rec.Body.Bytes(), &record); err != nil {
+			t.Fatalf("Bad JSON for \"%s\": %s", peer, err)
+		}
+		if record.Canonical != "keyserver.computer42.org" || len(record.IPs) != 2 || record.Distance != 2 ||
+			record.Node == nil || record.Node.Keycount != node.Keycount {
+			t.Fatalf("Bad record for \"%s\": %+v", peer, record)
+		}
+		if record.IPs[0].Country != "DE" {
+			t.Fatalf("Country missing: %+v", record.IPs)
+		}
+		if strings.Contains(rec.Body.String(), "admin@computer42.example") {
+			t.Fatalf("Contact not redacted: %s", rec.Body)
+		}
+	}
+	if node.AdminContact == "" || node.Settings["Server contact"] == "" {
+		t.Fatalf("Redaction changed the snapshot")
+	}
+
+	rec := testGet(t, apiHostRecordPage, SERVE_PREFIX+"/host-record?peer=gone.example.org")
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "DNS: not found") {
+		t.Fatalf("Down host gave %d: %s", rec.Code, rec.Body)
+	}
+	rec = testGet(t, apiHostRecordPage, SERVE_PREFIX+"/host-record?peer=192.0.2.99")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Unknown IP gave status %d", rec.Code)
+	}
+}
+
+func TestCountryDrift(t *testing.T) {
+	previous := &PersistedHostInfo{
+		HostMap: HostMap{
+			"a.example.org": &SksNode{IpList: []string{"192.0.2.1", "2001:db8::1"}},
+			"b.example.org": &SksNode{IpList: []string{"192.0.2.2"}},
+			"c.example.org": &SksNode{IpList: []string{"192.0.2.3"}},
+		},
+		IPCountryMap: IPCountryMap{"192.0.2.1": "DE", "2001:db8::1": "DE", "192.0.2.2": "NL", "192.0.2.3": "US"},
+	}
+	counts := CountryServerCounts(previous)
+	if counts["DE"] != 1 || counts["NL"] != 1 || counts["US"] != 1 || len(counts) != 3 {
+		t.Fatalf("Bad country counts: %v", counts)
+	}
+
+	drift := CountryDistributionDrift(map[string]int{"DE": 4, "NL": 1, "FR": 1}, counts)
+	got := make([]string, len(drift))
+	for i, d := range drift {
+		got[i] = fmt.Sprintf("%s:%d", d.Country, d.Delta)
+	}
+	if strings.Join(got, " ") != "DE:3 FR:1 US:-1 NL:0" {
+		t.Fatalf("Bad drift order: %v", got)
+	}
+
+	loadTestPersisted(t)
+	rec := testGet(t, apiCountryDriftPage, SERVE_PREFIX+"/country-drift")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"countries"`) {
+		t.Fatalf("Bad country-drift page: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestProxyCohorts(t *testing.T) {
+	hostmap := HostMap{
+		"native.example.org":  &SksNode{ServerHeader: "sks_www/1.1.4", Keycount: 3000000},
+		"gnuks.example.org":   &SksNode{ServerHeader: "GnuKS/0.1", Keycount: 3000200},
+		"via.example.org":     &SksNode{ServerHeader: "sks_www/1.1.4", ViaHeader: "1.1 proxy", Keycount: 3000100},
+		"nginx.example.org":   &SksNode{ServerHeader: "nginx/1.2.1", Keycount: 3000300},
+		"unknown.example.org": &SksNode{ServerHeader: "nginx", Keycount: -2},
+	}
+	proxied, native := ProxyCohorts(hostmap)
+	if native.Servers != 2 || native.WithKeycount != 2 || native.Mean != 3000100 || native.StdDev != 100 {
+		t.Fatalf("Bad native cohort: %+v", native)
+	}
+	if proxied.Servers != 3 || proxied.WithKeycount != 2 || proxied.Min != 3000100 || proxied.Max != 3000300 ||
+		proxied.Percent != 60 {
+		t.Fatalf("Bad proxied cohort: %+v", proxied)
+	}
+}
+
+func TestAddressFamilies(t *testing.T) {
+	persisted := loadTestPersisted(t)
+	if node := persisted.HostMap["keys.kfwebs.net"]; !node.HasIPv4 || !node.HasIPv6 {
+		t.Fatalf("Dual-stack host not flagged: %+v", node)
+	}
+	if node := persisted.HostMap["odin.stueve.us"]; node.HasIPv4 || !node.HasIPv6 {
+		t.Fatalf("IPv6-only host misflagged: %+v", node)
+	}
+
+	rec := testGet(t, apiAddressFamiliesPage, SERVE_PREFIX+"/address-families")
+	var result struct {
+		Total     int         `json:"total"`
+		IPv6      FamilyCount `json:"ipv6"`
+		DualStack FamilyCount `json:"dual_stack"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Bad JSON: %s\n%s", err, rec.Body)
+	}
+	if result.Total != 84 || result.IPv6.Servers != 45 || result.DualStack.Servers != 44 ||
+		result.IPv6.Fraction != 45.0/84 {
+		t.Fatalf("Bad address family summary: %+v", result)
+	}
+}
+
+func TestPrefixConcentration(t *testing.T) {
+	for ip, want := range map[string]string{
+		"192.0.2.77":              "192.0.2.0/24",
+		"2001:db8:1234:5678::1":   "2001:db8:1234::/48",
+		"::ffff:198.51.100.1":     "198.51.100.0/24",
+		"not-an-ip":               "",
+		"2001:db8:1234:ffff::abc": "2001:db8:1234::/48",
+	} {
+		if got := ipPrefix(ip); got != want {
+			t.Fatalf("Prefix of %s: got %q, expected %q", ip, got, want)
+		}
+	}
+
+	hostmap := HostMap{
+		"a.example.org": {IpList: []string{"192.0.2.1", "2001:db8:1::1"}},
+		"b.example.org": {IpList: []string{"192.0.2.2"}},
+		"c.example.org": {IpList: []string{"192.0.2.3", "192.0.2.4"}},
+		"d.example.net": {IpList: []string{"198.51.100.1", "2001:db8:1:2::1"}},
+	}
+	prefixes := PrefixConcentration(hostmap, 10)
+	if len(prefixes) != 3 {
+		t.Fatalf("Expected 3 prefixes, got %+v", prefixes)
+	}
+	if p := prefixes[0]; p.Prefix != "192.0.2.0/24" || p.Servers != 3 || len(p.Hostnames) != 3 {
+		t.Fatalf("Bad most crowded prefix: %+v", p)
+	}
+	if p := prefixes[1]; p.Prefix != "2001:db8:1::/48" || p.Servers != 2 {
+		t.Fatalf("Bad second prefix: %+v", p)
+	}
+	if limited := PrefixConcentration(hostmap, 1); len(limited) != 1 {
+		t.Fatalf("Count not applied: %+v", limited)
+	}
+
+	loadTestPersisted(t)
+	rec := testGet(t, apiPrefixConcentrationPage, SERVE_PREFIX+"/prefix-concentration?count=5")
+	var result struct {
+		Prefixes []PrefixServers `json:"prefixes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Bad JSON: %s\n%s", err, rec.Body)
+	}
+	if len(result.Prefixes) != 5 || result.Prefixes[0].Servers < result.Prefixes[4].Servers {
+		t.Fatalf("Bad prefix report: %+v", result.Prefixes)
+	}
+}
+
+func TestCoLocatedServers(t *testing.T) {
+	hostmap := HostMap{
+		"a.example.org": {IpList: []string{"192.0.2.1", "2001:db8:1::1"}},
+		"b.example.org": {IpList: []string{"192.0.2.130"}},
+		"c.example.org": {IpList: []string{"198.51.100.1"}},
+		"d.example.net": {IpList: []string{"2001:db8:1:2::1"}},
+	}
+	groups := CoLocatedServers(hostmap, 24, 48)
+	if len(groups) != 2 || len(groups["192.0.2.0/24"]) != 2 || len(groups["2001:db8:1::/48"]) != 2 {
+		t.Fatalf("Bad groups at /24 and /48: %v", groups)
+	}
+	groups = CoLocatedServers(hostmap, 25, 64)
+	if len(groups) != 0 {
+		t.Fatalf("Groups at /25 and /64 should be singletons: %v", groups)
+	}
+	groups = CoLocatedServers(hostmap, 8, 32)
+	if hostnames := groups["192.0.0.0/8"]; len(hostnames) != 2 || hostnames[0] != "a.example.org" {
+		t.Fatalf("Bad group at /8: %v", groups)
+	}
+
+	loadTestPersisted(t)
+	rec := testGet(t, apiCoLocatedPage, SERVE_PREFIX+"/co-located?bits4=16")
+	var result struct {
+		Bits4  int                 `json:"bits4"`
+		Groups map[string][]string `json:"groups"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Bad JSON: %s\n%s", err, rec.Body)
+	}
+	if result.Bits4 != 16 || len(result.Groups) == 0 {
+		t.Fatalf("Bad co-located report: %s", rec.Body)
+	}
+	for prefix, hostnames := range result.Groups {
+		if len(hostnames) < 2 {
+			t.Fatalf("Singleton group %s: %v", prefix, hostnames)
+		}
+	}
+	for _, bad := range []string{"bits4=0", "bits4=33", "bits6=129", "bits6=lots"} {
+		if rec := testGet(t, apiCoLocatedPage, SERVE_PREFIX+"/co-located?"+bad); rec.Code != http.StatusBadRequest {
+			t.Fatalf("Bad parameter %q accepted: %d", bad, rec.Code)
+		}
+	}
+}
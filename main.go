@@ -20,7 +20,6 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"math/rand"
 	"os"
 	"os/signal"
 	"runtime"
@@ -41,10 +40,19 @@ var (
 	flSksPortHkp         = flag.Int("sks-port-hkp", 11371, "Default SKS HKP port")
 	flTimeoutStatsFetch  = flag.Int("timeout-stats-fetch", 30, "Timeout for fetching stats from a remote server")
 	flCountriesZone      = flag.String("countries-zone", "zz.countries.nerd.dk.", "DNS zone for determining IP locations")
+	flGeoIPDatabase      = flag.String("geoip-db", "", "MaxMind .mmdb database for IP locations, instead of -countries-zone")
 	flKeysSanityMin      = flag.Int("keys-sanity-min", 3100000, "Minimum number of keys that's sane, or we're broken")
+	flKeysSanityMax      = flag.Int("keys-sanity-max", 100000000, "Servers claiming more keys than this are left out of ip-valid entirely; 0 for no limit")
+	flQuarantineVersions = flag.String("quarantine-versions", "1.0.10", "Comma-separated SKS versions counted in ip-valid stats but not yielded")
+	flTrustedServers     = flag.String("trusted-servers", "", "Comma-separated known-good servers whose keycounts put a floor under the ip-valid threshold")
+	flSkipAnalyzeErrors  = flag.Bool("skip-analyze-errors", false, "Leave servers whose stats page had an analyze error out of ip-valid entirely")
+	flMergeByNodename    = flag.Bool("merge-by-nodename", false, "Weight servers reporting the same Nodename as one in ip-valid stats; may over-merge")
 	flKeysDailyJitter    = flag.Int("keys-daily-jitter", 500, "Max daily jitter in key count")
 	flScanIntervalSecs   = flag.Int("scan-interval", 3600*8, "How often to trigger a scan")
 	flScanIntervalJitter = flag.Int("scan-interval-jitter", 120, "Jitter in scan interval")
+	flMaxScanDuration    = flag.Duration("max-scan-duration", 0, "Stop taking on new hosts once a scan has run this long (0: unlimited)")
+	flMinScanHosts       = flag.Int("min-scan-hosts", 10, "Don't install a scan cut short by -max-scan-duration with fewer hosts than this")
+	flMinHostFraction    = flag.Float64("min-host-fraction", 0, "Reject a scan with fewer hosts than this fraction of the current one, keeping it on standby (0: never)")
 	flLogFile            = flag.String("log-file", "sksdaemon.log", "Where to write logfiles")
 	flLogStdout          = flag.Bool("log-stdout", false, "Log to stdout instead of log-file")
 	flJsonDump           = flag.String("json-dump", "", "File to dump JSON of spidered hosts to")
@@ -52,6 +60,47 @@ var (
 	flJsonPersistPath    = flag.String("json-persist", "", "File to load at startup if exists, and write to at SIGUSR1")
 	flStartedFlagfile    = flag.String("started-file", "", "Create this file after started and running")
 	flHttpFetchTimeout   = flag.Duration("http-fetch-timeout", 2*time.Minute, "Timeout for HTTP fetch from SKS servers")
+	flHttpDialTimeout    = flag.Duration("http-dial-timeout", 15*time.Second, "Timeout for connecting to SKS servers, within -http-fetch-timeout")
+	flHttpTlsTimeout     = flag.Duration("http-tls-timeout", 15*time.Second, "Timeout for TLS handshakes with SKS servers or proxies")
+	flHttpHeaderTimeout  = flag.Duration("http-header-timeout", time.Minute, "Timeout waiting for response headers once a request is sent")
+	flMaxConcurrentDNS   = flag.Int("max-concurrent-dns", 32, "Most DNS lookups of hostnames to have in flight at once (0: unlimited)")
+	flDnsRetries         = flag.Int("dns-retries", 2, "How many times to retry a temporary DNS failure")
+	flDnsRetryBackoff    = flag.Duration("dns-retry-backoff", 5*time.Second, "Delay before first DNS retry, doubling each time")
+	flNormalizeIPv6      = flag.Bool("normalize-ipv6", true, "Store and give IPv6 addresses in canonical compressed form, so that one address has one form")
+	flFailedQuietPeriod  = flag.Duration("failed-quiet-period", 0, "Fetch a host again when listed this long after its fetch failed in the same scan (0: never)")
+	flDnsCnames          = flag.Bool("dns-cnames", false, "Also look up CNAMEs, to merge hosts which are aliases in DNS before de-duplicating by IP")
+	flHttpProxy          = flag.String("http-proxy", "", "Proxy URL for fetching stats pages (default: from $HTTP_PROXY etc)")
+	flSocksProxy         = flag.String("socks-proxy", "", "SOCKS5 proxy host:port for fetching stats pages, eg Tor; .onion hosts are then spidered")
+	flPoolHostname       = flag.String("pool-hostname", "", "Pool name in DNS for /sks-peers/pool-diff to compare with the current ip-valid set")
+	flZoneOwner          = flag.String("zone-owner", "@", "Default owner name for ip-valid format=zone records")
+	flZoneTTL            = flag.Int("zone-ttl", 3600, "Default TTL for ip-valid format=zone records")
+	flStatsPaths         = flag.String("stats-paths", kDEFAULT_STATS_PATH, "Comma-separated paths to try in turn for each server's stats page")
+	flStatsPathsFile     = flag.String("stats-paths-file", "", "File of hostname/stats-paths pairs overriding -stats-paths per host")
+	flMaxRedirects       = flag.Int("max-redirects", 0, "Follow this many redirects when fetching a stats page (0: treat any redirect as a failure)")
+	flMaxBodyBytes       = flag.Int64("max-body-bytes", 4<<20, "Maximum size of stats page to accept from an SKS server")
+	flAdminTokensFile    = flag.String("admin-tokens-file", "", "File of tokens (and their scopes) for admin URIs")
+	flPurgeAfterFailures = flag.Int("purge-after-failures", 0, "Drop hosts failing this many consecutive scans (0: never)")
+	flPurgeAfterAge      = flag.Duration("purge-after-age", 0, "Drop hosts failing continuously for this long (0: never)")
+	flGraceScans         = flag.Int("grace-scans", 0, "Keep last-known-good data for hosts failing up to this many consecutive scans (0: off)")
+	flGraceAge           = flag.Duration("grace-age", 0, "Keep last-known-good data for hosts failing for up to this long (0: off)")
+	flStaticScans        = flag.Int("static-keycount-scans", 3, "Flag servers whose keycount is unchanged over this many scans while the mesh grows")
+	flSkipSuffixes       = flag.String("skip-suffixes", ".onion,.i2p,.local", "Comma-separated hostname suffixes never to look up in DNS")
+	flCrawlSuffixes      = flag.String("crawl-suffixes", "", "Comma-separated hostname suffixes; only follow gossip peers under these")
+	flPinnedHosts        = flag.String("pinned-hosts", "", "Comma-separated hosts always scanned and kept, never purged or pruned, even when unreachable")
+	flKeepNearest        = flag.Int("keep-nearest", 0, "Keep only this many hosts nearest the seeds in each scan's results (0: all)")
+	flMaxConsidering     = flag.Int("max-hostnames", 20000, "Most distinct hostnames to consider in one scan (0: unlimited)")
+	flMaxPeersPerHost    = flag.Int("max-peers-per-host", 1000, "Most gossip peers to follow from any one server (0: unlimited)")
+	flAnnotationsFile    = flag.String("annotations-file", "", "File of hostname/note pairs to show alongside hosts")
+	flCountryRetries     = flag.Int("country-retries", 2, "How many times to retry a failed country lookup")
+	flCountryBatch       = flag.Int("country-batch", 0, "With -geoip-db, look up countries for this many IPs per go-routine (0: one per IP)")
+	flRespectRobots      = flag.Bool("respect-robots", false, "Honour each server's robots.txt before fetching its stats page")
+	flLogScanPhases      = flag.Bool("log-scan-phases", true, "Log the time each scan spent on DNS, fetches and country lookups")
+	flDiagnosticsDir     = flag.String("diagnostics-dir", os.TempDir(), "Where to write the diagnostics dump taken on SIGUSR2")
+	flKeepRawPages       = flag.Bool("keep-raw-pages", false, "Retain each server's raw stats page, for debugging parse failures")
+	flPublicContacts     = flag.Bool("public-contacts", false, "Serve server operators' contacts to all, not just to admin tokens with scope \"contacts\"")
+	flScanWebhook        = flag.String("scan-webhook", "", "URL to POST a JSON summary to after each scan")
+	flScanWebhookSecret  = flag.String("scan-webhook-secret-file", "", "File holding the key for signing -scan-webhook requests")
+	flScanHistoryDB      = flag.String("scan-history-db", "", "SQLite database to record each scan's hosts in, for querying history (needs -tags sqlite)")
 )
 
 var serverHeadersNative = map[string]bool{
@@ -90,8 +139,30 @@ type PersistedHostInfo struct {
 	DepthSorted  []string
 	Graph        *HostGraph
 	Timestamp    time.Time
+	RawPages     map[string][]byte // only with -keep-raw-pages
+	SharedIPs    []SharedIP
+	Summary      *ScanSummary
+	// Keycounts from the snapshot this one replaced, for spotting trends
+	PreviousKeycounts map[string]int
+	// Likewise, servers per country
+	PreviousCountryCounts map[string]int
+	// Sorted by queried hostname; nil when loaded from JSON
+	HostnameMismatches []HostnameMismatch
+	// Sorted by hostname; nil when loaded from JSON
+	SelfPeers []SelfPeer
+	// Hosts dropped by -keep-nearest
+	PrunedHosts int
+	// Hostnames queued this scan which never became nodes, with why: the
+	// fetch failed or DNS was bad; nil when loaded from JSON
+	DownHosts map[string]string
+	// Where the scan spent its time; nil when loaded from JSON
+	Phases *ScanPhases
 }
 
+// Each scan builds a fresh PersistedHostInfo, and once installed by
+// SetCurrentPersisted it is never modified, so the lock only guards the
+// pointer swap: handlers should fetch the pointer once per request and use
+// that snapshot throughout.
 var (
 	currentHostInfo    *PersistedHostInfo
 	currentHostMapLock sync.RWMutex
@@ -121,64 +192,65 @@ func GetCurrentHostlist() []string {
 	return currentHostInfo.Sorted
 }
 
-func SetCurrentPersisted(p *PersistedHostInfo) {
+func preparePersisted(p *PersistedHostInfo) {
 	p.Timestamp = time.Now()
+	p.LoadAnnotations()
+	p.Summary = NewScanSummary(p)
 	p.LogInformation()
-	currentHostMapLock.Lock()
-	defer currentHostMapLock.Unlock()
-	currentHostInfo = p
 }
 
-func normaliseMeshAndSet(spider *Spider, dumpJson bool) {
-	go func(s *Spider) {
-		persisted := GeneratePersistedInformation(s)
-		SetCurrentPersisted(persisted)
-		persisted.UpdateStatsCounters(spider)
-		runtime.GC()
-		if dumpJson && *flJsonDump != "" {
-			Log.Printf("Saving JSON to \"%s\"", *flJsonDump)
-			err := persisted.HostMap.DumpJSONToFile(*flJsonDump)
-			if err != nil {
-				Log.Printf("Error saving JSON to \"%s\": %s", *flJsonDump, err)
-				// continue anyway
-			}
-			runtime.GC()
+func previousKeycounts(previous *PersistedHostInfo) map[string]int {
+	counts := make(map[string]int, len(previous.HostMap))
+	for hostname, node := range previous.HostMap {
+		if node.Keycount > 1 {
+			counts[hostname] = node.Keycount
 		}
-	}(spider)
+	}
+	return counts
 }
 
-func respiderPeriodically() {
-	for {
-		var delay time.Duration = time.Duration(*flScanIntervalSecs) * time.Second
-		if *flScanIntervalJitter > 0 {
-			jitter := rand.Int63n(int64(*flScanIntervalJitter) * int64(time.Second))
-			jitter -= int64(*flScanIntervalJitter) * int64(time.Second) / 2
-			delay += time.Duration(jitter)
-		}
-		minDelay := time.Minute * 30
-		if delay < minDelay {
-			Log.Printf("respider period too low, capping %d up to %d", delay, minDelay)
-			delay = minDelay
+func SetCurrentPersisted(p *PersistedHostInfo) {
+	preparePersisted(p)
+	currentHostMapLock.Lock()
+	defer currentHostMapLock.Unlock()
+	if currentHostInfo != nil && p.PreviousKeycounts == nil {
+		p.PreviousKeycounts = previousKeycounts(currentHostInfo)
+	}
+	if currentHostInfo != nil && p.PreviousCountryCounts == nil {
+		p.PreviousCountryCounts = CountryServerCounts(currentHostInfo)
+	}
+	standbyHostInfo = currentHostInfo
+	currentHostInfo = p
+}
+
+// Returns nil if the new scan was rejected in favour of the current one.
+// That's decided before generating the snapshot, since generating it records
+// the scan's failures in staleHosts, and a rejected scan mustn't count.
+func normaliseMeshAndSet(spider *Spider, dumpJson bool) *PersistedHostInfo {
+	if reason := snapshotRejection(spider.hostCount(), GetCurrentPersisted(), *flMinHostFraction); reason != "" {
+		Log.Printf("Rejecting new scan, keeping the current snapshot: %s", reason)
+		SetStandbyPersisted(generatePersistedInformation(spider, false))
+		return nil
+	}
+	persisted := GeneratePersistedInformation(spider)
+	SetCurrentPersisted(persisted)
+	keycountHistory.record(persisted.HostMap)
+	persisted.UpdateStatsCounters(spider)
+	runtime.GC()
+	if dumpJson && *flJsonDump != "" {
+		Log.Printf("Saving JSON to \"%s\"", *flJsonDump)
+		err := persisted.HostMap.DumpJSONToFile(*flJsonDump)
+		if err != nil {
+			Log.Printf("Error saving JSON to \"%s\": %s", *flJsonDump, err)
+			// continue anyway
 		}
-		Log.Printf("Sleeping %s before next respider", delay)
-		time.Sleep(delay)
-		Log.Printf("Awoken!  Time to spider.")
-		var spider *Spider
-		func() {
-			spider = StartSpider()
-			defer func(sp *Spider) {
-				if r := recover(); r != nil {
-					Log.Printf("Spider paniced: %s", r)
-				}
-				sp.Terminate()
-			}(spider)
-			spider.AddHost(*flSpiderStartHost, 0)
-			spider.Wait()
-		}()
-		normaliseMeshAndSet(spider, false)
+		runtime.GC()
 	}
+	return persisted
 }
 
+var scanScheduler *Scheduler
+
 var httpServing sync.WaitGroup
 
 func startHttpServing() {
@@ -216,10 +288,51 @@ func Main() {
 		fmt.Fprintf(os.Stderr, "Bad jitter, must be >= 0 [got: %d]\n", *flScanIntervalJitter)
 		os.Exit(1)
 	}
+	if err := SetIpValidTunables(ipValidTunablesFromFlags()); err != nil {
+		fmt.Fprintf(os.Stderr, "Bad ip-valid tunables: %s\n", err)
+		os.Exit(1)
+	}
 
 	setupLogging()
 	Log.Printf("started")
 
+	if err := setupFetchClient(); err != nil {
+		Log.Fatalf("Bad proxy configuration: %s", err)
+	}
+
+	if *flGeoIPDatabase != "" {
+		if err := OpenGeoIPDatabase(*flGeoIPDatabase); err != nil {
+			Log.Printf("Failed to open GeoIP database \"%s\": %s; continuing without countries", *flGeoIPDatabase, err)
+			geoipUnavailable = true
+		}
+	}
+
+	if *flAdminTokensFile != "" {
+		if err := LoadAdminTokens(*flAdminTokensFile); err != nil {
+			Log.Fatalf("Failed to load admin tokens from \"%s\": %s", *flAdminTokensFile, err)
+		}
+	}
+
+	if *flScanWebhookSecret != "" {
+		if err := LoadWebhookSecret(*flScanWebhookSecret); err != nil {
+			Log.Fatalf("Failed to load webhook secret from \"%s\": %s", *flScanWebhookSecret, err)
+		}
+	} else if *flScanWebhook != "" {
+		Log.Printf("No -scan-webhook-secret-file, so webhook requests will be unsigned")
+	}
+
+	if *flScanHistoryDB != "" {
+		db, err := OpenScanHistory(kSCAN_HISTORY_DRIVER, *flScanHistoryDB)
+		if err != nil {
+			Log.Fatalf("Failed to open scan history database \"%s\" (built without -tags sqlite?): %s", *flScanHistoryDB, err)
+		}
+		scanHistoryDB = db
+	}
+
+	scanScheduler = NewScheduler(
+		time.Duration(*flScanIntervalSecs)*time.Second,
+		time.Duration(*flScanIntervalJitter)*time.Second)
+
 	httpServing.Add(1)
 	go startHttpServing()
 
@@ -250,22 +363,19 @@ func Main() {
 			Sorted:       hostnames,
 			DepthSorted:  GenerateDepthSorted(hostmap),
 			Graph:        GenerateGraph(hostnames, hostmap, aliasMap),
+			SharedIPs:    FindSharedIPs(hostmap, nil),
 		})
 	} else {
-		spider := StartSpider()
-		spider.AddHost(*flSpiderStartHost, 0)
-		spider.Wait()
-		spider.Terminate()
+		scanScheduler.ScanAndWait(true)
 		Log.Printf("Spidering complete")
-		normaliseMeshAndSet(spider, true)
-		go respiderPeriodically()
+		go scanScheduler.Run()
 		doneRespider = true
 	}
 
 	if *flJsonPersistPath != "" {
 		signalChan := make(chan os.Signal)
 		if !doneRespider {
-			go respiderPeriodically()
+			go scanScheduler.Run()
 		}
 		go shutdownRunner(signalChan)
 		// Warning: Unix-specific, need to figure out how to make this signal-handling
@@ -274,6 +384,10 @@ func Main() {
 		signal.Notify(signalChan, syscall.SIGUSR1)
 	}
 
+	diagnosticsSignals := make(chan os.Signal, 1)
+	go diagnosticsDumpRunner(diagnosticsSignals)
+	signal.Notify(diagnosticsSignals, syscall.SIGUSR2)
+
 	if *flStartedFlagfile != "" {
 		fh, err := os.Create(*flStartedFlagfile)
 		if err == nil {
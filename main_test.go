@@ -0,0 +1,84 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Best run with -race: handlers read snapshots while scans install new ones.
+func TestPersistedSwapUnderLoad(t *testing.T) {
+	prepareTemplates()
+	snapshots := make([]*PersistedHostInfo, 20)
+	for i := range snapshots {
+		snapshots[i] = newTestPersisted(t)
+	}
+	SetCurrentPersisted(snapshots[0])
+
+	pages := []struct {
+		handler http.HandlerFunc
+		uri     string
+		expect  string
+	}{
+		{apiIpValidPage, SERVE_PREFIX + "/ip-valid?json", `"status":"COMPLETE"`},
+		{apiPeersPage, SERVE_PREFIX, "sks.spodhuis.org"},
+		{apiVersionsPage, SERVE_PREFIX + "/versions", "1.1.4"},
+		{apiKeycountHistogramPage, SERVE_PREFIX + "/keycount-histogram", "buckets"},
+	}
+
+	done := make(chan bool)
+	failures := make(chan string, 100)
+	var readers sync.WaitGroup
+	for _, page := range pages {
+		for i := 0; i < 4; i++ {
+			readers.Add(1)
+			go func(handler http.HandlerFunc, uri, expect string) {
+				defer readers.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					rec := testGet(t, handler, uri)
+					if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), expect) {
+						failures <- uri
+						return
+					}
+				}
+			}(page.handler, page.uri, page.expect)
+		}
+	}
+
+	for _, snapshot := range snapshots[1:] {
+		time.Sleep(5 * time.Millisecond)
+		SetCurrentPersisted(snapshot)
+		if GetCurrentPersisted() != snapshot {
+			t.Fatalf("Swapped snapshot not current")
+		}
+	}
+	close(done)
+	readers.Wait()
+	close(failures)
+	for uri := range failures {
+		t.Fatalf("Bad response from %s during snapshot swaps", uri)
+	}
+}
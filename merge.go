@@ -0,0 +1,173 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// Several spiders may be run at once over disjoint seed lists, for faster
+// coverage, and their results combined into one snapshot.  Each host found
+// is replayed into a fresh spider much as a scan would have come across it:
+// folded into a host already merged with the same name or an IP in common,
+// as processDnsResult does, or else filed under the name it reports for
+// itself, as processHostResult does.
+
+// The spiders must have finished; they are only read from.
+func MergeSpiders(spiders ...*Spider) *PersistedHostInfo {
+	merged := newSpider()
+	for _, from := range spiders {
+		merged.mergeFrom(from)
+	}
+	// A failure in one spider is moot if another got through
+	for hostname := range merged.badDNS {
+		if _, ok := merged.knownHosts[hostname]; ok {
+			delete(merged.badDNS, hostname)
+			delete(merged.dnsFailures, hostname)
+		}
+	}
+	for hostname := range merged.queryErrors {
+		if merged.serverInfos[merged.knownHosts[hostname]] != nil {
+			delete(merged.queryErrors, hostname)
+		}
+	}
+	Log.Printf("Merged %d spiders into %d hosts", len(spiders), len(merged.serverInfos))
+	return GeneratePersistedInformation(merged)
+}
+
+func (spider *Spider) mergeFrom(from *Spider) {
+	for _, hostname := range GenerateHostlistSorted(HostMap(from.serverInfos)) {
+		spider.mergeHost(from, hostname)
+	}
+	// DNS aliases and nodenames, which aren't in aliasesForHost
+	for alias, canonical := range from.knownHosts {
+		if _, ok := spider.knownHosts[alias]; ok {
+			continue
+		}
+		if mergedAs, ok := spider.knownHosts[canonical]; ok {
+			spider.knownHosts[alias] = mergedAs
+		}
+	}
+	for ip, country := range from.countriesForIPs {
+		if old := spider.countriesForIPs[ip]; country != "" && (old == "" || old == kCOUNTRY_UNKNOWN) {
+			spider.countriesForIPs[ip] = country
+		}
+	}
+	for hostname := range from.considering {
+		spider.considering[hostname] = true
+	}
+	for hostname := range from.badDNS {
+		spider.badDNS[hostname] = true
+	}
+	for hostname, reason := range from.dnsFailures {
+		spider.dnsFailures[hostname] = reason
+	}
+	for hostname, err := range from.queryErrors {
+		spider.queryErrors[hostname] = err
+	}
+	for hostname := range from.robotsRefused {
+		spider.robotsRefused[hostname] = true
+	}
+	for hostname, mismatch := range from.nameMismatches {
+		if _, ok := spider.nameMismatches[hostname]; !ok {
+			spider.nameMismatches[hostname] = mismatch
+		}
+	}
+	for hostname, self := range from.selfPeers {
+		if _, ok := spider.selfPeers[hostname]; !ok {
+			spider.selfPeers[hostname] = self
+		}
+	}
+	for hostname, page := range from.rawPages {
+		if canonical, ok := spider.knownHosts[hostname]; ok {
+			hostname = canonical
+		}
+		if _, ok := spider.rawPages[hostname]; !ok {
+			spider.rawPages[hostname] = page
+		}
+	}
+	spider.capSkipped += from.capSkipped
+	spider.abandonedHosts += from.abandonedHosts
+	spider.phases.dns += from.phases.dns
+	spider.phases.fetch += from.phases.fetch
+	spider.phases.country += from.phases.country
+	if from.started.Before(spider.started) {
+		spider.started = from.started
+	}
+}
+
+func (spider *Spider) mergeHost(from *Spider, hostname string) {
+	node := from.serverInfos[hostname]
+	ipList := from.ipsForHost[hostname]
+	aliases := from.aliasesForHost[hostname]
+
+	canonical, known := spider.knownHosts[hostname]
+	for i := 0; !known && i < len(aliases); i++ {
+		canonical, known = spider.knownHosts[aliases[i]]
+	}
+	for i := 0; !known && i < len(ipList); i++ {
+		canonical, known = spider.knownIPs[ipList[i]]
+	}
+	if known {
+		if canonical != hostname {
+			Log.Printf("Merging \"%s\" into \"%s\", found by another spider", hostname, canonical)
+		}
+		spider.mergeDnsAlias(hostname, canonical, ipList)
+		for _, alias := range append([]string{hostname}, aliases...) {
+			spider.knownHosts[alias] = canonical
+			spider.addAlias(canonical, alias)
+		}
+		if spider.serverInfos[canonical] == nil && node != nil {
+			spider.serverInfos[canonical] = node
+		}
+		spider.mergeDistance(from, hostname, canonical)
+		return
+	}
+
+	// A shiny new host, as from processDnsResult
+	spider.knownHosts[hostname] = hostname
+	spider.aliasesForHost[hostname] = []string{hostname}
+	for _, alias := range aliases {
+		spider.knownHosts[alias] = hostname
+		spider.addAlias(hostname, alias)
+	}
+	spider.ipsForHost[hostname] = flattenIPs(ipList)
+	for _, ip := range ipList {
+		spider.knownIPs[ip] = hostname
+	}
+	spider.serverInfos[hostname] = nil
+	spider.mergeDistance(from, hostname, hostname)
+	if node != nil {
+		spider.recordServerInfo(hostname, node)
+	}
+}
+
+func (spider *Spider) addAlias(canonical, alias string) {
+	for _, have := range spider.aliasesForHost[canonical] {
+		if have == alias {
+			return
+		}
+	}
+	spider.aliasesForHost[canonical] = append(spider.aliasesForHost[canonical], alias)
+}
+
+// Nearest wins: each spider only knows its own seeds' distances
+func (spider *Spider) mergeDistance(from *Spider, hostname, canonical string) {
+	distance, ok := from.distances[hostname]
+	if !ok {
+		return
+	}
+	if old, ok := spider.distances[canonical]; !ok || distance < old {
+		spider.distances[canonical] = distance
+	}
+}
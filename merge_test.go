@@ -0,0 +1,101 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"sort"
+	"testing"
+)
+
+// As a finished scan leaves things, without the network
+func scannedSpider(hostname string, distance int, ipList []string, aliases ...string) *Spider {
+	spider := newSpider()
+	spider.addScanned(hostname, distance, ipList, aliases...)
+	return spider
+}
+
+func (spider *Spider) addScanned(hostname string, distance int, ipList []string, aliases ...string) {
+	spider.considering[hostname] = true
+	spider.knownHosts[hostname] = hostname
+	spider.aliasesForHost[hostname] = append([]string{hostname}, aliases...)
+	for _, alias := range aliases {
+		spider.considering[alias] = true
+		spider.knownHosts[alias] = hostname
+	}
+	spider.ipsForHost[hostname] = ipList
+	for _, ip := range ipList {
+		spider.knownIPs[ip] = hostname
+		spider.countriesForIPs[ip] = "DK"
+	}
+	spider.distances[hostname] = distance
+	spider.serverInfos[hostname] = &SksNode{
+		Hostname: hostname,
+		Keycount: 3169004,
+		Settings: map[string]string{"Hostname": hostname},
+	}
+}
+
+func TestMergeSpiders(t *testing.T) {
+	setupTestLogging()
+	savedStale := staleHosts
+	defer func() { staleHosts = savedStale }()
+	staleHosts = newStaleTracker()
+
+	first := scannedSpider("keys.example.org", 0, []string{"130.225.1.1"})
+	first.addScanned("pgp.example.com", 1, []string{"130.225.2.1"})
+	// Found again by the second spider, under an alias and at another IP of
+	// its round-robin, nearer to that spider's seed
+	second := scannedSpider("other.example.net", 0, []string{"130.225.3.1"})
+	second.addScanned("keys.example.org", 1, []string{"130.225.1.2"}, "alt.example.org")
+	// Not known by name, but shares an IP
+	second.addScanned("keys.example.com", 2, []string{"130.225.2.1"})
+	second.badDNS["pgp.example.com"] = true
+
+	persisted := MergeSpiders(first, second)
+	if len(persisted.HostMap) != 3 {
+		t.Fatalf("Expected 3 hosts, got %d: %v", len(persisted.HostMap), persisted.Sorted)
+	}
+	node, ok := persisted.HostMap["keys.example.org"]
+	if !ok {
+		t.Fatalf("Overlapping host missing: %v", persisted.Sorted)
+	}
+	ips := append([]string(nil), node.IpList...)
+	sort.Strings(ips)
+	if len(ips) != 2 || ips[0] != "130.225.1.1" || ips[1] != "130.225.1.2" {
+		t.Fatalf("Overlapping host's IPs not combined: %v", node.IpList)
+	}
+	if node.Distance != 0 {
+		t.Fatalf("Expected the nearer distance 0, got %d", node.Distance)
+	}
+	for _, alias := range []string{"alt.example.org", "keys.example.org"} {
+		if persisted.AliasMap[alias] != "keys.example.org" {
+			t.Fatalf("Alias %q maps to %q", alias, persisted.AliasMap[alias])
+		}
+	}
+	if _, ok := persisted.HostMap["keys.example.com"]; ok {
+		t.Fatalf("Host sharing an IP not merged")
+	}
+	if persisted.AliasMap["keys.example.com"] != "pgp.example.com" {
+		t.Fatalf("Host sharing an IP not aliased: %q", persisted.AliasMap["keys.example.com"])
+	}
+	if _, ok := persisted.DownHosts["pgp.example.com"]; ok {
+		t.Fatalf("Host reached by one spider listed as down")
+	}
+	if persisted.IPCountryMap["130.225.3.1"] != "DK" {
+		t.Fatalf("Countries not merged: %v", persisted.IPCountryMap)
+	}
+}
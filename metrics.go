@@ -0,0 +1,97 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// Prometheus-style histograms of how long remote servers and DNS take to
+// answer, cumulative over the life of the process, for alerting on latency
+// creeping up across the mesh.  The text exposition format is simple enough
+// not to need the client library.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const ContentTypePrometheus = "text/plain; version=0.0.4; charset=utf-8"
+
+// Bucket upper bounds, in seconds; fetches can take up to -http-fetch-timeout
+var (
+	kFETCH_DURATION_BUCKETS = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+	kDNS_DURATION_BUCKETS   = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+type durationHistogram struct {
+	name    string
+	help    string
+	bounds  []float64
+	lock    sync.Mutex
+	buckets []uint64 // not cumulative; one extra for +Inf
+	sum     float64
+	count   uint64
+}
+
+var (
+	fetchDurations = newDurationHistogram("sks_spider_fetch_duration_seconds",
+		"Time taken to fetch a server's stats page, whether or not it succeeded", kFETCH_DURATION_BUCKETS)
+	dnsDurations = newDurationHistogram("sks_spider_dns_duration_seconds",
+		"Time taken to resolve a server's hostname", kDNS_DURATION_BUCKETS)
+)
+
+func newDurationHistogram(name, help string, bounds []float64) *durationHistogram {
+	return &durationHistogram{
+		name:    name,
+		help:    help,
+		bounds:  bounds,
+		buckets: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *durationHistogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := 0
+	for i < len(h.bounds) && seconds > h.bounds[i] {
+		i += 1
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.buckets[i] += 1
+	h.sum += seconds
+	h.count += 1
+}
+
+func (h *durationHistogram) Render(out io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.buckets[i]
+		fmt.Fprintf(out, "%s_bucket{le=\"%s\"} %d\n", h.name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(out, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(out, "%s_sum %s\n%s_count %d\n", h.name, strconv.FormatFloat(h.sum, 'g', -1, 64), h.name, h.count)
+}
+
+func apiMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentTypePrometheus)
+	fetchDurations.Render(w)
+	dnsDurations.Render(w)
+}
@@ -0,0 +1,74 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDurationHistogram(t *testing.T) {
+	h := newDurationHistogram("test_duration_seconds", "Test durations", []float64{0.1, 1})
+	for _, d := range []time.Duration{62500 * time.Microsecond, 125 * time.Millisecond, 500 * time.Millisecond, 3 * time.Second} {
+		h.Observe(d)
+	}
+	var out bytes.Buffer
+	h.Render(&out)
+	for _, want := range []string{
+		"# TYPE test_duration_seconds histogram\n",
+		"test_duration_seconds_bucket{le=\"0.1\"} 1\n",
+		"test_duration_seconds_bucket{le=\"1\"} 3\n",
+		"test_duration_seconds_bucket{le=\"+Inf\"} 4\n",
+		"test_duration_seconds_sum 3.6875\n",
+		"test_duration_seconds_count 4\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("Missing %q in:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestMetricsObservedFromResults(t *testing.T) {
+	setupTestLogging()
+	fetchesBefore, dnsBefore := fetchDurations.count, dnsDurations.count
+	spider := newSpider()
+	spider.processDnsResult(&DnsResult{"gone.example.org", nil, &net.DNSError{Err: "no such host", Name: "gone.example.org", IsNotFound: true}, "", 20 * time.Millisecond})
+	spider.processHostResult(&HostResult{
+		hostname: "down.example.org",
+		node:     &SksNode{Hostname: "down.example.org", FetchDuration: 2 * time.Second},
+		err:      errors.New("connection refused"),
+	})
+	if fetchDurations.count != fetchesBefore+1 || dnsDurations.count != dnsBefore+1 {
+		t.Fatalf("Durations not observed: fetch %d -> %d, dns %d -> %d",
+			fetchesBefore, fetchDurations.count, dnsBefore, dnsDurations.count)
+	}
+
+	rec := testGet(t, apiMetrics, "/metrics")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("Bad response %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	for _, name := range []string{"sks_spider_fetch_duration_seconds_count", "sks_spider_dns_duration_seconds_count"} {
+		if !strings.Contains(rec.Body.String(), name) {
+			t.Fatalf("Missing %s in:\n%s", name, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// Hosts named by the operator as anchors of the mesh.  They're seeded into
+// every scan, never purged as stale nor pruned by -keep-nearest, and are kept
+// in each snapshot even when a scan can't reach them, so that a transient
+// failure doesn't silently drop a known-good core server from the inventory.
+
+import (
+	"fmt"
+)
+
+const kPINNED_UNREACHABLE = "pinned, unreachable"
+
+func pinnedHosts() []string {
+	return parseHostList(*flPinnedHosts)
+}
+
+func isPinnedHost(hostname string) bool {
+	for _, h := range pinnedHosts() {
+		if h == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+// A pinned host may have been given as an alias; the flag goes on the
+// canonical node, which is what staleness and pruning look at.
+func (spider *Spider) markPinned(hostMap HostMap) {
+	for _, hostname := range pinnedHosts() {
+		if canonical, ok := spider.knownHosts[hostname]; ok {
+			hostname = canonical
+		}
+		if node, ok := hostMap[hostname]; ok {
+			node.Pinned = true
+		}
+	}
+}
+
+func (spider *Spider) unreachableReason(hostname string) string {
+	if err, ok := spider.queryErrors[hostname]; ok {
+		return err.Error()
+	}
+	if spider.robotsRefused[hostname] {
+		return errRobotsDisallowed.Error()
+	}
+	if reason, ok := spider.dnsFailures[hostname]; ok {
+		return reason
+	}
+	if spider.badDNS[hostname] {
+		return "bad DNS"
+	}
+	return "not reached this scan"
+}
+
+// Called after carryForward, so a pinned host within the grace window keeps
+// its last-known-good data; any other pinned host missing from the results
+// gets a placeholder, which is never yielded by ip-valid.
+func (spider *Spider) retainPinned(hostMap HostMap) int {
+	retained := 0
+	for _, hostname := range pinnedHosts() {
+		if canonical, ok := spider.knownHosts[hostname]; ok {
+			if _, ok := hostMap[canonical]; ok {
+				continue
+			}
+		}
+		if _, ok := hostMap[hostname]; ok {
+			hostMap[hostname].Pinned = true
+			continue
+		}
+		hostMap[hostname] = &SksNode{
+			Hostname:     hostname,
+			Port:         *flSksPortHkp,
+			Keycount:     -2,
+			AnalyzeError: fmt.Sprintf("%s: %s", kPINNED_UNREACHABLE, spider.unreachableReason(hostname)),
+			Pinned:       true,
+		}
+		retained += 1
+	}
+	if retained > 0 {
+		Log.Printf("Retained %d pinned hosts which this scan couldn't reach", retained)
+	}
+	return retained
+}
@@ -0,0 +1,66 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRetainPinned(t *testing.T) {
+	setupTestLogging()
+	saved := *flPinnedHosts
+	defer func() { *flPinnedHosts = saved }()
+	*flPinnedHosts = "good.example.org,alias.example.org,down.example.org,gone.example.org"
+
+	spider := newSpider()
+	spider.knownHosts["alias.example.org"] = "canonical.example.org"
+	spider.queryErrors["down.example.org"] = errors.New("connection refused")
+	spider.dnsFailures["gone.example.org"] = "not found"
+	hostMap := HostMap{
+		"good.example.org":      &SksNode{Hostname: "good.example.org", Keycount: 3200000},
+		"canonical.example.org": &SksNode{Hostname: "canonical.example.org", Keycount: 3200000},
+	}
+	spider.markPinned(hostMap)
+	if retained := spider.retainPinned(hostMap); retained != 2 {
+		t.Fatalf("Expected 2 pinned hosts retained, got %d", retained)
+	}
+	if len(hostMap) != 4 {
+		t.Fatalf("Alias of a present host retained separately: %v", hostMap)
+	}
+	for hostname, node := range hostMap {
+		if !node.Pinned {
+			t.Fatalf("Host %s not marked pinned", hostname)
+		}
+	}
+	if node := hostMap["good.example.org"]; node.AnalyzeError != "" || node.Keycount != 3200000 {
+		t.Fatalf("Reachable pinned host altered: %+v", node)
+	}
+	for hostname, reason := range map[string]string{
+		"down.example.org": "connection refused",
+		"gone.example.org": "not found",
+	} {
+		node := hostMap[hostname]
+		if !strings.HasPrefix(node.AnalyzeError, kPINNED_UNREACHABLE) || !strings.HasSuffix(node.AnalyzeError, reason) {
+			t.Fatalf("Bad error for %s: %q", hostname, node.AnalyzeError)
+		}
+		if node.Keycount > 1 {
+			t.Fatalf("Unreachable pinned host %s would be yielded: %+v", hostname, node)
+		}
+	}
+}
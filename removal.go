@@ -0,0 +1,154 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// One worklist for pool maintainers, of the servers which fail any of the
+// chosen health checks, rather than one endpoint per signal to be cross-read
+// by hand.
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	kREMOVAL_LOW_KEYCOUNT = "low_keycount" // desynced: outside ip-valid's bounds
+	kREMOVAL_STATIC       = "static"       // keycount stuck while the mesh grows
+	kREMOVAL_UNREACHABLE  = "unreachable"  // carried forward, or no keycount
+	kREMOVAL_VERSION      = "version"      // older than minimum_version
+)
+
+var removalCriteria = []string{kREMOVAL_LOW_KEYCOUNT, kREMOVAL_STATIC, kREMOVAL_UNREACHABLE, kREMOVAL_VERSION}
+
+type RemovalCandidate struct {
+	Hostname string   `json:"hostname"`
+	Keycount int      `json:"keycount"`
+	Version  string   `json:"version,omitempty"`
+	Reasons  []string `json:"reasons"`
+}
+
+// In host order; minimum is only used for the version criterion.
+func RemovalCandidates(persisted *PersistedHostInfo, tunables IpValidTunables, criteria map[string]bool, minimum *SksVersion) []RemovalCandidate {
+	base := newIpValidBase(persisted, tunables)
+	static := make(map[string]bool)
+	if criteria[kREMOVAL_STATIC] {
+		servers, _, _ := keycountHistory.Static()
+		for _, server := range servers {
+			static[server.Hostname] = true
+		}
+	}
+
+	candidates := make([]RemovalCandidate, 0)
+	for _, hostname := range persisted.Sorted {
+		node := persisted.HostMap[hostname]
+		reasons := make([]string, 0, 2)
+		if criteria[kREMOVAL_UNREACHABLE] {
+			if !node.LastGoodScan.IsZero() {
+				reasons = append(reasons, fmt.Sprintf("unreachable, data carried forward from %s", node.LastGoodScan.UTC().Format("2006-01-02 15:04:05")))
+			} else if node.Keycount <= 1 {
+				reason := "no keycount"
+				if node.AnalyzeError != "" {
+					reason += ": " + node.AnalyzeError
+				}
+				reasons = append(reasons, reason)
+			}
+		}
+		if criteria[kREMOVAL_LOW_KEYCOUNT] && base.threshold != nil && node.Keycount > 1 && len(node.IpList) > 0 {
+			_, inBounds := base.threshold.inBounds[node.IpList[0]]
+			if node.Keycount < base.threshold.threshold {
+				reasons = append(reasons, fmt.Sprintf("keycount %d below threshold %d", node.Keycount, base.threshold.threshold))
+			} else if !inBounds {
+				reasons = append(reasons, fmt.Sprintf("keycount %d outside the statistical bounds", node.Keycount))
+			}
+		}
+		if static[hostname] {
+			reasons = append(reasons, fmt.Sprintf("keycount stuck at %d for %d scans", node.Keycount, *flStaticScans))
+		}
+		if criteria[kREMOVAL_VERSION] && minimum != nil {
+			if version := NewSksVersion(node.Version); version == nil {
+				reasons = append(reasons, fmt.Sprintf("unparseable version \"%s\"", node.Version))
+			} else if !version.IsAtLeast(minimum) {
+				reasons = append(reasons, fmt.Sprintf("version %s below minimum %s", version, minimum))
+			}
+		}
+		if len(reasons) > 0 {
+			candidates = append(candidates, RemovalCandidate{
+				Hostname: hostname,
+				Keycount: node.Keycount,
+				Version:  node.Version,
+				Reasons:  reasons,
+			})
+		}
+	}
+	return candidates
+}
+
+// criteria is comma-separated, from those above, defaulting to all of them;
+// the version criterion needs minimum_version, and is skipped by default
+// without it.
+func apiRemovalCandidatesPage(w http.ResponseWriter, req *http.Request) {
+	persisted := reportSetup(w, req)
+	if persisted == nil {
+		return
+	}
+	var minimum *SksVersion
+	if v := req.Form.Get("minimum_version"); v != "" {
+		if minimum = NewSksVersion(v); minimum == nil {
+			http.Error(w, fmt.Sprintf("Bad minimum_version \"%s\"", v), http.StatusBadRequest)
+			return
+		}
+	}
+	criteria := make(map[string]bool, len(removalCriteria))
+	if list := req.Form.Get("criteria"); list != "" {
+		for _, criterion := range strings.Split(list, ",") {
+			criterion = strings.TrimSpace(criterion)
+			known := false
+			for _, c := range removalCriteria {
+				known = known || c == criterion
+			}
+			if !known {
+				http.Error(w, fmt.Sprintf("Unknown criterion \"%s\", use some of: %s", criterion, strings.Join(removalCriteria, ",")), http.StatusBadRequest)
+				return
+			}
+			criteria[criterion] = true
+		}
+		if criteria[kREMOVAL_VERSION] && minimum == nil {
+			http.Error(w, "The version criterion needs minimum_version", http.StatusBadRequest)
+			return
+		}
+	} else {
+		for _, c := range removalCriteria {
+			criteria[c] = c != kREMOVAL_VERSION || minimum != nil
+		}
+	}
+
+	applied := make([]string, 0, len(criteria))
+	for _, c := range removalCriteria {
+		if criteria[c] {
+			applied = append(applied, c)
+		}
+	}
+	result := map[string]interface{}{
+		"criteria": applied,
+		"servers":  RemovalCandidates(persisted, GetIpValidTunables(), criteria, minimum),
+	}
+	if minimum != nil {
+		result["minimum_version"] = minimum.String()
+	}
+	reportWriteJson(w, req, result)
+}
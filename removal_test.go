@@ -0,0 +1,124 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func removalCandidates(t *testing.T, query string) map[string]RemovalCandidate {
+	rec := testGet(t, apiRemovalCandidatesPage, SERVE_PREFIX+"/removal-candidates?"+query)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Query %q: bad status %d: %s", query, rec.Code, rec.Body)
+	}
+	var result struct {
+		Criteria []string           `json:"criteria"`
+		Servers  []RemovalCandidate `json:"servers"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Bad JSON: %s\n%s", err, rec.Body)
+	}
+	byHost := make(map[string]RemovalCandidate, len(result.Servers))
+	for _, server := range result.Servers {
+		byHost[server.Hostname] = server
+	}
+	return byHost
+}
+
+func TestRemovalCandidates(t *testing.T) {
+	persisted := loadTestPersisted(t)
+	savedScans, savedHistory := *flStaticScans, keycountHistory
+	defer func() { *flStaticScans, keycountHistory = savedScans, savedHistory }()
+	*flStaticScans = 2
+	keycountHistory = &keycountTracker{}
+
+	// Stuck while everything else grows
+	var stuck string
+	for _, hostname := range persisted.Sorted {
+		if persisted.HostMap[hostname].Keycount > 1 {
+			stuck = hostname
+			break
+		}
+	}
+	grown := make(HostMap, len(persisted.HostMap))
+	for hostname, node := range persisted.HostMap {
+		moved := *node
+		if hostname != stuck && moved.Keycount > 1 {
+			moved.Keycount -= 1000
+		}
+		grown[hostname] = &moved
+	}
+	keycountHistory.record(grown)
+	keycountHistory.record(persisted.HostMap)
+
+	unreachable := removalCandidates(t, "criteria=unreachable")
+	if down, ok := unreachable["sks1.webtru.st"]; !ok || !strings.Contains(down.Reasons[0], "HTTP GET failure") {
+		t.Fatalf("Failed server not a candidate: %+v", down)
+	}
+	for hostname, candidate := range unreachable {
+		if node := persisted.HostMap[hostname]; node.Keycount > 1 && node.LastGoodScan.IsZero() {
+			t.Fatalf("Healthy server a candidate: %+v", candidate)
+		}
+	}
+
+	base := newIpValidBase(persisted, GetIpValidTunables())
+	low := removalCandidates(t, "criteria=low_keycount")
+	if len(low) == 0 {
+		t.Fatalf("No low keycount candidates in test data")
+	}
+	for _, hostname := range persisted.Sorted {
+		node := persisted.HostMap[hostname]
+		if node.Keycount <= 1 || len(node.IpList) == 0 {
+			continue
+		}
+		count, inBounds := base.threshold.inBounds[node.IpList[0]]
+		passes := inBounds && count >= base.threshold.threshold
+		if _, listed := low[hostname]; listed == passes {
+			t.Fatalf("%s: keycount %d, listed %v, passes ip-valid %v", hostname, node.Keycount, listed, passes)
+		}
+	}
+
+	old := removalCandidates(t, "criteria=version&minimum_version=1.1.4")
+	for _, hostname := range persisted.Sorted {
+		version := NewSksVersion(persisted.HostMap[hostname].Version)
+		if _, listed := old[hostname]; listed != (version == nil || !version.IsAtLeast(NewSksVersion("1.1.4"))) {
+			t.Fatalf("%s: version %q, listed %v", hostname, persisted.HostMap[hostname].Version, listed)
+		}
+	}
+
+	all := removalCandidates(t, "")
+	if server := all[stuck]; len(server.Reasons) == 0 || !strings.Contains(server.Reasons[len(server.Reasons)-1], "stuck") {
+		t.Fatalf("Stuck server %s not a candidate: %+v", stuck, server)
+	}
+	for _, server := range all {
+		if strings.Contains(strings.Join(server.Reasons, ";"), "version") {
+			t.Fatalf("Version criterion applied without minimum_version: %+v", server)
+		}
+	}
+	if len(all) < len(low) || len(all) < len(unreachable) {
+		t.Fatalf("Fewer candidates with all criteria (%d) than some (%d, %d)", len(all), len(low), len(unreachable))
+	}
+
+	for _, query := range []string{"criteria=bogus", "criteria=version", "minimum_version=1.x"} {
+		if rec := testGet(t, apiRemovalCandidatesPage, SERVE_PREFIX+"/removal-candidates?"+query); rec.Code != http.StatusBadRequest {
+			t.Fatalf("Query %q: got status %d, expected %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// Opt-in good citizenship for crawling third-party infrastructure: honour a
+// keyserver's robots.txt before fetching its stats page.  If robots.txt is
+// missing or can't be fetched, we fetch anyway, as crawlers conventionally do.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const kROBOTS_AGENT = "sks_peers"
+
+var errRobotsDisallowed = errors.New("stats page disallowed by robots.txt")
+
+type robotsRule struct {
+	allow   bool
+	length  int
+	matcher *regexp.Regexp
+}
+
+// A nil *robotsRules allows everything
+type robotsRules struct {
+	rules []robotsRule
+}
+
+// Paths may use '*' for any sequence and a trailing '$' to anchor the end,
+// per the common extensions.
+func newRobotsRule(allow bool, pattern string) robotsRule {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+	re := "^" + strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1)
+	if anchored {
+		re += "$"
+	}
+	return robotsRule{allow: allow, length: len(pattern), matcher: regexp.MustCompile(re)}
+}
+
+// The longest matching rule wins, with Allow winning a tie.
+func (rr *robotsRules) Allowed(path string) bool {
+	if rr == nil {
+		return true
+	}
+	allowed, longest := true, -1
+	for _, rule := range rr.rules {
+		if !rule.matcher.MatchString(path) {
+			continue
+		}
+		if rule.length > longest || (rule.length == longest && rule.allow) {
+			allowed, longest = rule.allow, rule.length
+		}
+	}
+	return allowed
+}
+
+// Rules from the groups naming our agent, or if there are none, from the
+// "*" groups.
+func parseRobots(in io.Reader, agent string) *robotsRules {
+	agent = strings.ToLower(agent)
+	var specific, wildcard []robotsRule
+	var forUs, forAll, inAgents bool
+	haveSpecific := false
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		field := strings.ToLower(strings.TrimSpace(line[:colon]))
+		value := strings.TrimSpace(line[colon+1:])
+		switch field {
+		case "user-agent":
+			if !inAgents {
+				forUs, forAll = false, false
+				inAgents = true
+			}
+			ua := strings.ToLower(value)
+			if ua == "*" {
+				forAll = true
+			} else if ua != "" && strings.Contains(agent, ua) {
+				forUs = true
+				haveSpecific = true
+			}
+		case "allow", "disallow":
+			inAgents = false
+			if value == "" {
+				continue
+			}
+			rule := newRobotsRule(field == "allow", value)
+			if forUs {
+				specific = append(specific, rule)
+			}
+			if forAll {
+				wildcard = append(wildcard, rule)
+			}
+		default:
+			inAgents = false
+		}
+	}
+	if haveSpecific {
+		return &robotsRules{rules: specific}
+	}
+	return &robotsRules{rules: wildcard}
+}
+
+// Per-scan cache, shared by the QueryHost go-routines.  Two concurrent
+// fetches for the same host may both fetch robots.txt; that's cheaper than
+// serialising all of them.
+type robotsCache struct {
+	lock  sync.Mutex
+	hosts map[string]*robotsRules
+}
+
+func newRobotsCache() *robotsCache {
+	return &robotsCache{hosts: make(map[string]*robotsRules)}
+}
+
+func (rc *robotsCache) rulesFor(hostname string, port int) *robotsRules {
+	key := fmt.Sprintf("%s:%d", hostname, port)
+	rc.lock.Lock()
+	rules, ok := rc.hosts[key]
+	rc.lock.Unlock()
+	if ok {
+		return rules
+	}
+	rules, err := fetchRobots(hostname, port)
+	if err != nil {
+		Log.Printf("[%s] No usable robots.txt, assuming allowed: %s", hostname, err)
+	}
+	rc.lock.Lock()
+	rc.hosts[key] = rules
+	rc.lock.Unlock()
+	return rules
+}
+
+func (rc *robotsCache) Allowed(sn *SksNode) bool {
+	sn.Normalize()
+	return rc.rulesFor(sn.Hostname, sn.Port).Allowed(sn.uriRel)
+}
+
+// A missing robots.txt is nil rules and no error.
+func fetchRobots(hostname string, port int) (*robotsRules, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:%d/robots.txt", hostname, port), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "sks_peers/0.2 (SKS mesh spidering)")
+	resp, err := HttpDoWithTimeout(fetchClient, req, *flHttpFetchTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+	buf, err := readLimitedBody(resp.Body, *flMaxBodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	return parseRobots(bytes.NewReader(buf), kROBOTS_AGENT), nil
+}
@@ -0,0 +1,144 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRobots(t *testing.T) {
+	const robots = `# comment
+User-agent: *
+Disallow: /pks/
+
+User-agent: Googlebot
+User-agent: SKS_Peers
+Disallow: /private/ # trailing comment
+Allow: /pks/lookup?op=stats$
+Disallow: /*.php
+`
+	rules := parseRobots(strings.NewReader(robots), kROBOTS_AGENT)
+	for path, want := range map[string]bool{
+		"/pks/lookup?op=stats":   true,
+		"/pks/lookup?op=stats&x": true,
+		"/private/x":             false,
+		"/index.php":             false,
+		"/pks/add":               true,
+	} {
+		if got := rules.Allowed(path); got != want {
+			t.Fatalf("Path %q: expected allowed=%v, got %v", path, want, got)
+		}
+	}
+
+	rules = parseRobots(strings.NewReader(robots), "somebot")
+	if rules.Allowed("/pks/lookup?op=stats") || !rules.Allowed("/private/x") {
+		t.Fatalf("Wildcard group not applied to other agents")
+	}
+	var none *robotsRules
+	if !none.Allowed("/pks/lookup?op=stats") {
+		t.Fatalf("Nil rules disallow")
+	}
+	rules = parseRobots(strings.NewReader("User-agent: *\nDisallow: /pks/\nAllow: /pks/lookup\n"), kROBOTS_AGENT)
+	if !rules.Allowed("/pks/lookup?op=stats") {
+		t.Fatalf("Longer Allow did not beat shorter Disallow")
+	}
+}
+
+func TestQueryHostRespectsRobots(t *testing.T) {
+	setupTestLogging()
+	savedRobots, savedPort := *flRespectRobots, *flSksPortHkp
+	defer func() { *flRespectRobots, *flSksPortHkp = savedRobots, savedPort }()
+	*flRespectRobots = true
+
+	robots := "User-agent: *\nDisallow: /pks/\n"
+	robotsFetches, statsFetches := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/robots.txt" {
+			robotsFetches += 1
+			if robots == "" {
+				http.NotFound(w, req)
+				return
+			}
+			fmt.Fprint(w, robots)
+			return
+		}
+		statsFetches += 1
+		fmt.Fprint(w, "<html><body></body></html>")
+	}))
+	defer server.Close()
+	host, port := testServerHostPort(t, server)
+	*flSksPortHkp = port
+
+	spider := newSpider()
+	for i := 0; i < 2; i++ {
+		spider.shared.QueryHost(host)
+		result := <-spider.shared.hostResult
+		if result.err != errRobotsDisallowed {
+			t.Fatalf("Disallowed host fetched: %v", result.err)
+		}
+	}
+	if robotsFetches != 1 || statsFetches != 0 {
+		t.Fatalf("Expected 1 cached robots.txt fetch and no stats fetch, got %d and %d", robotsFetches, statsFetches)
+	}
+
+	robots = ""
+	spider = newSpider()
+	spider.shared.QueryHost(host)
+	if result := <-spider.shared.hostResult; result.err == errRobotsDisallowed {
+		t.Fatalf("Missing robots.txt treated as disallowing")
+	}
+	if statsFetches != 1 {
+		t.Fatalf("Stats page not fetched without robots.txt")
+	}
+}
+
+func TestRobotsRefusalNotStale(t *testing.T) {
+	setupTestLogging()
+	saved := *flGraceScans
+	defer func() { *flGraceScans = saved }()
+	*flGraceScans = 2
+
+	spider := newSpider()
+	seedResolvedHost(spider, "private.example.org", []string{"192.0.2.1"})
+	spider.processHostResult(&HostResult{hostname: "private.example.org", err: errRobotsDisallowed})
+	if _, ok := spider.queryErrors["private.example.org"]; ok || !spider.robotsRefused["private.example.org"] {
+		t.Fatalf("Robots refusal recorded as a fetch failure: %v", spider.queryErrors)
+	}
+
+	st := newStaleTracker()
+	now := time.Now()
+	previous := &PersistedHostInfo{
+		Timestamp: now.Add(-time.Hour),
+		HostMap: HostMap{
+			"private.example.org": &SksNode{Hostname: "private.example.org", Keycount: 3200000, IpList: []string{"192.0.2.1"}},
+		},
+	}
+	hostMap := HostMap{}
+	st.update(hostMap, spider.queryErrors, spider.badDNS, now)
+	st.carryForward(hostMap, previous, now)
+	if _, ok := hostMap["private.example.org"]; ok {
+		t.Fatalf("Old data carried forward for a host refusing by robots.txt")
+	}
+	if len(st.List()) != 0 {
+		t.Fatalf("Robots refusal counted as stale: %+v", st.List())
+	}
+}
@@ -0,0 +1,156 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// Each installed scan, written to an SQLite database for SQL queries over the
+// history of the mesh, which the in-memory snapshots can't answer.  The
+// driver needs cgo, so it's only linked in when built with "-tags sqlite";
+// without it, -scan-history-db fails at start-up.
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const kSCAN_HISTORY_DRIVER = "sqlite3"
+
+var scanHistorySchema = []string{
+	`CREATE TABLE IF NOT EXISTS scans (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp TEXT NOT NULL,
+		host_count INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS hosts (
+		scan_id INTEGER NOT NULL REFERENCES scans(id),
+		hostname TEXT NOT NULL,
+		version TEXT,
+		keycount INTEGER,
+		ips TEXT,
+		country TEXT,
+		peer_count INTEGER
+	)`,
+	`CREATE INDEX IF NOT EXISTS hosts_hostname ON hosts (hostname)`,
+}
+
+var (
+	scanHistoryDB *sql.DB
+	// One scan at a time, however slow the disk; SQLite would only make
+	// a second writer wait anyway.
+	scanHistoryLock sync.Mutex
+)
+
+func OpenScanHistory(driver, filename string) (*sql.DB, error) {
+	db, err := sql.Open(driver, filename)
+	if err != nil {
+		return nil, err
+	}
+	for _, statement := range scanHistorySchema {
+		if _, err = db.Exec(statement); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("creating schema: %s", err)
+		}
+	}
+	return db, nil
+}
+
+type scanHistoryHost struct {
+	hostname  string
+	version   string
+	keycount  int
+	ips       string // comma-separated, as are the countries
+	country   string
+	peerCount int
+}
+
+func scanHistoryHosts(persisted *PersistedHostInfo) []scanHistoryHost {
+	hosts := make([]scanHistoryHost, 0, len(persisted.Sorted))
+	for _, hostname := range persisted.Sorted {
+		node := persisted.HostMap[hostname]
+		if node == nil {
+			continue
+		}
+		countries := make([]string, 0, len(node.IpList))
+		seen := make(map[string]bool, len(node.IpList))
+		for _, ip := range node.IpList {
+			if country := persisted.IPCountryMap[ip]; country != "" && !seen[country] {
+				seen[country] = true
+				countries = append(countries, country)
+			}
+		}
+		hosts = append(hosts, scanHistoryHost{
+			hostname:  hostname,
+			version:   node.Version,
+			keycount:  node.Keycount,
+			ips:       strings.Join(node.IpList, ","),
+			country:   strings.Join(countries, ","),
+			peerCount: len(node.GossipPeerList),
+		})
+	}
+	return hosts
+}
+
+func writeScanHistory(db *sql.DB, persisted *PersistedHostInfo) (int64, error) {
+	hosts := scanHistoryHosts(persisted)
+	scanHistoryLock.Lock()
+	defer scanHistoryLock.Unlock()
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(`INSERT INTO scans (timestamp, host_count) VALUES (?, ?)`,
+		persisted.Timestamp.UTC().Format(time.RFC3339), len(hosts))
+	if err != nil {
+		return 0, err
+	}
+	scanId, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	insert, err := tx.Prepare(`INSERT INTO hosts (scan_id, hostname, version, keycount, ips, country, peer_count)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return 0, err
+	}
+	defer insert.Close()
+	for _, host := range hosts {
+		if _, err = insert.Exec(scanId, host.hostname, host.version, host.keycount, host.ips, host.country, host.peerCount); err != nil {
+			return 0, err
+		}
+	}
+	return scanId, tx.Commit()
+}
+
+// Only once the snapshot is installed, and off in its own go-routine, so
+// that neither the scan nor the API waits on the disk.
+func recordScanHistory(persisted *PersistedHostInfo) {
+	if scanHistoryDB == nil || persisted == nil {
+		return
+	}
+	go func(db *sql.DB) {
+		started := time.Now()
+		scanId, err := writeScanHistory(db, persisted)
+		if err != nil {
+			Log.Printf("Scan history: failed to record scan of %s: %s", persisted.Timestamp, err)
+			return
+		}
+		Log.Printf("Scan history: recorded scan %d, %d hosts, in %s", scanId, len(persisted.HostMap), time.Since(started))
+	}(scanHistoryDB)
+}
@@ -0,0 +1,27 @@
+//go:build sqlite
+// +build sqlite
+
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// The SQLite driver for -scan-history-db needs cgo, so isn't linked in by
+// default; build with "-tags sqlite" to have it.
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
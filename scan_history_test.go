@@ -0,0 +1,145 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records what would be written, so that the SQL side can be tested without
+// the cgo SQLite driver.
+type recordingDriver struct {
+	sync.Mutex
+	execs     []recordedExec
+	committed int
+	failOn    string
+}
+
+type recordedExec struct {
+	query string
+	args  []driver.Value
+}
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) { return &recordingConn{d}, nil }
+
+type recordingConn struct{ d *recordingDriver }
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{c.d, query}, nil
+}
+func (c *recordingConn) Close() error              { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) { return &recordingTx{c.d}, nil }
+
+type recordingTx struct{ d *recordingDriver }
+
+func (tx *recordingTx) Commit() error {
+	tx.d.Lock()
+	defer tx.d.Unlock()
+	tx.d.committed += 1
+	return nil
+}
+func (tx *recordingTx) Rollback() error { return nil }
+
+type recordingStmt struct {
+	d     *recordingDriver
+	query string
+}
+
+func (s *recordingStmt) Close() error  { return nil }
+func (s *recordingStmt) NumInput() int { return -1 }
+func (s *recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.Lock()
+	defer s.d.Unlock()
+	if s.d.failOn != "" && strings.Contains(s.query, s.d.failOn) {
+		return nil, fmt.Errorf("disk full")
+	}
+	s.d.execs = append(s.d.execs, recordedExec{s.query, args})
+	return recordingResult{}, nil
+}
+func (s *recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+type recordingResult struct{}
+
+func (recordingResult) LastInsertId() (int64, error) { return 1, nil }
+func (recordingResult) RowsAffected() (int64, error) { return 1, nil }
+
+var testHistoryDriver = &recordingDriver{}
+
+func init() {
+	sql.Register("recording", testHistoryDriver)
+}
+
+func TestScanHistory(t *testing.T) {
+	persisted := &PersistedHostInfo{
+		HostMap: HostMap{
+			"keys.example.org": &SksNode{Version: "1.1.6", Keycount: 6000000, IpList: []string{"192.0.2.1", "2001:db8::1"},
+				GossipPeerList: []string{"pgp.example.net", "sks.example.com"}},
+			"pgp.example.net": &SksNode{Version: "2.1.0", Keycount: 5900000, IpList: []string{"198.51.100.7"}},
+		},
+		IPCountryMap: IPCountryMap{"192.0.2.1": "DE", "2001:db8::1": "DE", "198.51.100.7": "NL"},
+		Sorted:       []string{"keys.example.org", "pgp.example.net"},
+		Timestamp:    time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC),
+	}
+
+	db, err := OpenScanHistory("recording", "history.db")
+	if err != nil {
+		t.Fatalf("Opening failed: %s", err)
+	}
+	defer db.Close()
+	if len(testHistoryDriver.execs) != len(scanHistorySchema) || !strings.Contains(testHistoryDriver.execs[0].query, "IF NOT EXISTS scans") {
+		t.Fatalf("Schema not created: %+v", testHistoryDriver.execs)
+	}
+
+	testHistoryDriver.execs = nil
+	if _, err := writeScanHistory(db, persisted); err != nil {
+		t.Fatalf("Writing failed: %s", err)
+	}
+	execs := testHistoryDriver.execs
+	if len(execs) != 3 || testHistoryDriver.committed != 1 {
+		t.Fatalf("Expected a scan and 2 hosts committed, got %d commits: %+v", testHistoryDriver.committed, execs)
+	}
+	if !strings.Contains(execs[0].query, "INTO scans") || execs[0].args[0] != "2026-10-16T12:00:00Z" || execs[0].args[1] != int64(2) {
+		t.Fatalf("Bad scan row: %+v", execs[0])
+	}
+	want := []driver.Value{"keys.example.org", "1.1.6", int64(6000000), "192.0.2.1,2001:db8::1", "DE", int64(2)}
+	for i, value := range want {
+		if execs[1].args[i+1] != value {
+			t.Fatalf("Bad host row, column %d: got %v, expected %v: %+v", i+1, execs[1].args[i+1], value, execs[1])
+		}
+	}
+	if execs[2].args[1] != "pgp.example.net" || execs[2].args[5] != "NL" || execs[2].args[6] != int64(0) {
+		t.Fatalf("Bad host row: %+v", execs[2])
+	}
+
+	testHistoryDriver.failOn = "INTO hosts"
+	defer func() { testHistoryDriver.failOn = "" }()
+	if _, err := writeScanHistory(db, persisted); err == nil || testHistoryDriver.committed != 1 {
+		t.Fatalf("Failed write committed, or error lost: %v", err)
+	}
+
+	if _, err := OpenScanHistory("no-such-driver", "history.db"); err == nil {
+		t.Fatalf("Opened history with no driver")
+	}
+}
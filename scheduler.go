@@ -0,0 +1,173 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Don't let a bad flag value hammer the mesh
+const kSCAN_MIN_INTERVAL = 30 * time.Minute
+
+// Runs a scan every Interval (+/- Jitter/2), installing the results as the
+// current persisted information.  If a scan is still running when the next
+// is due, that tick is skipped rather than starting a second spider.
+type Scheduler struct {
+	Interval time.Duration
+	Jitter   time.Duration
+
+	lock     sync.Mutex
+	running  bool
+	nextScan time.Time
+}
+
+func NewScheduler(interval, jitter time.Duration) *Scheduler {
+	return &Scheduler{Interval: interval, Jitter: jitter}
+}
+
+// Zero until the first delay has been calculated
+func (s *Scheduler) NextScan() time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.nextScan
+}
+
+func (s *Scheduler) Running() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.running
+}
+
+func (s *Scheduler) nextDelay() time.Duration {
+	delay := s.Interval
+	if s.Jitter > 0 {
+		jitter := time.Duration(rand.Int63n(int64(s.Jitter)))
+		delay += jitter - s.Jitter/2
+	}
+	if delay < kSCAN_MIN_INTERVAL {
+		Log.Printf("respider period too low, capping %s up to %s", delay, kSCAN_MIN_INTERVAL)
+		delay = kSCAN_MIN_INTERVAL
+	}
+	return delay
+}
+
+func (s *Scheduler) tryStart() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.running {
+		return false
+	}
+	s.running = true
+	return true
+}
+
+func (s *Scheduler) finished() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.running = false
+}
+
+// Start a scan immediately, unless one is already running.
+func (s *Scheduler) ScanNow() bool {
+	if !s.tryStart() {
+		return false
+	}
+	go s.scan(false)
+	return true
+}
+
+// For the initial scan at startup, run in the caller's go-routine but still
+// marked as running, so that nothing else starts a scan meanwhile.
+func (s *Scheduler) ScanAndWait(dumpJson bool) bool {
+	if !s.tryStart() {
+		return false
+	}
+	s.scan(dumpJson)
+	return true
+}
+
+// Never returns; invoke as a go-routine.
+func (s *Scheduler) Run() {
+	for {
+		delay := s.nextDelay()
+		s.lock.Lock()
+		s.nextScan = time.Now().Add(delay)
+		s.lock.Unlock()
+		Log.Printf("Sleeping %s before next respider", delay)
+		time.Sleep(delay)
+		if !s.tryStart() {
+			Log.Printf("Awoken, but previous scan still running; skipping this one")
+			continue
+		}
+		Log.Printf("Awoken!  Time to spider.")
+		go s.scan(false)
+	}
+}
+
+func (s *Scheduler) scan(dumpJson bool) {
+	defer s.finished()
+	started := time.Now()
+	Log.Printf("Scan starting")
+	var spider *Spider
+	complete := true
+	LoadStatsPathsFile()
+	func() {
+		spider = StartSpider(context.Background())
+		defer func(sp *Spider) {
+			if r := recover(); r != nil {
+				Log.Printf("Spider paniced: %s", r)
+			}
+			sp.Terminate()
+		}(spider)
+		spider.AddHost(*flSpiderStartHost, 0)
+		for _, hostname := range pinnedHosts() {
+			spider.AddHost(hostname, 0)
+		}
+		complete = spider.WaitAtMost(*flMaxScanDuration)
+	}()
+	if *flLogScanPhases {
+		Log.Printf("Scan phases: %s", spider.Phases())
+	}
+	if !complete {
+		gathered := 0
+		for _, node := range spider.serverInfos {
+			if node != nil {
+				gathered += 1
+			}
+		}
+		Log.Printf("Scan cut short by -max-scan-duration after %s: %d hosts gathered, %d hostnames abandoned",
+			time.Since(started), gathered, spider.abandonedHosts)
+		if gathered < *flMinScanHosts {
+			Log.Printf("Not installing partial scan with fewer than %d hosts", *flMinScanHosts)
+			return
+		}
+	}
+	persisted := normaliseMeshAndSet(spider, dumpJson)
+	duration := time.Since(started)
+	if persisted == nil {
+		Log.Printf("Scan finished after %s, but was rejected", duration)
+		return
+	}
+	Log.Printf("Scan finished after %s with %d hosts", duration, len(persisted.HostMap))
+	if len(persisted.HostMap) > 0 {
+		notifyScanWebhook(persisted.Summary, duration)
+		recordScanHistory(persisted)
+	}
+}
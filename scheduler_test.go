@@ -0,0 +1,51 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedulerDelay(t *testing.T) {
+	setupTestLogging()
+	s := NewScheduler(8*time.Hour, 2*time.Minute)
+	for i := 0; i < 100; i++ {
+		d := s.nextDelay()
+		if d < 8*time.Hour-time.Minute || d >= 8*time.Hour+time.Minute {
+			t.Fatalf("Delay %s outside of jitter range", d)
+		}
+	}
+	s = NewScheduler(time.Minute, 0)
+	if d := s.nextDelay(); d != kSCAN_MIN_INTERVAL {
+		t.Fatalf("Short interval not capped, got %s", d)
+	}
+}
+
+func TestSchedulerSkipsOverlap(t *testing.T) {
+	s := NewScheduler(time.Hour, 0)
+	if !s.tryStart() {
+		t.Fatalf("Idle scheduler refused to start")
+	}
+	if s.tryStart() {
+		t.Fatalf("Scheduler started a second concurrent scan")
+	}
+	s.finished()
+	if s.Running() || !s.tryStart() {
+		t.Fatalf("Scheduler did not become startable after finishing")
+	}
+}
@@ -77,6 +77,11 @@ func LoadJSONFromFile(filename string) (HostMap, error) {
 	for n := range hostmap {
 		if hostmap[n] != nil {
 			hostmap[n].initialised = true
+			if len(hostmap[n].IpList) > 0 {
+				hostmap[n].IpList = flattenIPs(hostmap[n].IpList)
+			}
+			// dumps from before these existed
+			hostmap[n].setAddressFamilies()
 		}
 	}
 	return hostmap, nil
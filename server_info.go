@@ -17,9 +17,12 @@
 package sks_spider
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -47,18 +50,41 @@ type SksNode struct {
 	Settings       map[string]string
 	GossipPeers    map[string]string
 	GossipPeerList []string
+	ReportedPeers  int // self-reported gossip peer count, 0 if none
+	PeersListed    int `json:"peers_listed,omitempty"` // when more than flMaxPeersPerHost
 	MailsyncPeers  []string
 	Version        string
 	Software       string
 	Keycount       int
+	FetchDuration  time.Duration
+	HttpProto      string `json:"http_proto,omitempty"`
+	TLSVersion     string `json:"tls_version,omitempty"`
+	TLSCipherSuite string `json:"tls_cipher_suite,omitempty"`
+	StatsPath      string `json:"stats_path,omitempty"` // which candidate gave a stats page
+	FinalURL       string `json:"final_url,omitempty"`  // after redirects, with -max-redirects
+	CrossHost      bool   `json:"cross_host_redirect,omitempty"`
+	AdminContact   string `json:"admin_contact,omitempty"` // see -public-contacts
+	KeyTotal       int    `json:"key_total,omitempty"`     // from Settings, where given
+	HTTPPortNum    int    `json:"http_port,omitempty"`
+	ReconPortNum   int    `json:"recon_port,omitempty"`
 	pageContent    *htmlp.HtmlDocument
+	jsonStatus     *hockeypuckStats
+	rawPage        []byte
 	analyzeError   error
 
 	// And these are populated when converted into a HostMap
 	AnalyzeError string
 	IpList       []string
+	HasIPv4      bool `json:"has_ipv4"`
+	HasIPv6      bool `json:"has_ipv6"`
 	Aliases      []string
 	Distance     int
+	Annotation   string
+	// Non-zero when this scan failed and the data was carried forward from
+	// the snapshot of this time, within the grace window
+	LastGoodScan time.Time
+	// Named in -pinned-hosts: never purged or pruned
+	Pinned bool `json:"pinned,omitempty"`
 }
 
 func (sn *SksNode) Dump(out io.Writer) {
@@ -96,18 +122,23 @@ func (sn *SksNode) Normalize() bool {
 		// Will be overriden from the spider later
 		sn.Distance = -1
 	}
-	sn.uriRel = "/pks/lookup?op=stats"
-	sn.uri = fmt.Sprintf("http://%s:%d%s", sn.Hostname, sn.Port, sn.uriRel)
+	sn.setStatsPath(statsPathsFor(sn.Hostname)[0])
 	sn.initialised = true
 	return true
 }
 
+func (sn *SksNode) setStatsPath(path string) {
+	sn.uriRel = path
+	sn.uri = fmt.Sprintf("http://%s:%d%s", sn.Hostname, sn.Port, sn.uriRel)
+}
+
 // Dump the large content, let garbage collection reclaim space
 func (sn *SksNode) Minimize() {
 	if sn.pageContent != nil {
 		sn.pageContent.Free()
 		sn.pageContent = nil
 	}
+	sn.jsonStatus = nil
 }
 
 type httpFetchResults struct {
@@ -131,27 +162,122 @@ func HttpDoWithTimeout(c *http.Client, req *http.Request, timeout time.Duration)
 	panic("not reached")
 }
 
+// Each candidate path is tried in turn until one gives something which looks
+// like a stats page; whatever the last one gives is kept, for Analyze to
+// report on.
 func (sn *SksNode) Fetch() error {
+	return sn.FetchContext(context.Background())
+}
+
+// As Fetch, but cancelling ctx aborts the request in flight.
+func (sn *SksNode) FetchContext(ctx context.Context) error {
 	sn.Normalize()
-	req, err := http.NewRequest("GET", sn.uri, nil)
+	paths := statsPathsFor(sn.Hostname)
+	var err error
+	for i, path := range paths {
+		sn.setStatsPath(path)
+		err = sn.fetchStatsPage(ctx)
+		if err == nil && sn.isStatsPage() {
+			sn.StatsPath = path
+			return nil
+		}
+		if i == len(paths)-1 || ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			Log.Printf("[%s] Fetching %s failed, trying next path: %s", sn.Hostname, path, err)
+		} else {
+			Log.Printf("[%s] No stats page at %s (%s), trying next path", sn.Hostname, path, sn.Status)
+		}
+	}
+	return err
+}
+
+func (sn *SksNode) isStatsPage() bool {
+	if !strings.HasPrefix(sn.Status, "200") {
+		return false
+	}
+	if sn.jsonStatus != nil {
+		return true
+	}
+	if sn.pageContent == nil {
+		return false
+	}
+	for _, heading := range []string{"Settings", "Statistics"} {
+		res, err := sn.pageContent.Root().Search(fmt.Sprintf(`//*[text()="%s"]`, heading))
+		if err == nil && len(res) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (sn *SksNode) fetchStatsPage(ctx context.Context) error {
+	sn.Minimize()
+	sn.rawPage = nil
+	sn.Status, sn.ServerHeader, sn.ViaHeader = "", "", ""
+	req, err := http.NewRequestWithContext(ctx, "GET", sn.uri, nil)
 	if err != nil {
 		return err
 	}
 	req.Header.Set("User-Agent", "sks_peers/0.2 (SKS mesh spidering)")
-	resp, err := HttpDoWithTimeout(http.DefaultClient, req, *flHttpFetchTimeout)
+	resp, err := HttpDoWithTimeout(fetchClient, req, *flHttpFetchTimeout)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	sn.Status = resp.Status
+	sn.recordConnection(resp)
+	sn.recordRedirect(resp)
 	Log.Printf("[%s] Response status: %s", sn.Hostname, sn.Status)
 	sn.ServerHeader = resp.Header.Get("Server")
 	sn.ViaHeader = resp.Header.Get("Via")
 	//doc, err := ehtml.Parse(resp.Body)
-	buf, err := ioutil.ReadAll(resp.Body)
+	buf, err := readLimitedBody(resp.Body, *flMaxBodyBytes)
 	if err != nil {
 		return err
 	}
+	if *flKeepRawPages {
+		sn.rawPage = buf
+	}
+	return sn.parsePage(buf)
+}
+
+// For auditing the mesh's TLS; a page fetched over plain HTTP leaves the TLS
+// fields empty.
+func (sn *SksNode) recordConnection(resp *http.Response) {
+	sn.HttpProto = resp.Proto
+	if resp.TLS == nil {
+		return
+	}
+	sn.TLSVersion = tls.VersionName(resp.TLS.Version)
+	sn.TLSCipherSuite = tls.CipherSuiteName(resp.TLS.CipherSuite)
+}
+
+// A stats page is a few kB; anything huge is broken or hostile and we don't
+// want to OOM finding out which.
+func readLimitedBody(body io.Reader, max int64) ([]byte, error) {
+	buf, err := ioutil.ReadAll(&io.LimitedReader{R: body, N: max + 1})
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) > max {
+		return nil, fmt.Errorf("response body exceeds limit of %d bytes", max)
+	}
+	return buf, nil
+}
+
+// Split out from Fetch so that a captured stats page can be analyzed without
+// needing a live server.
+func (sn *SksNode) parsePage(buf []byte) error {
+	if looksLikeJson(buf) {
+		stats, err := parseHockeypuckStats(buf)
+		if err != nil {
+			return err
+		}
+		sn.jsonStatus = stats
+		return nil
+	}
 	doc, err := htmlp.Parse(buf, htmlp.DefaultEncodingBytes, nil, htmlp.DefaultParseOption, htmlp.DefaultEncodingBytes)
 	if err != nil {
 		return err
@@ -239,6 +365,11 @@ func (sn *SksNode) Analyze() {
 		sn.analyzeError = fmt.Errorf("HTTP GET failure: %s", sn.Status)
 		return
 	}
+	if sn.jsonStatus != nil {
+		sn.analyzeHockeypuck()
+		sn.Minimize()
+		return
+	}
 
 	if mailsync, err := sn.plainRowsOf("Outgoing Mailsync Peers"); err == nil {
 		sn.MailsyncPeers = mailsync
@@ -246,18 +377,25 @@ func (sn *SksNode) Analyze() {
 	if settings, err := sn.kvdictFromTable("Settings"); err == nil {
 		sn.Settings = settings
 	}
-	sn.Version = sn.Settings["Version"]
-	sn.Software = sn.Settings["Software"]
-	if res, err := sn.pageContent.Root().Search(`//h2[text()="Statistics"]`); err == nil {
-		content := res[0].NextSibling().Content()
-		if strings.HasPrefix(content, "Total number of keys") {
-			content = strings.TrimSpace(strings.SplitN(content, ":", 2)[1])
-			sn.Keycount, err = strconv.Atoi(content)
-			if err != nil {
+	sn.Version, _ = sn.ReportedVersion()
+	sn.Software, _ = sn.ReportedSoftware()
+	sn.AdminContact, _ = sn.ReportedContact()
+	// A page cut short, or mangled by a proxy, can lack any of the pieces
+	// here, which used to panic; the keycount is then left as unknown.
+	if res, err := sn.pageContent.Root().Search(`//h2[text()="Statistics"]`); err == nil && len(res) > 0 {
+		if next := res[0].NextSibling(); next != nil {
+			content := next.Content()
+			if strings.HasPrefix(content, "Total number of keys") {
 				sn.Keycount = -1
+				if parts := strings.SplitN(content, ":", 2); len(parts) == 2 {
+					if count, err := strconv.Atoi(strings.TrimSpace(parts[1])); err == nil {
+						sn.Keycount = count
+					}
+				}
 			}
 		}
 	}
+	sn.setTypedSettings()
 
 	if peers, err := sn.dictFromPlainRows("Gossip Peers"); err == nil {
 		sn.GossipPeerList = make([]string, len(peers))
@@ -274,21 +412,56 @@ func (sn *SksNode) Analyze() {
 		}
 		sn.GossipPeers = peers
 	}
+	sn.ReportedPeers, _ = sn.ReportedPeerCount()
+	if sn.PeerListTruncated() {
+		Log.Printf("[%s] Parsed %d gossip peers but server reports %d", sn.Hostname, len(sn.GossipPeerList), sn.ReportedPeers)
+	}
 
 	sn.Minimize()
 }
 
+// Derived from IpList, so that consumers of the JSON needn't classify
+// addresses themselves.
+func (sn *SksNode) setAddressFamilies() {
+	sn.HasIPv4, sn.HasIPv6 = false, false
+	for _, ipstr := range sn.IpList {
+		ip := net.ParseIP(ipstr)
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			sn.HasIPv4 = true
+		} else {
+			sn.HasIPv6 = true
+		}
+	}
+}
+
+// Without a Via header and with the keyserver's own Server header, we're
+// talking to the keyserver directly rather than through a web-proxy.
+func (sn *SksNode) ServedNatively() bool {
+	if sn.ViaHeader != "" {
+		return false
+	}
+	server := strings.ToLower(strings.SplitN(sn.ServerHeader, "/", 2)[0])
+	return serverHeadersNative[server]
+}
+
 func (sn *SksNode) Url() string {
 	if sn.uri != "" {
 		return sn.uri
 	}
 	// JSON reloaded
-	return fmt.Sprintf("http://%s:%d/pks/lookup?op=stats", sn.Hostname, sn.Port)
+	path := sn.StatsPath
+	if path == "" {
+		path = kDEFAULT_STATS_PATH
+	}
+	return fmt.Sprintf("http://%s:%d%s", sn.Hostname, sn.Port, path)
 }
 
 func NodeUrl(name string, sn *SksNode) string {
 	if sn != nil {
 		return sn.Url()
 	}
-	return fmt.Sprintf("http://%s:%d/pks/lookup?op=stats", name, *flSksPortHkp)
+	return fmt.Sprintf("http://%s:%d%s", name, *flSksPortHkp, statsPathsFor(name)[0])
 }
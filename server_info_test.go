@@ -0,0 +1,99 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Split a test server's URL into the host and port that an SksNode wants
+func testServerHostPort(t *testing.T, server *httptest.Server) (string, int) {
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Bad test server URL \"%s\": %s", server.URL, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		t.Fatalf("Bad test server port \"%s\": %s", portStr, err)
+	}
+	return host, port
+}
+
+func TestFetchBodyLimit(t *testing.T) {
+	setupTestLogging()
+	savedMax, savedPort := *flMaxBodyBytes, *flSksPortHkp
+	defer func() { *flMaxBodyBytes, *flSksPortHkp = savedMax, savedPort }()
+	*flMaxBodyBytes = 1024
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "<html><body><p>%s</p></body></html>", strings.Repeat("x", 1<<20))
+	}))
+	defer server.Close()
+	host, port := testServerHostPort(t, server)
+	*flSksPortHkp = port
+
+	spider := newSpider()
+	spider.shared.QueryHost(host)
+	result := <-spider.shared.hostResult
+	if result.err == nil || !strings.Contains(result.err.Error(), "exceeds limit") {
+		t.Fatalf("Oversized body not rejected: %v", result.err)
+	}
+	spider.processHostResult(result)
+	if _, ok := spider.queryErrors[host]; !ok {
+		t.Fatalf("Oversized body not recorded as a query error")
+	}
+	if spider.serverInfos[host] != nil {
+		t.Fatalf("Host with oversized body recorded as having data")
+	}
+}
+
+func TestRecordConnection(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "<html></html>")
+	})
+	for _, tc := range []struct {
+		server *httptest.Server
+		tls    bool
+	}{
+		{httptest.NewServer(handler), false},
+		{httptest.NewTLSServer(handler), true},
+	} {
+		defer tc.server.Close()
+		resp, err := tc.server.Client().Get(tc.server.URL)
+		if err != nil {
+			t.Fatalf("Fetch from %s failed: %s", tc.server.URL, err)
+		}
+		resp.Body.Close()
+		node := &SksNode{}
+		node.recordConnection(resp)
+		if node.HttpProto != "HTTP/1.1" {
+			t.Fatalf("Bad protocol from %s: %q", tc.server.URL, node.HttpProto)
+		}
+		if tc.tls && (!strings.HasPrefix(node.TLSVersion, "TLS ") || !strings.HasPrefix(node.TLSCipherSuite, "TLS_")) {
+			t.Fatalf("TLS not recorded: version %q cipher %q", node.TLSVersion, node.TLSCipherSuite)
+		}
+		if !tc.tls && (node.TLSVersion != "" || node.TLSCipherSuite != "") {
+			t.Fatalf("TLS recorded for plain HTTP: version %q cipher %q", node.TLSVersion, node.TLSCipherSuite)
+		}
+	}
+}
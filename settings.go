@@ -0,0 +1,155 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// Typed access to the "Settings" table of a stats page, so that callers
+// don't need to know the magic keys or repeat the parsing.
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Keys as they appear in the Settings table, with the trailing colon removed
+const (
+	kSETTING_HOSTNAME    = "Hostname"
+	kSETTING_NODENAME    = "Nodename"
+	kSETTING_VERSION     = "Version"
+	kSETTING_SOFTWARE    = "Software"
+	kSETTING_HTTP_PORT   = "HTTP port"
+	kSETTING_RECON_PORT  = "Recon port"
+	kSETTING_DEBUG_LEVEL = "Debug level"
+	kSETTING_CONTACT     = "Server contact"
+)
+
+// Stock SKS doesn't report how many peers it has, but some builds put a
+// count in the Settings table, under any of these names.
+var peerCountSettings = []string{"Gossip peers", "Number of peers", "Peer count"}
+
+// Likewise a total key count, beside the one under Statistics
+var keyTotalSettings = []string{"Total number of keys", "Total keys"}
+
+func (sn *SksNode) settingString(key string) (string, bool) {
+	if sn.Settings == nil {
+		return "", false
+	}
+	value, ok := sn.Settings[key]
+	if !ok {
+		return "", false
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", false
+	}
+	return value, true
+}
+
+func (sn *SksNode) settingInt(key string) (int, bool) {
+	value, ok := sn.settingString(key)
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	return i, true
+}
+
+func (sn *SksNode) settingPort(key string) (int, bool) {
+	port, ok := sn.settingInt(key)
+	if !ok || port < 1 || port > 65535 {
+		return 0, false
+	}
+	return port, true
+}
+
+// The hostname which the server claims for itself, which need not match the
+// name we used to query it.
+func (sn *SksNode) ReportedHostname() (string, bool) {
+	return sn.settingString(kSETTING_HOSTNAME)
+}
+
+// Only some servers report a nodename; it's often not a hostname at all.
+func (sn *SksNode) NodeName() (string, bool) {
+	return sn.settingString(kSETTING_NODENAME)
+}
+
+func (sn *SksNode) ReportedVersion() (string, bool) {
+	return sn.settingString(kSETTING_VERSION)
+}
+
+// SKS doesn't report this, other implementations (GnuKS) do.
+func (sn *SksNode) ReportedSoftware() (string, bool) {
+	return sn.settingString(kSETTING_SOFTWARE)
+}
+
+// Whatever the operator put there: usually a key ID, sometimes an email
+// address, often nothing.
+func (sn *SksNode) ReportedContact() (string, bool) {
+	return sn.settingString(kSETTING_CONTACT)
+}
+
+func (sn *SksNode) HTTPPort() (int, bool) {
+	return sn.settingPort(kSETTING_HTTP_PORT)
+}
+
+func (sn *SksNode) ReconPort() (int, bool) {
+	return sn.settingPort(kSETTING_RECON_PORT)
+}
+
+func (sn *SksNode) DebugLevel() (int, bool) {
+	return sn.settingInt(kSETTING_DEBUG_LEVEL)
+}
+
+func (sn *SksNode) ReportedPeerCount() (int, bool) {
+	for _, key := range peerCountSettings {
+		if count, ok := sn.settingInt(key); ok && count >= 0 {
+			return count, true
+		}
+	}
+	return 0, false
+}
+
+func (sn *SksNode) ReportedKeyTotal() (int, bool) {
+	for _, key := range keyTotalSettings {
+		if total, ok := sn.settingInt(key); ok && total >= 0 {
+			return total, true
+		}
+	}
+	return 0, false
+}
+
+// The typed fields are left zero for anything missing or garbage.  Where the
+// Settings table has a total too, Keycount is still the Statistics count; a
+// disagreement is only logged.
+func (sn *SksNode) setTypedSettings() {
+	sn.HTTPPortNum, _ = sn.HTTPPort()
+	sn.ReconPortNum, _ = sn.ReconPort()
+	total, ok := sn.ReportedKeyTotal()
+	sn.KeyTotal = total
+	if ok && total != sn.Keycount {
+		Log.Printf("[%s] Warning: keycount %d under Statistics, but %d in Settings",
+			sn.Hostname, sn.Keycount, total)
+	}
+}
+
+// A parsed peer list shorter than the server's own count means we mangled
+// the page, or the page itself was truncated.
+func (sn *SksNode) PeerListTruncated() bool {
+	return sn.ReportedPeers > len(sn.GossipPeerList)
+}
@@ -0,0 +1,224 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const TEST_STATS_SKS = "data/stats-sks-1.1.4.html"
+const TEST_STATS_GNUKS = "data/stats-gnuks.html"
+const TEST_STATS_HOCKEYPUCK = "data/stats-hockeypuck.json"
+const TEST_STATS_SETTINGS_TOTAL = "data/stats-sks-settings-total.html"
+
+func loadCapturedNode(t *testing.T, filename, hostname string) *SksNode {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read \"%s\": %s", filename, err)
+	}
+	node := &SksNode{Hostname: hostname, Status: "200 OK"}
+	node.Normalize()
+	if err = node.parsePage(buf); err != nil {
+		t.Fatalf("Failed to parse \"%s\": %s", filename, err)
+	}
+	node.Analyze()
+	return node
+}
+
+func TestSettingsSks(t *testing.T) {
+	node := loadCapturedNode(t, TEST_STATS_SKS, "keys.kfwebs.net")
+
+	if name, ok := node.ReportedHostname(); !ok || name != "keys.kfwebs.net" {
+		t.Fatalf("Bad hostname: %q %v", name, ok)
+	}
+	if name, ok := node.NodeName(); !ok || name != "alpha" {
+		t.Fatalf("Bad nodename: %q %v", name, ok)
+	}
+	if port, ok := node.HTTPPort(); !ok || port != 11372 {
+		t.Fatalf("Bad HTTP port: %d %v", port, ok)
+	}
+	if port, ok := node.ReconPort(); !ok || port != 11370 {
+		t.Fatalf("Bad recon port: %d %v", port, ok)
+	}
+	if level, ok := node.DebugLevel(); !ok || level != 5 {
+		t.Fatalf("Bad debug level: %d %v", level, ok)
+	}
+	if software, ok := node.ReportedSoftware(); ok {
+		t.Fatalf("SKS unexpectedly reported software \"%s\"", software)
+	}
+	if node.Version != "1.1.4+" {
+		t.Fatalf("Bad version: %q", node.Version)
+	}
+	if node.AdminContact != "0x0b7f8b60e3edfae3" {
+		t.Fatalf("Bad contact: %q", node.AdminContact)
+	}
+	if node.Keycount != 3169004 {
+		t.Fatalf("Bad keycount: %d", node.Keycount)
+	}
+	if node.HTTPPortNum != 11372 || node.ReconPortNum != 11370 || node.KeyTotal != 0 {
+		t.Fatalf("Bad typed settings: http %d recon %d total %d", node.HTTPPortNum, node.ReconPortNum, node.KeyTotal)
+	}
+	if len(node.GossipPeerList) != 4 {
+		t.Fatalf("Expected 4 gossip peers, got %d: %v", len(node.GossipPeerList), node.GossipPeerList)
+	}
+}
+
+func TestSettingsGnuks(t *testing.T) {
+	node := loadCapturedNode(t, TEST_STATS_GNUKS, "keyserver.rainydayz.org")
+
+	if name, ok := node.NodeName(); ok {
+		t.Fatalf("Unexpectedly found nodename \"%s\"", name)
+	}
+	if port, ok := node.HTTPPort(); !ok || port != 11371 {
+		t.Fatalf("Bad HTTP port: %d %v", port, ok)
+	}
+	if port, ok := node.ReconPort(); ok {
+		t.Fatalf("Unparseable recon port accepted as %d", port)
+	}
+	if node.Software != "GnuKS" {
+		t.Fatalf("Bad software: %q", node.Software)
+	}
+	if node.AdminContact != "" {
+		t.Fatalf("Contact %q from a page without one", node.AdminContact)
+	}
+}
+
+func TestSettingsMissing(t *testing.T) {
+	node := &SksNode{Hostname: "example.org"}
+	if _, ok := node.ReportedHostname(); ok {
+		t.Fatalf("Got hostname from node without settings")
+	}
+	if _, ok := node.HTTPPort(); ok {
+		t.Fatalf("Got HTTP port from node without settings")
+	}
+	node.Settings = map[string]string{"HTTP port": "70000", "Nodename": "  "}
+	if port, ok := node.HTTPPort(); ok {
+		t.Fatalf("Out-of-range HTTP port accepted as %d", port)
+	}
+	if _, ok := node.NodeName(); ok {
+		t.Fatalf("Blank nodename accepted")
+	}
+}
+
+func TestSettingsPeerCount(t *testing.T) {
+	node := loadCapturedNode(t, TEST_STATS_SKS, "keys.kfwebs.net")
+	if count, ok := node.ReportedPeerCount(); ok || node.ReportedPeers != 0 {
+		t.Fatalf("SKS unexpectedly reported %d peers", count)
+	}
+	if node.PeerListTruncated() {
+		t.Fatalf("Peer list truncated without a reported count")
+	}
+
+	node.Settings["Number of peers"] = "6"
+	node.ReportedPeers, _ = node.ReportedPeerCount()
+	if node.ReportedPeers != 6 || !node.PeerListTruncated() {
+		t.Fatalf("Claimed 6 peers with 4 listed not flagged: %d", node.ReportedPeers)
+	}
+
+	persisted := &PersistedHostInfo{
+		HostMap: HostMap{"keys.kfwebs.net": node, "fine.example.org": &SksNode{}},
+		Sorted:  []string{"fine.example.org", "keys.kfwebs.net"},
+	}
+	var out bytes.Buffer
+	PeerCountDiagnostics(&out, persisted)
+	if !strings.Contains(out.String(), "keys.kfwebs.net") || !strings.Contains(out.String(), "parsed 4 of 6") ||
+		strings.Contains(out.String(), "fine.example.org") {
+		t.Fatalf("Bad diagnostics:\n%s", out.String())
+	}
+}
+
+func TestSettingsHockeypuck(t *testing.T) {
+	node := loadCapturedNode(t, TEST_STATS_HOCKEYPUCK, "keyserver.example.net")
+
+	if node.analyzeError != nil {
+		t.Fatalf("Analyze failed: %s", node.analyzeError)
+	}
+	if name, ok := node.ReportedHostname(); !ok || name != "keyserver.example.net" {
+		t.Fatalf("Bad hostname: %q %v", name, ok)
+	}
+	if name, ok := node.NodeName(); !ok || name != "hkp1" {
+		t.Fatalf("Bad nodename: %q %v", name, ok)
+	}
+	if port, ok := node.HTTPPort(); !ok || port != 11371 {
+		t.Fatalf("Bad HTTP port: %d %v", port, ok)
+	}
+	if port, ok := node.ReconPort(); !ok || port != 11370 {
+		t.Fatalf("Bad recon port: %d %v", port, ok)
+	}
+	if node.Version != "2.1.0" || node.Software != "Hockeypuck" {
+		t.Fatalf("Bad version: %q %q", node.Software, node.Version)
+	}
+	if node.Keycount != 6382107 {
+		t.Fatalf("Bad keycount: %d", node.Keycount)
+	}
+	if node.HTTPPortNum != 11371 || node.ReconPortNum != 11370 {
+		t.Fatalf("Bad typed ports: http %d recon %d", node.HTTPPortNum, node.ReconPortNum)
+	}
+	if node.AdminContact != "0x1234567890ABCDEF" {
+		t.Fatalf("Bad contact: %q", node.AdminContact)
+	}
+	if len(node.GossipPeerList) != 3 || node.GossipPeerList[1] != "gpg-keyserver.de" {
+		t.Fatalf("Expected 3 gossip peers, got %d: %v", len(node.GossipPeerList), node.GossipPeerList)
+	}
+	if node.GossipPeers["keys.thoma.cc"] != "11370" {
+		t.Fatalf("Bad gossip peer ports: %v", node.GossipPeers)
+	}
+	if node.jsonStatus != nil {
+		t.Fatalf("Parsed status not released")
+	}
+}
+
+func TestSettingsKeyTotal(t *testing.T) {
+	setupTestLogging()
+	// Garbage HTTP port and Statistics count, but a total under Settings
+	node := loadCapturedNode(t, TEST_STATS_SETTINGS_TOTAL, "keys.kfwebs.net")
+	if node.analyzeError != nil {
+		t.Fatalf("Analyze failed: %s", node.analyzeError)
+	}
+	if node.HTTPPortNum != 0 || node.ReconPortNum != 11370 {
+		t.Fatalf("Bad typed ports: http %d recon %d", node.HTTPPortNum, node.ReconPortNum)
+	}
+	if node.KeyTotal != 3169010 || node.Keycount == 3169010 {
+		t.Fatalf("Settings total replaced unparseable keycount: total %d keycount %d", node.KeyTotal, node.Keycount)
+	}
+
+	// Where both are given, Statistics wins
+	node.Keycount = 3169004
+	node.setTypedSettings()
+	if node.KeyTotal != 3169010 || node.Keycount != 3169004 {
+		t.Fatalf("Statistics keycount overridden: total %d keycount %d", node.KeyTotal, node.Keycount)
+	}
+
+	node.Settings = map[string]string{"Total keys": "-5", "Recon port": "0x2c6a"}
+	node.setTypedSettings()
+	if node.KeyTotal != 0 || node.ReconPortNum != 0 || node.Keycount != 3169004 {
+		t.Fatalf("Garbage settings not left zero: %+v", node)
+	}
+	node.Settings = map[string]string{"Total": "12"}
+	node.setTypedSettings()
+	if node.KeyTotal != 0 {
+		t.Fatalf("Bare \"Total\" taken as the key total: %d", node.KeyTotal)
+	}
+	node.Settings = nil
+	node.setTypedSettings()
+	if node.KeyTotal != 0 || node.HTTPPortNum != 0 {
+		t.Fatalf("Typed settings from a node without settings: %+v", node)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// The snapshot before the current one is kept on standby, for comparison and
+// so that a bad scan can be rolled back.  A scan rejected for losing too many
+// hosts becomes the standby instead, in case the loss was real after all.
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Guarded by currentHostMapLock, and as immutable as the current snapshot
+var standbyHostInfo *PersistedHostInfo
+
+func GetStandbyPersisted() *PersistedHostInfo {
+	currentHostMapLock.RLock()
+	defer currentHostMapLock.RUnlock()
+	return standbyHostInfo
+}
+
+func SetStandbyPersisted(p *PersistedHostInfo) {
+	preparePersisted(p)
+	currentHostMapLock.Lock()
+	defer currentHostMapLock.Unlock()
+	standbyHostInfo = p
+}
+
+// Swaps the current and standby snapshots, so that a promotion can itself be
+// undone; returns the new current snapshot, or nil if there's no standby.
+// The promoted snapshot's previous counts are taken from the one it replaces,
+// on a copy since the standby may already have been published.
+func PromoteStandbyPersisted() *PersistedHostInfo {
+	currentHostMapLock.Lock()
+	defer currentHostMapLock.Unlock()
+	if standbyHostInfo == nil {
+		return nil
+	}
+	promoted := *standbyHostInfo
+	promoted.PreviousKeycounts = nil
+	promoted.PreviousCountryCounts = nil
+	if currentHostInfo != nil {
+		promoted.PreviousKeycounts = previousKeycounts(currentHostInfo)
+		promoted.PreviousCountryCounts = CountryServerCounts(currentHostInfo)
+	}
+	currentHostInfo, standbyHostInfo = &promoted, currentHostInfo
+	return currentHostInfo
+}
+
+// A scan which has lost hosts wholesale is more likely a problem at our end,
+// such as the start host being unreachable, than half the mesh vanishing.
+// Returns why a scan finding this many hosts should be rejected, or "" to
+// accept it.
+func snapshotRejection(hosts int, current *PersistedHostInfo, minFraction float64) string {
+	if current == nil || minFraction <= 0 {
+		return ""
+	}
+	if float64(hosts) < minFraction*float64(len(current.HostMap)) {
+		return fmt.Sprintf("only %d hosts, fewer than %g of the current %d",
+			hosts, minFraction, len(current.HostMap))
+	}
+	return ""
+}
+
+func apiPromotez(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentTypeTextPlain)
+	if req.Method != "POST" {
+		http.Error(w, "Promotion must be requested with POST", http.StatusMethodNotAllowed)
+		return
+	}
+	current := PromoteStandbyPersisted()
+	if current == nil {
+		http.Error(w, "No standby snapshot to promote", http.StatusConflict)
+		return
+	}
+	Log.Printf("Standby snapshot from %s promoted to current by %s", current.Timestamp, req.RemoteAddr)
+	fmt.Fprintf(w, "Promoted snapshot from %s, with %d hosts; the one it replaced is now on standby.\n",
+		current.Timestamp.UTC().Format("2006-01-02T15:04:05Z"), len(current.HostMap))
+}
+
+type SnapshotSummaries struct {
+	Current *ScanSummary `json:"current"`
+	Standby *ScanSummary `json:"standby,omitempty"`
+}
+
+func apiSnapshotsPage(w http.ResponseWriter, req *http.Request) {
+	if reportSetup(w, req) == nil {
+		return
+	}
+	// Both at once, in case of a promotion between fetching them
+	currentHostMapLock.RLock()
+	current, standby := currentHostInfo, standbyHostInfo
+	currentHostMapLock.RUnlock()
+	summaries := SnapshotSummaries{Current: current.Summary}
+	if standby != nil {
+		summaries.Standby = standby.Summary
+	}
+	reportWriteJson(w, req, summaries)
+}
@@ -0,0 +1,126 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSnapshotRejection(t *testing.T) {
+	current := newTestPersisted(t)
+	smaller := newTestPersisted(t)
+	for _, name := range smaller.Sorted[:len(smaller.Sorted)/2+1] {
+		delete(smaller.HostMap, name)
+	}
+	if reason := snapshotRejection(len(smaller.HostMap), current, 0.5); reason == "" {
+		t.Fatalf("Scan with %d of %d hosts not rejected", len(smaller.HostMap), len(current.HostMap))
+	}
+	for _, tc := range []struct {
+		current  *PersistedHostInfo
+		fraction float64
+	}{
+		{current, 0}, {current, 0.4}, {nil, 0.5},
+	} {
+		if reason := snapshotRejection(len(smaller.HostMap), tc.current, tc.fraction); reason != "" {
+			t.Fatalf("Scan rejected with fraction %g: %s", tc.fraction, reason)
+		}
+	}
+}
+
+func TestSnapshotPromotion(t *testing.T) {
+	first := loadTestPersisted(t)
+	second := loadTestPersisted(t)
+	defer func() {
+		currentHostMapLock.Lock()
+		standbyHostInfo = nil
+		currentHostMapLock.Unlock()
+	}()
+	if GetStandbyPersisted() != first || GetCurrentPersisted() != second {
+		t.Fatalf("Previous snapshot not kept on standby")
+	}
+
+	rec := testGet(t, apiSnapshotsPage, SERVE_PREFIX+"/snapshots")
+	var summaries struct {
+		Current, Standby *ScanSummary
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &summaries); err != nil {
+		t.Fatalf("Bad JSON: %s\n%s", err, rec.Body)
+	}
+	if summaries.Standby == nil || !summaries.Standby.Timestamp.Equal(first.Timestamp) {
+		t.Fatalf("Bad snapshot summaries: %s", rec.Body)
+	}
+
+	if rec := testGet(t, apiPromotez, "/promotez"); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Promotion with GET: got status %d", rec.Code)
+	}
+	promote := func() int {
+		req, _ := http.NewRequest("POST", "/promotez", nil)
+		rec := httptest.NewRecorder()
+		apiPromotez(rec, req)
+		return rec.Code
+	}
+	// The promoted snapshot is a copy, sharing the rest of the original
+	if code := promote(); code != http.StatusOK || GetCurrentPersisted().Summary != first.Summary || GetStandbyPersisted() != second {
+		t.Fatalf("Standby not promoted: status %d", code)
+	}
+	promoted := GetCurrentPersisted()
+	if promoted.PreviousCountryCounts == nil || len(promoted.PreviousKeycounts) != len(previousKeycounts(second)) {
+		t.Fatalf("Promoted snapshot lacks previous counts: %d keycounts", len(promoted.PreviousKeycounts))
+	}
+	if code := promote(); code != http.StatusOK || GetCurrentPersisted().Summary != second.Summary {
+		t.Fatalf("Promotion not undone: status %d", code)
+	}
+
+	currentHostMapLock.Lock()
+	standbyHostInfo = nil
+	currentHostMapLock.Unlock()
+	if code := promote(); code != http.StatusConflict || GetCurrentPersisted().Summary != second.Summary {
+		t.Fatalf("Promotion without standby: status %d", code)
+	}
+}
+
+func TestRejectedScanNotStale(t *testing.T) {
+	current := loadTestPersisted(t)
+	savedStale, savedFraction := staleHosts, *flMinHostFraction
+	defer func() {
+		staleHosts, *flMinHostFraction = savedStale, savedFraction
+		currentHostMapLock.Lock()
+		standbyHostInfo = nil
+		currentHostMapLock.Unlock()
+	}()
+	staleHosts = newStaleTracker()
+	*flMinHostFraction = 0.5
+
+	spider := scannedSpider("keys.example.org", 0, []string{"130.225.1.1"})
+	spider.queryErrors["down.example.org"] = errors.New("connection refused")
+	if persisted := normaliseMeshAndSet(spider, false); persisted != nil {
+		t.Fatalf("Scan with %d hosts accepted", len(persisted.HostMap))
+	}
+	if GetCurrentPersisted() != current {
+		t.Fatalf("Current snapshot replaced by a rejected scan")
+	}
+	if standby := GetStandbyPersisted(); standby == nil || len(standby.HostMap) != 1 {
+		t.Fatalf("Rejected scan not kept on standby")
+	}
+	if stale := staleHosts.List(); len(stale) != 0 {
+		t.Fatalf("Rejected scan's failures tracked as stale: %v", stale)
+	}
+}
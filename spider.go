@@ -20,24 +20,40 @@ package sks_spider
 // under which it's known and the aliases, and de-duping by IP address
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"time"
+	"unicode"
+)
+
+import (
+	maxminddb "github.com/oschwald/maxminddb-golang"
 )
 
 const QUEUE_DEPTH int = 100
 
+// How long a partial batch of country lookups may wait for more IPs
+const kCOUNTRY_BATCH_DELAY = 200 * time.Millisecond
+
+const kONION_SUFFIX = ".onion"
+
 type DnsResult struct {
 	hostname string
 	ipList   []string
 	err      error
+	cname    string // DNS canonical name, with flDnsCnames
+	duration time.Duration
 }
 
 type HostsRequest struct {
-	hostnames []string
-	distance  int
-	origin    string
+	hostnames     []string
+	distance      int
+	origin        string
+	fixedDistance bool // use distance even if origin's is known
 }
 
 type HostResult struct {
@@ -47,15 +63,20 @@ type HostResult struct {
 }
 
 type CountryResult struct {
-	ip      string
-	country string
-	err     error
+	ip       string
+	country  string
+	err      error
+	duration time.Duration
 }
 
 type spiderShared struct {
 	dnsResult     chan *DnsResult
 	hostResult    chan *HostResult
 	countryResult chan *CountryResult
+	robots        *robotsCache
+	dnsSlots      chan bool // nil for unlimited DNS lookups in flight
+	ctx           context.Context
+	geoip         GeoIPProvider
 }
 
 // This persists for the length of one data gathering run.
@@ -65,6 +86,8 @@ type Spider struct {
 	shared           *spiderShared
 	considering      map[string]bool     // already looking this host up in DNS
 	badDNS           map[string]bool     // record bogus hostnames
+	dnsFailures      map[string]string   // why DNS failed, for diagnostics
+	dnsAttempts      map[string]int      // lookups made per host, for retry limiting
 	knownHosts       map[string]string   // aliases to canonical hostname from server info page
 	aliasesForHost   map[string][]string // for a hostname, reverse aliases
 	knownIPs         map[string]string   // IPs to same canonical hostname
@@ -75,32 +98,86 @@ type Spider struct {
 	pendingCountries map[string]int
 	distances        map[string]int
 	countriesForIPs  map[string]string
+	countryAttempts  map[string]int              // lookups made per IP, for retry limiting
+	cnameTargets     map[string]string           // DNS canonical name to first host found with it
+	rawPages         map[string][]byte           // with flKeepRawPages, including hosts which failed
+	nameMismatches   map[string]HostnameMismatch // by queried hostname
+	selfPeers        map[string][]string         // by canonical hostname, the peer entries naming itself
+	countryBatch     []string                    // IPs awaiting a batched country lookup
+	countryFlush     <-chan time.Time            // nil unless countryBatch is non-empty
+	capSkipped       int                         // hostnames not considered because of flMaxConsidering
+	fetchFailedAt    map[string]time.Time        // when each host in queryErrors failed
+	robotsRefused    map[string]bool             // asked not to be crawled; not failures
+	skipSuffixes     []string                    // from flSkipSuffixes
+	crawlSuffixes    []string                    // from flCrawlSuffixes; empty for no restriction
+	abandon          chan bool                   // the scan deadline has passed
+	abandoning       bool                        // so take on no new work
+	abandonedHosts   int                         // hostnames dropped because of that
 	terminate        chan bool
+	stopped          chan bool // closed once the main loop has returned
+	started          time.Time
+	phases           scanPhaseTimes
 }
 
-func StartSpider() *Spider {
+// Summed as each result comes back to the main loop
+type scanPhaseTimes struct {
+	dns     time.Duration
+	fetch   time.Duration
+	country time.Duration
+}
+
+func newSpider() *Spider {
 	shared := new(spiderShared)
 	shared.dnsResult = make(chan *DnsResult, QUEUE_DEPTH)
 	shared.hostResult = make(chan *HostResult, QUEUE_DEPTH)
 	shared.countryResult = make(chan *CountryResult, QUEUE_DEPTH)
+	shared.robots = newRobotsCache()
+	shared.ctx = context.Background()
+	shared.geoip = currentGeoIPProvider()
+	if *flMaxConcurrentDNS > 0 {
+		shared.dnsSlots = make(chan bool, *flMaxConcurrentDNS)
+	}
 
 	spider := new(Spider)
 	spider.shared = shared
 	spider.batchAddHost = make(chan *HostsRequest, QUEUE_DEPTH)
 	spider.considering = make(map[string]bool)
 	spider.badDNS = make(map[string]bool)
+	spider.dnsFailures = make(map[string]string)
+	spider.dnsAttempts = make(map[string]int)
 	spider.knownHosts = make(map[string]string)
 	spider.aliasesForHost = make(map[string][]string)
 	spider.knownIPs = make(map[string]string)
 	spider.ipsForHost = make(map[string][]string)
 	spider.serverInfos = make(map[string]*SksNode)
 	spider.queryErrors = make(map[string]error)
+	spider.fetchFailedAt = make(map[string]time.Time)
+	spider.robotsRefused = make(map[string]bool)
 	spider.pendingHosts = make(map[string]int)
 	spider.pendingCountries = make(map[string]int)
 	spider.distances = make(map[string]int)
 	spider.countriesForIPs = make(map[string]string)
+	spider.countryAttempts = make(map[string]int)
+	spider.rawPages = make(map[string][]byte)
+	spider.nameMismatches = make(map[string]HostnameMismatch)
+	spider.selfPeers = make(map[string][]string)
+	spider.cnameTargets = make(map[string]string)
+	spider.skipSuffixes = effectiveSkipSuffixes()
+	spider.crawlSuffixes = parseHostSuffixes(*flCrawlSuffixes)
+	spider.abandon = make(chan bool)
 	spider.terminate = make(chan bool)
+	spider.stopped = make(chan bool)
+	spider.started = time.Now()
+	return spider
+}
 
+// Cancelling ctx aborts the DNS lookups, fetches and country lookups in
+// flight, rather than letting them run to their timeouts, and stops the main
+// loop; Wait then returns once their results have been thrown away.  Add no
+// hosts after cancelling.
+func StartSpider(ctx context.Context) *Spider {
+	spider := newSpider()
+	spider.shared.ctx = ctx
 	KillDummySpiderForDiagnosticsChannel()
 	go spiderMainLoop(spider)
 	return spider
@@ -127,26 +204,72 @@ func (spider *Spider) Wait() {
 	spider.pending.Wait()
 }
 
+// As Wait, but once maxDuration has passed, the spider stops taking on new
+// hosts and only waits for work already in flight, which is bounded by the
+// fetch and DNS timeouts.  Returns false if the scan was cut short.
+func (spider *Spider) WaitAtMost(maxDuration time.Duration) bool {
+	if maxDuration <= 0 {
+		spider.Wait()
+		return true
+	}
+	done := make(chan bool)
+	go func() {
+		spider.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(maxDuration):
+	}
+	select {
+	case spider.abandon <- true:
+	case <-spider.stopped:
+	}
+	<-done
+	return false
+}
+
+// Safe to call after the context has been cancelled, when the main loop is
+// already gone.
 func (spider *Spider) Terminate() {
-	spider.terminate <- true
+	select {
+	case spider.terminate <- true:
+	case <-spider.stopped:
+	}
 	go DummySpiderForDiagnosticsChannel()
 }
 
 func (spider *Spider) AddHost(hostname string, distance int) {
+	hostname = normalizeHostname(hostname)
 	spider.pending.Add(1)
 	spider.pendingHosts[hostname] += 1
 	spider.batchAddHost <- &HostsRequest{hostnames: []string{hostname}, distance: distance}
 }
 
 func (spider *Spider) BatchAddHost(origin string, hostlist []string) {
+	spider.batchAddHosts(&HostsRequest{origin: origin}, hostlist)
+}
+
+// As BatchAddHost, but the hosts are put at the given distance rather than
+// one further out than origin, for mixing seed lists.
+func (spider *Spider) BatchAddHostAtDistance(origin string, hostlist []string, distance int) {
+	spider.batchAddHosts(&HostsRequest{origin: origin, distance: distance, fixedDistance: true}, hostlist)
+}
+
+func (spider *Spider) batchAddHosts(request *HostsRequest, hostlist []string) {
+	request.hostnames = make([]string, len(hostlist))
+	request.origin = normalizeHostname(request.origin)
 	spider.pending.Add(len(hostlist))
-	for _, h := range hostlist {
-		spider.pendingHosts[h] += 1
+	for i, h := range hostlist {
+		request.hostnames[i] = normalizeHostname(h)
+		spider.pendingHosts[request.hostnames[i]] += 1
 	}
-	spider.batchAddHost <- &HostsRequest{hostnames: hostlist, origin: origin}
+	spider.batchAddHost <- request
 }
 
 func spiderMainLoop(spider *Spider) {
+	defer close(spider.stopped)
 	for {
 		select {
 		case hostreq := <-spider.batchAddHost:
@@ -161,24 +284,131 @@ func spiderMainLoop(spider *Spider) {
 			spider.processHostResult(hostResult)
 			spider.pendingHosts[hostResult.hostname] -= 1
 			spider.pending.Done()
+		case <-spider.countryFlush:
+			spider.flushCountryBatch()
 		case countryResult := <-spider.shared.countryResult:
 			spider.processCountryResult(countryResult)
 			spider.pendingCountries[countryResult.ip] -= 1
 			spider.pending.Done()
+		case <-spider.abandon:
+			spider.abandoning = true
+			inFlight := 0
+			for _, count := range spider.pendingHosts {
+				if count > 0 {
+					inFlight += 1
+				}
+			}
+			Log.Printf("Scan deadline reached; taking on no new hosts, waiting for %d in flight", inFlight)
 		case out := <-diagnosticSpiderDump:
 			spider.diagnosticDumpInRoutine(out)
 			diagnosticSpiderDone <- true
 		case <-spider.terminate:
-			break
+			spider.discardInFlight()
+			return
+		case <-spider.shared.ctx.Done():
+			Log.Printf("Spider cancelled: %s", spider.shared.ctx.Err())
+			spider.discardInFlight()
+			return
+		}
+	}
+}
+
+// Work still in flight when terminated would otherwise block forever on a
+// full result channel, and leave anyone in Wait() waiting; so its results
+// are consumed and thrown away, until the pending count drains to zero.
+// The maps aren't touched, so diagnostics can still read them.
+func (spider *Spider) discardInFlight() {
+	inFlight := 0
+	for _, count := range spider.pendingHosts {
+		if count > 0 {
+			inFlight += 1
+		}
+	}
+	for _, count := range spider.pendingCountries {
+		if count > 0 {
+			inFlight += 1
+		}
+	}
+	if inFlight > 0 {
+		Log.Printf("Spider terminated with %d hosts and IPs in flight; discarding their results", inFlight)
+	}
+	// Queued IPs are counted as pending, but have no go-routine to finish them
+	spider.flushCountryBatch()
+
+	drained := make(chan bool)
+	go func() {
+		spider.pending.Wait()
+		close(drained)
+	}()
+	go func() {
+		for {
+			select {
+			case hostreq := <-spider.batchAddHost:
+				spider.pending.Add(-len(hostreq.hostnames))
+			case <-spider.shared.dnsResult:
+				spider.pending.Done()
+			case <-spider.shared.hostResult:
+				spider.pending.Done()
+			case <-spider.shared.countryResult:
+				spider.pending.Done()
+			case <-drained:
+				return
+			}
 		}
+	}()
+}
+
+// A comma-separated list to normalized suffixes, each starting with a dot.
+func parseHostSuffixes(list string) []string {
+	suffixes := make([]string, 0, 4)
+	for _, s := range strings.Split(list, ",") {
+		s = normalizeHostname(s)
+		if s == "" {
+			continue
+		}
+		if !strings.HasPrefix(s, ".") {
+			s = "." + s
+		}
+		suffixes = append(suffixes, s)
 	}
+	return suffixes
+}
+
+// Tor, I2P, mDNS and the like: DNS lookups for these always fail, so don't
+// waste a lookup and a badDNS entry finding that out.  Hostname must already
+// be normalized, so matching is case-insensitive.  With -socks-proxy, the
+// .onion skip is lifted, whatever -skip-suffixes says, because those hosts
+// are then reachable; other suffixes stay skipped.
+func (spider *Spider) skipSuffixFor(hostname string) string {
+	for _, suffix := range spider.skipSuffixes {
+		if strings.HasSuffix(hostname, suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
+
+// For testing one operator's servers: only gossip peers under one of the
+// crawl suffixes are followed, though seed hosts are always taken.  A suffix
+// ".example.org" also matches "example.org" itself.
+func (spider *Spider) outOfScope(hostname string, request *HostsRequest) bool {
+	if len(spider.crawlSuffixes) == 0 || request.origin == "" {
+		return false
+	}
+	for _, suffix := range spider.crawlSuffixes {
+		if strings.HasSuffix(hostname, suffix) || hostname == suffix[1:] {
+			return false
+		}
+	}
+	return true
 }
 
 func (spider *Spider) considerHost(hostname string, request *HostsRequest) {
 	skip := false
 	distance := -1
+	hostname = normalizeHostname(hostname)
 
-	if request.origin != "" {
+	if request.origin != "" && !request.fixedDistance {
 		if d, ok := spider.distances[request.origin]; ok {
 			distance = d + 1
 		}
@@ -191,7 +421,19 @@ func (spider *Spider) considerHost(hostname string, request *HostsRequest) {
 		spider.distances[hostname] = distance
 	}
 
-	if _, ok := spider.considering[hostname]; ok {
+	// Failed hosts are already in considering, but are worth a word when
+	// another server lists them, and maybe a second try.
+	if failedAt, ok := spider.fetchFailedAt[hostname]; ok && !spider.abandoning {
+		if *flFailedQuietPeriod > 0 && time.Since(failedAt) >= *flFailedQuietPeriod {
+			spider.refetchHost(hostname, failedAt)
+			return
+		}
+		Log.Printf("Skipping \"%s\", recently failed this scan", hostname)
+		skip = true
+	} else if _, ok := spider.considering[hostname]; ok {
+		skip = true
+	} else if spider.abandoning {
+		spider.abandonedHosts += 1
 		skip = true
 	} else if _, ok := BlacklistedHosts[hostname]; ok {
 		Log.Printf("Ignoring blacklisted host: \"%s\"", hostname)
@@ -209,8 +451,11 @@ func (spider *Spider) considerHost(hostname string, request *HostsRequest) {
 	} else if strings.Contains(hostname, "pool.") {
 		Log.Printf("Ignoring pool hostname: %s", hostname)
 		skip = true
-	} else if strings.HasSuffix(hostname, ".local") {
-		Log.Printf("Ignoring .local hostname: %s", hostname)
+	} else if spider.outOfScope(hostname, request) {
+		Log.Printf("Ignoring hostname outside crawl suffixes: %s", hostname)
+		skip = true
+	} else if suffix := spider.skipSuffixFor(hostname); suffix != "" {
+		Log.Printf("Ignoring hostname under special-use suffix %s: %s", suffix, hostname)
 		skip = true
 	} else {
 		for _, hn := range blacklistedQueryHosts {
@@ -221,6 +466,15 @@ func (spider *Spider) considerHost(hostname string, request *HostsRequest) {
 			skip = true
 		}
 	}
+	// Only new hostnames get this far, so this bounds the memory used by a
+	// mesh full of wildcard DNS nonsense.
+	if !skip && *flMaxConsidering > 0 && len(spider.considering) >= *flMaxConsidering {
+		if spider.capSkipped == 0 {
+			Log.Printf("Consideration cap reached (%d hostnames); ignoring further new hostnames", *flMaxConsidering)
+		}
+		spider.capSkipped += 1
+		skip = true
+	}
 	if skip {
 		spider.pendingHosts[hostname] -= 1
 		spider.pending.Done()
@@ -229,13 +483,155 @@ func (spider *Spider) considerHost(hostname string, request *HostsRequest) {
 
 	spider.considering[hostname] = true
 	spider.distances[hostname] = distance
+	spider.lookupHost(hostname, 0)
+}
+
+// The pending count taken for the mention which brought the host back covers
+// the fetch, and is released when its result comes in.
+func (spider *Spider) refetchHost(hostname string, failedAt time.Time) {
+	Log.Printf("Fetching \"%s\" again, %s after it failed", hostname, time.Since(failedAt).Truncate(time.Second))
+	delete(spider.fetchFailedAt, hostname)
+	delete(spider.queryErrors, hostname)
+	go spider.shared.QueryHost(hostname)
+}
+
+// Through a SOCKS proxy, .onion peers can be reached after all
+func effectiveSkipSuffixes() []string {
+	suffixes := parseHostSuffixes(*flSkipSuffixes)
+	if *flSocksProxy != "" {
+		suffixes = withoutSuffix(suffixes, kONION_SUFFIX)
+	}
+	return suffixes
+}
+
+func withoutSuffix(suffixes []string, unwanted string) []string {
+	result := make([]string, 0, len(suffixes))
+	for _, suffix := range suffixes {
+		if suffix != unwanted {
+			result = append(result, suffix)
+		}
+	}
+	return result
+}
 
+// Only Tor can resolve onion names, so they're handed to the SOCKS proxy at
+// fetch time; locally, such a host just has no IPs.
+func resolvedByProxy(hostname string) bool {
+	return *flSocksProxy != "" && strings.HasSuffix(hostname, kONION_SUFFIX)
+}
+
+// Replaced by tests
+var (
+	lookupHostFunc  = net.DefaultResolver.LookupHost
+	lookupCNAMEFunc = net.DefaultResolver.LookupCNAME
+)
+
+func (spider *Spider) lookupHost(hostname string, delay time.Duration) {
+	spider.dnsAttempts[hostname] += 1
+	if resolvedByProxy(hostname) {
+		go func(shared *spiderShared) {
+			shared.dnsResult <- &DnsResult{hostname, nil, nil, "", 0}
+		}(spider.shared)
+		return
+	}
 	go func(shared *spiderShared) {
-		ipList, err := net.LookupHost(hostname)
-		shared.dnsResult <- &DnsResult{hostname, ipList, err}
+		// Cancelled while waiting is still a result, to drop the pending count
+		cancelled := func() {
+			shared.dnsResult <- &DnsResult{hostname, nil, shared.ctx.Err(), "", 0}
+		}
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-shared.ctx.Done():
+				cancelled()
+				return
+			}
+		}
+		// A flood of hostnames from one big peer list mustn't become a flood
+		// of queries to the local resolver.
+		if shared.dnsSlots != nil {
+			select {
+			case shared.dnsSlots <- true:
+			case <-shared.ctx.Done():
+				cancelled()
+				return
+			}
+			defer func() { <-shared.dnsSlots }()
+		}
+		// LookupHost follows CNAMEs but doesn't say where it ended up; a
+		// failure here just leaves us de-duplicating by IP alone.
+		var cname string
+		lookupStart := time.Now()
+		if *flDnsCnames {
+			if target, err := lookupCNAMEFunc(shared.ctx, hostname); err == nil {
+				cname = normalizeHostname(target)
+			}
+		}
+		ipList, err := lookupHostFunc(shared.ctx, hostname)
+		shared.dnsResult <- &DnsResult{hostname, ipList, err, cname, time.Since(lookupStart)}
 	}(spider.shared)
 }
 
+// A SERVFAIL or timeout might well succeed if asked again shortly, but there's
+// no point in asking again about a name which doesn't exist.
+func classifyDnsError(err error) (reason string, retryable bool) {
+	dnsErr, ok := err.(*net.DNSError)
+	if !ok {
+		return err.Error(), false
+	}
+	switch {
+	case dnsErr.IsNotFound:
+		return "not found", false
+	case dnsErr.IsTimeout:
+		return "timeout", true
+	case dnsErr.IsTemporary:
+		return "temporary failure", true
+	}
+	return dnsErr.Err, false
+}
+
+// DNS is case-insensitive and servers are inconsistent about whether they
+// report a fully-qualified name with the trailing dot; we want one form for
+// all the map keys.
+func normalizeHostname(hostname string) string {
+	return strings.TrimRight(strings.ToLower(strings.TrimSpace(hostname)), ".")
+}
+
+// A mangled stats page can give us any old junk as a peer; each entry which
+// survives becomes a DNS lookup, so weed out what can't be a hostname.  Any
+// port is dropped, as only the name matters to the DNS stage.
+func cleanGossipPeers(peers []string) (cleaned []string, dropped int) {
+	cleaned = make([]string, 0, len(peers))
+	for _, peer := range peers {
+		peer = strings.TrimSpace(peer)
+		if host, _, err := net.SplitHostPort(peer); err == nil {
+			peer = host
+		}
+		peer = normalizeHostname(peer)
+		if peer == "" || strings.IndexFunc(peer, func(r rune) bool {
+			return unicode.IsSpace(r) || unicode.IsControl(r)
+		}) >= 0 {
+			dropped += 1
+			continue
+		}
+		cleaned = append(cleaned, peer)
+	}
+	return cleaned, dropped
+}
+
+// Resolvers and old snapshots don't agree on one textual form for IPv6
+// addresses, and the IP is a map key in too many places for two forms of one
+// address to be safe.
+func normalizeIP(ip string) string {
+	if !*flNormalizeIPv6 || !strings.Contains(ip, ":") {
+		return ip
+	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
 func flattenIPs(ipLists ...[]string) []string {
 	var maxlen = 0
 	for i := range ipLists {
@@ -244,6 +640,7 @@ func flattenIPs(ipLists ...[]string) []string {
 	result := make([]string, 0, maxlen)
 	for i := range ipLists {
 		for _, ip := range ipLists[i] {
+			ip = normalizeIP(ip)
 			found := false
 			for _, ip2 := range result {
 				if ip == ip2 {
@@ -261,11 +658,32 @@ func flattenIPs(ipLists ...[]string) []string {
 
 func (spider *Spider) processDnsResult(dns *DnsResult) {
 	hostname := dns.hostname
+	if dns.duration > 0 {
+		dnsDurations.Observe(dns.duration)
+		spider.phases.dns += dns.duration
+	}
+	if spider.abandoning {
+		spider.abandonedHosts += 1
+		return
+	}
 	if dns.err != nil {
-		Log.Printf("DNS resolution failure for \"%s\": %s", hostname, dns.err)
+		reason, retryable := classifyDnsError(dns.err)
+		spider.dnsFailures[hostname] = reason
+		attempts := spider.dnsAttempts[hostname]
+		if retryable && attempts <= *flDnsRetries {
+			delay := *flDnsRetryBackoff << uint(attempts-1)
+			Log.Printf("DNS resolution failure for \"%s\" (%s), retry %d in %s: %s",
+				hostname, reason, attempts, delay, dns.err)
+			spider.pending.Add(1)
+			spider.pendingHosts[hostname] += 1
+			spider.lookupHost(hostname, delay)
+			return
+		}
+		Log.Printf("DNS resolution failure for \"%s\" (%s): %s", hostname, reason, dns.err)
 		spider.badDNS[hostname] = true
 		return
 	}
+	delete(spider.dnsFailures, hostname)
 	ipList := flattenIPs(dns.ipList)
 	for _, ip := range ipList {
 		if IPDisallowed(ip) {
@@ -273,28 +691,40 @@ func (spider *Spider) processDnsResult(dns *DnsResult) {
 			spider.badDNS[hostname] = true
 			return
 		}
+	}
+	// Same DNS target as a host we already have, so the same server, even
+	// if the two lookups didn't happen to return a common IP.
+	if first, ok := spider.cnameTargets[dns.cname]; ok && dns.cname != "" {
+		canonical := spider.knownHosts[first]
+		Log.Printf("Host \"%s\" has the same DNS canonical name \"%s\" as \"%s\"", hostname, dns.cname, canonical)
+		spider.mergeDnsAlias(hostname, canonical, ipList)
+		return
+	}
+	for _, ip := range ipList {
 		canonical, ok := spider.knownIPs[ip]
 		if !ok {
 			continue
 		}
-		spider.knownHosts[hostname] = canonical
-		for _, ip2 := range ipList {
-			spider.knownIPs[ip2] = canonical
+		if dns.cname != "" {
+			spider.cnameTargets[dns.cname] = canonical
 		}
-		spider.ipsForHost[canonical] = flattenIPs(spider.ipsForHost[canonical], ipList)
+		spider.mergeDnsAlias(hostname, canonical, ipList)
 		return
 	}
 	// should be shiny new host after this point
+	if dns.cname != "" {
+		spider.cnameTargets[dns.cname] = hostname
+	}
 	spider.knownHosts[hostname] = hostname
 	spider.aliasesForHost[hostname] = []string{hostname}
 	spider.ipsForHost[hostname] = ipList
 	for _, ip := range ipList {
 		spider.knownIPs[ip] = hostname
-		if _, ok2 := spider.countriesForIPs[ip]; !ok2 {
+		if _, ok2 := spider.countriesForIPs[ip]; !ok2 && !geoipUnavailable {
 			spider.countriesForIPs[ip] = ""
 			spider.pendingCountries[ip] += 1
 			spider.pending.Add(1)
-			go spider.shared.QueryCountryForIP(ip)
+			spider.queueCountryLookup(ip)
 		}
 	}
 	spider.serverInfos[hostname] = nil
@@ -303,17 +733,37 @@ func (spider *Spider) processDnsResult(dns *DnsResult) {
 	go spider.shared.QueryHost(hostname)
 }
 
+func (spider *Spider) mergeDnsAlias(hostname, canonical string, ipList []string) {
+	spider.knownHosts[hostname] = canonical
+	for _, ip := range ipList {
+		spider.knownIPs[ip] = canonical
+	}
+	spider.ipsForHost[canonical] = flattenIPs(spider.ipsForHost[canonical], ipList)
+}
+
 func (sResults *spiderShared) QueryHost(hostname string) {
 	node := &SksNode{Hostname: hostname}
-	err := node.Fetch()
-	if err != nil {
+	if err := sResults.ctx.Err(); err != nil {
 		sResults.hostResult <- &HostResult{hostname: hostname, err: err}
 		return
 	}
+	if *flRespectRobots && !sResults.robots.Allowed(node) {
+		Log.Printf("[%s] Skipping, %s", hostname, errRobotsDisallowed)
+		sResults.hostResult <- &HostResult{hostname: hostname, err: errRobotsDisallowed}
+		return
+	}
+	fetchStart := time.Now()
+	err := node.FetchContext(sResults.ctx)
+	node.FetchDuration = time.Since(fetchStart)
+	if err != nil {
+		sResults.hostResult <- &HostResult{hostname: hostname, node: node, err: err}
+		return
+	}
 	var analyzePaniced bool = false
 	func() {
 		defer func() {
 			if x := recover(); x != nil {
+				recordAnalyzePanic(hostname, x, debug.Stack())
 				e := fmt.Errorf("analyze panic: %v", x)
 				node.analyzeError = e
 				sResults.hostResult <- &HostResult{hostname: hostname, node: node, err: e}
@@ -328,26 +778,133 @@ func (sResults *spiderShared) QueryHost(hostname string) {
 	return
 }
 
+// A server calling itself something other than the name we found it by; often
+// just an alias, sometimes a misconfiguration advertising the wrong name.
+type HostnameMismatch struct {
+	Queried  string `json:"queried"`
+	Reported string `json:"reported_hostname"`
+	Nodename string `json:"nodename,omitempty"`
+}
+
+// A server with itself in its own gossip peer list, with the entries which
+// named it.
+type SelfPeer struct {
+	Hostname string   `json:"hostname"`
+	ListedAs []string `json:"listed_as"`
+}
+
 func (spider *Spider) processHostResult(hr *HostResult) {
 	hostname := hr.hostname
-	canonical := hostname
 	node := hr.node
 	err := hr.err
+	if node != nil && node.FetchDuration > 0 {
+		fetchDurations.Observe(node.FetchDuration)
+		spider.phases.fetch += node.FetchDuration
+	}
+	// Not a failure: the host is up, and keeping it out of queryErrors keeps
+	// it out of the stale tracking, so its old data isn't carried forward
+	// against the operator's wishes.
+	if err == errRobotsDisallowed {
+		spider.robotsRefused[hostname] = true
+		return
+	}
 	if err != nil {
 		Log.Printf("Failure fetching \"%s\": %s", hostname, err)
 		spider.queryErrors[hostname] = err
+		spider.fetchFailedAt[hostname] = time.Now()
+		if node != nil && node.rawPage != nil {
+			spider.rawPages[hostname] = node.rawPage
+		}
 		return
 	}
-	own_hostname, ok := node.Settings["Hostname"]
+	canonical := spider.recordServerInfo(hostname, node)
+	peers, dropped := cleanGossipPeers(node.GossipPeerList)
+	if dropped > 0 {
+		Log.Printf("[%s] Dropped %d malformed gossip peers", hostname, dropped)
+	}
+	if self := spider.selfPeerEntries(hostname, canonical, peers); len(self) > 0 {
+		Log.Printf("[%s] Lists itself as a gossip peer: %s", canonical, strings.Join(self, " "))
+		spider.selfPeers[canonical] = self
+	}
+	// One bad peer list mustn't balloon the crawl; the whole list is kept
+	// on the node, only the peers followed are cut.
+	if *flMaxPeersPerHost > 0 && len(peers) > *flMaxPeersPerHost {
+		Log.Printf("[%s] Following only %d of %d gossip peers", hostname, *flMaxPeersPerHost, len(peers))
+		node.PeersListed = len(peers)
+		peers = peers[:*flMaxPeersPerHost]
+	}
+	spider.BatchAddHost(canonical, peers)
+}
+
+// Harmless to the crawl, which already knows the host, but a self-loop in the
+// membership file is a configuration error worth telling the operator about.
+// A peer is the server itself by the name it was queried as, its canonical
+// name, any alias, or any of its IPs.
+func (spider *Spider) selfPeerEntries(hostname, canonical string, peers []string) []string {
+	var self []string
+	for _, peer := range peers {
+		if peer == hostname || peer == canonical ||
+			spider.knownHosts[peer] == canonical || spider.knownIPs[normalizeIP(peer)] == canonical {
+			self = append(self, peer)
+		}
+	}
+	return self
+}
 
-	if ok && own_hostname != hostname {
+// Files node under the name it reports for itself, if it's safe to, moving
+// over the aliases, IPs and distance recorded under hostname; returns the
+// name it's filed under, or hostname if it was dropped as a duplicate.
+func (spider *Spider) recordServerInfo(hostname string, node *SksNode) string {
+	canonical := hostname
+	own_hostname, ok := node.ReportedHostname()
+	own_hostname = normalizeHostname(own_hostname)
+	if ok && own_hostname != "" && own_hostname != hostname {
+		nodename, _ := node.NodeName()
+		spider.nameMismatches[hostname] = HostnameMismatch{
+			Queried:  hostname,
+			Reported: own_hostname,
+			Nodename: nodename,
+		}
+	}
+
+	if ok && own_hostname != "" && own_hostname != hostname && spider.reassignmentCycles(hostname, own_hostname) {
+		Log.Printf("Warning: \"%s\" reports its hostname as \"%s\", which already resolves back to \"%s\"; not reassigning canonical name",
+			hostname, own_hostname, hostname)
+		// Another server holds hostname, having claimed it as its own name.
+		// Rather than lose this one's data, it has the name it reports,
+		// which stops being an alias; its addresses stay with hostname, so
+		// it's listed but yields no IPs.  Only if that name is also taken is
+		// it dropped.
+		if oldnode := spider.serverInfos[hostname]; oldnode != nil && oldnode != node {
+			if other := spider.serverInfos[own_hostname]; other != nil && other.Hostname != hostname {
+				Log.Printf("Warning: dropping data fetched as \"%s\", both it and \"%s\" hold other servers", hostname, own_hostname)
+				return hostname
+			}
+			canonical = own_hostname
+			spider.knownHosts[canonical] = canonical
+			aliases := make([]string, 0, len(spider.aliasesForHost[hostname]))
+			for _, alias := range spider.aliasesForHost[hostname] {
+				if alias != canonical {
+					aliases = append(aliases, alias)
+				}
+			}
+			spider.aliasesForHost[hostname] = aliases
+			spider.aliasesForHost[canonical] = []string{canonical}
+			if _, ok3 := spider.distances[canonical]; !ok3 {
+				spider.distances[canonical] = spider.distances[hostname]
+			}
+		}
+	} else if ok && own_hostname != "" && own_hostname != hostname {
 		canonical = own_hostname
 		oldnode, ok2 := spider.serverInfos[canonical]
 		if ok2 && oldnode != nil {
 			Log.Printf("Duplicate fetch, got serverInfo for \"%s\" and again as \"%s\"", canonical, hostname)
 		}
 
-		delete(spider.serverInfos, hostname)
+		// Unless it's a server given this name by the cycle handling above
+		if old := spider.serverInfos[hostname]; old == nil || old.Hostname == hostname {
+			delete(spider.serverInfos, hostname)
+		}
 
 		if _, ok3 := spider.knownHosts[canonical]; !ok3 {
 			spider.knownHosts[canonical] = canonical
@@ -372,25 +929,118 @@ func (spider *Spider) processHostResult(hr *HostResult) {
 		}
 	}
 
-	own_nodename, ok := node.Settings["Nodename"]
-	if ok && own_nodename != canonical && own_nodename != own_hostname {
+	own_nodename, ok := node.NodeName()
+	own_nodename = normalizeHostname(own_nodename)
+	if ok && own_nodename != "" && own_nodename != canonical && own_nodename != own_hostname {
 		if _, ok2 := spider.knownHosts[own_nodename]; !ok2 {
 			spider.knownHosts[own_nodename] = canonical
 		}
 	}
 
 	spider.serverInfos[canonical] = node
-	spider.BatchAddHost(canonical, node.GossipPeerList)
-	return
+	if node.rawPage != nil {
+		spider.rawPages[canonical] = node.rawPage
+	}
+	return canonical
+}
+
+// Two servers each claiming the other's name would otherwise swap canonical
+// names back and forth, each deleting the serverInfo stored by the other.  So
+// if another server's info is already stored under hostname, and the name it
+// wants to move to leads back to hostname, that's a cycle.
+func (spider *Spider) reassignmentCycles(hostname, canonical string) bool {
+	if spider.serverInfos[hostname] == nil {
+		return false
+	}
+	seen := make(map[string]bool)
+	for next := canonical; !seen[next]; {
+		seen[next] = true
+		alias, ok := spider.knownHosts[next]
+		if !ok {
+			return false
+		}
+		if alias == hostname {
+			return true
+		}
+		next = alias
+	}
+	return false
 }
 
 func (sResults *spiderShared) QueryCountryForIP(ipstr string) {
-	country, err := CountryForIPString(ipstr)
-	sResults.countryResult <- &CountryResult{ip: ipstr, country: country, err: err}
+	lookupStart := time.Now()
+	country, err := sResults.geoip.CountryForIP(sResults.ctx, ipstr)
+	sResults.countryResult <- &CountryResult{ip: ipstr, country: country, err: err, duration: time.Since(lookupStart)}
+}
+
+// Each IP must already be counted in pending; that's only dropped as each
+// CountryResult comes back, so Wait() can't return with a batch unflushed.
+// Batching only applies to GeoIP lookups: DNS lookups are slow enough that
+// they want to be in parallel, and other providers are unknown quantities.
+func (spider *Spider) queueCountryLookup(ipstr string) {
+	spider.countryAttempts[ipstr] += 1
+	if _, local := spider.shared.geoip.(*MaxMindProvider); !local || *flCountryBatch <= 0 {
+		go spider.shared.QueryCountryForIP(ipstr)
+		return
+	}
+	if len(spider.countryBatch) == 0 {
+		spider.countryFlush = time.After(kCOUNTRY_BATCH_DELAY)
+	}
+	spider.countryBatch = append(spider.countryBatch, ipstr)
+	if len(spider.countryBatch) >= *flCountryBatch {
+		spider.flushCountryBatch()
+	}
+}
+
+func (spider *Spider) flushCountryBatch() {
+	spider.countryFlush = nil
+	if len(spider.countryBatch) == 0 {
+		return
+	}
+	go spider.shared.QueryCountriesForIPs(spider.shared.geoip.(*MaxMindProvider).reader, spider.countryBatch)
+	spider.countryBatch = nil
+}
+
+// The reader is memory-mapped and safe for concurrent use, so this saves the
+// cost of a go-routine per IP, not of opening the database.  Per
+// BenchmarkCountryLookup*, 2000 IPs take ~5.6ms one go-routine per IP and
+// ~0.9ms in batches of 100; small next to a scan taking minutes, but cheap.
+func (sResults *spiderShared) QueryCountriesForIPs(reader *maxminddb.Reader, ips []string) {
+	for _, ipstr := range ips {
+		lookupStart := time.Now()
+		country, err := countryFromGeoIP(reader, ipstr)
+		sResults.countryResult <- &CountryResult{ip: ipstr, country: country, err: err, duration: time.Since(lookupStart)}
+	}
 }
 
+// Doubles with each retry; a var so that tests needn't wait
+var countryRetryDelay = 2 * time.Second
+
+// A failure might be a DNS hiccup, or the GeoIP handle being reloaded, so is
+// worth another go; if it keeps failing, the IP is marked as unknown rather
+// than left blank, which means something else.
 func (spider *Spider) processCountryResult(cr *CountryResult) {
+	spider.phases.country += cr.duration
 	if cr.err == nil {
 		spider.countriesForIPs[cr.ip] = cr.country
+		return
+	}
+	attempts := spider.countryAttempts[cr.ip]
+	if attempts <= *flCountryRetries {
+		delay := countryRetryDelay << uint(attempts-1)
+		Log.Printf("Country lookup failure for [%s], retry %d in %s: %s", cr.ip, attempts, delay, cr.err)
+		spider.countryAttempts[cr.ip] += 1
+		spider.pending.Add(1)
+		spider.pendingCountries[cr.ip] += 1
+		go func(shared *spiderShared, ipstr string) {
+			select {
+			case <-time.After(delay):
+			case <-shared.ctx.Done():
+			}
+			shared.QueryCountryForIP(ipstr)
+		}(spider.shared, cr.ip)
+		return
 	}
+	Log.Printf("Country lookup failure for [%s], giving up after %d attempts: %s", cr.ip, attempts, cr.err)
+	spider.countriesForIPs[cr.ip] = kCOUNTRY_UNKNOWN
 }
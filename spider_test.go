@@ -0,0 +1,758 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func setupTestLogging() {
+	if Log == nil {
+		Log = log.New(ioutil.Discard, "", 0)
+	}
+}
+
+// Put a host into the spider as though DNS had just resolved it, without
+// kicking off any network queries.
+func seedResolvedHost(spider *Spider, hostname string, ipList []string) {
+	spider.considering[hostname] = true
+	spider.distances[hostname] = 1
+	spider.knownHosts[hostname] = hostname
+	spider.aliasesForHost[hostname] = []string{hostname}
+	spider.ipsForHost[hostname] = ipList
+	for _, ip := range ipList {
+		spider.knownIPs[ip] = hostname
+	}
+	spider.serverInfos[hostname] = nil
+}
+
+func TestNormalizeHostname(t *testing.T) {
+	for given, want := range map[string]string{
+		"example.org":    "example.org",
+		"Example.ORG.":   "example.org",
+		" example.org. ": "example.org",
+		"":               "",
+	} {
+		if got := normalizeHostname(given); got != want {
+			t.Fatalf("normalizeHostname(%q) = %q, expected %q", given, got, want)
+		}
+	}
+}
+
+func TestSelfReportedNameCaseAndDot(t *testing.T) {
+	setupTestLogging()
+	spider := newSpider()
+	seedResolvedHost(spider, "example.org", []string{"8.8.8.8"})
+
+	node := &SksNode{Hostname: "example.org", Settings: map[string]string{
+		"Hostname": "Example.ORG.",
+		"Nodename": "EXAMPLE.org",
+	}}
+	spider.processHostResult(&HostResult{hostname: "example.org", node: node})
+
+	if len(spider.serverInfos) != 1 {
+		t.Fatalf("Expected 1 serverInfo, got %d: %v", len(spider.serverInfos), spider.serverInfos)
+	}
+	if spider.serverInfos["example.org"] != node {
+		t.Fatalf("serverInfo not recorded under normalized name")
+	}
+	for alias, canonical := range spider.knownHosts {
+		if alias != "example.org" || canonical != "example.org" {
+			t.Fatalf("Unexpected knownHosts entry: %q -> %q", alias, canonical)
+		}
+	}
+	if len(spider.aliasesForHost) != 1 {
+		t.Fatalf("Expected aliases for 1 host, got %v", spider.aliasesForHost)
+	}
+}
+
+func TestBatchAddHostNormalizes(t *testing.T) {
+	spider := newSpider()
+	spider.BatchAddHost("Origin.Example.", []string{"Peer.Example.ORG.", "peer2.example.org"})
+	req := <-spider.batchAddHost
+	if req.origin != "origin.example" {
+		t.Fatalf("Origin not normalized: %q", req.origin)
+	}
+	if req.hostnames[0] != "peer.example.org" || req.hostnames[1] != "peer2.example.org" {
+		t.Fatalf("Hostnames not normalized: %v", req.hostnames)
+	}
+	if spider.pendingHosts["peer.example.org"] != 1 {
+		t.Fatalf("Pending count keyed by un-normalized name: %v", spider.pendingHosts)
+	}
+}
+
+func TestClassifyDnsError(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		retryable bool
+	}{
+		{&net.DNSError{Err: "no such host", Name: "x.example", IsNotFound: true}, false},
+		{&net.DNSError{Err: "server misbehaving", Name: "x.example", IsTemporary: true}, true},
+		{&net.DNSError{Err: "i/o timeout", Name: "x.example", IsTimeout: true}, true},
+		{&net.DNSError{Err: "something odd", Name: "x.example"}, false},
+		{errors.New("not a DNS error"), false},
+	} {
+		reason, retryable := classifyDnsError(tc.err)
+		if retryable != tc.retryable {
+			t.Fatalf("Error %q (%s): retryable=%v, expected %v", tc.err, reason, retryable, tc.retryable)
+		}
+		if reason == "" {
+			t.Fatalf("Error %q gave no reason", tc.err)
+		}
+	}
+}
+
+func TestPermanentDnsFailure(t *testing.T) {
+	setupTestLogging()
+	spider := newSpider()
+	spider.considering["gone.example.org"] = true
+	spider.dnsAttempts["gone.example.org"] = 1
+	spider.processDnsResult(&DnsResult{
+		hostname: "gone.example.org",
+		err:      &net.DNSError{Err: "no such host", Name: "gone.example.org", IsNotFound: true},
+	})
+	if !spider.badDNS["gone.example.org"] {
+		t.Fatalf("Not-found host not recorded as bad DNS")
+	}
+	if spider.dnsFailures["gone.example.org"] != "not found" {
+		t.Fatalf("Bad DNS failure reason: %q", spider.dnsFailures["gone.example.org"])
+	}
+	if spider.dnsAttempts["gone.example.org"] != 1 {
+		t.Fatalf("Not-found host was retried")
+	}
+}
+
+func TestConsiderationCap(t *testing.T) {
+	setupTestLogging()
+	saved := *flMaxConsidering
+	defer func() { *flMaxConsidering = saved }()
+	*flMaxConsidering = 2
+
+	spider := newSpider()
+	spider.considering["one.example.org"] = true
+	spider.considering["two.example.org"] = true
+	spider.pending.Add(1)
+	spider.pendingHosts["three.example.org"] += 1
+	spider.considerHost("three.example.org", &HostsRequest{distance: 1})
+
+	if spider.considering["three.example.org"] {
+		t.Fatalf("Host considered beyond the cap")
+	}
+	if spider.capSkipped != 1 {
+		t.Fatalf("Skip over cap not counted: %d", spider.capSkipped)
+	}
+	if spider.pendingHosts["three.example.org"] != 0 {
+		t.Fatalf("Pending count not dropped for skipped host")
+	}
+	// Would hang if the skip failed to drop the pending count
+	spider.pending.Wait()
+}
+
+func TestCanonicalReassignmentCycle(t *testing.T) {
+	setupTestLogging()
+	var logged bytes.Buffer
+	oldLog := Log
+	Log = log.New(&logged, "", 0)
+	defer func() { Log = oldLog }()
+
+	spider := newSpider()
+	seedResolvedHost(spider, "a.example.org", []string{"192.0.2.1"})
+	seedResolvedHost(spider, "b.example.org", []string{"192.0.2.2"})
+	nodeA := &SksNode{Hostname: "a.example.org", Settings: map[string]string{"Hostname": "b.example.org"}}
+	nodeB := &SksNode{Hostname: "b.example.org", Settings: map[string]string{"Hostname": "a.example.org"}}
+
+	for round := 0; round < 3; round++ {
+		spider.processHostResult(&HostResult{hostname: "a.example.org", node: nodeA})
+		spider.processHostResult(&HostResult{hostname: "b.example.org", node: nodeB})
+		if len(spider.serverInfos) != 2 || spider.serverInfos["b.example.org"] != nodeA || spider.serverInfos["a.example.org"] != nodeB {
+			t.Fatalf("Round %d: both servers' data not kept stably: %v", round, spider.serverInfos)
+		}
+		for _, name := range []string{"a.example.org", "b.example.org"} {
+			if spider.knownHosts[name] != name {
+				t.Fatalf("Round %d: \"%s\" maps to \"%s\"", round, name, spider.knownHosts[name])
+			}
+		}
+	}
+	for _, alias := range spider.aliasesForHost["b.example.org"] {
+		if alias == "a.example.org" {
+			t.Fatalf("\"a.example.org\" still an alias of \"b.example.org\": %v", spider.aliasesForHost)
+		}
+	}
+	if !strings.Contains(logged.String(), "not reassigning canonical name") {
+		t.Fatalf("No warning logged about the cycle:\n%s", logged.String())
+	}
+}
+
+func TestBatchAddHostAtDistance(t *testing.T) {
+	setupTestLogging()
+	spider := newSpider()
+	seedResolvedHost(spider, "origin.example.org", []string{"192.0.2.1"})
+	seedResolvedHost(spider, "peer.example.org", []string{"192.0.2.2"})
+	spider.distances["peer.example.org"] = 5
+
+	spider.BatchAddHostAtDistance("Origin.Example.ORG", []string{"Peer.Example.ORG."}, 3)
+	req := <-spider.batchAddHost
+	if !req.fixedDistance || req.distance != 3 || req.origin != "origin.example.org" {
+		t.Fatalf("Bad request: %+v", req)
+	}
+	spider.considerHost(req.hostnames[0], req)
+	if d := spider.distances["peer.example.org"]; d != 3 {
+		t.Fatalf("Expected forced distance 3, got %d", d)
+	}
+
+	spider.BatchAddHost("origin.example.org", []string{"peer.example.org"})
+	req = <-spider.batchAddHost
+	if req.fixedDistance {
+		t.Fatalf("Plain BatchAddHost request has fixed distance")
+	}
+	spider.considerHost(req.hostnames[0], req)
+	if d := spider.distances["peer.example.org"]; d != 2 {
+		t.Fatalf("Expected distance 2 from origin, got %d", d)
+	}
+}
+
+func TestSkipSuffixes(t *testing.T) {
+	got := parseHostSuffixes("Onion, .I2P. ,,local")
+	if strings.Join(got, " ") != ".onion .i2p .local" {
+		t.Fatalf("Bad suffix parse: %q", got)
+	}
+
+	setupTestLogging()
+	var logged bytes.Buffer
+	oldLog := Log
+	Log = log.New(&logged, "", 0)
+	defer func() { Log = oldLog }()
+
+	spider := newSpider()
+	for _, hostname := range []string{"keys.abcdefghijklmnop.ONION", "sks.example.i2p.", "printer.local"} {
+		spider.pending.Add(1)
+		spider.pendingHosts[normalizeHostname(hostname)] += 1
+		spider.considerHost(hostname, &HostsRequest{distance: 1})
+	}
+	if len(spider.considering) != 0 || len(spider.badDNS) != 0 {
+		t.Fatalf("Special-use hostnames considered: %v / %v", spider.considering, spider.badDNS)
+	}
+	if !strings.Contains(logged.String(), "special-use suffix .onion: keys.abcdefghijklmnop.onion") {
+		t.Fatalf("Skip reason not logged:\n%s", logged.String())
+	}
+	spider.pending.Wait()
+	if suffix := spider.skipSuffixFor("onion.example.org"); suffix != "" {
+		t.Fatalf("Suffix %s matched mid-name", suffix)
+	}
+}
+
+func TestCrawlSuffixes(t *testing.T) {
+	setupTestLogging()
+	saved := *flCrawlSuffixes
+	defer func() { *flCrawlSuffixes = saved }()
+	*flCrawlSuffixes = "Example.ORG"
+
+	spider := newSpider()
+	seedResolvedHost(spider, "seed.example.org", []string{"192.0.2.1"})
+	spider.BatchAddHost("seed.example.org", []string{"other.example.net", "example.org.evil.net", "evilexample.org"})
+	req := <-spider.batchAddHost
+	for _, hostname := range req.hostnames {
+		spider.considerHost(hostname, req)
+	}
+	if len(spider.considering) != 1 {
+		t.Fatalf("Out-of-scope peers considered: %v", spider.considering)
+	}
+	// Would hang if skipping failed to drop the pending counts
+	spider.pending.Wait()
+
+	for hostname, want := range map[string]bool{
+		"keys.example.org": false,
+		"example.org":      false,
+		"example.net":      true,
+	} {
+		if got := spider.outOfScope(hostname, req); got != want {
+			t.Fatalf("outOfScope(%q) = %v, expected %v", hostname, got, want)
+		}
+	}
+	if spider.outOfScope("seed.example.net", &HostsRequest{distance: 0}) {
+		t.Fatalf("Seed host treated as out of scope")
+	}
+}
+
+func TestSocksProxyOnionHosts(t *testing.T) {
+	setupTestLogging()
+	saved := *flSocksProxy
+	defer func() { *flSocksProxy = saved }()
+
+	if suffix := newSpider().skipSuffixFor("keys.abcdefghijklmnop.onion"); suffix != ".onion" {
+		t.Fatalf("Onion host not skipped without a SOCKS proxy")
+	}
+	*flSocksProxy = "127.0.0.1:9050"
+	spider := newSpider()
+	if suffix := spider.skipSuffixFor("keys.abcdefghijklmnop.onion"); suffix != "" {
+		t.Fatalf("Onion host skipped despite SOCKS proxy, by %s", suffix)
+	}
+	if suffix := spider.skipSuffixFor("sks.example.i2p"); suffix != ".i2p" {
+		t.Fatalf("Other suffixes no longer skipped")
+	}
+	spider.lookupHost("keys.abcdefghijklmnop.onion", 0)
+	result := <-spider.shared.dnsResult
+	if result.err != nil || len(result.ipList) != 0 {
+		t.Fatalf("Onion name resolved locally: %v %v", result.ipList, result.err)
+	}
+}
+
+func TestWaitAtMostAbandons(t *testing.T) {
+	setupTestLogging()
+	spider := newSpider()
+	go spiderMainLoop(spider)
+
+	// A DNS lookup in flight, which will only finish after the deadline
+	spider.considering["slow.example.org"] = true
+	spider.pending.Add(1)
+	spider.pendingHosts["slow.example.org"] += 1
+	finished := make(chan bool)
+	go func() {
+		finished <- spider.WaitAtMost(10 * time.Millisecond)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	spider.shared.dnsResult <- &DnsResult{"slow.example.org", []string{"192.0.2.1"}, nil, "", 0}
+
+	if <-finished {
+		t.Fatalf("Scan past its deadline reported as complete")
+	}
+	if spider.abandonedHosts != 1 {
+		t.Fatalf("Expected 1 abandoned host, got %d", spider.abandonedHosts)
+	}
+	if _, ok := spider.serverInfos["slow.example.org"]; ok {
+		t.Fatalf("Host queried after the deadline")
+	}
+
+	quick := newSpider()
+	if !quick.WaitAtMost(time.Minute) {
+		t.Fatalf("Scan with nothing pending cut short")
+	}
+}
+
+func TestTerminateStopsMainLoop(t *testing.T) {
+	setupTestLogging()
+	spider := newSpider()
+	exited := make(chan bool)
+	go func() {
+		spiderMainLoop(spider)
+		close(exited)
+	}()
+
+	// More DNS lookups in flight than the result channel can hold
+	const late = QUEUE_DEPTH * 2
+	spider.pending.Add(late)
+	spider.pendingHosts["late.example.org"] += late
+	spider.Terminate()
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatalf("Main loop still running after Terminate")
+	}
+
+	sent := make(chan bool)
+	go func() {
+		for i := 0; i < late; i++ {
+			spider.shared.dnsResult <- &DnsResult{"late.example.org", []string{"192.0.2.1"}, nil, "", 0}
+		}
+		close(sent)
+	}()
+	waited := make(chan bool)
+	go func() {
+		spider.Wait()
+		close(waited)
+	}()
+	for _, c := range []chan bool{sent, waited} {
+		select {
+		case <-c:
+		case <-time.After(time.Second):
+			t.Fatalf("Results in flight at Terminate not discarded")
+		}
+	}
+	if _, ok := spider.knownHosts["late.example.org"]; ok {
+		t.Fatalf("Result processed after Terminate")
+	}
+}
+
+func TestCancelAbortsLookups(t *testing.T) {
+	setupTestLogging()
+	savedLimit, savedLookup := *flMaxConcurrentDNS, lookupHostFunc
+	defer func() { *flMaxConcurrentDNS, lookupHostFunc = savedLimit, savedLookup }()
+	// So that some lookups are still queued for a slot when cancelled
+	*flMaxConcurrentDNS = 2
+
+	var started int32
+	lookupHostFunc = func(ctx context.Context, hostname string) ([]string, error) {
+		atomic.AddInt32(&started, 1)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	spider := newSpider()
+	spider.shared.ctx = ctx
+	go spiderMainLoop(spider)
+	for i := 0; i < 5; i++ {
+		spider.AddHost(fmt.Sprintf("host%d.example.org", i), 0)
+	}
+	for atomic.LoadInt32(&started) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	waited := make(chan bool)
+	go func() {
+		spider.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatalf("Wait still blocked after cancel")
+	}
+	select {
+	case <-spider.stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Main loop still running after cancel")
+	}
+	// As the scheduler does, regardless
+	spider.Terminate()
+	if n := atomic.LoadInt32(&started); n > 2 {
+		t.Fatalf("%d lookups started, queued ones should have been abandoned", n)
+	}
+}
+
+func TestCountryLookupRetry(t *testing.T) {
+	setupTestLogging()
+	savedRetries, savedDelay := *flCountryRetries, countryRetryDelay
+	defer func() { *flCountryRetries, countryRetryDelay = savedRetries, savedDelay }()
+	*flCountryRetries = 1
+	countryRetryDelay = time.Millisecond
+
+	spider := newSpider()
+	spider.countriesForIPs["bogus"] = ""
+	spider.countryAttempts["bogus"] = 1
+	spider.processCountryResult(&CountryResult{ip: "bogus", err: errors.New("handle reloading")})
+	if spider.countriesForIPs["bogus"] != "" || spider.pendingCountries["bogus"] != 1 {
+		t.Fatalf("Failed lookup not retried")
+	}
+	// "bogus" isn't an IP, so the retry fails too, without touching the network
+	result := <-spider.shared.countryResult
+	if result.err == nil {
+		t.Fatalf("Lookup of bogus IP succeeded: %q", result.country)
+	}
+	spider.processCountryResult(result)
+	if got := spider.countriesForIPs["bogus"]; got != kCOUNTRY_UNKNOWN {
+		t.Fatalf("Expected unknown country after retries, got %q", got)
+	}
+	if spider.countryAttempts["bogus"] != 2 {
+		t.Fatalf("Expected 2 attempts, got %d", spider.countryAttempts["bogus"])
+	}
+}
+
+func TestHostnameMismatches(t *testing.T) {
+	setupTestLogging()
+	spider := newSpider()
+	seedResolvedHost(spider, "alias.example.org", []string{"192.0.2.1"})
+	seedResolvedHost(spider, "same.example.org", []string{"192.0.2.2"})
+	spider.processHostResult(&HostResult{hostname: "alias.example.org", node: &SksNode{
+		Hostname: "alias.example.org",
+		Settings: map[string]string{"Hostname": "Real.Example.ORG", "Nodename": "alpha"},
+	}})
+	spider.processHostResult(&HostResult{hostname: "same.example.org", node: &SksNode{
+		Hostname: "same.example.org",
+		Settings: map[string]string{"Hostname": "same.example.org.", "Nodename": "beta"},
+	}})
+
+	mismatches := sortedMismatches(spider.nameMismatches)
+	if len(mismatches) != 1 {
+		t.Fatalf("Expected 1 mismatch, got %+v", mismatches)
+	}
+	want := HostnameMismatch{Queried: "alias.example.org", Reported: "real.example.org", Nodename: "alpha"}
+	if mismatches[0] != want {
+		t.Fatalf("Bad mismatch %+v", mismatches[0])
+	}
+
+	persisted := newTestPersisted(t)
+	persisted.HostnameMismatches = mismatches
+	SetCurrentPersisted(persisted)
+	rec := testGet(t, apiHostnameMismatchesPage, SERVE_PREFIX+"/hostname-mismatches")
+	if !strings.Contains(rec.Body.String(), `"reported_hostname":"real.example.org"`) {
+		t.Fatalf("Mismatch not served:\n%s", rec.Body)
+	}
+}
+
+func TestSelfPeers(t *testing.T) {
+	setupTestLogging()
+	spider := newSpider()
+	seedResolvedHost(spider, "keys.example.org", []string{"192.0.2.1"})
+	spider.aliasesForHost["keys.example.org"] = []string{"keys.example.org", "pool.example.org"}
+	spider.knownHosts["pool.example.org"] = "keys.example.org"
+	seedResolvedHost(spider, "other.example.org", []string{"192.0.2.2"})
+	spider.processHostResult(&HostResult{hostname: "keys.example.org", node: &SksNode{
+		Hostname:       "keys.example.org",
+		GossipPeerList: []string{"other.example.org", "Pool.Example.ORG", "192.0.2.1", "keys.example.org:11370"},
+	}})
+	spider.processHostResult(&HostResult{hostname: "other.example.org", node: &SksNode{
+		Hostname:       "other.example.org",
+		GossipPeerList: []string{"keys.example.org", "192.0.2.1"},
+	}})
+	if request := <-spider.batchAddHost; len(request.hostnames) != 4 {
+		t.Fatalf("Self-peering changed the peers followed: %v", request.hostnames)
+	}
+
+	if len(spider.selfPeers) != 1 {
+		t.Fatalf("Expected only keys.example.org self-peering, got %v", spider.selfPeers)
+	}
+	self := spider.selfPeers["keys.example.org"]
+	if len(self) != 3 || self[0] != "pool.example.org" || self[1] != "192.0.2.1" || self[2] != "keys.example.org" {
+		t.Fatalf("Bad self-peer entries %v", self)
+	}
+
+	persisted := newTestPersisted(t)
+	persisted.SelfPeers = sortedSelfPeers(spider.selfPeers, HostMap{"keys.example.org": &SksNode{}})
+	SetCurrentPersisted(persisted)
+	rec := testGet(t, apiSelfPeersPage, SERVE_PREFIX+"/self-peers")
+	if !strings.Contains(rec.Body.String(), `"listed_as":["pool.example.org","192.0.2.1","keys.example.org"]`) {
+		t.Fatalf("Self-peers not served:\n%s", rec.Body)
+	}
+}
+
+func TestDnsConcurrencyLimit(t *testing.T) {
+	setupTestLogging()
+	savedLimit, savedLookup := *flMaxConcurrentDNS, lookupHostFunc
+	defer func() { *flMaxConcurrentDNS, lookupHostFunc = savedLimit, savedLookup }()
+	*flMaxConcurrentDNS = 10
+
+	var inFlight, maxInFlight int32
+	lookupHostFunc = func(ctx context.Context, hostname string) ([]string, error) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			seen := atomic.LoadInt32(&maxInFlight)
+			if n <= seen || atomic.CompareAndSwapInt32(&maxInFlight, seen, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		return []string{"192.0.2.1"}, nil
+	}
+
+	spider := newSpider()
+	const hosts = 2000
+	for i := 0; i < hosts; i++ {
+		spider.lookupHost(fmt.Sprintf("host%d.example.org", i), 0)
+	}
+	for i := 0; i < hosts; i++ {
+		<-spider.shared.dnsResult
+	}
+	if maxInFlight > 10 {
+		t.Fatalf("%d DNS lookups in flight at once, limit 10", maxInFlight)
+	}
+	if maxInFlight < 2 {
+		t.Fatalf("DNS lookups not concurrent at all")
+	}
+}
+
+func TestDnsCnameMerge(t *testing.T) {
+	setupTestLogging()
+	savedFlag, savedHost, savedCNAME := *flDnsCnames, lookupHostFunc, lookupCNAMEFunc
+	defer func() { *flDnsCnames, lookupHostFunc, lookupCNAMEFunc = savedFlag, savedHost, savedCNAME }()
+	*flDnsCnames = true
+	// Round-robin, so the two lookups share no IP
+	lookupHostFunc = func(ctx context.Context, hostname string) ([]string, error) {
+		if hostname == "keys.example.org" {
+			return []string{"130.225.1.1"}, nil
+		}
+		return []string{"130.225.1.2"}, nil
+	}
+	lookupCNAMEFunc = func(ctx context.Context, hostname string) (string, error) {
+		return "Pool.Example.NET.", nil
+	}
+
+	spider := newSpider()
+	for _, hostname := range []string{"keys.example.org", "pgp.example.com"} {
+		spider.considering[hostname] = true
+		spider.lookupHost(hostname, 0)
+		dns := <-spider.shared.dnsResult
+		if dns.cname != "pool.example.net" {
+			t.Fatalf("Bad CNAME for %s: %q", hostname, dns.cname)
+		}
+		spider.processDnsResult(dns)
+	}
+	if canonical := spider.knownHosts["pgp.example.com"]; canonical != "keys.example.org" {
+		t.Fatalf("CNAME-equal host not merged, canonical %q", canonical)
+	}
+	if _, ok := spider.serverInfos["pgp.example.com"]; ok {
+		t.Fatalf("CNAME-equal host queried as a server of its own")
+	}
+	if ips := spider.ipsForHost["keys.example.org"]; len(ips) != 2 {
+		t.Fatalf("IPs not merged: %v", ips)
+	}
+
+	// Without the flag, only IPs de-duplicate
+	*flDnsCnames = false
+	spider = newSpider()
+	for _, hostname := range []string{"keys.example.org", "pgp.example.com"} {
+		spider.lookupHost(hostname, 0)
+		dns := <-spider.shared.dnsResult
+		if dns.cname != "" {
+			t.Fatalf("CNAME looked up without -dns-cnames: %q", dns.cname)
+		}
+		spider.processDnsResult(dns)
+	}
+	if canonical := spider.knownHosts["pgp.example.com"]; canonical != "pgp.example.com" {
+		t.Fatalf("Hosts merged without -dns-cnames, canonical %q", canonical)
+	}
+}
+
+func TestIPv6Normalized(t *testing.T) {
+	setupTestLogging()
+	flat := flattenIPs([]string{"2001:DB8:0:0::1", "192.0.2.1"}, []string{"2001:db8::1", "2001:0db8:0000::0001"})
+	if len(flat) != 2 || flat[0] != "2001:db8::1" || flat[1] != "192.0.2.1" {
+		t.Fatalf("Equivalent IPv6 forms not flattened to one: %v", flat)
+	}
+
+	spider := newSpider()
+	spider.processDnsResult(&DnsResult{"keys.example.org", []string{"2A01:4F8:0:0::7"}, nil, "", 0})
+	spider.processDnsResult(&DnsResult{"pgp.example.com", []string{"2a01:4f8::7"}, nil, "", 0})
+	if canonical := spider.knownHosts["pgp.example.com"]; canonical != "keys.example.org" {
+		t.Fatalf("Host with the same IPv6 address in another form not merged, canonical %q", canonical)
+	}
+	if _, ok := spider.knownIPs["2a01:4f8::7"]; !ok || len(spider.knownIPs) != 1 {
+		t.Fatalf("Bad knownIPs: %v", spider.knownIPs)
+	}
+
+	saved := *flNormalizeIPv6
+	defer func() { *flNormalizeIPv6 = saved }()
+	*flNormalizeIPv6 = false
+	if flat := flattenIPs([]string{"2001:DB8::1", "2001:db8::1"}); len(flat) != 2 {
+		t.Fatalf("IPv6 normalized with -normalize-ipv6=false: %v", flat)
+	}
+}
+
+func TestRecentlyFailedSkipped(t *testing.T) {
+	setupTestLogging()
+	saved := *flFailedQuietPeriod
+	defer func() { *flFailedQuietPeriod = saved }()
+	*flFailedQuietPeriod = 0
+
+	spider := newSpider()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	spider.shared.ctx = ctx
+	spider.considering["down.example.org"] = true
+	spider.serverInfos["down.example.org"] = nil
+	spider.processHostResult(&HostResult{hostname: "down.example.org", err: errors.New("connection refused")})
+	if _, ok := spider.fetchFailedAt["down.example.org"]; !ok {
+		t.Fatalf("Failure time not recorded")
+	}
+
+	mention := func() {
+		spider.pending.Add(1)
+		spider.pendingHosts["down.example.org"] += 1
+		spider.considerHost("down.example.org", &HostsRequest{origin: "keys.example.org"})
+	}
+	mention()
+	if spider.pendingHosts["down.example.org"] != 0 {
+		t.Fatalf("Pending count not released on skip: %d", spider.pendingHosts["down.example.org"])
+	}
+	spider.pending.Wait()
+
+	// Once the quiet period is over, a mention brings a second fetch
+	*flFailedQuietPeriod = time.Minute
+	spider.fetchFailedAt["down.example.org"] = time.Now().Add(-30 * time.Second)
+	mention()
+	if spider.pendingHosts["down.example.org"] != 0 {
+		t.Fatalf("Pending count not released within the quiet period")
+	}
+	spider.fetchFailedAt["down.example.org"] = time.Now().Add(-2 * time.Minute)
+	mention()
+	if _, ok := spider.queryErrors["down.example.org"]; ok {
+		t.Fatalf("Old failure kept for refetched host")
+	}
+	select {
+	case hr := <-spider.shared.hostResult:
+		if hr.hostname != "down.example.org" {
+			t.Fatalf("Unexpected fetch of %q", hr.hostname)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Host not fetched again after the quiet period")
+	}
+	if spider.pendingHosts["down.example.org"] != 1 {
+		t.Fatalf("Refetch not pending: %d", spider.pendingHosts["down.example.org"])
+	}
+}
+
+func TestCleanGossipPeers(t *testing.T) {
+	peers := []string{" Keys.Example.ORG. ", "pgp.example.net:11370", "", "bad host.example.com",
+		"ctl\x07.example.com", "[2001:db8::1]:11370", "sks.example.com\t"}
+	cleaned, dropped := cleanGossipPeers(peers)
+	want := []string{"keys.example.org", "pgp.example.net", "2001:db8::1", "sks.example.com"}
+	if dropped != 3 || len(cleaned) != len(want) {
+		t.Fatalf("Expected %v with 3 dropped, got %v with %d", want, cleaned, dropped)
+	}
+	for i := range want {
+		if cleaned[i] != want[i] {
+			t.Fatalf("Expected %v, got %v", want, cleaned)
+		}
+	}
+
+	spider := newSpider()
+	node := &SksNode{Hostname: "keys.example.org", GossipPeerList: peers}
+	spider.processHostResult(&HostResult{hostname: "keys.example.org", node: node})
+	request := <-spider.batchAddHost
+	if len(request.hostnames) != len(want) || spider.pendingHosts["bad host.example.com"] != 0 {
+		t.Fatalf("Malformed peers queued: %v", request.hostnames)
+	}
+}
+
+func TestMaxPeersPerHost(t *testing.T) {
+	setupTestLogging()
+	saved := *flMaxPeersPerHost
+	defer func() { *flMaxPeersPerHost = saved }()
+	*flMaxPeersPerHost = 3
+
+	peers := []string{"a.example.org", "b.example.org", "c.example.org", "d.example.org", "e.example.org"}
+	spider := newSpider()
+	node := &SksNode{Hostname: "keys.example.org", GossipPeerList: peers}
+	spider.processHostResult(&HostResult{hostname: "keys.example.org", node: node})
+	request := <-spider.batchAddHost
+	if len(request.hostnames) != 3 || request.hostnames[2] != "c.example.org" {
+		t.Fatalf("Expected the first 3 peers followed, got %v", request.hostnames)
+	}
+	if node.PeersListed != 5 || len(node.GossipPeerList) != 5 {
+		t.Fatalf("Original peer list not kept: listed %d, %v", node.PeersListed, node.GossipPeerList)
+	}
+
+	*flMaxPeersPerHost = 0
+	node = &SksNode{Hostname: "keys.example.org", GossipPeerList: peers}
+	spider = newSpider()
+	spider.processHostResult(&HostResult{hostname: "keys.example.org", node: node})
+	if request := <-spider.batchAddHost; len(request.hostnames) != 5 || node.PeersListed != 0 {
+		t.Fatalf("Peers cut without a limit: %v", request.hostnames)
+	}
+}
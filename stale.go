@@ -0,0 +1,183 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// Hosts which keep failing, scan after scan, are eventually dropped from the
+// inventory instead of lingering as errors forever.  This state persists
+// across scans, unlike everything in the Spider.
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type StaleHost struct {
+	Hostname     string    `json:"hostname"`
+	Failures     int       `json:"consecutive_failures"`
+	FirstFailure time.Time `json:"first_failure"`
+	LastError    string    `json:"last_error"`
+	Purged       bool      `json:"purged"`
+}
+
+type staleTracker struct {
+	lock  sync.Mutex
+	hosts map[string]*StaleHost
+}
+
+var staleHosts = newStaleTracker()
+
+func newStaleTracker() *staleTracker {
+	return &staleTracker{hosts: make(map[string]*StaleHost)}
+}
+
+func (st *staleTracker) shouldPurge(sh *StaleHost, now time.Time) bool {
+	if *flPurgeAfterFailures > 0 && sh.Failures >= *flPurgeAfterFailures {
+		return true
+	}
+	if *flPurgeAfterAge > 0 && now.Sub(sh.FirstFailure) >= *flPurgeAfterAge {
+		return true
+	}
+	return false
+}
+
+// Called once per scan with the fresh results: hosts with an analyze error,
+// which couldn't be fetched at all, or whose DNS was bad, count as failed;
+// any other host in the hostMap is a success and resets its count.  Hosts
+// due for purging are removed from hostMap, unless pinned.  Hosts not seen
+// at all this scan are forgotten.
+func (st *staleTracker) update(hostMap HostMap, queryErrors map[string]error, badDNS map[string]bool, now time.Time) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	failed := make(map[string]string, len(queryErrors)+len(badDNS))
+	for hostname := range badDNS {
+		failed[hostname] = "bad DNS"
+	}
+	for hostname, err := range queryErrors {
+		failed[hostname] = err.Error()
+	}
+	for hostname, node := range hostMap {
+		if node.AnalyzeError != "" {
+			failed[hostname] = node.AnalyzeError
+		}
+	}
+
+	for hostname := range st.hosts {
+		if _, ok := failed[hostname]; !ok {
+			delete(st.hosts, hostname)
+		}
+	}
+
+	for hostname, reason := range failed {
+		sh, ok := st.hosts[hostname]
+		if !ok {
+			sh = &StaleHost{Hostname: hostname, FirstFailure: now}
+			st.hosts[hostname] = sh
+		}
+		sh.Failures += 1
+		sh.LastError = reason
+		if node, ok := hostMap[hostname]; (ok && node.Pinned) || isPinnedHost(hostname) {
+			sh.Purged = false
+		} else {
+			sh.Purged = st.shouldPurge(sh, now)
+		}
+		if sh.Purged {
+			if _, ok := hostMap[hostname]; ok {
+				Log.Printf("Purging stale host \"%s\" after %d consecutive failures since %s",
+					hostname, sh.Failures, sh.FirstFailure.UTC().Format(time.RFC3339))
+				delete(hostMap, hostname)
+			}
+		}
+	}
+}
+
+func (st *staleTracker) withinGrace(sh *StaleHost, now time.Time) bool {
+	if *flGraceScans <= 0 && *flGraceAge <= 0 {
+		return false
+	}
+	if *flGraceScans > 0 && sh.Failures > *flGraceScans {
+		return false
+	}
+	if *flGraceAge > 0 && now.Sub(sh.FirstFailure) > *flGraceAge {
+		return false
+	}
+	return true
+}
+
+// Called after update: a failing host still within the grace window keeps
+// the data it had in the previous snapshot, if that was good, so that one
+// transient failure doesn't flap it out of the ip-valid pool.  The previous
+// snapshot is immutable, so the node is copied.
+func (st *staleTracker) carryForward(hostMap HostMap, previous *PersistedHostInfo, now time.Time) int {
+	if previous == nil {
+		return 0
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	carried := 0
+	for hostname, sh := range st.hosts {
+		if sh.Purged || !st.withinGrace(sh, now) {
+			continue
+		}
+		old, ok := previous.HostMap[hostname]
+		if !ok || old.Keycount <= 1 || old.AnalyzeError != "" {
+			continue
+		}
+		node := *old
+		if node.LastGoodScan.IsZero() {
+			node.LastGoodScan = previous.Timestamp
+		}
+		hostMap[hostname] = &node
+		carried += 1
+	}
+	if carried > 0 {
+		Log.Printf("Carried forward last-known-good data for %d failing hosts", carried)
+	}
+	return carried
+}
+
+// Copies, sorted most-failed first
+func (st *staleTracker) List() []StaleHost {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	list := make([]StaleHost, 0, len(st.hosts))
+	for _, sh := range st.hosts {
+		list = append(list, *sh)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Failures != list[j].Failures {
+			return list[i].Failures > list[j].Failures
+		}
+		return list[i].Hostname < list[j].Hostname
+	})
+	return list
+}
+
+func apiStaleHostsPage(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form information", http.StatusBadRequest)
+		return
+	}
+	reportWriteJson(w, req, map[string]interface{}{
+		"purge_after_failures": *flPurgeAfterFailures,
+		"purge_after_age":      flPurgeAfterAge.String(),
+		"hosts":                staleHosts.List(),
+	})
+}
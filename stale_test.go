@@ -0,0 +1,142 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStalePurge(t *testing.T) {
+	setupTestLogging()
+	saved := *flPurgeAfterFailures
+	defer func() { *flPurgeAfterFailures = saved }()
+	*flPurgeAfterFailures = 3
+
+	st := newStaleTracker()
+	now := time.Now()
+	scan := func() HostMap {
+		hostMap := HostMap{
+			"good.example.org":   &SksNode{},
+			"broken.example.org": &SksNode{AnalyzeError: "HTTP GET failure: 500"},
+		}
+		st.update(hostMap, map[string]error{"down.example.org": errors.New("connection refused")},
+			map[string]bool{"nxdomain.example.org": true}, now)
+		now = now.Add(time.Hour)
+		return hostMap
+	}
+
+	for i := 1; i < 3; i++ {
+		hostMap := scan()
+		if _, ok := hostMap["broken.example.org"]; !ok {
+			t.Fatalf("Host purged after only %d failures", i)
+		}
+	}
+	hostMap := scan()
+	if _, ok := hostMap["broken.example.org"]; ok {
+		t.Fatalf("Host not purged after 3 failures")
+	}
+	if _, ok := hostMap["good.example.org"]; !ok {
+		t.Fatalf("Good host purged")
+	}
+	list := st.List()
+	if len(list) != 3 || list[0].Failures != 3 || !list[0].Purged {
+		t.Fatalf("Bad stale list: %+v", list)
+	}
+	if list[2].Hostname != "nxdomain.example.org" || list[2].Failures != 3 || list[2].LastError != "bad DNS" {
+		t.Fatalf("Bad DNS not counted as a failure: %+v", list[2])
+	}
+
+	// Recovery resets the count
+	st.update(HostMap{"broken.example.org": &SksNode{}}, nil, nil, now)
+	if len(st.List()) != 0 {
+		t.Fatalf("Recovered host still listed: %+v", st.List())
+	}
+}
+
+func TestStaleGraceCarryForward(t *testing.T) {
+	setupTestLogging()
+	saved := *flGraceScans
+	defer func() { *flGraceScans = saved }()
+	*flGraceScans = 2
+
+	st := newStaleTracker()
+	now := time.Now()
+	previous := &PersistedHostInfo{
+		Timestamp: now.Add(-time.Hour),
+		HostMap: HostMap{
+			"flaky.example.org":  &SksNode{Hostname: "flaky.example.org", Keycount: 3200000, IpList: []string{"192.0.2.1"}},
+			"broken.example.org": &SksNode{Hostname: "broken.example.org", Keycount: -2, AnalyzeError: "HTTP GET failure: 500"},
+		},
+	}
+	original := previous.HostMap["flaky.example.org"]
+	lastGood := previous.Timestamp
+	scan := func() HostMap {
+		hostMap := HostMap{
+			"flaky.example.org": &SksNode{Hostname: "flaky.example.org", Keycount: -2, AnalyzeError: "HTTP GET failure: 503"},
+		}
+		st.update(hostMap, map[string]error{"broken.example.org": errors.New("connection refused")}, nil, now)
+		st.carryForward(hostMap, previous, now)
+		now = now.Add(time.Hour)
+		return hostMap
+	}
+
+	for i := 1; i <= 2; i++ {
+		hostMap := scan()
+		node := hostMap["flaky.example.org"]
+		if node.Keycount != 3200000 || node.LastGoodScan != lastGood {
+			t.Fatalf("Scan %d: last-known-good data not carried forward: %+v", i, node)
+		}
+		if _, ok := hostMap["broken.example.org"]; ok {
+			t.Fatalf("Scan %d: host without good data carried forward", i)
+		}
+		previous = &PersistedHostInfo{Timestamp: now, HostMap: hostMap}
+	}
+	if !original.LastGoodScan.IsZero() {
+		t.Fatalf("Previous snapshot modified")
+	}
+	if node := scan()["flaky.example.org"]; node.Keycount != -2 || !node.LastGoodScan.IsZero() {
+		t.Fatalf("Carried forward beyond the grace window: %+v", node)
+	}
+}
+
+func TestStalePinnedNeverPurged(t *testing.T) {
+	setupTestLogging()
+	savedFailures, savedPinned := *flPurgeAfterFailures, *flPinnedHosts
+	defer func() { *flPurgeAfterFailures, *flPinnedHosts = savedFailures, savedPinned }()
+	*flPurgeAfterFailures = 1
+	*flPinnedHosts = "Anchor.example.org, down.example.org"
+
+	st := newStaleTracker()
+	hostMap := HostMap{
+		"anchor.example.org": &SksNode{AnalyzeError: "HTTP GET failure: 500"},
+		"broken.example.org": &SksNode{AnalyzeError: "HTTP GET failure: 500"},
+	}
+	st.update(hostMap, map[string]error{"down.example.org": errors.New("connection refused")}, nil, time.Now())
+	if _, ok := hostMap["anchor.example.org"]; !ok {
+		t.Fatalf("Pinned host purged")
+	}
+	if _, ok := hostMap["broken.example.org"]; ok {
+		t.Fatalf("Unpinned host not purged")
+	}
+	for _, sh := range st.List() {
+		if sh.Purged != (sh.Hostname == "broken.example.org") {
+			t.Fatalf("Bad purge state: %+v", sh)
+		}
+	}
+}
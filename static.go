@@ -0,0 +1,117 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// A server whose keycount doesn't move, scan after scan, while the rest of
+// the mesh grows has most likely stopped syncing.  Like the stale hosts, this
+// needs state kept across scans, but only the keycounts.
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+)
+
+type scanKeycounts struct {
+	median int
+	counts map[string]int
+}
+
+type keycountTracker struct {
+	lock  sync.Mutex
+	scans []scanKeycounts // oldest first, at most flStaticScans
+}
+
+var keycountHistory = &keycountTracker{}
+
+type StaticServer struct {
+	Hostname string `json:"hostname"`
+	Keycount int    `json:"keycount"`
+}
+
+func medianKeycount(counts map[string]int) int {
+	if len(counts) == 0 {
+		return 0
+	}
+	values := make([]int, 0, len(counts))
+	for _, count := range counts {
+		values = append(values, count)
+	}
+	sort.Ints(values)
+	return values[len(values)/2]
+}
+
+// Called once per scan, with the freshly installed snapshot
+func (kt *keycountTracker) record(hostMap HostMap) {
+	counts := make(map[string]int, len(hostMap))
+	for hostname, node := range hostMap {
+		// Carried-forward data would look static by construction
+		if node.Keycount > 1 && node.LastGoodScan.IsZero() {
+			counts[hostname] = node.Keycount
+		}
+	}
+	kt.lock.Lock()
+	defer kt.lock.Unlock()
+	kt.scans = append(kt.scans, scanKeycounts{median: medianKeycount(counts), counts: counts})
+	if keep := *flStaticScans; keep > 0 && len(kt.scans) > keep {
+		kt.scans = kt.scans[len(kt.scans)-keep:]
+	}
+}
+
+// Servers with the same keycount in every one of the last flStaticScans
+// scans, provided the median rose over those scans; nil until we have that
+// many scans.
+func (kt *keycountTracker) Static() (servers []StaticServer, medianThen, medianNow int) {
+	kt.lock.Lock()
+	defer kt.lock.Unlock()
+	if *flStaticScans < 2 || len(kt.scans) < *flStaticScans {
+		return nil, 0, 0
+	}
+	first, last := kt.scans[0], kt.scans[len(kt.scans)-1]
+	if last.median <= first.median {
+		return []StaticServer{}, first.median, last.median
+	}
+	servers = make([]StaticServer, 0)
+	for hostname, count := range last.counts {
+		static := true
+		for _, scan := range kt.scans {
+			if scan.counts[hostname] != count {
+				static = false
+				break
+			}
+		}
+		if static {
+			servers = append(servers, StaticServer{Hostname: hostname, Keycount: count})
+		}
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Hostname < servers[j].Hostname })
+	return servers, first.median, last.median
+}
+
+func apiStaticKeycountsPage(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form information", http.StatusBadRequest)
+		return
+	}
+	servers, medianThen, medianNow := keycountHistory.Static()
+	reportWriteJson(w, req, map[string]interface{}{
+		"scans":       *flStaticScans,
+		"median_then": medianThen,
+		"median_now":  medianNow,
+		"servers":     servers,
+	})
+}
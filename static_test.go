@@ -0,0 +1,58 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStaticKeycounts(t *testing.T) {
+	saved := *flStaticScans
+	defer func() { *flStaticScans = saved }()
+	*flStaticScans = 3
+
+	kt := &keycountTracker{}
+	scan := func(growing, stuck, carried int) {
+		kt.record(HostMap{
+			"a.example.org":     &SksNode{Keycount: growing},
+			"b.example.org":     &SksNode{Keycount: growing + 5},
+			"stuck.example.org": &SksNode{Keycount: stuck},
+			"grace.example.org": &SksNode{Keycount: carried, LastGoodScan: time.Now()},
+		})
+	}
+	scan(3000000, 2900000, 2800000)
+	scan(3000500, 2900000, 2800000)
+	if servers, _, _ := kt.Static(); servers != nil {
+		t.Fatalf("Flagged servers with only 2 scans: %v", servers)
+	}
+	scan(3001000, 2900000, 2800000)
+	servers, then, now := kt.Static()
+	if len(servers) != 1 || servers[0].Hostname != "stuck.example.org" || then >= now {
+		t.Fatalf("Bad static servers: %v (median %d -> %d)", servers, then, now)
+	}
+	if len(kt.scans) != 3 {
+		t.Fatalf("History not trimmed: %d scans", len(kt.scans))
+	}
+
+	// A mesh which isn't growing tells us nothing
+	scan(3001000, 2900000, 2800000)
+	scan(3001000, 2900000, 2800000)
+	if servers, _, _ := kt.Static(); len(servers) != 0 {
+		t.Fatalf("Flagged servers while the mesh stood still: %v", servers)
+	}
+}
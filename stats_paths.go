@@ -0,0 +1,84 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// Where to find a server's stats page.  SKS has it at /pks/lookup?op=stats,
+// other keyserver software elsewhere, so there's a list of candidates to try
+// in order, globally with -stats-paths and per-host with -stats-paths-file.
+
+import (
+	"strings"
+	"sync"
+)
+
+const kDEFAULT_STATS_PATH = "/pks/lookup?op=stats"
+
+var (
+	hostStatsPaths     map[string][]string
+	hostStatsPathsLock sync.RWMutex
+)
+
+// Paths must be absolute; anything else is ignored rather than fetched as
+// some odd relative URL.
+func parseStatsPaths(list string) []string {
+	paths := make([]string, 0, 2)
+	for _, path := range strings.Split(list, ",") {
+		if path = strings.TrimSpace(path); strings.HasPrefix(path, "/") {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// Same layout as -annotations-file: hostname, whitespace, then the paths,
+// comma-separated.  Re-read at the start of each scan, so edits need no
+// restart; if it can't be read, the previous overrides stay.
+func LoadStatsPathsFile() {
+	if *flStatsPathsFile == "" {
+		return
+	}
+	lines, err := LoadAnnotations(*flStatsPathsFile)
+	if err != nil {
+		Log.Printf("Failed to load stats paths from \"%s\": %s", *flStatsPathsFile, err)
+		return
+	}
+	overrides := make(map[string][]string, len(lines))
+	for hostname, list := range lines {
+		if paths := parseStatsPaths(list); len(paths) > 0 {
+			overrides[hostname] = paths
+		} else {
+			Log.Printf("No usable stats paths for \"%s\" in \"%s\"", hostname, *flStatsPathsFile)
+		}
+	}
+	hostStatsPathsLock.Lock()
+	hostStatsPaths = overrides
+	hostStatsPathsLock.Unlock()
+}
+
+// Never empty
+func statsPathsFor(hostname string) []string {
+	hostStatsPathsLock.RLock()
+	paths, ok := hostStatsPaths[hostname]
+	hostStatsPathsLock.RUnlock()
+	if ok {
+		return paths
+	}
+	if paths = parseStatsPaths(*flStatsPaths); len(paths) > 0 {
+		return paths
+	}
+	return []string{kDEFAULT_STATS_PATH}
+}
@@ -0,0 +1,99 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStatsPathCandidates(t *testing.T) {
+	setupTestLogging()
+	saved := *flStatsPaths
+	defer func() { *flStatsPaths = saved }()
+
+	fake := newFakeKeyserverFromFile(t, TEST_STATS_SKS)
+	defer fake.Close()
+	fake.statsPath = "/pks/stats"
+
+	*flStatsPaths = kDEFAULT_STATS_PATH + ", /pks/stats"
+	node := fake.FetchNode(t)
+	if node.StatsPath != "/pks/stats" || node.Keycount != 3169004 {
+		t.Fatalf("Second candidate path not used: path=%q keycount=%d", node.StatsPath, node.Keycount)
+	}
+	if fake.requests != 2 {
+		t.Fatalf("Expected 2 requests, got %d", fake.requests)
+	}
+
+	// With only the default, the 404 is what Analyze sees
+	*flStatsPaths = kDEFAULT_STATS_PATH
+	node = fake.FetchNode(t)
+	if node.StatsPath != "" || node.Keycount != -2 || node.analyzeError == nil {
+		t.Fatalf("Missing stats page not reported: path=%q keycount=%d err=%v", node.StatsPath, node.Keycount, node.analyzeError)
+	}
+}
+
+func TestStatsPathsFile(t *testing.T) {
+	setupTestLogging()
+	saved := *flStatsPathsFile
+	defer func() {
+		*flStatsPathsFile = saved
+		hostStatsPathsLock.Lock()
+		hostStatsPaths = nil
+		hostStatsPathsLock.Unlock()
+	}()
+
+	dir, err := ioutil.TempDir("", "stats-paths")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	*flStatsPathsFile = filepath.Join(dir, "paths")
+	content := "# comments as for annotations\nHockeypuck.Example.org /pks/stats,/pks/lookup?op=stats\nbad.example.org relative\n"
+	if err := ioutil.WriteFile(*flStatsPathsFile, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	LoadStatsPathsFile()
+
+	if paths := statsPathsFor("hockeypuck.example.org"); len(paths) != 2 || paths[0] != "/pks/stats" {
+		t.Fatalf("Per-host paths not loaded: %v", paths)
+	}
+	for _, hostname := range []string{"bad.example.org", "other.example.org"} {
+		if paths := statsPathsFor(hostname); len(paths) != 1 || paths[0] != kDEFAULT_STATS_PATH {
+			t.Fatalf("Bad paths for %s: %v", hostname, paths)
+		}
+	}
+}
+
+func TestStatsPathHockeypuckJson(t *testing.T) {
+	setupTestLogging()
+	saved := *flStatsPaths
+	defer func() { *flStatsPaths = saved }()
+
+	fake := newFakeKeyserverFromFile(t, TEST_STATS_HOCKEYPUCK)
+	defer fake.Close()
+	fake.statsPath = "/pks/lookup?op=stats&options=mr"
+	fake.serverHeader = ""
+
+	*flStatsPaths = fake.statsPath + "," + kDEFAULT_STATS_PATH
+	node := fake.FetchNode(t)
+	if node.StatsPath != fake.statsPath || node.Keycount != 6382107 || len(node.GossipPeerList) != 3 {
+		t.Fatalf("Bad analysis of JSON status: path=%q keycount=%d peers=%v", node.StatsPath, node.Keycount, node.GossipPeerList)
+	}
+}
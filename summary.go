@@ -0,0 +1,112 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Aggregates over a scan, computed once as the snapshot is installed rather
+// than on every request.  Like the rest of the snapshot, never modified after.
+type ScanSummary struct {
+	Timestamp         time.Time      `json:"timestamp"`
+	TotalHosts        int            `json:"total_hosts"`
+	Reachable         int            `json:"reachable"`
+	Failed            int            `json:"failed"`
+	DistinctIPs       int            `json:"distinct_ips"`
+	DistinctCountries int            `json:"distinct_countries"`
+	UnknownCountryIPs int            `json:"unknown_country_ips"`
+	PrunedHosts       int            `json:"pruned_hosts,omitempty"`
+	DownHosts         int            `json:"down_hosts,omitempty"`
+	Versions          map[string]int `json:"versions"`
+	Phases            *ScanPhases    `json:"phases,omitempty"`
+}
+
+// DNS, fetch and country lookup times are summed over every lookup, so with
+// many in flight at once each can be far more than the wall-clock time of
+// the scan; it's how they compare which says where the time went.
+type ScanPhases struct {
+	DnsSeconds     float64 `json:"dns_seconds"`
+	FetchSeconds   float64 `json:"fetch_seconds"`
+	CountrySeconds float64 `json:"country_seconds"`
+	WallSeconds    float64 `json:"wall_seconds"`
+}
+
+func (spider *Spider) Phases() *ScanPhases {
+	return &ScanPhases{
+		DnsSeconds:     spider.phases.dns.Seconds(),
+		FetchSeconds:   spider.phases.fetch.Seconds(),
+		CountrySeconds: spider.phases.country.Seconds(),
+		WallSeconds:    time.Since(spider.started).Seconds(),
+	}
+}
+
+func (phases *ScanPhases) String() string {
+	second := func(s float64) time.Duration {
+		return (time.Duration(s * float64(time.Second))).Round(time.Millisecond)
+	}
+	return fmt.Sprintf("wall-clock %s; summed DNS %s, fetches %s, country lookups %s",
+		second(phases.WallSeconds), second(phases.DnsSeconds), second(phases.FetchSeconds), second(phases.CountrySeconds))
+}
+
+func NewScanSummary(p *PersistedHostInfo) *ScanSummary {
+	summary := &ScanSummary{
+		Timestamp:   p.Timestamp,
+		TotalHosts:  len(p.HostMap),
+		PrunedHosts: p.PrunedHosts,
+		DownHosts:   len(p.DownHosts),
+		Versions:    make(map[string]int, 20),
+		Phases:      p.Phases,
+	}
+	ips := make(map[string]bool, len(p.HostMap)*2)
+	countries := make(map[string]bool, 50)
+	unknown := make(map[string]bool)
+	for _, node := range p.HostMap {
+		if node.AnalyzeError != "" {
+			summary.Failed += 1
+		} else {
+			summary.Reachable += 1
+		}
+		if node.Version != "" {
+			summary.Versions[node.Version] += 1
+		}
+		for _, ip := range node.IpList {
+			ips[ip] = true
+			switch country := p.IPCountryMap[ip]; country {
+			case "":
+			case kCOUNTRY_UNKNOWN:
+				unknown[ip] = true
+			default:
+				countries[country] = true
+			}
+		}
+	}
+	summary.DistinctIPs = len(ips)
+	summary.DistinctCountries = len(countries)
+	summary.UnknownCountryIPs = len(unknown)
+	return summary
+}
+
+func apiSummaryPage(w http.ResponseWriter, req *http.Request) {
+	persisted := reportSetup(w, req)
+	if persisted == nil {
+		return
+	}
+	reportWriteJson(w, req, persisted.Summary)
+}
@@ -0,0 +1,103 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScanSummary(t *testing.T) {
+	persisted := &PersistedHostInfo{
+		HostMap: HostMap{
+			"a.example.org": &SksNode{Version: "1.1.4", IpList: []string{"192.0.2.1", "2001:db8::1"}},
+			"b.example.org": &SksNode{Version: "1.1.4", IpList: []string{"192.0.2.2"}},
+			"c.example.org": &SksNode{AnalyzeError: "broken", IpList: []string{"192.0.2.2"}},
+		},
+		IPCountryMap: IPCountryMap{"192.0.2.1": "NL", "2001:db8::1": "NL", "192.0.2.2": "DK"},
+	}
+	summary := NewScanSummary(persisted)
+	if summary.TotalHosts != 3 || summary.Reachable != 2 || summary.Failed != 1 {
+		t.Fatalf("Bad host counts: %+v", summary)
+	}
+	if summary.DistinctIPs != 3 || summary.DistinctCountries != 2 {
+		t.Fatalf("Bad IP/country counts: %+v", summary)
+	}
+	if len(summary.Versions) != 1 || summary.Versions["1.1.4"] != 2 {
+		t.Fatalf("Bad versions: %v", summary.Versions)
+	}
+
+	persisted.IPCountryMap["192.0.2.1"] = kCOUNTRY_UNKNOWN
+	if summary = NewScanSummary(persisted); summary.UnknownCountryIPs != 1 || summary.DistinctCountries != 2 {
+		t.Fatalf("Unknown country counted as a country: %+v", summary)
+	}
+
+	loaded := loadTestPersisted(t)
+	rec := testGet(t, apiSummaryPage, SERVE_PREFIX+"/summary")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Bad status %d: %s", rec.Code, rec.Body)
+	}
+	var served ScanSummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil {
+		t.Fatalf("Bad JSON: %s", err)
+	}
+	if served.TotalHosts != len(loaded.HostMap) || served.Versions["1.1.3"] == 0 {
+		t.Fatalf("Served summary does not match snapshot: %+v", served)
+	}
+	rec = testGet(t, apiIpValidPage, SERVE_PREFIX+"/ip-valid?stats")
+	if !strings.Contains(rec.Body.String(), "STATS: scan: ") {
+		t.Fatalf("Summary not in ip-valid stats")
+	}
+}
+
+func TestScanPhases(t *testing.T) {
+	setupTestLogging()
+	spider := newSpider()
+	spider.started = time.Now().Add(-time.Minute)
+	for i := 0; i < 2; i++ {
+		spider.processDnsResult(&DnsResult{"gone.example.org", nil, errors.New("no such host"), "", 3 * time.Second})
+	}
+	spider.processHostResult(&HostResult{
+		hostname: "down.example.org",
+		node:     &SksNode{Hostname: "down.example.org", FetchDuration: 30 * time.Second},
+		err:      errors.New("connection refused"),
+	})
+	spider.processCountryResult(&CountryResult{ip: "130.225.1.1", country: "DK", duration: 500 * time.Millisecond})
+
+	phases := spider.Phases()
+	if phases.DnsSeconds != 6 || phases.FetchSeconds != 30 || phases.CountrySeconds != 0.5 {
+		t.Fatalf("Bad phase totals: %+v", phases)
+	}
+	if phases.WallSeconds < 60 {
+		t.Fatalf("Bad wall-clock time: %+v", phases)
+	}
+	if s := phases.String(); !strings.Contains(s, "summed DNS 6s, fetches 30s, country lookups 500ms") {
+		t.Fatalf("Bad phases log line: %s", s)
+	}
+
+	persisted := newTestPersisted(t)
+	persisted.Phases = phases
+	SetCurrentPersisted(persisted)
+	rec := testGet(t, apiSummaryPage, SERVE_PREFIX+"/summary")
+	if !strings.Contains(rec.Body.String(), `"fetch_seconds":30`) {
+		t.Fatalf("Phases not in summary: %s", rec.Body)
+	}
+}
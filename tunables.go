@@ -0,0 +1,187 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// The knobs of the ip-valid filter, which operators may want to adjust
+// without a restart when the mesh changes under them.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type IpValidTunables struct {
+	SanityMin          int      `json:"keys_sanity_min"`
+	SanityMax          int      `json:"keys_sanity_max"` // 0 for no limit
+	DailyJitter        int      `json:"keys_daily_jitter"`
+	BucketSize         int      `json:"bucket_size"`
+	QuarantineVersions []string `json:"quarantine_versions"`
+	TrustedServers     []string `json:"trusted_servers"`
+}
+
+var (
+	ipValidTunables     *IpValidTunables
+	ipValidTunablesLock sync.RWMutex
+)
+
+// Until something is set, the flags are the tunables.
+func ipValidTunablesFromFlags() IpValidTunables {
+	return IpValidTunables{
+		SanityMin:          *flKeysSanityMin,
+		SanityMax:          *flKeysSanityMax,
+		DailyJitter:        *flKeysDailyJitter,
+		BucketSize:         kBUCKET_SIZE,
+		QuarantineVersions: parseVersionList(*flQuarantineVersions),
+		TrustedServers:     parseHostList(*flTrustedServers),
+	}
+}
+
+// Each request should take one copy and use it throughout, so that a change
+// part-way through doesn't mix old and new values.
+func GetIpValidTunables() IpValidTunables {
+	ipValidTunablesLock.RLock()
+	defer ipValidTunablesLock.RUnlock()
+	if ipValidTunables == nil {
+		return ipValidTunablesFromFlags()
+	}
+	t := *ipValidTunables
+	t.QuarantineVersions = append([]string(nil), t.QuarantineVersions...)
+	t.TrustedServers = append([]string(nil), t.TrustedServers...)
+	return t
+}
+
+func SetIpValidTunables(t IpValidTunables) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	t.QuarantineVersions = append([]string(nil), t.QuarantineVersions...)
+	t.TrustedServers = append([]string(nil), t.TrustedServers...)
+	ipValidTunablesLock.Lock()
+	defer ipValidTunablesLock.Unlock()
+	ipValidTunables = &t
+	return nil
+}
+
+func (t *IpValidTunables) validate() error {
+	if t.SanityMin < 0 {
+		return fmt.Errorf("keys_sanity_min must be >= 0 [got: %d]", t.SanityMin)
+	}
+	if t.SanityMax < 0 {
+		return fmt.Errorf("keys_sanity_max must be >= 0 [got: %d]", t.SanityMax)
+	}
+	if t.SanityMax != 0 && t.SanityMax < t.SanityMin {
+		return fmt.Errorf("keys_sanity_max must be 0 or >= keys_sanity_min %d [got: %d]", t.SanityMin, t.SanityMax)
+	}
+	if t.DailyJitter < 0 {
+		return fmt.Errorf("keys_daily_jitter must be >= 0 [got: %d]", t.DailyJitter)
+	}
+	if t.BucketSize <= 0 {
+		return fmt.Errorf("bucket_size must be > 0 [got: %d]", t.BucketSize)
+	}
+	return nil
+}
+
+// A parse error or a hostile page can claim any number of keys, and one
+// huge keycount would drag the statistics towards it.
+func (t *IpValidTunables) aboveSanityMax(keycount int) bool {
+	return t.SanityMax > 0 && keycount > t.SanityMax
+}
+
+// Versions with known problems: such servers still count towards the
+// statistics, but are dropped from the results.
+func parseVersionList(list string) []string {
+	versions := make([]string, 0, 2)
+	for _, version := range strings.Split(list, ",") {
+		if version = strings.TrimSpace(version); version != "" {
+			versions = append(versions, version)
+		}
+	}
+	return versions
+}
+
+// Hostnames given on the command line or in a form, normalized
+func parseHostList(list string) []string {
+	hosts := make([]string, 0, 4)
+	for _, h := range strings.Split(list, ",") {
+		if h = normalizeHostname(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// GET shows the tunables in force; POST changes those given as form
+// parameters, leaving the rest alone, and "reset" goes back to the flags.
+func apiTunablesz(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		if err := req.ParseForm(); err != nil {
+			http.Error(w, fmt.Sprintf("Bad form: %s", err), http.StatusBadRequest)
+			return
+		}
+		t := GetIpValidTunables()
+		if req.Form.Get("reset") != "" {
+			t = ipValidTunablesFromFlags()
+		}
+		for _, field := range []struct {
+			name string
+			dest *int
+		}{
+			{"keys_sanity_min", &t.SanityMin},
+			{"keys_sanity_max", &t.SanityMax},
+			{"keys_daily_jitter", &t.DailyJitter},
+			{"bucket_size", &t.BucketSize},
+		} {
+			value := req.Form.Get(field.name)
+			if value == "" {
+				continue
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Bad %s: %s", field.name, err), http.StatusBadRequest)
+				return
+			}
+			*field.dest = n
+		}
+		if _, ok := req.Form["quarantine_versions"]; ok {
+			t.QuarantineVersions = parseVersionList(req.Form.Get("quarantine_versions"))
+		}
+		if _, ok := req.Form["trusted_servers"]; ok {
+			t.TrustedServers = parseHostList(req.Form.Get("trusted_servers"))
+		}
+		if err := SetIpValidTunables(t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		Log.Printf("ip-valid tunables changed by %s: sanity_min=%d sanity_max=%d jitter=%d bucket_size=%d quarantine=%v trusted=%v",
+			req.RemoteAddr, t.SanityMin, t.SanityMax, t.DailyJitter, t.BucketSize, t.QuarantineVersions, t.TrustedServers)
+	} else if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(w, "Tunables are shown with GET and changed with POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", ContentTypeJson)
+	b, err := json.Marshal(GetIpValidTunables())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("JSON encoding failure: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+	fmt.Fprintf(w, "\n")
+}
@@ -0,0 +1,93 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func postTunables(t *testing.T, form url.Values) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", "/tunablesz", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatalf("Bad request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	apiTunablesz(rec, req)
+	return rec
+}
+
+func TestIpValidTunables(t *testing.T) {
+	loadTestPersisted(t)
+	defer func() {
+		ipValidTunablesLock.Lock()
+		ipValidTunables = nil
+		ipValidTunablesLock.Unlock()
+	}()
+
+	defaults := ipValidJsonStatus(t, "")
+	rec := testGet(t, apiTunablesz, "/tunablesz")
+	var shown IpValidTunables
+	if err := json.Unmarshal(rec.Body.Bytes(), &shown); err != nil {
+		t.Fatalf("Bad JSON: %s\n%s", err, rec.Body)
+	}
+	if shown.SanityMin != *flKeysSanityMin || shown.BucketSize != kBUCKET_SIZE || len(shown.QuarantineVersions) != 1 {
+		t.Fatalf("Tunables not taken from flags: %+v", shown)
+	}
+
+	rec = postTunables(t, url.Values{"keys_daily_jitter": {"20000"}, "quarantine_versions": {""}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Bad status %d: %s", rec.Code, rec.Body)
+	}
+	changed := ipValidJsonStatus(t, "")
+	if changed["minimum"].(float64) != defaults["minimum"].(float64)-(20000-float64(*flKeysDailyJitter)) {
+		t.Fatalf("Jitter change not applied: threshold %v -> %v", defaults["minimum"], changed["minimum"])
+	}
+	if changed["count"].(float64) <= defaults["count"].(float64) {
+		t.Fatalf("Lower threshold without quarantine did not raise count: %v -> %v", defaults["count"], changed["count"])
+	}
+	if GetIpValidTunables().SanityMin != *flKeysSanityMin {
+		t.Fatalf("Unchanged tunable was altered: %+v", GetIpValidTunables())
+	}
+
+	rec = postTunables(t, url.Values{"keys_sanity_min": {"100000000"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Bad status %d: %s", rec.Code, rec.Body)
+	}
+	if broken := ipValidJsonStatus(t, ""); broken["reason"] != "broken_data" {
+		t.Fatalf("Raised sanity minimum not applied: %v", broken)
+	}
+
+	for _, bad := range []url.Values{{"bucket_size": {"0"}}, {"keys_daily_jitter": {"-1"}}, {"keys_sanity_min": {"lots"}}, {"keys_sanity_max": {"1000"}}} {
+		if rec = postTunables(t, bad); rec.Code != http.StatusBadRequest {
+			t.Fatalf("Bad tunables %v accepted: status %d", bad, rec.Code)
+		}
+	}
+
+	rec = postTunables(t, url.Values{"reset": {"1"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Bad status %d: %s", rec.Code, rec.Body)
+	}
+	if reset := ipValidJsonStatus(t, ""); reset["count"] != defaults["count"] || reset["minimum"] != defaults["minimum"] {
+		t.Fatalf("Reset did not restore defaults: %v vs %v", reset, defaults)
+	}
+}
@@ -17,11 +17,17 @@
 package sks_spider
 
 import (
+	"container/list"
 	"fmt"
 	"regexp"
 	"strconv"
+	"sync"
 )
 
+// Only a few versions are in the wild at once, but a bounded cache stops a
+// server reporting junk from growing it without limit.
+const kVERSION_CACHE_SIZE = 64
+
 type SksVersion struct {
 	Major, Minor, Release uint
 	Tag                   string
@@ -33,7 +39,53 @@ func init() {
 	sksVersionRegexp = regexp.MustCompile(`^(\d+)\.(\d+)\.(\d+)(\+?)$`)
 }
 
+// Version strings are few and repeat across every host, so parsed versions
+// are cached and shared: callers must not modify what they're given.
+type sksVersionCache struct {
+	sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // of *sksVersionCacheEntry, most recently used first
+}
+
+type sksVersionCacheEntry struct {
+	raw     string
+	version *SksVersion
+}
+
+var sksVersions = newSksVersionCache(kVERSION_CACHE_SIZE)
+
+func newSksVersionCache(size int) *sksVersionCache {
+	return &sksVersionCache{
+		size:    size,
+		entries: make(map[string]*list.Element, size),
+		order:   list.New(),
+	}
+}
+
+// Unparseable strings are cached too, as nil.
+func (c *sksVersionCache) get(s string) *SksVersion {
+	c.Lock()
+	defer c.Unlock()
+	if elem, ok := c.entries[s]; ok {
+		c.order.MoveToFront(elem)
+		return elem.Value.(*sksVersionCacheEntry).version
+	}
+	version := parseSksVersion(s)
+	c.entries[s] = c.order.PushFront(&sksVersionCacheEntry{raw: s, version: version})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*sksVersionCacheEntry).raw)
+	}
+	return version
+}
+
 func NewSksVersion(s string) *SksVersion {
+	return sksVersions.get(s)
+}
+
+func parseSksVersion(s string) *SksVersion {
 	matches := sksVersionRegexp.FindStringSubmatch(s)
 	if matches == nil {
 		return nil
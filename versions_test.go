@@ -78,3 +78,58 @@ func TestVersionMatching(t *testing.T) {
 		}
 	}
 }
+
+func TestVersionCache(t *testing.T) {
+	cache := newSksVersionCache(2)
+	first := cache.get("1.1.4")
+	if first == nil || cache.get("1.1.4") != first {
+		t.Fatalf("Cached version not shared: %v", first)
+	}
+	if cache.get("junk") != nil || cache.get("junk") != nil {
+		t.Fatalf("Unparseable version yielded a result")
+	}
+	cache.get("1.1.5")
+	if len(cache.entries) != 2 || cache.order.Len() != 2 {
+		t.Fatalf("Cache grew beyond its size: %d entries, %d in order", len(cache.entries), cache.order.Len())
+	}
+	if _, ok := cache.entries["1.1.4"]; ok {
+		t.Fatalf("Least recently used version not evicted")
+	}
+	if again := cache.get("1.1.4"); again == first || again.String() != "1.1.4" {
+		t.Fatalf("Bad version after eviction: %v", again)
+	}
+}
+
+func benchmarkVersionInventory(b *testing.B) []string {
+	setupTestLogging()
+	hostmap, err := LoadJSONFromFile(TEST_DATA_FILE)
+	if err != nil {
+		b.Fatalf("Failed to load \"%s\": %s", TEST_DATA_FILE, err)
+	}
+	// As apiIpValidPage sees them: once per host, per request
+	versions := make([]string, 0, len(hostmap))
+	for _, node := range hostmap {
+		versions = append(versions, node.Version)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	return versions
+}
+
+func BenchmarkVersionParse(b *testing.B) {
+	versions := benchmarkVersionInventory(b)
+	for n := 0; n < b.N; n++ {
+		for _, v := range versions {
+			parseSksVersion(v)
+		}
+	}
+}
+
+func BenchmarkVersionCached(b *testing.B) {
+	versions := benchmarkVersionInventory(b)
+	for n := 0; n < b.N; n++ {
+		for _, v := range versions {
+			NewSksVersion(v)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+// After each scan, tell some external automation about it: rebuild a DNS
+// zone, say something in chat, whatever.  Delivery happens in its own
+// go-routine and never holds up the scan pipeline.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	kWEBHOOK_ATTEMPTS         = 3
+	kWEBHOOK_TIMEOUT          = 30 * time.Second
+	kWEBHOOK_SIGNATURE_HEADER = "X-Sks-Spider-Signature"
+)
+
+// Doubles after each failed attempt; a var so that tests needn't wait
+var webhookRetryBackoff = 10 * time.Second
+
+var webhookSecret []byte
+
+type ScanWebhookPayload struct {
+	Timestamp       time.Time `json:"timestamp"`
+	Hosts           int       `json:"hosts"`
+	Reachable       int       `json:"reachable"`
+	DistinctIPs     int       `json:"distinct_ips"`
+	DurationSeconds float64   `json:"duration_seconds"`
+}
+
+// The whole file, less surrounding whitespace, is the HMAC key.
+func LoadWebhookSecret(filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	secret := strings.TrimSpace(string(content))
+	if secret == "" {
+		return fmt.Errorf("empty webhook secret")
+	}
+	webhookSecret = []byte(secret)
+	return nil
+}
+
+// HMAC-SHA256 of the exact request body, as "sha256=<hex>"
+func webhookSignature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func notifyScanWebhook(summary *ScanSummary, duration time.Duration) {
+	if *flScanWebhook == "" || summary == nil {
+		return
+	}
+	payload := &ScanWebhookPayload{
+		Timestamp:       summary.Timestamp,
+		Hosts:           summary.TotalHosts,
+		Reachable:       summary.Reachable,
+		DistinctIPs:     summary.DistinctIPs,
+		DurationSeconds: duration.Seconds(),
+	}
+	go deliverScanWebhook(*flScanWebhook, webhookSecret, payload)
+}
+
+func deliverScanWebhook(url string, secret []byte, payload *ScanWebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		Log.Printf("Webhook: unable to encode payload: %s", err)
+		return err
+	}
+	backoff := webhookRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err = postScanWebhook(url, secret, body)
+		if err == nil {
+			Log.Printf("Webhook: delivered scan summary to <%s>", url)
+			return nil
+		}
+		if attempt >= kWEBHOOK_ATTEMPTS {
+			Log.Printf("Webhook: giving up on <%s> after %d attempts: %s", url, attempt, err)
+			return err
+		}
+		Log.Printf("Webhook: attempt %d to <%s> failed, retrying in %s: %s", attempt, url, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postScanWebhook(url string, secret, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "sks_peers/0.2 (SKS mesh spidering)")
+	if secret != nil {
+		req.Header.Set(kWEBHOOK_SIGNATURE_HEADER, webhookSignature(secret, body))
+	}
+	resp, err := HttpDoWithTimeout(http.DefaultClient, req, kWEBHOOK_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP POST failure: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+/*
+   Copyright 2009-2013 Phil Pennock
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sks_spider
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestScanWebhookDelivery(t *testing.T) {
+	setupTestLogging()
+	saved := webhookRetryBackoff
+	defer func() { webhookRetryBackoff = saved }()
+	webhookRetryBackoff = time.Millisecond
+
+	secret := []byte("sekrit")
+	attempts := 0
+	var got ScanWebhookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts += 1
+		if attempts == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		if sig := req.Header.Get(kWEBHOOK_SIGNATURE_HEADER); sig != webhookSignature(secret, body) {
+			t.Errorf("Bad signature %q", sig)
+		}
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("Bad payload: %s\n%s", err, body)
+		}
+	}))
+	defer server.Close()
+
+	payload := &ScanWebhookPayload{Hosts: 84, Reachable: 80, DistinctIPs: 130, DurationSeconds: 42.5}
+	if err := deliverScanWebhook(server.URL, secret, payload); err != nil {
+		t.Fatalf("Delivery failed: %s", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("Expected a retry after failure, got %d attempts", attempts)
+	}
+	if got.Hosts != 84 || got.DistinctIPs != 130 || got.DurationSeconds != 42.5 {
+		t.Fatalf("Payload mangled: %+v", got)
+	}
+
+	failures := 0
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		failures += 1
+		if req.Header.Get(kWEBHOOK_SIGNATURE_HEADER) != "" {
+			t.Errorf("Signed without a secret")
+		}
+		http.NotFound(w, req)
+	}))
+	defer failing.Close()
+	if err := deliverScanWebhook(failing.URL, nil, payload); err == nil {
+		t.Fatalf("Persistent failure not reported")
+	}
+	if failures != kWEBHOOK_ATTEMPTS {
+		t.Fatalf("Expected %d attempts, got %d", kWEBHOOK_ATTEMPTS, failures)
+	}
+}